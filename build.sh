@@ -1,7 +1,12 @@
 #!/bin/bash
 
 mkdir -p ./bin
-go build -o ./bin/tileserver ./tileserver/server.go
-go build -o ./bin/import ./plan/
+go build -o ./bin/tileserver ./tileserver/main/
+go build -o ./bin/import ./plan/main/
 go build -o ./bin/ingest ./store/main/
 go build -o ./bin/merge ./merger/main/
+go build -o ./bin/export ./render/main/
+go build -o ./bin/diffstat ./diffstat/main/
+go build -o ./bin/verify ./verify/main/
+go build -o ./bin/compose ./compose/main/
+go build -o ./bin/wplace ./wplace/
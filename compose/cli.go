@@ -0,0 +1,111 @@
+package compose
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Hugi-R/wplace-archive-world-map/img"
+	"github.com/Hugi-R/wplace-archive-world-map/logging"
+	"github.com/Hugi-R/wplace-archive-world-map/store"
+)
+
+// Main runs the compose command line, args without the program name
+func Main(args []string) error {
+	fs := flag.NewFlagSet("compose", flag.ExitOnError)
+	base := fs.String("base", "", "Mandatory base DB path, the base of every diff")
+	diffs := fs.String("diffs", "", "Mandatory comma separated diff DB paths, oldest first")
+	chained := fs.Bool("chained", false, "Optional, each diff is made from the state left by the previous ones instead of from the base, the diffs are applied in order")
+	out := fs.String("out", "", "Mandatory out DB path, must not exist")
+	diffEncoding := fs.String("diff-encoding", img.DiffErasuresName, "Optional encoding of the composed diff tiles: erasures to keep the pixels turned transparent, or transparent (default erasures)")
+	sparseMaxRuns := fs.Int("sparse-max-runs", img.DefaultSparseMaxRuns, "Optional, store the diff tiles of up to this many runs of changed pixels in the sparse format instead of PNG. 0 stores them all as PNG (default 1000)")
+	compression := fs.String("compression", img.CompressionDefault, "Optional PNG compression level: default, speed, best, or none. best is smaller but much slower (default default)")
+	workers := fs.Int("workers", 10, "Optional number of workers (default 10)")
+	asJSON := fs.Bool("json", false, "Optional, print the stats as JSON")
+
+	fs.Parse(args)
+	if err := logging.Setup(); err != nil {
+		return err
+	}
+
+	// Check mandatory flags
+	if *base == "" {
+		return fmt.Errorf("missing required flag: --base")
+	}
+	if *diffs == "" {
+		return fmt.Errorf("missing required flag: --diffs")
+	}
+	if *out == "" {
+		return fmt.Errorf("missing required flag: --out")
+	}
+	if _, err := os.Stat(*out); err == nil {
+		return fmt.Errorf("out DB %s already exists", *out)
+	}
+	encoding, err := img.ParseDiffEncoding(*diffEncoding)
+	if err != nil {
+		return err
+	}
+	level, err := img.ParseCompressionLevel(*compression)
+	if err != nil {
+		return err
+	}
+
+	baseDB, err := store.NewTileDB(*base, true)
+	if err != nil {
+		return fmt.Errorf("failed to open base tile database %s: %w", *base, err)
+	}
+	defer baseDB.Close()
+	var sources []TileSource
+	var lastDB store.TileDB
+	for _, p := range strings.Split(*diffs, ",") {
+		diffDB, err := store.NewTileDB(p, true)
+		if err != nil {
+			return fmt.Errorf("failed to open diff tile database %s: %w", p, err)
+		}
+		defer diffDB.Close()
+		sources = append(sources, &diffDB)
+		lastDB = diffDB
+	}
+
+	outDB, err := store.NewTileDB(*out, false)
+	if err != nil {
+		return fmt.Errorf("failed to open out tile database %s: %w", *out, err)
+	}
+	defer outDB.Close()
+	// The composed diff is the state of the last diff, with its release
+	meta, err := store.ReadMeta(lastDB.DB)
+	if err != nil {
+		return err
+	}
+	for key, value := range meta {
+		if err := outDB.SetMeta(key, value); err != nil {
+			return err
+		}
+	}
+
+	stats, err := Compose(&baseDB, sources, &outDB, Options{Encoding: encoding, SparseMaxRuns: *sparseMaxRuns, Compression: level, Workers: *workers, Chained: *chained})
+	if err != nil {
+		return err
+	}
+	if err := outDB.RecordTileCounts(); err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(stats)
+	}
+	var total LevelStat
+	for _, s := range stats {
+		fmt.Printf("z=%d: %d tiles, %d changed, %d new, %d unchanged\n", s.Z, s.Tiles, s.Changed, s.New, s.Unchanged)
+		total.Tiles += s.Tiles
+		total.Changed += s.Changed
+		total.New += s.New
+		total.Unchanged += s.Unchanged
+	}
+	fmt.Printf("Total: %d tiles, %d changed, %d new, %d unchanged\n", total.Tiles, total.Changed, total.New, total.Unchanged)
+	return nil
+}
@@ -0,0 +1,208 @@
+// Package compose merges a chain of diff DBs of the same base into a single diff DB of the base,
+// like the daily diffs of a week into one weekly diff.
+package compose
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"image/png"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Hugi-R/wplace-archive-world-map/img"
+)
+
+// MaxZ is the zoom level of the ingested tiles, the levels 0 to MaxZ are composed
+const MaxZ = 11
+
+// TileSource is the read side of a store.TileDB
+type TileSource interface {
+	ListTiles(z int) ([][2]uint16, error)
+	GetTile(z, x, y int) ([]byte, error)
+}
+
+// TileWriter is the write side of a store.TileDB
+type TileWriter interface {
+	PutTileAutoCRC(z, x, y int, data []byte) error
+}
+
+// Options configures Compose
+type Options struct {
+	Encoding      img.DiffEncoding     // Encoding of the composed diff tiles
+	SparseMaxRuns int                  // See img.EncodeDiff
+	Compression   png.CompressionLevel // PNG compression level of the composed tiles, see img.ParseCompressionLevel
+	Workers       int
+	// Chained tells each diff is made from the state left by the previous ones instead of from the base,
+	// see Compose
+	Chained bool
+}
+
+// LevelStat counts the tiles of one zoom level of Compose
+type LevelStat struct {
+	Z         int `json:"z"`
+	Tiles     int `json:"tiles"`     // Tiles in at least one diff
+	Changed   int `json:"changed"`   // Diff tiles written, changed from the base
+	New       int `json:"new"`       // Full tiles written, missing from the base
+	Unchanged int `json:"unchanged"` // Tiles back to their base tile, not written
+}
+
+// Compose writes to out the diff from base of the tiles reconstructed from the diffs, oldest first.
+//
+// The diffs are made from the base, as the ingest makes them: the newest diff holds the state of every tile, each
+// tile is reconstructed with img.UnDiffPaletted from the base tile and the newest diff, and a tile missing from it is
+// back to its base tile. The older diffs are only listed, for the stats. With opts.Chained, each diff is made from the state left by the previous ones: each diff is applied over
+// the tile reconstructed from the previous ones, starting from the base tile, and a tile missing from a diff is
+// left as reconstructed by the previous ones.
+// The result is diffed from the base tile with img.DiffPaletted. A tile missing from the base is a full tile in the
+// diffs, the one of the newest diff is written as is, or when chained of the last diff having it. A tile back to its base tile is not written, as unchanged tiles of a diff DB.
+// Erasures are kept when both the diffs and opts.Encoding record them, see img.DiffErasures.
+func Compose(base TileSource, diffs []TileSource, out TileWriter, opts Options) ([]LevelStat, error) {
+	if len(diffs) == 0 {
+		return nil, fmt.Errorf("no diff to compose")
+	}
+	stats := make([]LevelStat, 0, MaxZ+1)
+	for z := range MaxZ + 1 {
+		stat, err := composeLevel(base, diffs, out, z, opts)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, stat)
+	}
+	return stats, nil
+}
+
+func composeLevel(base TileSource, diffs []TileSource, out TileWriter, z int, opts Options) (LevelStat, error) {
+	stat := LevelStat{Z: z}
+	seen := make(map[[2]uint16]bool)
+	var tiles [][2]uint16
+	for i, diff := range diffs {
+		list, err := diff.ListTiles(z)
+		if err != nil {
+			return stat, fmt.Errorf("failed to list tiles of level %d of diff %d: %w", z, i, err)
+		}
+		for _, t := range list {
+			if !seen[t] {
+				seen[t] = true
+				tiles = append(tiles, t)
+			}
+		}
+	}
+	stat.Tiles = len(tiles)
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		firstErr  error
+		changed   atomic.Int64
+		added     atomic.Int64
+		unchanged atomic.Int64
+	)
+	jobs := make(chan [2]uint16)
+	for range max(opts.Workers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range jobs {
+				x, y := int(t[0]), int(t[1])
+				data, isNew, err := composeTile(base, diffs, z, x, y, opts)
+				if err == nil && data != nil {
+					err = out.PutTileAutoCRC(z, x, y, data)
+				}
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					continue
+				}
+				switch {
+				case data == nil:
+					unchanged.Add(1)
+				case isNew:
+					added.Add(1)
+				default:
+					changed.Add(1)
+				}
+			}
+		}()
+	}
+	for _, t := range tiles {
+		jobs <- t
+	}
+	close(jobs)
+	wg.Wait()
+
+	stat.Changed = int(changed.Load())
+	stat.New = int(added.Load())
+	stat.Unchanged = int(unchanged.Load())
+	return stat, firstErr
+}
+
+// composeTile returns the composed diff tile z/x/y, nil when back to the base tile.
+// isNew tells it is a full tile, missing from the base.
+func composeTile(base TileSource, diffs []TileSource, z, x, y int, opts Options) (data []byte, isNew bool, err error) {
+	first := firstDiff(len(diffs), opts.Chained)
+	baseData, err := base.GetTile(z, x, y)
+	if errors.Is(err, sql.ErrNoRows) {
+		// New tile, each diff has the full tile, the last one wins
+		for i := len(diffs) - 1; i >= first; i-- {
+			data, err := diffs[i].GetTile(z, x, y)
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			}
+			if err != nil {
+				return nil, false, err
+			}
+			data, err = img.DiffToPng(data)
+			return data, true, err
+		}
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	baseImg, err := img.DecodePaletted(baseData)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to decode base tile %d/%d/%d: %w", z, x, y, err)
+	}
+	tile := baseImg
+	for i := first; i < len(diffs); i++ {
+		diffData, err := diffs[i].GetTile(z, x, y)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		diffImg, err := img.DecodePaletted(diffData)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to decode tile %d/%d/%d of diff %d: %w", z, x, y, i, err)
+		}
+		tile, err = img.UnDiffPaletted(tile, diffImg)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to apply tile %d/%d/%d of diff %d: %w", z, x, y, i, err)
+		}
+	}
+
+	diff, changes, err := img.DiffPaletted(baseImg, tile, opts.Encoding)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to diff tile %d/%d/%d: %w", z, x, y, err)
+	}
+	if !changes {
+		return nil, false, nil
+	}
+	data, err = img.EncodeDiff(diff, opts.SparseMaxRuns, opts.Compression)
+	return data, false, err
+}
+
+// firstDiff returns the index of the first of the n diffs making the state of a tile:
+// all of them, oldest first, when chained, only the newest one when made from the base.
+func firstDiff(n int, chained bool) int {
+	if chained {
+		return 0
+	}
+	return n - 1
+}
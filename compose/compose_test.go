@@ -0,0 +1,249 @@
+package compose
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/Hugi-R/wplace-archive-world-map/img"
+	"github.com/Hugi-R/wplace-archive-world-map/storetest"
+)
+
+// Size of the synthetic tiles, small to keep the tests fast
+const fixtureSize = 8
+
+// Days of the chain of diffs
+const days = 7
+
+// putPngT encodes the tile as PNG in s
+func putPngT(t *testing.T, s *storetest.MemStore, x int, tile *image.Paletted) {
+	t.Helper()
+	data, err := img.EncodePng(tile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutTileAutoCRC(MaxZ, x, 0, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// putDiffT stores the diff from prev to next in s, as the ingest of a diff, nothing if unchanged
+func putDiffT(t *testing.T, s *storetest.MemStore, x int, prev, next *image.Paletted) {
+	t.Helper()
+	diff, changes, err := img.DiffPaletted(prev, next, img.DiffErasures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changes {
+		return
+	}
+	data, err := img.EncodeDiff(diff, img.DefaultSparseMaxRuns, png.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutTileAutoCRC(MaxZ, x, 0, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// decodeT decodes the tile x of level MaxZ of s
+func decodeT(t *testing.T, s TileSource, x int) *image.Paletted {
+	t.Helper()
+	data, err := s.GetTile(MaxZ, x, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tile, err := img.DecodePaletted(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tile
+}
+
+// chainFixture returns a base, a chain of daily diffs at level MaxZ and the state of each tile on the last day:
+//   - tile 0 changes on most days, with erasures, and is unchanged on others
+//   - tile 1 changes on the first day and is reverted on the second
+//   - tile 2 is missing from the base, a full tile changed on days 2 and 5, and in each diff from day 2 when made
+//     from the base
+//   - tile 3 only has a pixel erased on day 3
+//   - tile 4 changes a pixel on the first day, reverted on the second when another pixel changes
+//
+// The diffs are made from the base, as the ingest makes them, or from the state of the previous day when chained.
+func chainFixture(t *testing.T, chained bool) (*storetest.MemStore, []*storetest.MemStore, []*image.Paletted) {
+	base := storetest.NewMemStore()
+	diffs := make([]*storetest.MemStore, days)
+	for d := range diffs {
+		diffs[d] = storetest.NewMemStore()
+	}
+	fill := func(x, y int) uint8 { return uint8(1 + (x+y)%8) }
+	states := make([]*image.Paletted, 5)
+	for x := range states {
+		states[x] = img.NewEmptyPaletted(fixtureSize)
+		if x == 2 {
+			continue
+		}
+		for y := range fixtureSize {
+			for px := range fixtureSize {
+				states[x].SetColorIndex(px, y, fill(px, y))
+			}
+		}
+		putPngT(t, base, x, states[x])
+	}
+	baseStates := append([]*image.Paletted(nil), states...)
+
+	r := rand.New(rand.NewPCG(1, 2))
+	for d, diff := range diffs {
+		for x, prev := range states {
+			next := image.NewPaletted(prev.Rect, prev.Palette)
+			copy(next.Pix, prev.Pix)
+			switch {
+			case x == 0 && d%3 != 1:
+				for range 5 {
+					next.Pix[r.IntN(len(next.Pix))] = uint8(r.IntN(10))
+				}
+				if d == 0 {
+					next.Pix[0] = 0
+				}
+			case (x == 1 || x == 4) && d == 0:
+				next.Pix[1] = 9
+			case x == 1 && d == 1:
+				next.Pix[1] = fill(1, 0)
+			case x == 4 && d == 1:
+				next.Pix[1] = fill(1, 0)
+				next.Pix[3] = 9
+			case x == 2 && (d == 2 || d == 5):
+				for i := range next.Pix {
+					next.Pix[i] = uint8(d + i%2)
+				}
+				putPngT(t, diff, x, next)
+				states[x] = next
+				continue
+			case x == 3 && d == 3:
+				next.Pix[2] = 0
+			}
+			switch {
+			case chained:
+				putDiffT(t, diff, x, prev, next)
+			case x != 2:
+				putDiffT(t, diff, x, baseStates[x], next)
+			case d >= 2:
+				// The ingest writes the full tile of each tile missing from the base
+				putPngT(t, diff, x, next)
+			}
+			states[x] = next
+		}
+	}
+	return base, diffs, states
+}
+
+// sources returns the stores as tile sources
+func sources(stores []*storetest.MemStore) []TileSource {
+	diffs := make([]TileSource, len(stores))
+	for i, d := range stores {
+		diffs[i] = d
+	}
+	return diffs
+}
+
+// composedT returns the tile x of level MaxZ of the base with the composed diff applied
+func composedT(t *testing.T, base, out TileSource, x int) *image.Paletted {
+	t.Helper()
+	tile, err := img.UnDiffPaletted(decodeT(t, base, x), decodeT(t, out, x))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tile
+}
+
+func TestCompose(t *testing.T) {
+	base, diffStores, states := chainFixture(t, false)
+	out := storetest.NewMemStore()
+	stats, err := Compose(base, sources(diffStores), out, Options{Encoding: img.DiffErasures, SparseMaxRuns: img.DefaultSparseMaxRuns, Workers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat := stats[MaxZ]; stat.Tiles != 5 || stat.Changed != 3 || stat.New != 1 || stat.Unchanged != 1 {
+		t.Fatalf("expected 5 tiles, 3 changed, 1 new, 1 unchanged, got %+v", stat)
+	}
+
+	// The composed diff applied on the base is the state of the last day
+	for _, x := range []int{0, 3, 4} {
+		if composed := composedT(t, base, out, x); !bytes.Equal(composed.Pix, states[x].Pix) {
+			t.Fatalf("tile %d: expected %v, got %v", x, states[x].Pix, composed.Pix)
+		}
+	}
+	// The pixel reverted to its base color on the second day, not the color of the first day
+	if tile4 := composedT(t, base, out, 4); tile4.Pix[1] != decodeT(t, base, 4).Pix[1] || tile4.Pix[3] != 9 {
+		t.Fatalf("expected tile 4 pixel 1 reverted and pixel 3 changed, got %v", tile4.Pix)
+	}
+	if decodeT(t, out, 3).Pix[2] == 0 {
+		t.Fatal("expected the erasure of tile 3 recorded")
+	}
+	// Changed on the first day and reverted on the second, missing from the newer diffs
+	if _, err := out.GetTile(MaxZ, 1, 0); err == nil {
+		t.Fatal("expected the reverted tile 1 not written")
+	}
+	if tile1 := decodeT(t, base, 1); !bytes.Equal(tile1.Pix, states[1].Pix) {
+		t.Fatalf("expected tile 1 back to its base tile %v, got %v", tile1.Pix, states[1].Pix)
+	}
+	if last := decodeT(t, diffStores[5], 2); !bytes.Equal(decodeT(t, out, 2).Pix, last.Pix) {
+		t.Fatal("expected the full tile of day 5 for tile 2")
+	}
+}
+
+func TestComposeChained(t *testing.T) {
+	base, diffStores, states := chainFixture(t, true)
+	diffs := sources(diffStores)
+	out := storetest.NewMemStore()
+	stats, err := Compose(base, diffs, out, Options{Encoding: img.DiffErasures, SparseMaxRuns: img.DefaultSparseMaxRuns, Workers: 2, Chained: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat := stats[MaxZ]
+	if stat.Tiles != 5 || stat.Changed != 3 || stat.New != 1 || stat.Unchanged != 1 {
+		t.Fatalf("expected 5 tiles, 3 changed, 1 new, 1 unchanged, got %+v", stat)
+	}
+	if stats[0].Tiles != 0 {
+		t.Fatalf("expected no tile at level 0, got %+v", stats[0])
+	}
+
+	// The composed diff applied on the base is the diffs applied in order
+	for _, x := range []int{0, 3, 4} {
+		baseTile := decodeT(t, base, x)
+		expected := baseTile
+		for _, d := range diffStores {
+			if _, err := d.GetTile(MaxZ, x, 0); err != nil {
+				continue
+			}
+			if expected, err = img.UnDiffPaletted(expected, decodeT(t, d, x)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if composed := composedT(t, base, out, x); !bytes.Equal(composed.Pix, expected.Pix) || !bytes.Equal(composed.Pix, states[x].Pix) {
+			t.Fatalf("tile %d: expected %v, got %v", x, expected.Pix, composed.Pix)
+		}
+	}
+	if decodeT(t, out, 3).Pix[2] == 0 {
+		t.Fatal("expected the erasure of tile 3 recorded")
+	}
+	// Reverted to the base
+	if _, err := out.GetTile(MaxZ, 1, 0); err == nil {
+		t.Fatal("expected the reverted tile 1 not written")
+	}
+	// The last full tile
+	if last := decodeT(t, diffStores[5], 2); !bytes.Equal(decodeT(t, out, 2).Pix, last.Pix) {
+		t.Fatal("expected the full tile of day 5 for tile 2")
+	}
+
+	// Without erasures, a tile only erasing pixels has no change
+	out = storetest.NewMemStore()
+	stats, err = Compose(base, diffs, out, Options{Encoding: img.DiffTransparent, Workers: 2, Chained: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats[MaxZ].Unchanged != 2 || out.Len(MaxZ) != 3 {
+		t.Fatalf("expected tiles 1 and 3 unchanged, got %+v", stats[MaxZ])
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Hugi-R/wplace-archive-world-map/compose"
+)
+
+func main() {
+	start := time.Now()
+	err := compose.Main(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	elapsed := time.Since(start)
+	fmt.Fprintf(os.Stderr, "Elapsed time: %s\n", elapsed)
+}
@@ -0,0 +1,81 @@
+package diffstat
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Hugi-R/wplace-archive-world-map/store"
+)
+
+// Main runs the diffstat command line, args without the program name
+func Main(args []string) error {
+	fs := flag.NewFlagSet("diffstat", flag.ExitOnError)
+	from := fs.String("from", "", "Mandatory old DB path")
+	to := fs.String("to", "", "Mandatory new DB path")
+	base := fs.String("base", "", "Optional base DB path, when --to is a diff DB")
+	z := fs.Int("z", -1, "Optional zoom level to compare, -1 compares all levels from 0 to 11 (default -1)")
+	workers := fs.Int("workers", 10, "Optional number of workers (default 10)")
+	asJSON := fs.Bool("json", false, "Optional, print the stats as JSON")
+
+	fs.Parse(args)
+
+	// Check mandatory flags
+	if *from == "" {
+		return fmt.Errorf("missing required flag: --from")
+	}
+	if *to == "" {
+		return fmt.Errorf("missing required flag: --to")
+	}
+
+	fromDB, err := store.NewTileDB(*from, true)
+	if err != nil {
+		return fmt.Errorf("failed to open tile database %s: %w", *from, err)
+	}
+	defer fromDB.Close()
+	toDB, err := store.NewTileDB(*to, true)
+	if err != nil {
+		return fmt.Errorf("failed to open tile database %s: %w", *to, err)
+	}
+	defer toDB.Close()
+
+	var toSource TileSource = &toDB
+	if *base != "" {
+		baseDB, err := store.NewTileDB(*base, true)
+		if err != nil {
+			return fmt.Errorf("failed to open base tile database %s: %w", *base, err)
+		}
+		defer baseDB.Close()
+		toSource = NewDiffSource(&toDB, &baseDB)
+	}
+
+	zooms := []int{*z}
+	if *z < 0 {
+		zooms = nil
+		for i := range 12 {
+			zooms = append(zooms, i)
+		}
+	}
+
+	stats, err := Compare(&fromDB, toSource, zooms, *workers)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(stats)
+	}
+	var total LevelStat
+	for _, s := range stats {
+		fmt.Printf("z=%d: %d added, %d removed, %d changed tiles, %d changed pixels\n", s.Z, s.Added, s.Removed, s.Changed, s.ChangedPixels)
+		total.Added += s.Added
+		total.Removed += s.Removed
+		total.Changed += s.Changed
+		total.ChangedPixels += s.ChangedPixels
+	}
+	fmt.Printf("Total: %d added, %d removed, %d changed tiles, %d changed pixels\n", total.Added, total.Removed, total.Changed, total.ChangedPixels)
+	return nil
+}
@@ -0,0 +1,190 @@
+package diffstat
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Hugi-R/wplace-archive-world-map/img"
+)
+
+// TileSource is the read side of a store.TileDB
+type TileSource interface {
+	ListTiles(z int) ([][2]uint16, error)
+	GetTile(z, x, y int) ([]byte, error)
+}
+
+// diffSource reconstructs the full tiles of a diff DB from its base
+type diffSource struct {
+	diff TileSource
+	base TileSource
+}
+
+// NewDiffSource returns the tiles of the diff DB applied on its base DB
+func NewDiffSource(diff, base TileSource) TileSource {
+	return diffSource{diff: diff, base: base}
+}
+
+func (s diffSource) ListTiles(z int) ([][2]uint16, error) {
+	baseTiles, err := s.base.ListTiles(z)
+	if err != nil {
+		return nil, err
+	}
+	diffTiles, err := s.diff.ListTiles(z)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[[2]uint16]bool, len(baseTiles))
+	for _, t := range baseTiles {
+		seen[t] = true
+	}
+	for _, t := range diffTiles {
+		if !seen[t] {
+			baseTiles = append(baseTiles, t)
+		}
+	}
+	return baseTiles, nil
+}
+
+func (s diffSource) GetTile(z, x, y int) ([]byte, error) {
+	diffData, diffErr := s.diff.GetTile(z, x, y)
+	baseData, baseErr := s.base.GetTile(z, x, y)
+	if diffErr != nil {
+		// Unchanged tile
+		return baseData, baseErr
+	}
+	if baseErr != nil {
+		// New tile
+		return diffData, nil
+	}
+	diff, err := img.DecodePaletted(diffData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode diff tile %d/%d/%d: %w", z, x, y, err)
+	}
+	base, err := img.DecodePaletted(baseData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode base tile %d/%d/%d: %w", z, x, y, err)
+	}
+	undiff, err := img.UnDiffPaletted(base, diff)
+	if err != nil {
+		return nil, fmt.Errorf("failed to undiff tile %d/%d/%d: %w", z, x, y, err)
+	}
+	return img.EncodePng(undiff)
+}
+
+// LevelStat counts the changes of one zoom level
+type LevelStat struct {
+	Z             int   `json:"z"`
+	Added         int   `json:"added"`
+	Removed       int   `json:"removed"`
+	Changed       int   `json:"changed"`
+	ChangedPixels int64 `json:"changed_pixels"`
+}
+
+// Compare counts, for each zoom level, the tiles added, removed and changed from `from` to `to`,
+// and the pixels changed in the tiles present in both.
+func Compare(from, to TileSource, zooms []int, workers int) ([]LevelStat, error) {
+	stats := make([]LevelStat, 0, len(zooms))
+	for _, z := range zooms {
+		stat, err := compareLevel(from, to, z, workers)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, stat)
+	}
+	return stats, nil
+}
+
+func compareLevel(from, to TileSource, z, workers int) (LevelStat, error) {
+	stat := LevelStat{Z: z}
+	fromTiles, err := from.ListTiles(z)
+	if err != nil {
+		return stat, fmt.Errorf("failed to list tiles of level %d: %w", z, err)
+	}
+	toTiles, err := to.ListTiles(z)
+	if err != nil {
+		return stat, fmt.Errorf("failed to list tiles of level %d: %w", z, err)
+	}
+
+	inFrom := make(map[[2]uint16]bool, len(fromTiles))
+	for _, t := range fromTiles {
+		inFrom[t] = true
+	}
+	var both [][2]uint16
+	for _, t := range toTiles {
+		if inFrom[t] {
+			both = append(both, t)
+			delete(inFrom, t)
+		} else {
+			stat.Added++
+		}
+	}
+	stat.Removed = len(inFrom)
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		changed  atomic.Int64
+		pixels   atomic.Int64
+	)
+	tiles := make(chan [2]uint16)
+	for range max(workers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range tiles {
+				n, err := changedPixels(from, to, z, int(t[0]), int(t[1]))
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					continue
+				}
+				if n > 0 {
+					changed.Add(1)
+					pixels.Add(int64(n))
+				}
+			}
+		}()
+	}
+	for _, t := range both {
+		tiles <- t
+	}
+	close(tiles)
+	wg.Wait()
+
+	stat.Changed = int(changed.Load())
+	stat.ChangedPixels = pixels.Load()
+	return stat, firstErr
+}
+
+func changedPixels(from, to TileSource, z, x, y int) (int, error) {
+	fromData, err := from.GetTile(z, x, y)
+	if err != nil {
+		return 0, err
+	}
+	toData, err := to.GetTile(z, x, y)
+	if err != nil {
+		return 0, err
+	}
+	if bytes.Equal(fromData, toData) {
+		return 0, nil
+	}
+	fromImg, err := img.DecodePaletted(fromData)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode tile %d/%d/%d: %w", z, x, y, err)
+	}
+	toImg, err := img.DecodePaletted(toData)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode tile %d/%d/%d: %w", z, x, y, err)
+	}
+	n, err := img.ChangedPixels(fromImg, toImg)
+	if err != nil {
+		return 0, fmt.Errorf("tile %d/%d/%d: %w", z, x, y, err)
+	}
+	return n, nil
+}
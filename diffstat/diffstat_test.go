@@ -0,0 +1,85 @@
+package diffstat
+
+import (
+	"fmt"
+	"image"
+	"testing"
+
+	"github.com/Hugi-R/wplace-archive-world-map/img"
+)
+
+// memSource holds encoded tiles of a single level
+type memSource map[[2]uint16][]byte
+
+func (s memSource) ListTiles(z int) ([][2]uint16, error) {
+	var res [][2]uint16
+	for t := range s {
+		res = append(res, t)
+	}
+	return res, nil
+}
+
+func (s memSource) GetTile(z, x, y int) ([]byte, error) {
+	data, ok := s[[2]uint16{uint16(x), uint16(y)}]
+	if !ok {
+		return nil, fmt.Errorf("tile %d/%d/%d not found", z, x, y)
+	}
+	return data, nil
+}
+
+// tileT encodes a 4x4 paletted tile with the given palette indexes
+func tileT(pix []uint8, t *testing.T) []byte {
+	tile := image.NewPaletted(image.Rect(0, 0, 4, 4), img.NewPaletter().Palette())
+	copy(tile.Pix, pix)
+	data, err := img.EncodePng(tile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestCompare(t *testing.T) {
+	blank := make([]uint8, 16)
+	red := make([]uint8, 16)
+	for i := range red {
+		red[i] = 7
+	}
+	// Two red pixels, one turned transparent
+	partial := append([]uint8{}, red...)
+	partial[0] = 5
+	partial[1] = 0
+
+	from := memSource{
+		{0, 0}: tileT(red, t),
+		{1, 0}: tileT(red, t),
+		{2, 0}: tileT(red, t), // Removed
+	}
+	to := memSource{
+		{0, 0}: tileT(red, t),     // Unchanged
+		{1, 0}: tileT(partial, t), // Changed
+		{3, 0}: tileT(blank, t),   // Added
+	}
+
+	stats, err := Compare(from, to, []int{11}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := LevelStat{Z: 11, Added: 1, Removed: 1, Changed: 1, ChangedPixels: 2}
+	if len(stats) != 1 || stats[0] != expected {
+		t.Fatalf("expected %+v, got %+v", expected, stats)
+	}
+
+	t.Run("DiffSource", func(t *testing.T) {
+		diffPix := make([]uint8, 16)
+		diffPix[0] = 5
+		diff := memSource{{1, 0}: tileT(diffPix, t)}
+		stats, err := Compare(from, NewDiffSource(diff, from), []int{11}, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := LevelStat{Z: 11, Changed: 1, ChangedPixels: 1}
+		if len(stats) != 1 || stats[0] != expected {
+			t.Fatalf("expected %+v, got %+v", expected, stats)
+		}
+	})
+}
@@ -3,9 +3,13 @@ module github.com/Hugi-R/wplace-archive-world-map
 go 1.24.6
 
 require (
+	github.com/HugoSmits86/nativewebp v0.9.3
 	github.com/bodgit/sevenzip v1.6.1
 	github.com/gorilla/mux v1.8.1
+	github.com/klauspost/compress v1.18.0
 	github.com/mattn/go-sqlite3 v1.14.32
+	github.com/ulikunitz/xz v0.5.12
+	go.etcd.io/bbolt v1.4.3
 )
 
 require (
@@ -13,10 +17,9 @@ require (
 	github.com/bodgit/plumbing v1.3.0 // indirect
 	github.com/bodgit/windows v1.0.1 // indirect
 	github.com/hashicorp/golang-lru/v2 v2.0.7 // indirect
-	github.com/klauspost/compress v1.18.0 // indirect
 	github.com/pierrec/lz4/v4 v4.1.22 // indirect
 	github.com/spf13/afero v1.11.0 // indirect
-	github.com/ulikunitz/xz v0.5.12 // indirect
 	go4.org v0.0.0-20200411211856-f5505b9728dd // indirect
+	golang.org/x/sys v0.29.0 // indirect
 	golang.org/x/text v0.25.0 // indirect
 )
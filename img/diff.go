@@ -3,10 +3,45 @@ package img
 import (
 	"fmt"
 	"image"
-	"reflect"
+	"image/color"
+	"image/png"
 )
 
-func Diff(base []byte, new []byte) ([]byte, bool, error) {
+// DiffEncoding is the encoding of the diff tiles.
+//
+// Both encodings set unchanged pixels to index 0, transparent, so a diff is applied by drawing it over its base.
+// DiffTransparent can't tell a pixel turned transparent from an unchanged pixel, the erasure is lost.
+// DiffErasures appends a sentinel color to the palette of the diff, an erased pixel is set to this index.
+// The sentinel is transparent too, so drawing the diff over its base, as the map page does, still works but keeps erased pixels.
+type DiffEncoding int
+
+const (
+	DiffTransparent DiffEncoding = iota
+	DiffErasures
+)
+
+// Diff encoding names, for ParseDiffEncoding
+const (
+	DiffTransparentName = "transparent"
+	DiffErasuresName    = "erasures"
+)
+
+// ParseDiffEncoding parses a diff encoding name
+func ParseDiffEncoding(name string) (DiffEncoding, error) {
+	switch name {
+	case DiffTransparentName, "":
+		return DiffTransparent, nil
+	case DiffErasuresName:
+		return DiffErasures, nil
+	}
+	return DiffTransparent, fmt.Errorf("invalid diff encoding %s, must be one of: transparent, erasures", name)
+}
+
+// erasedColor is the sentinel color of DiffErasures, transparent black as the unused palette slots
+var erasedColor color.Color = color.RGBA{0, 0, 0, 0}
+
+// Diff returns the diff of the tiles, encoded with EncodeDiff at the PNG compression level
+func Diff(base []byte, new []byte, encoding DiffEncoding, sparseMax int, level png.CompressionLevel) ([]byte, bool, error) {
 	baseI, err := DecodeImage(base)
 	if err != nil {
 		return nil, false, err
@@ -25,11 +60,11 @@ func Diff(base []byte, new []byte) ([]byte, bool, error) {
 		return nil, false, fmt.Errorf("input image new is not paletted")
 	}
 
-	diff, changes, err := DiffPaletted(baseP, newP)
+	diff, changes, err := DiffPaletted(baseP, newP, encoding)
 	if err != nil {
 		return nil, false, err
 	}
-	diffData, err := EncodePng(diff)
+	diffData, err := EncodeDiff(diff, sparseMax, level)
 	if err != nil {
 		return nil, false, err
 	}
@@ -37,23 +72,41 @@ func Diff(base []byte, new []byte) ([]byte, bool, error) {
 	return diffData, changes, nil
 }
 
-func DiffPaletted(base *image.Paletted, new *image.Paletted) (*image.Paletted, bool, error) {
-	// Check palettes are the same
-	if !reflect.DeepEqual(base.Palette, new.Palette) {
-		return nil, false, fmt.Errorf("input images base and new have different palettes")
+// DiffPaletted returns the diff of new over base, with the palette of base.
+// The palette of new may have the colors of base in another order, or only some of them, as CompactPalette.
+func DiffPaletted(base *image.Paletted, new *image.Paletted, encoding DiffEncoding) (*image.Paletted, bool, error) {
+	// Check the colors of new are colors of base
+	remap, missing := paletteRemap(new.Palette, base.Palette)
+	if missing >= 0 {
+		return nil, false, fmt.Errorf("input images base and new have different palettes, color %d of new is not in base", missing)
 	}
 	// Check size
 	if len(base.Pix) != len(new.Pix) {
 		return nil, false, fmt.Errorf("input images differ in size")
 	}
 
-	diff := image.NewPaletted(base.Rect, base.Palette)
+	palette := base.Palette
+	erased := uint8(0) // Erasures are lost with DiffTransparent
+	if encoding == DiffErasures {
+		if len(base.Palette) >= 256 {
+			return nil, false, fmt.Errorf("palette is full, no index left to encode erasures")
+		}
+		erased = uint8(len(base.Palette))
+		palette = append(append(color.Palette{}, base.Palette...), erasedColor)
+	}
+	diff := image.NewPaletted(base.Rect, palette)
 
+	// With DiffTransparent, a tile only erasing pixels has no change: its diff would be all unchanged pixels
 	changes := false
 	for i := range len(base.Pix) {
-		if base.Pix[i] != new.Pix[i] {
-			diff.Pix[i] = new.Pix[i]
-			changes = true
+		if n := remap[new.Pix[i]]; base.Pix[i] != n {
+			if n == 0 {
+				diff.Pix[i] = erased
+				changes = changes || encoding == DiffErasures
+			} else {
+				diff.Pix[i] = n
+				changes = true
+			}
 		} else {
 			diff.Pix[i] = 0 // transparent, see imgpack.go
 		}
@@ -62,10 +115,20 @@ func DiffPaletted(base *image.Paletted, new *image.Paletted) (*image.Paletted, b
 	return diff, changes, nil
 }
 
+// UnDiffPaletted applies the diff new on base, the encoding of the diff is read from its palette:
+// one more color than the base palette is DiffErasures.
+// The palette of new may have the colors of base in another order, index 0 is always an unchanged pixel.
 func UnDiffPaletted(base *image.Paletted, new *image.Paletted) (*image.Paletted, error) {
-	// Check palettes are the same
-	if !reflect.DeepEqual(base.Palette, new.Palette) {
-		return nil, fmt.Errorf("input images base and new have different palettes")
+	// Check the colors of new are colors of base, but the erased sentinel
+	erased := -1
+	newPalette := new.Palette
+	if len(newPalette) == len(base.Palette)+1 {
+		erased = len(base.Palette)
+		newPalette = newPalette[:erased]
+	}
+	remap, missing := paletteRemap(newPalette, base.Palette)
+	if missing >= 0 {
+		return nil, fmt.Errorf("input images base and new have different palettes, color %d of new is not in base", missing)
 	}
 	// Check size
 	if len(base.Pix) != len(new.Pix) {
@@ -77,11 +140,74 @@ func UnDiffPaletted(base *image.Paletted, new *image.Paletted) (*image.Paletted,
 		if new.Pix[i] == 0 {
 			// if new pix is transparent, use base
 			undiff.Pix[i] = base.Pix[i]
+		} else if int(new.Pix[i]) == erased {
+			// else if erased, transparent
+			undiff.Pix[i] = 0
 		} else {
 			// else use new
-			undiff.Pix[i] = new.Pix[i]
+			undiff.Pix[i] = remap[new.Pix[i]]
 		}
 	}
 
 	return undiff, nil
 }
+
+// samePalette compares the colors of the palettes.
+// The PNG decoder returns NRGBA colors for the palette entries covered by the transparency chunk, RGBA for the others,
+// so the diff palette, with its transparent sentinel last, has the same colors in other types.
+func samePalette(a, b color.Palette) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		r1, g1, b1, a1 := a[i].RGBA()
+		r2, g2, b2, a2 := b[i].RGBA()
+		if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+			return false
+		}
+	}
+	return true
+}
+
+// paletteRemap maps the indexes of the palette from to the indexes of the same colors in to,
+// the first one of a color repeated in to, as the transparent unused slots.
+// Indexes of from are kept when the palettes are the same. missing is the first color of from not in to, -1 if none,
+// it is mapped to 0.
+func paletteRemap(from, to color.Palette) (remap [256]uint8, missing int) {
+	missing = -1
+	if samePalette(from, to) {
+		for i := range remap {
+			remap[i] = uint8(i)
+		}
+		return remap, missing
+	}
+	indexes := make(map[[4]uint32]uint8, len(to))
+	for i := len(to) - 1; i >= 0; i-- {
+		r, g, b, a := to[i].RGBA()
+		indexes[[4]uint32{r, g, b, a}] = uint8(i)
+	}
+	for i, c := range from {
+		r, g, b, a := c.RGBA()
+		index, ok := indexes[[4]uint32{r, g, b, a}]
+		if !ok && missing < 0 {
+			missing = i
+		}
+		remap[i] = index
+	}
+	return remap, missing
+}
+
+// ChangedPixels counts the pixels differing between base and new, including pixels turned transparent
+func ChangedPixels(base *image.Paletted, new *image.Paletted) (int, error) {
+	if _, _, err := DiffPaletted(base, new, DiffTransparent); err != nil {
+		return 0, err
+	}
+	remap, _ := paletteRemap(new.Palette, base.Palette)
+	changed := 0
+	for i := range len(base.Pix) {
+		if base.Pix[i] != remap[new.Pix[i]] {
+			changed++
+		}
+	}
+	return changed, nil
+}
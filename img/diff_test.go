@@ -0,0 +1,149 @@
+package img
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"reflect"
+	"testing"
+)
+
+// pixT builds a 4x1 paletted tile of the project palette
+func pixT(pix ...uint8) *image.Paletted {
+	p := image.NewPaletted(image.Rect(0, 0, len(pix), 1), NewPaletter().Palette())
+	copy(p.Pix, pix)
+	return p
+}
+
+func TestDiffRoundTrip(t *testing.T) {
+	// Unchanged, paint, erase, repaint, erase then paint
+	base := pixT(7, 0, 7, 7, 0)
+	new := pixT(7, 5, 0, 5, 0)
+	next := pixT(7, 5, 0, 5, 9)
+
+	cases := []struct {
+		name     string
+		encoding DiffEncoding
+		want     *image.Paletted
+	}{
+		{"transparent", DiffTransparent, pixT(7, 5, 7, 5, 0)}, // The erasure is lost
+		{"erasures", DiffErasures, new},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// Through PNG, as stored in the DBs
+			baseData, err := EncodePng(base)
+			if err != nil {
+				t.Fatal(err)
+			}
+			newData, err := EncodePng(new)
+			if err != nil {
+				t.Fatal(err)
+			}
+			diffData, changes, err := Diff(baseData, newData, c.encoding, 0, png.DefaultCompression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !changes {
+				t.Fatal("expected changes")
+			}
+			diff, err := DecodePaletted(diffData)
+			if err != nil {
+				t.Fatal(err)
+			}
+			baseDecoded, err := DecodePaletted(baseData)
+			if err != nil {
+				t.Fatal(err)
+			}
+			undiff, err := UnDiffPaletted(baseDecoded, diff)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(undiff.Pix) != string(c.want.Pix) {
+				t.Fatalf("expected %v, got %v", c.want.Pix, undiff.Pix)
+			}
+
+			// Then erase to paint, on the undiffed tile
+			diff2, _, err := DiffPaletted(undiff, next, c.encoding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			undiff2, err := UnDiffPaletted(undiff, diff2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if undiff2.Pix[4] != 9 {
+				t.Fatalf("expected the erased pixel painted again, got %v", undiff2.Pix)
+			}
+		})
+	}
+}
+
+func TestDiffErasuresUnchanged(t *testing.T) {
+	base := pixT(7, 0, 5)
+	diff, changes, err := DiffPaletted(base, pixT(7, 0, 5), DiffErasures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes {
+		t.Fatal("expected no changes")
+	}
+	if len(diff.Palette) != len(base.Palette)+1 {
+		t.Fatalf("expected the erased sentinel in the palette, got %d colors", len(diff.Palette))
+	}
+	if _, err := ParseDiffEncoding("bogus"); err == nil {
+		t.Fatal("expected an error on an unknown encoding")
+	}
+}
+
+func TestDiffTransparentErasuresOnly(t *testing.T) {
+	// Erasures are lost with DiffTransparent, so erasing only is no change
+	base := pixT(7, 0, 5)
+	if _, changes, err := DiffPaletted(base, pixT(0, 0, 5), DiffTransparent); err != nil || changes {
+		t.Fatalf("expected no changes, got %v, %v", changes, err)
+	}
+	if _, changes, err := DiffPaletted(base, pixT(0, 0, 5), DiffErasures); err != nil || !changes {
+		t.Fatalf("expected the erasure to be a change, got %v, %v", changes, err)
+	}
+}
+
+func TestDiffReorderedPalette(t *testing.T) {
+	base := pixT(7, 0, 7, 5)
+	// The colors of the project palette, 5 and 7 swapped
+	palette := append(color.Palette{}, base.Palette...)
+	palette[5], palette[7] = palette[7], palette[5]
+	new := image.NewPaletted(base.Rect, palette)
+	copy(new.Pix, []uint8{5, 7, 0, 5}) // Unchanged, paint 5, erase, repaint 7
+
+	diff, changes, err := DiffPaletted(base, new, DiffErasures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changes {
+		t.Fatal("expected changes")
+	}
+	erased := uint8(len(base.Palette))
+	if want := []uint8{0, 5, erased, 7}; !reflect.DeepEqual(diff.Pix, want) {
+		t.Fatalf("expected the diff %v on the base palette, got %v", want, diff.Pix)
+	}
+	if n, err := ChangedPixels(base, new); err != nil || n != 3 {
+		t.Fatalf("expected 3 changed pixels, got %d, %v", n, err)
+	}
+
+	// A diff of reordered palette applies too, index 0 is unchanged
+	reordered := image.NewPaletted(base.Rect, palette)
+	copy(reordered.Pix, []uint8{0, 7, 0, 5})
+	undiff, err := UnDiffPaletted(base, reordered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint8{7, 5, 7, 7}; !reflect.DeepEqual(undiff.Pix, want) {
+		t.Fatalf("expected %v, got %v", want, undiff.Pix)
+	}
+
+	// Colors missing from the base palette still differ
+	palette[5] = color.RGBA{1, 2, 3, 255}
+	if _, _, err := DiffPaletted(base, new, DiffTransparent); err == nil {
+		t.Fatal("expected an error on a color missing from the base palette")
+	}
+}
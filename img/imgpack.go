@@ -2,103 +2,181 @@ package img
 
 import (
 	"bytes"
+	_ "embed"
+	"encoding/csv"
 	"fmt"
 	"image"
 	"image/color"
+	"image/draw"
 	"image/png"
 	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/HugoSmits86/nativewebp"
 )
 
-var colorToIndex = map[[3]uint8]int{
-	{0, 0, 0}:       1,  // Black
-	{60, 60, 60}:    2,  // Dark Gray
-	{120, 120, 120}: 3,  // Gray
-	{170, 170, 170}: 32, // Medium Gray
-	{210, 210, 210}: 4,  // Light Gray
-	{255, 255, 255}: 5,  // White
-	{96, 0, 24}:     6,  // Deep Red
-	{165, 14, 30}:   33, // Dark Red
-	{237, 28, 36}:   7,  // Red
-	{250, 128, 114}: 34, // Light Red
-	{228, 92, 26}:   35, // Dark Orange
-	{255, 127, 39}:  8,  // Orange
-	{246, 170, 9}:   9,  // Gold
-	{249, 221, 59}:  10, // Yellow
-	{255, 250, 188}: 11, // Light Yellow
-	{156, 132, 49}:  37, // Dark Goldenrod
-	{197, 173, 49}:  38, // Goldenrod
-	{232, 212, 95}:  39, // Light Goldenrod
-	{74, 107, 58}:   40, // Dark Olive
-	{90, 148, 74}:   41, // Olive
-	{132, 197, 115}: 42, // Light Olive
-	{14, 185, 104}:  12, // Dark Green
-	{19, 230, 123}:  13, // Green
-	{135, 255, 94}:  14, // Light Green
-	{12, 129, 110}:  15, // Dark Teal
-	{16, 174, 166}:  16, // Teal
-	{19, 225, 190}:  17, // Light Teal
-	{15, 121, 159}:  43, // Dark Cyan
-	{96, 247, 242}:  20, // Cyan
-	{187, 250, 242}: 44, // Light Cyan
-	{40, 80, 158}:   18, // Dark Blue
-	{64, 147, 228}:  19, // Blue
-	{125, 199, 255}: 45, // Light Blue
-	{77, 49, 184}:   46, // Dark Indigo
-	{107, 80, 246}:  21, // Indigo
-	{153, 177, 251}: 22, // Light Indigo
-	{74, 66, 132}:   47, // Dark Slate Blue
-	{122, 113, 196}: 48, // Slate Blue
-	{181, 174, 241}: 49, // Light Slate Blue
-	{120, 12, 153}:  23, // Dark Purple
-	{170, 56, 185}:  24, // Purple
-	{224, 159, 249}: 25, // Light Purple
-	{203, 0, 122}:   26, // Dark Pink
-	{236, 31, 128}:  27, // Pink
-	{243, 141, 169}: 28, // Light Pink
-	{155, 82, 73}:   53, // Dark Peach
-	{209, 128, 120}: 54, // Peach
-	{250, 182, 164}: 55, // Light Peach
-	{104, 70, 52}:   29, // Dark Brown
-	{149, 104, 42}:  30, // Brown
-	{219, 164, 99}:  50, // Light Brown
-	{123, 99, 82}:   56, // Dark Tan
-	{156, 132, 107}: 57, // Tan
-	{214, 181, 148}: 36, // Light Tan
-	{209, 128, 81}:  51, // Dark Beige
-	{248, 178, 119}: 31, // Beige
-	{255, 197, 165}: 52, // Light Beige
-	{109, 100, 63}:  61, // Dark Stone
-	{148, 140, 107}: 62, // Stone
-	{205, 197, 158}: 63, // Light Stone
-	{51, 57, 65}:    58, // Dark Slate
-	{109, 117, 141}: 59, // Slate
-	{179, 185, 209}: 60, // Light Slate
-	//{0, 0, 0}:       0,  // Transparent (special, not listed to avoid conflicts)
+// Wplace palette as index,r,g,b,name. Index 0 is reserved for transparent.
+//
+//go:embed palette.csv
+var paletteCSV string
+
+// Default palette, color to palette index
+var colorToIndex = mustParsePalette(paletteCSV)
+
+// Default palette as built by NewPaletter, index 0 transparent
+var defaultPalette = NewPaletter().Palette()
+
+// parsePalette reads a palette CSV with an index,r,g,b,name header
+func parsePalette(data string) (map[[3]uint8]int, error) {
+	records, err := csv.NewReader(strings.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read palette: %w", err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("empty palette")
+	}
+	colors := make(map[[3]uint8]int, len(records)-1)
+	for _, record := range records[1:] {
+		if len(record) < 4 {
+			return nil, fmt.Errorf("invalid palette line %v", record)
+		}
+		var values [4]uint8
+		for i := range values {
+			v, err := strconv.ParseUint(record[i], 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid palette line %v: %w", record, err)
+			}
+			values[i] = uint8(v)
+		}
+		colors[[3]uint8{values[1], values[2], values[3]}] = int(values[0])
+	}
+	return colors, nil
+}
+
+func mustParsePalette(data string) map[[3]uint8]int {
+	colors, err := parsePalette(data)
+	if err != nil {
+		panic(err)
+	}
+	if err := checkColors(colors); err != nil {
+		panic(err)
+	}
+	return colors
+}
+
+// checkColors verifies palette indexes are unique, fit in a byte, and leave index 0 to transparent
+func checkColors(colors map[[3]uint8]int) error {
+	seen := make(map[int][3]uint8, len(colors))
+	for rgb, idx := range colors {
+		if idx <= 0 || idx > 255 {
+			return fmt.Errorf("color %v has index %d, expected 1 to 255 (0 is transparent)", rgb, idx)
+		}
+		if other, ok := seen[idx]; ok {
+			return fmt.Errorf("colors %v and %v share index %d", other, rgb, idx)
+		}
+		seen[idx] = rgb
+	}
+	return nil
 }
 
 type Paletter struct {
+	colors           map[[3]uint8]int
 	palette          []color.Color
 	compressionLevel png.CompressionLevel
+	compact          bool          // Encode with the palette reduced to the used colors, see CompactPalette
+	maxDistance      float64       // Max RGB distance to match an unknown color to the nearest palette color, 0 for strict
+	unknown          *atomic.Int64 // Count of unknown colors encountered, shared by copies
 }
 
+// NewPaletter creates a strict paletter using the Wplace palette, unknown colors become transparent
 func NewPaletter() Paletter {
+	return newPaletter(colorToIndex)
+}
+
+// NewPaletterFromColors creates a strict paletter using a custom palette, mapping colors to indexes.
+// Index 0 is reserved for transparent.
+func NewPaletterFromColors(colors map[[3]uint8]int) (Paletter, error) {
+	if err := checkColors(colors); err != nil {
+		return Paletter{}, err
+	}
+	return newPaletter(colors), nil
+}
+
+func newPaletter(colors map[[3]uint8]int) Paletter {
+	size := 1
+	for _, idx := range colors {
+		size = max(size, idx+1)
+	}
 	p := Paletter{
-		palette:          make([]color.Color, 64),
-		compressionLevel: png.DefaultCompression, // BestCompression is 9x slower. Best speed is 4x faster but at significantly worse compression ratio
+		colors:           colors,
+		palette:          make([]color.Color, size),
+		compressionLevel: png.DefaultCompression, // See ParseCompressionLevel for the tradeoffs
+		unknown:          &atomic.Int64{},
 	}
 	p.buildPalette()
 	return p
 }
 
-func (p Paletter) buildPalette() {
-	// Build palette from colorToIndex
-	for rgb, idx := range colorToIndex {
-		if idx == 0 {
-			p.palette[idx] = color.RGBA{0, 0, 0, 0} // Transparent
-		} else if idx >= 0 && idx < len(p.palette) {
-			p.palette[idx] = color.RGBA{rgb[0], rgb[1], rgb[2], 255}
+// NewNearestPaletter creates a paletter mapping unknown colors to the nearest palette color,
+// by Euclidean RGB distance. Colors further than maxDistance from any palette color become transparent.
+func NewNearestPaletter(maxDistance float64) Paletter {
+	p := NewPaletter()
+	p.maxDistance = maxDistance
+	return p
+}
+
+// Palette returns the palette of the images produced by the paletter
+func (p Paletter) Palette() color.Palette {
+	return p.palette
+}
+
+// UnknownColors returns the count of unknown colors encountered, one per palette entry for paletted images, one per pixel otherwise
+func (p Paletter) UnknownColors() int64 {
+	return p.unknown.Load()
+}
+
+// colorIndex returns the palette index of an opaque color
+func (p Paletter) colorIndex(r8, g8, b8 uint8) int {
+	idx, ok := p.colors[[3]uint8{r8, g8, b8}]
+	if ok {
+		return idx
+	}
+	p.unknown.Add(1)
+	if p.maxDistance > 0 {
+		if idx, ok := nearestColorIndex(p.colors, r8, g8, b8, p.maxDistance); ok {
+			return idx
+		}
+	}
+	return 0 // Unknown color -> transparent
+}
+
+// nearestColorIndex returns the index of the nearest palette color, if within maxDistance
+func nearestColorIndex(colors map[[3]uint8]int, r8, g8, b8 uint8, maxDistance float64) (int, bool) {
+	best, bestDist := 0, -1
+	for rgb, idx := range colors {
+		dr := int(rgb[0]) - int(r8)
+		dg := int(rgb[1]) - int(g8)
+		db := int(rgb[2]) - int(b8)
+		dist := dr*dr + dg*dg + db*db
+		// Lowest index on equal distance, to be deterministic
+		if bestDist < 0 || dist < bestDist || (dist == bestDist && idx < best) {
+			best, bestDist = idx, dist
 		}
 	}
+	if float64(bestDist) > maxDistance*maxDistance {
+		return 0, false
+	}
+	return best, true
+}
+
+func (p Paletter) buildPalette() {
+	// Build palette from colors, index 0 stays transparent
+	for rgb, idx := range p.colors {
+		p.palette[idx] = color.RGBA{rgb[0], rgb[1], rgb[2], 255}
+	}
 
 	// Fill empty palette slots with transparent black
 	for i := range p.palette {
@@ -118,15 +196,7 @@ func (p Paletter) SwapPalette(img *image.Paletted) *image.Paletted {
 		if a == 0 {
 			idx = 0 // Transparent
 		} else {
-			r8 := uint8(r >> 8)
-			g8 := uint8(g >> 8)
-			b8 := uint8(b >> 8)
-			var ok bool
-			idx, ok = colorToIndex[[3]uint8{r8, g8, b8}]
-			if !ok {
-				fmt.Printf("Unknown color: %d %d %d\n", r8, g8, b8)
-				idx = 0 // Unknown color -> transparent
-			}
+			idx = p.colorIndex(uint8(r>>8), uint8(g>>8), uint8(b>>8))
 		}
 		indexMap[uint8(i)] = uint8(idx)
 	}
@@ -150,15 +220,7 @@ func (p Paletter) RGBAToPalette(img image.Image) image.Image {
 			if a == 0 {
 				idx = 0 // Transparent -> 0
 			} else {
-				r8 := uint8(r >> 8)
-				g8 := uint8(g >> 8)
-				b8 := uint8(b >> 8)
-				var ok bool
-				idx, ok = colorToIndex[[3]uint8{r8, g8, b8}]
-				if !ok {
-					fmt.Printf("Unknown color: %d %d %d\n", r8, g8, b8)
-					idx = 0 // Unknown color -> 0
-				}
+				idx = p.colorIndex(uint8(r>>8), uint8(g>>8), uint8(b>>8))
 			}
 			outImg.SetColorIndex(x, y, uint8(idx))
 		}
@@ -176,53 +238,182 @@ func (p Paletter) ToPalette(img image.Image) image.Image {
 	}
 }
 
+// WithCompressionLevel returns a copy of the paletter packing PNGs at level, see ParseCompressionLevel
+func (p Paletter) WithCompressionLevel(level png.CompressionLevel) Paletter {
+	p.compressionLevel = level
+	return p
+}
+
+// WithCompactPalette returns a copy of the paletter encoding PNGs with the palette reduced to the used colors, see CompactPalette
+func (p Paletter) WithCompactPalette(compact bool) Paletter {
+	p.compact = compact
+	return p
+}
+
 func (p Paletter) PngPack(img image.Image, out io.Writer) error {
-	outImg := p.ToPalette(img)
+	return p.EncodePng(p.ToPalette(img), out)
+}
 
-	enc := png.Encoder{
-		CompressionLevel: p.compressionLevel,
+// EncodePng encodes an image already converted by ToPalette, at the compression level of the paletter
+func (p Paletter) EncodePng(img image.Image, out io.Writer) error {
+	if paletted, ok := img.(*image.Paletted); ok && p.compact {
+		img = CompactPalette(paletted)
 	}
-	if err := enc.Encode(out, outImg); err != nil {
-		return err
+	return encodePng(out, img, p.compressionLevel)
+}
+
+// RemapPalette returns img with the palette palette, img itself if it already has the same colors.
+// Tiles encoded with CompactPalette are mapped back to the full palette, so they can be merged and diffed.
+// Colors missing from palette become index 0, transparent.
+func RemapPalette(img *image.Paletted, palette color.Palette) *image.Paletted {
+	if samePalette(img.Palette, palette) {
+		return img
 	}
-	return nil
+	remap, _ := paletteRemap(img.Palette, palette)
+	remapped := image.NewPaletted(img.Rect, palette)
+	for i, p := range img.Pix {
+		remapped.Pix[i] = remap[p]
+	}
+	return remapped
 }
 
-// EmptyImage produces a 1000x1000 png of alpha=0
-func EmptyImage() []byte {
-	img := image.NewRGBA(image.Rect(0, 0, 1000, 1000))
-	for x := 0; x < 1000; x++ {
-		for y := 0; y < 1000; y++ {
-			img.Set(x, y, color.Transparent)
+// CompactPalette returns img with a palette of only the colors it uses, in the order of its palette,
+// img itself if it uses them all. The PNG encoder picks the bit depth from the palette size,
+// so a tile of up to 2, 4 or 16 colors is encoded with 1, 2 or 4 bits per pixel instead of 8.
+// The result is a standard PNG, but its palette differs from the palette of the paletter, see RemapPalette to restore it.
+func CompactPalette(img *image.Paletted) *image.Paletted {
+	var used [256]bool
+	for _, i := range img.Pix {
+		used[i] = true
+	}
+	var remap [256]uint8
+	palette := make(color.Palette, 0, len(img.Palette))
+	for i, c := range img.Palette {
+		if used[i] {
+			remap[i] = uint8(len(palette))
+			palette = append(palette, c)
 		}
 	}
-	var buf bytes.Buffer
-	if err := png.Encode(&buf, img); err != nil {
-		return nil
+	if len(palette) == len(img.Palette) {
+		return img
 	}
-	return buf.Bytes()
+	compact := image.NewPaletted(img.Rect, palette)
+	for i, p := range img.Pix {
+		compact.Pix[i] = remap[p]
+	}
+	return compact
 }
 
-func EmptyImagePaletted(size int) image.Image {
+// IsAllTransparent is true when every pixel of img has a transparent color
+func IsAllTransparent(img *image.Paletted) bool {
+	var transparent [256]bool
+	for i, c := range img.Palette {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			transparent[i] = true
+		}
+	}
+	for _, p := range img.Pix {
+		if !transparent[p] {
+			return false
+		}
+	}
+	return true
+}
+
+// Compression level names, for ParseCompressionLevel
+const (
+	CompressionDefault = "default"
+	CompressionSpeed   = "speed"
+	CompressionBest    = "best"
+	CompressionNone    = "none"
+)
+
+// ParseCompressionLevel parses a PNG compression level name.
+// On the tiles of img/testdata, compared to default, best is 7% smaller but 28x slower to encode,
+// speed is 17% larger but 1.8x faster, see BenchmarkEncodePngLevel.
+func ParseCompressionLevel(name string) (png.CompressionLevel, error) {
+	switch name {
+	case CompressionDefault, "":
+		return png.DefaultCompression, nil
+	case CompressionSpeed:
+		return png.BestSpeed, nil
+	case CompressionBest:
+		return png.BestCompression, nil
+	case CompressionNone:
+		return png.NoCompression, nil
+	}
+	return png.DefaultCompression, fmt.Errorf("invalid compression level %s, must be one of: default, speed, best, none", name)
+}
+
+// Width and height of a Wplace tile, in pixels.
+// The default tile size, the DBs record the size of their tiles, see store.TileDB.TileSize.
+const TileSize = 1000
+
+// EmptyImage produces a size square png of alpha=0
+func EmptyImage(size int) []byte {
 	img := image.NewRGBA(image.Rect(0, 0, size, size))
 	for x := 0; x < size; x++ {
 		for y := 0; y < size; y++ {
 			img.Set(x, y, color.Transparent)
 		}
 	}
-	p := NewPaletter()
-	return p.ToPalette(img)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// EmptyImagePaletted returns a fully transparent tile of the default palette, see NewEmptyPaletted
+func EmptyImagePaletted(size int) image.Image {
+	return NewEmptyPaletted(size)
+}
+
+// NewEmptyPaletted returns a fully transparent size x size image of the default palette, like NewPaletter makes.
+// Every pixel is index 0, allocated directly without converting a transparent RGBA image.
+func NewEmptyPaletted(size int) *image.Paletted {
+	// Cloned, the caller may change the palette of its image
+	return image.NewPaletted(image.Rect(0, 0, size, size), slices.Clone(defaultPalette))
 }
 
 func EncodePng(i image.Image) ([]byte, error) {
+	return EncodePngLevel(i, png.DefaultCompression)
+}
+
+// EncodePngLevel encodes the image as PNG with the compression level
+func EncodePngLevel(i image.Image, level png.CompressionLevel) ([]byte, error) {
+	var buf bytes.Buffer
+	err := encodePng(&buf, i, level)
+	return buf.Bytes(), err
+}
+
+func encodePng(out io.Writer, i image.Image, level png.CompressionLevel) error {
 	enc := png.Encoder{
-		CompressionLevel: png.DefaultCompression,
+		CompressionLevel: level,
+	}
+	return enc.Encode(out, i)
+}
+
+// EncodeWebp encodes the image as lossless WebP
+func EncodeWebp(i image.Image) ([]byte, error) {
+	// The encoder only accepts NRGBA
+	nrgba, ok := i.(*image.NRGBA)
+	if !ok {
+		nrgba = image.NewNRGBA(i.Bounds())
+		draw.Draw(nrgba, nrgba.Bounds(), i, i.Bounds().Min, draw.Src)
 	}
 	var buf bytes.Buffer
-	err := enc.Encode(&buf, i)
+	err := nativewebp.Encode(&buf, nrgba, nil)
 	return buf.Bytes(), err
 }
 
+// FitTile crops or pads i with transparent pixels to a size square, anchored at the top left
+func FitTile(i image.Image, size int) image.Image {
+	fitted := image.NewNRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(fitted, fitted.Bounds(), i, i.Bounds().Min, draw.Src)
+	return fitted
+}
+
 func DecodeImage(data []byte) (image.Image, error) {
 	i, _, err := image.Decode(bytes.NewReader(data))
 	return i, err
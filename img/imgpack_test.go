@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"image"
+	"image/color"
 	"os"
 	"reflect"
 	"testing"
@@ -83,3 +84,259 @@ func BenchmarkImgPack(b *testing.B) {
 	})
 	fmt.Fprintf(os.Stdout, "Img packed size: %d kiB\n", len(packed.Bytes())/1024)
 }
+
+func TestUnknownColors(t *testing.T) {
+	// Slightly off the palette red (237, 28, 36)
+	offRed := color.RGBA{240, 30, 33, 255}
+	src := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	src.Set(0, 0, offRed)
+	src.Set(1, 0, color.RGBA{237, 28, 36, 255})
+	red := colorToIndex[[3]uint8{237, 28, 36}]
+
+	t.Run("Strict", func(t *testing.T) {
+		p := NewPaletter()
+		res := p.RGBAToPalette(src).(*image.Paletted)
+		if res.Pix[0] != 0 || int(res.Pix[1]) != red {
+			t.Fatalf("expected [0 %d], got %v", red, res.Pix)
+		}
+		if p.UnknownColors() != 1 {
+			t.Fatalf("expected 1 unknown color, got %d", p.UnknownColors())
+		}
+	})
+
+	t.Run("Nearest", func(t *testing.T) {
+		p := NewNearestPaletter(10)
+		res := p.RGBAToPalette(src).(*image.Paletted)
+		if int(res.Pix[0]) != red || int(res.Pix[1]) != red {
+			t.Fatalf("expected [%d %d], got %v", red, red, res.Pix)
+		}
+		if p.UnknownColors() != 1 {
+			t.Fatalf("expected 1 unknown color, got %d", p.UnknownColors())
+		}
+	})
+
+	t.Run("NearestTooFar", func(t *testing.T) {
+		p := NewNearestPaletter(2)
+		res := p.RGBAToPalette(src).(*image.Paletted)
+		if res.Pix[0] != 0 {
+			t.Fatalf("expected transparent, got %d", res.Pix[0])
+		}
+	})
+
+	t.Run("SwapPalette", func(t *testing.T) {
+		p := NewNearestPaletter(10)
+		pal := image.NewPaletted(image.Rect(0, 0, 1, 1), color.Palette{offRed})
+		res := p.SwapPalette(pal)
+		if int(res.Pix[0]) != red {
+			t.Fatalf("expected %d, got %d", red, res.Pix[0])
+		}
+	})
+}
+
+func TestPaletterFromColors(t *testing.T) {
+	t.Run("Default", func(t *testing.T) {
+		p := NewPaletter()
+		if len(p.palette) != 64 {
+			t.Fatalf("expected 64 colors, got %d", len(p.palette))
+		}
+		if _, _, _, a := p.palette[0].RGBA(); a != 0 {
+			t.Fatal("index 0 is not transparent")
+		}
+	})
+
+	t.Run("Custom", func(t *testing.T) {
+		p, err := NewPaletterFromColors(map[[3]uint8]int{{255, 0, 0}: 1, {0, 0, 255}: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		src := image.NewRGBA(image.Rect(0, 0, 3, 1))
+		src.Set(0, 0, color.RGBA{255, 0, 0, 255})
+		src.Set(1, 0, color.RGBA{0, 0, 255, 255})
+		src.Set(2, 0, color.RGBA{0, 0, 0, 255})
+		res := p.RGBAToPalette(src).(*image.Paletted)
+		if !reflect.DeepEqual(res.Pix, []uint8{1, 3, 0}) {
+			t.Fatalf("expected [1 3 0], got %v", res.Pix)
+		}
+		if len(res.Palette) != 4 {
+			t.Fatalf("expected 4 colors, got %d", len(res.Palette))
+		}
+	})
+
+	t.Run("ReservedTransparent", func(t *testing.T) {
+		if _, err := NewPaletterFromColors(map[[3]uint8]int{{0, 0, 0}: 0}); err == nil {
+			t.Fatal("expected an error for index 0")
+		}
+	})
+
+	t.Run("DuplicateIndex", func(t *testing.T) {
+		if _, err := NewPaletterFromColors(map[[3]uint8]int{{0, 0, 0}: 1, {1, 1, 1}: 1}); err == nil {
+			t.Fatal("expected an error for a duplicate index")
+		}
+	})
+}
+
+func BenchmarkEncodePngLevel(b *testing.B) {
+	tiles := []image.Image{
+		loadImageB("testdata/tiles-146_0-0.png", b),
+		loadImageB("testdata/tile-v2-11-1036-704.png", b),
+		loadImageB("testdata/tile-v2-11-1036-705.png", b),
+		loadImageB("testdata/tile-v2-11-1037-704.png", b),
+		loadImageB("testdata/tile-v2-11-1037-705.png", b),
+		loadImageB("testdata/tile-v0-10-0-0.png", b),
+	}
+	p := NewPaletter()
+	for i := range tiles {
+		tiles[i] = p.ToPalette(tiles[i])
+	}
+	for _, name := range []string{CompressionDefault, CompressionSpeed, CompressionBest} {
+		level, err := ParseCompressionLevel(name)
+		if err != nil {
+			b.Fatal(err)
+		}
+		size := 0
+		b.Run(name, func(b *testing.B) {
+			for b.Loop() {
+				size = 0
+				for _, tile := range tiles {
+					data, err := EncodePngLevel(tile, level)
+					if err != nil {
+						b.Fatal(err)
+					}
+					size += len(data)
+				}
+			}
+		})
+		fmt.Fprintf(os.Stdout, "%s: %d kiB for %d tiles\n", name, size/1024, len(tiles))
+	}
+}
+
+func TestCompressionLevel(t *testing.T) {
+	if _, err := ParseCompressionLevel("fastest"); err == nil {
+		t.Fatal("expected an error for an unknown level")
+	}
+	im := loadImageT("testdata/tiles-146_0-0.png", t)
+	sizes := make(map[string]int)
+	for _, name := range []string{CompressionNone, CompressionSpeed, CompressionBest} {
+		level, err := ParseCompressionLevel(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var packed bytes.Buffer
+		if err := NewPaletter().WithCompressionLevel(level).PngPack(im, &packed); err != nil {
+			t.Fatal(err)
+		}
+		sizes[name] = packed.Len()
+	}
+	if sizes[CompressionNone] <= sizes[CompressionSpeed] || sizes[CompressionSpeed] <= sizes[CompressionBest] {
+		t.Fatalf("expected sizes decreasing with the compression level, got %v", sizes)
+	}
+}
+
+func TestIsAllTransparent(t *testing.T) {
+	tile := EmptyImagePaletted(TileSize).(*image.Paletted)
+	if !IsAllTransparent(tile) {
+		t.Fatal("expected the empty tile to be transparent")
+	}
+	tile.Pix[len(tile.Pix)-1] = 5
+	if IsAllTransparent(tile) {
+		t.Fatal("expected a painted pixel to be seen")
+	}
+	// The erased sentinel of a diff is transparent too
+	diff, _, err := DiffPaletted(pixT(5, 5), pixT(0, 5), DiffErasures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsAllTransparent(diff) {
+		t.Fatal("expected the erasure diff to be transparent")
+	}
+}
+
+func TestCompactPalette(t *testing.T) {
+	p := NewPaletter()
+	// A level 10 tile, of 45 colors
+	im := loadImageT("testdata/tile-v0-10-0-0.png", t)
+	paletted := p.ToPalette(im).(*image.Paletted)
+	var full, compact bytes.Buffer
+	if err := p.EncodePng(paletted, &full); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.WithCompactPalette(true).EncodePng(paletted, &compact); err != nil {
+		t.Fatal(err)
+	}
+	if compact.Len() >= full.Len() {
+		t.Errorf("expected the compact tile smaller, got %d bytes, %d with the full palette", compact.Len(), full.Len())
+	}
+
+	decoded, err := DecodePaletted(compact.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Palette) >= len(paletted.Palette) {
+		t.Fatalf("expected a compact palette, got %d colors", len(decoded.Palette))
+	}
+	remapped := RemapPalette(decoded, p.Palette())
+	if !samePalette(remapped.Palette, paletted.Palette) || !bytes.Equal(remapped.Pix, paletted.Pix) {
+		t.Fatal("expected the compact tile back to the full palette with the same pixels")
+	}
+	if RemapPalette(paletted, p.Palette()) != paletted {
+		t.Fatal("expected a tile of the full palette unchanged")
+	}
+
+	// 3 colors fit in 2 bits per pixel
+	tile := EmptyImagePaletted(TileSize).(*image.Paletted)
+	for i := range tile.Pix {
+		tile.Pix[i] = uint8(i % 7 / 3 * 5)
+	}
+	small := CompactPalette(tile)
+	if len(small.Palette) != 3 || small.Pix[0] != 0 || small.Pix[3] != 1 || small.Pix[6] != 2 {
+		t.Fatalf("expected 3 colors remapped in order, got %d colors, pixels %v", len(small.Palette), small.Pix[:7])
+	}
+	full.Reset()
+	compact.Reset()
+	if err := p.EncodePng(tile, &full); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.WithCompactPalette(true).EncodePng(tile, &compact); err != nil {
+		t.Fatal(err)
+	}
+	if compact.Len() >= full.Len() {
+		t.Errorf("expected the 3 colors tile smaller, got %d bytes, %d with the full palette", compact.Len(), full.Len())
+	}
+}
+
+// emptyImagePalettedRGBA is the conversion of a transparent RGBA image NewEmptyPaletted replaces, its reference
+func emptyImagePalettedRGBA(size int) *image.Paletted {
+	rgba := image.NewRGBA(image.Rect(0, 0, size, size))
+	for x := 0; x < size; x++ {
+		for y := 0; y < size; y++ {
+			rgba.Set(x, y, color.Transparent)
+		}
+	}
+	return NewPaletter().ToPalette(rgba).(*image.Paletted)
+}
+
+func TestNewEmptyPaletted(t *testing.T) {
+	expected := emptyImagePalettedRGBA(TileSize)
+	empty := NewEmptyPaletted(TileSize)
+	if empty.Rect != expected.Rect || !reflect.DeepEqual(empty.Palette, expected.Palette) || !bytes.Equal(empty.Pix, expected.Pix) {
+		t.Fatal("expected the same image as converting a transparent RGBA image")
+	}
+	// The palette is not shared between images
+	empty.Palette[1] = color.RGBA{1, 2, 3, 255}
+	if reflect.DeepEqual(NewEmptyPaletted(TileSize).Palette, empty.Palette) {
+		t.Fatal("expected a palette per image")
+	}
+}
+
+func BenchmarkEmptyPaletted(b *testing.B) {
+	b.Run("RGBA", func(b *testing.B) {
+		for b.Loop() {
+			emptyImagePalettedRGBA(TileSize)
+		}
+	})
+	b.Run("Direct", func(b *testing.B) {
+		for b.Loop() {
+			NewEmptyPaletted(TileSize)
+		}
+	})
+}
@@ -14,16 +14,27 @@ func MergeAndResize(positions map[[2]int][]byte, block int) (image.Image, error)
 		return nil, fmt.Errorf("invalid number of images to merge, got: %d, want: %d", len(positions), block*block)
 	}
 
-	imgW, imgH := 1000, 1000
-	canvasW := block * imgW
-	canvasH := block * imgH
-	canvas := image.NewRGBA(image.Rect(0, 0, canvasW, canvasH))
-
+	// The size of the tiles is the size of the first decoded
+	imgW, imgH := 0, 0
+	images := make(map[[2]int]image.Image, len(positions))
 	for pos, data := range positions {
 		img, _, err := image.Decode(bytes.NewReader(data))
 		if err != nil {
 			return nil, err
 		}
+		size := img.Bounds().Size()
+		if imgW == 0 {
+			imgW, imgH = size.X, size.Y
+		} else if size.X != imgW || size.Y != imgH {
+			return nil, fmt.Errorf("input images differ in size, %v and %dx%d", size, imgW, imgH)
+		}
+		images[pos] = img
+	}
+	canvasW := block * imgW
+	canvasH := block * imgH
+	canvas := image.NewRGBA(image.Rect(0, 0, canvasW, canvasH))
+
+	for pos, img := range images {
 		x := pos[0] * imgW
 		y := pos[1] * imgH
 		for i := 0; i < imgW; i++ {
@@ -73,7 +84,8 @@ func FastResizeAndMerge(a, b, c, d image.Image, resizeFunc func(image.Image) ima
 	rc := resizeFunc(c)
 	rd := resizeFunc(d)
 
-	imgW, imgH := a.Bounds().Dx(), a.Bounds().Dy()
+	// Size of the resized images, the canvas is the size of one input image
+	imgW, imgH := ra.Bounds().Dx(), ra.Bounds().Dy()
 	canvasW := imgW * 2
 	canvasH := imgH * 2
 	canvas := image.NewRGBA(image.Rect(0, 0, canvasW, canvasH))
@@ -263,6 +275,10 @@ func FastPalettedResizeAndMerge(a, b, c, d image.Image, resizeFunc func(*image.P
 	if !reflect.DeepEqual(ap.Palette, dp.Palette) {
 		return nil, fmt.Errorf("input images A and D have different palettes")
 	}
+	// Check sizes are the same, a larger child would be drawn out of the canvas
+	if a.Bounds().Size() != b.Bounds().Size() || a.Bounds().Size() != c.Bounds().Size() || a.Bounds().Size() != d.Bounds().Size() {
+		return nil, fmt.Errorf("input images differ in size")
+	}
 
 	canvasW, canvasH := a.Bounds().Dx(), a.Bounds().Dy()
 	canvas := image.NewPaletted(image.Rect(0, 0, canvasW, canvasH), ap.Palette)
@@ -304,6 +320,11 @@ func FastPaletteResize2(in *image.Paletted, out *image.Paletted, xOffset, yOffse
 	}
 }
 
+// MostNonTransparentColor2x2Paletted returns the most frequent non transparent index of the 2x2 pixels
+// a b
+// c d
+// Ties are broken by position, the first in a, b, c, d order wins (top-left first).
+// Returns transparent only if all pixels are transparent.
 func MostNonTransparentColor2x2Paletted(a, b, c, d uint8, transparent uint8) uint8 {
 	// Replace fully transparent pixels with sentinel
 	a0 := a == transparent
@@ -313,7 +334,7 @@ func MostNonTransparentColor2x2Paletted(a, b, c, d uint8, transparent uint8) uin
 
 	// Return early if all transparent
 	if a0 && b0 && c0 && d0 {
-		return 0
+		return transparent
 	}
 
 	// Majority logic, skipping transparent
@@ -355,5 +376,19 @@ func MostNonTransparentColor2x2Paletted(a, b, c, d uint8, transparent uint8) uin
 			return v
 		}
 	}
-	return 0 // fallback, should not reach here
+	return transparent // fallback, should not reach here
+}
+
+// ResizeNearest scales i to w x h pixels, using the nearest pixel
+func ResizeNearest(i image.Image, w, h int) *image.NRGBA {
+	src := i.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		sy := src.Min.Y + y*src.Dy()/h
+		for x := range w {
+			sx := src.Min.X + x*src.Dx()/w
+			dst.Set(x, y, i.At(sx, sy))
+		}
+	}
+	return dst
 }
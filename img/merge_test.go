@@ -27,6 +27,51 @@ func loadFile(path string, b *testing.B) []byte {
 	return data
 }
 
+func TestFastResizeAndMerge(t *testing.T) {
+	i1 := loadImageT("testdata/tile-v2-11-1036-704.png", t)
+	i2 := loadImageT("testdata/tile-v2-11-1037-704.png", t)
+	i3 := loadImageT("testdata/tile-v2-11-1036-705.png", t)
+	i4 := loadImageT("testdata/tile-v2-11-1037-705.png", t)
+	merged := FastResizeAndMerge(i1, i2, i3, i4, FastAvgResize2)
+	if merged.Bounds() != i1.Bounds() {
+		t.Fatalf("expected merged size %v, got %v", i1.Bounds(), merged.Bounds())
+	}
+}
+
+// mostNonTransparentRef counts colors, ties go to the first in a, b, c, d order
+func mostNonTransparentRef(px [4]uint8, transparent uint8) uint8 {
+	best, bestCount := transparent, 0
+	for i, v := range px {
+		if v == transparent {
+			continue
+		}
+		count := 0
+		for _, w := range px[i:] {
+			if w == v {
+				count++
+			}
+		}
+		if count > bestCount {
+			best, bestCount = v, count
+		}
+	}
+	return best
+}
+
+func TestMostNonTransparentColor2x2Paletted(t *testing.T) {
+	// 0 is the usual transparent index, 3 checks nothing assumes it
+	for _, transparent := range []uint8{0, 3} {
+		for i := range 5 * 5 * 5 * 5 {
+			px := [4]uint8{uint8(i % 5), uint8(i / 5 % 5), uint8(i / 25 % 5), uint8(i / 125 % 5)}
+			got := MostNonTransparentColor2x2Paletted(px[0], px[1], px[2], px[3], transparent)
+			want := mostNonTransparentRef(px, transparent)
+			if got != want {
+				t.Fatalf("pixels %v (transparent %d): got %d, want %d", px, transparent, got, want)
+			}
+		}
+	}
+}
+
 func BenchmarkLoadImage(b *testing.B) {
 	b.Run("GoLoadImage", func(b *testing.B) {
 		for b.Loop() {
@@ -67,3 +112,19 @@ func BenchmarkFastResizeAndMerge(b *testing.B) {
 		}
 	})
 }
+
+func TestFastPalettedResizeAndMergeSizes(t *testing.T) {
+	small := EmptyImagePaletted(500)
+	large := EmptyImagePaletted(TileSize)
+	merged, err := FastPalettedResizeAndMerge(small, small, small, small, FastPaletteResize2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.Bounds() != small.Bounds() {
+		t.Fatalf("expected merged size %v, got %v", small.Bounds(), merged.Bounds())
+	}
+	// A larger child would be drawn out of the canvas
+	if _, err := FastPalettedResizeAndMerge(small, large, small, small, FastPaletteResize2); err == nil {
+		t.Fatal("expected an error for children of different sizes")
+	}
+}
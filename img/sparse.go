@@ -0,0 +1,202 @@
+package img
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"slices"
+)
+
+// SparseFormat is the first byte of a sparse diff tile, PNG tiles start with 0x89.
+//
+// Diff tiles are mostly unchanged pixels, index 0, yet an empty 1000x1000 PNG is already 2 kB.
+// A sparse tile lists the runs of changed pixels of the same color instead, in row major order:
+//
+//	SparseFormat, flags (sparseErasures), uvarint width, uvarint height, uvarint count,
+//	then count times: uvarint gap from the end of the previous run, uvarint length - 1, palette index.
+//
+// The palette is not stored, it is the palette of this project, with the erased sentinel of DiffErasures if flagged.
+// The format is registered to image.Decode, so DecodeImage and DecodePaletted read both formats.
+const SparseFormat byte = 0x01
+
+// sparseErasures flags a palette with the erased sentinel, see DiffErasures
+const sparseErasures byte = 1
+
+// DefaultSparseMaxRuns is the count of runs up to which a diff tile is stored sparse, see EncodeDiff.
+// Sparse tiles are smaller than PNG ones up to about 2000 runs of clustered changes, and 5000 of scattered pixels,
+// see BenchmarkEncodeDiff.
+const DefaultSparseMaxRuns = 1000
+
+// maxSparseSize bounds the width and height of a sparse tile, so a corrupt header can't make the decoder allocate
+// gigabytes. Tiles are 1000x1000, larger ones are encoded as PNG.
+const maxSparseSize = 4096
+
+// minSparseRun is the size in bytes of the smallest run, one byte per uvarint and the palette index
+const minSparseRun = 3
+
+func init() {
+	image.RegisterFormat("sparse", string(SparseFormat), decodeSparse, decodeSparseConfig)
+}
+
+// IsSparse tells if data is a sparse diff tile
+func IsSparse(data []byte) bool {
+	return len(data) > 0 && data[0] == SparseFormat
+}
+
+// EncodeDiff encodes a diff tile, sparse if it has at most sparseMax runs of changed pixels, PNG at level otherwise.
+// A sparseMax of 0 always encodes PNG. Tiles of another palette than the palette of this project are PNG.
+func EncodeDiff(diff *image.Paletted, sparseMax int, level png.CompressionLevel) ([]byte, error) {
+	flags, ok := sparsePalette(diff.Palette)
+	size := diff.Rect.Size()
+	if !ok || sparseMax <= 0 || size.X > maxSparseSize || size.Y > maxSparseSize {
+		return EncodePngLevel(diff, level)
+	}
+	var runs [][3]int // offset, length, index
+	for y := range size.Y {
+		row := diff.Pix[y*diff.Stride : y*diff.Stride+size.X]
+		for x, p := range row {
+			if p == 0 {
+				continue
+			}
+			offset := y*size.X + x
+			if n := len(runs); n > 0 && runs[n-1][0]+runs[n-1][1] == offset && runs[n-1][2] == int(p) {
+				runs[n-1][1]++
+				continue
+			}
+			if len(runs) == sparseMax {
+				return EncodePngLevel(diff, level)
+			}
+			runs = append(runs, [3]int{offset, 1, int(p)})
+		}
+	}
+
+	buf := make([]byte, 0, 2+3*binary.MaxVarintLen32+len(runs)*4)
+	buf = append(buf, SparseFormat, flags)
+	buf = binary.AppendUvarint(buf, uint64(size.X))
+	buf = binary.AppendUvarint(buf, uint64(size.Y))
+	buf = binary.AppendUvarint(buf, uint64(len(runs)))
+	end := 0
+	for _, run := range runs {
+		buf = binary.AppendUvarint(buf, uint64(run[0]-end))
+		buf = binary.AppendUvarint(buf, uint64(run[1]-1))
+		buf = append(buf, byte(run[2]))
+		end = run[0] + run[1]
+	}
+	return buf, nil
+}
+
+// sparseErasuresPalette is the palette of the sparse tiles flagged sparseErasures, computed once as defaultPalette
+var sparseErasuresPalette = append(slices.Clone(defaultPalette), erasedColor)
+
+// sparsePalette returns the flags of the palette p, ok if it can be stored sparse
+func sparsePalette(p color.Palette) (flags byte, ok bool) {
+	if len(p) == len(defaultPalette)+1 {
+		flags |= sparseErasures
+		p = p[:len(defaultPalette)]
+	}
+	return flags, samePalette(p, defaultPalette)
+}
+
+// sparseHeader reads the header of a sparse tile. The palette is shared, clone it before changing it.
+func sparseHeader(r io.ByteReader) (palette color.Palette, width, height int, err error) {
+	format, err := r.ReadByte()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if format != SparseFormat {
+		return nil, 0, 0, fmt.Errorf("sparse: invalid format %#x", format)
+	}
+	flags, err := r.ReadByte()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	w, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	h, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if w > maxSparseSize || h > maxSparseSize {
+		return nil, 0, 0, fmt.Errorf("sparse: invalid size %dx%d", w, h)
+	}
+	palette = defaultPalette
+	if flags&sparseErasures != 0 {
+		palette = sparseErasuresPalette
+	}
+	return palette, int(w), int(h), nil
+}
+
+func decodeSparseConfig(r io.Reader) (image.Config, error) {
+	palette, width, height, err := sparseHeader(bufio.NewReader(r))
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{ColorModel: palette, Width: width, Height: height}, nil
+}
+
+func decodeSparse(r io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	br := bytes.NewReader(data)
+	palette, width, height, err := sparseHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	count, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	// Checked before allocating the tile
+	if count > uint64(br.Len()/minSparseRun) || count > uint64(width*height) {
+		return nil, fmt.Errorf("sparse: %d runs don't fit the %d bytes of the %dx%d tile", count, br.Len(), width, height)
+	}
+	im := image.NewPaletted(image.Rect(0, 0, width, height), slices.Clone(palette))
+	end := 0
+	for range count {
+		gap, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, fmt.Errorf("sparse: %w", err)
+		}
+		length, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, fmt.Errorf("sparse: %w", err)
+		}
+		index, err := br.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("sparse: %w", err)
+		}
+		if gap > uint64(len(im.Pix)) || length >= uint64(len(im.Pix)) || end+int(gap)+int(length)+1 > len(im.Pix) {
+			return nil, fmt.Errorf("sparse: run out of the %dx%d tile", width, height)
+		}
+		if int(index) >= len(palette) {
+			return nil, fmt.Errorf("sparse: invalid palette index %d", index)
+		}
+		start := end + int(gap)
+		end = start + int(length) + 1
+		for i := start; i < end; i++ {
+			im.Pix[i] = index
+		}
+	}
+	return im, nil
+}
+
+// DiffToPng returns the diff tile data as PNG, transcoding sparse tiles
+func DiffToPng(data []byte) ([]byte, error) {
+	if !IsSparse(data) {
+		return data, nil
+	}
+	im, err := decodeSparse(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return EncodePng(im)
+}
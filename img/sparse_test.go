@@ -0,0 +1,155 @@
+package img
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestSparseRoundTrip(t *testing.T) {
+	base := pixT(7, 7, 7, 0, 0, 5, 5, 5)
+	new := pixT(9, 9, 7, 3, 0, 0, 0, 6)
+	for _, encoding := range []DiffEncoding{DiffTransparent, DiffErasures} {
+		diff, _, err := DiffPaletted(base, new, encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := EncodeDiff(diff, DefaultSparseMaxRuns, png.DefaultCompression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !IsSparse(data) {
+			t.Fatalf("expected a sparse tile, got %x", data[:4])
+		}
+		decoded, err := DecodePaletted(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Rect != diff.Rect || !bytes.Equal(decoded.Pix, diff.Pix) || !samePalette(decoded.Palette, diff.Palette) {
+			t.Fatalf("encoding %d: expected %v, got %v", encoding, diff.Pix, decoded.Pix)
+		}
+		undiff, err := UnDiffPaletted(base, decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encoding == DiffErasures && !bytes.Equal(undiff.Pix, new.Pix) {
+			t.Fatalf("expected %v, got %v", new.Pix, undiff.Pix)
+		}
+
+		pngData, err := DiffToPng(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fromPng, err := DecodePaletted(pngData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(fromPng.Pix, diff.Pix) {
+			t.Fatalf("expected %v once transcoded, got %v", diff.Pix, fromPng.Pix)
+		}
+	}
+}
+
+func TestSparseFallback(t *testing.T) {
+	diff := pixT(1, 2, 3, 4)
+	// 4 runs
+	for _, c := range []struct {
+		sparseMax int
+		sparse    bool
+	}{{4, true}, {3, false}, {0, false}} {
+		data, err := EncodeDiff(diff, c.sparseMax, png.DefaultCompression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if IsSparse(data) != c.sparse {
+			t.Errorf("max %d runs: expected sparse %v", c.sparseMax, c.sparse)
+		}
+	}
+
+	// Other palettes can't be stored sparse
+	other := image.NewPaletted(image.Rect(0, 0, 2, 1), pixT().Palette[:4])
+	other.Pix[0] = 1
+	data, err := EncodeDiff(other, DefaultSparseMaxRuns, png.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsSparse(data) {
+		t.Error("expected a PNG for another palette")
+	}
+}
+
+func TestSparseCorrupt(t *testing.T) {
+	data, err := EncodeDiff(pixT(0, 5, 5, 0), DefaultSparseMaxRuns, png.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecodePaletted(data[:len(data)-1]); err == nil {
+		t.Error("expected an error on a truncated tile")
+	}
+	// The run goes past the end of the tile
+	long := append([]byte{}, data...)
+	long[len(long)-2] = 10
+	if _, err := DecodePaletted(long); err == nil {
+		t.Error("expected an error on a run out of the tile")
+	}
+	// Headers of a huge tile, or of more runs than the data holds
+	for _, header := range [][]byte{
+		{SparseFormat, 0, 0xff, 0xff, 0x03, 0xff, 0xff, 0x03, 0},
+		{SparseFormat, 0, 0x88, 0x20, 0x88, 0x20, 0},
+		{SparseFormat, 0, 5, 5, 2, 0, 0, 1},
+		{SparseFormat, 0, 5, 5, 26},
+	} {
+		if _, err := DecodePaletted(header); err == nil {
+			t.Errorf("expected an error on the header %v", header)
+		}
+	}
+}
+
+// BenchmarkEncodeDiff compares the size of sparse and PNG diff tiles of a testdata tile,
+// with runs of 10 pixels as painted, and with scattered pixels
+func BenchmarkEncodeDiff(b *testing.B) {
+	base := NewPaletter().ToPalette(loadImageB("testdata/tile-v2-11-1036-704.png", b)).(*image.Paletted)
+	for _, clustered := range []bool{true, false} {
+		for _, changes := range []int{100, 1000, 10000} {
+			r := rand.New(rand.NewSource(1))
+			new := image.NewPaletted(base.Rect, base.Palette)
+			copy(new.Pix, base.Pix)
+			for range changes / 10 {
+				i, c := r.Intn(len(new.Pix)-10), uint8(1+r.Intn(len(base.Palette)-1))
+				for j := range 10 {
+					if clustered {
+						new.Pix[i+j] = c
+					} else {
+						new.Pix[r.Intn(len(new.Pix))] = c
+					}
+				}
+			}
+			diff, _, err := DiffPaletted(base, new, DiffTransparent)
+			if err != nil {
+				b.Fatal(err)
+			}
+			name := fmt.Sprintf("clustered=%v/changes=%d", clustered, changes)
+			sizes := make(map[string]int)
+			for _, format := range []string{"png", "sparse"} {
+				sparseMax := 0
+				if format == "sparse" {
+					sparseMax = len(diff.Pix)
+				}
+				b.Run(name+"/"+format, func(b *testing.B) {
+					for b.Loop() {
+						data, err := EncodeDiff(diff, sparseMax, png.DefaultCompression)
+						if err != nil {
+							b.Fatal(err)
+						}
+						sizes[format] = len(data)
+					}
+				})
+			}
+			fmt.Fprintf(os.Stdout, "%s: png %d B, sparse %d B\n", name, sizes["png"], sizes["sparse"])
+		}
+	}
+}
@@ -0,0 +1,31 @@
+// Package logging configures the slog default logger of the commands.
+package logging
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// Setup makes the slog default logger write text lines to stderr, from the level of the LOG_LEVEL environment variable:
+// debug, info (default), warn or error. The log package writes through it too, at info.
+func Setup() error {
+	level, err := ParseLevel(os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+	return nil
+}
+
+// ParseLevel parses a level name, case insensitive, info if empty
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if name == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return slog.LevelInfo, fmt.Errorf("invalid LOG_LEVEL %s, must be one of: debug, info, warn, error", name)
+	}
+	return level, nil
+}
@@ -0,0 +1,24 @@
+package logging
+
+import (
+	"log/slog"
+	"testing"
+)
+
+func TestParseLevel(t *testing.T) {
+	for name, want := range map[string]slog.Level{
+		"":      slog.LevelInfo,
+		"debug": slog.LevelDebug,
+		"INFO":  slog.LevelInfo,
+		"Warn":  slog.LevelWarn,
+		"error": slog.LevelError,
+	} {
+		got, err := ParseLevel(name)
+		if err != nil || got != want {
+			t.Fatalf("ParseLevel(%q): expected %v, got %v, %v", name, want, got, err)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Fatal("expected an error for an unknown level")
+	}
+}
@@ -0,0 +1,72 @@
+package merger
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/Hugi-R/wplace-archive-world-map/img"
+	"github.com/Hugi-R/wplace-archive-world-map/logging"
+	"github.com/Hugi-R/wplace-archive-world-map/profiling"
+)
+
+// Main runs the merge command line, args without the program name
+func Main(args []string) error {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	base := fs.String("base", "", "Optional base DB path")
+	target := fs.String("target", "", "Mandatory from path")
+	workers := fs.Int("workers", 16, "Optional number of workers, 0 picks one per CPU, up to 32 (default 16)")
+	initZ := fs.Int("initz", MaxInitialZ, "Optional initial zoom level, from 0 to 10. 10 builds all levels from the ingested z=11 tiles (default 10)")
+
+	force := fs.Bool("force", false, "Optional, merge again the tiles already present, rewriting every tile of the merged levels. Use after a change of the merge logic")
+
+	checkpoint := fs.Int("checkpoint", DefaultCheckpointInterval, "Optional number of tiles written between WAL checkpoints, bounding the WAL size. 0 disables them (default 1000)")
+
+	compression := fs.String("compression", img.CompressionDefault, "Optional PNG compression level: default, speed, best, or none. best is smaller but much slower (default default)")
+
+	diffEncoding := fs.String("diff-encoding", img.DiffTransparentName, "Optional encoding of the diff tiles, with --base: transparent, or erasures. Must be the encoding of the ingest (default transparent)")
+
+	sparseMaxRuns := fs.Int("sparse-max-runs", img.DefaultSparseMaxRuns, "Optional, with --base, store the diff tiles of up to this many runs of changed pixels in the sparse format instead of PNG. 0 stores them all as PNG (default 1000)")
+
+	compactPalette := fs.Bool("compact-palette", false, "Optional, without --base, encode the tiles with a palette of only their colors, at 1, 2 or 4 bits per pixel when few. Smaller tiles, but the DB can't be used as --base")
+
+	barrier := fs.Bool("barrier", false, "Optional, merge level by level instead of merging parents as soon as their children are done")
+
+	mode := fs.String("mode", ModeMajority, "Optional merge mode: majority, or average. Averaged DBs are RGBA and cannot be used as diff base (default majority)")
+
+	pprofAddr := fs.String("pprof", "", "Optional address to serve the pprof profiles on during the merge, like localhost:6060. Off by default")
+
+	fs.Parse(args)
+	if err := logging.Setup(); err != nil {
+		return err
+	}
+	if err := profiling.Start(*pprofAddr); err != nil {
+		return err
+	}
+
+	// Check mandatory flags
+	if *target == "" {
+		return fmt.Errorf("missing required flag: --from")
+	}
+
+	level, err := img.ParseCompressionLevel(*compression)
+	if err != nil {
+		return err
+	}
+	encoding, err := img.ParseDiffEncoding(*diffEncoding)
+	if err != nil {
+		return err
+	}
+
+	return Merge(*target, *base, MergeOptions{
+		InitZ:              *initZ,
+		Workers:            *workers,
+		Barrier:            *barrier,
+		Force:              *force,
+		Mode:               *mode,
+		CheckpointInterval: *checkpoint,
+		CompressionLevel:   level,
+		DiffEncoding:       encoding,
+		SparseMaxRuns:      *sparseMaxRuns,
+		CompactPalette:     *compactPalette,
+	})
+}
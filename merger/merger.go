@@ -2,11 +2,15 @@ package merger
 
 import (
 	"bytes"
+	"database/sql"
+	"errors"
 	"fmt"
 	"image"
 	"image/png"
-	"os"
+	"log/slog"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Hugi-R/wplace-archive-world-map/img"
@@ -15,18 +19,44 @@ import (
 
 type Merger struct {
 	initialZ  int
-	store     *store.TileDB
+	store     store.TileStore
 	workers   int
 	metrics   metrics
 	emptyTile *image.Paletted
 	force     bool
-	base      *store.TileDB
+	base      store.TileStore
 	useDiff   bool
+	diffEnc   img.DiffEncoding
+	sparseMax int
+	barrier   bool
+	mode      string
+	// Tiles written between WAL checkpoints, 0 disables them
+	checkpointInterval int64
+	written            atomic.Int64
+	compressionLevel   png.CompressionLevel
+	compact            bool // Encode the merged tiles with img.CompactPalette, without base
+	// First errReadTile of the workers, aborting the merge
+	readErrMu sync.Mutex
+	readErr   error
 }
 
+// errReadTile wraps the failures to read a tile from a DB, other than a missing tile.
+// Unlike a tile failing to decode or merge, the merge stops: the tile would be merged as empty.
+var errReadTile = errors.New("failed to read tile")
+
+// Merge modes, selecting how 2x2 pixels are downscaled
+const (
+	// ModeMajority keeps the most frequent non transparent color, output is paletted
+	ModeMajority = "majority"
+	// ModeAverage averages the colors, output is RGBA and cannot be diffed
+	ModeAverage = "average"
+)
+
+// metrics counts the jobs by status, sent by the workers on resChan
 type metrics struct {
 	ticker    *time.Ticker
 	resChan   chan job
+	done      chan struct{} // Closed once resChan is drained, see stopMetrics
 	merged    int64
 	skipped   int64
 	failed    int64
@@ -42,51 +72,180 @@ type job struct {
 	status string
 }
 
-func NewMerger(store *store.TileDB, workers int, initialZ int, force bool, base *store.TileDB) (*Merger, error) {
-	if initialZ < 0 || initialZ > 10 {
-		return nil, fmt.Errorf("invalid initial zoom level: %d", initialZ)
+// Statuses of a processed job, counted in the metrics
+const (
+	statusMerged  = "success" // Written
+	statusSkipped = "skip"    // Unchanged from the base, nothing written
+	statusEmpty   = "empty"   // No non-empty child, nothing written
+	statusFailed  = "fail"
+)
+
+// Zoom level of the ingested tiles, the bottom of the pyramid
+const SourceZoom = 11
+
+// Highest legal initial zoom level, merging it consumes the ingested tiles
+const MaxInitialZ = SourceZoom - 1
+
+// NewMerger creates a merger building levels initialZ down to 0, each level z from the tiles of z+1.
+// initialZ must be in [0, MaxInitialZ], use MaxInitialZ to build the whole pyramid from the ingested tiles.
+// A nil base merges without diff.
+func NewMerger(store store.TileStore, workers int, initialZ int, force bool, base store.TileStore) (*Merger, error) {
+	if initialZ < 0 || initialZ > MaxInitialZ {
+		return nil, fmt.Errorf("invalid initial zoom level: %d, must be between 0 and %d", initialZ, MaxInitialZ)
 	}
 
 	metrics := metrics{
 		resChan: make(chan job),
-	}
-	emptyTileEncode, err := img.EncodePng(img.EmptyImagePaletted(1000))
+		done:    make(chan struct{}),
+	}
+	m := &Merger{
+		initialZ: initialZ,
+		store:    store,
+		workers:  workers,
+		metrics:  metrics,
+		force:    force,
+		base:     base,
+		useDiff:  base != nil,
+		mode:     ModeMajority,
+	}
+	if err := m.SetTileSize(img.TileSize); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// SetTileSize sets the width and height of the tiles, img.TileSize by default.
+// A missing child is read as an empty tile of this size.
+func (m *Merger) SetTileSize(size int) error {
+	// Encoded and decoded, so its palette has the color types of the decoded tiles
+	emptyTileEncode, err := img.EncodePng(img.EmptyImagePaletted(size))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create empty tile: %w", err)
+		return fmt.Errorf("failed to create empty tile: %w", err)
 	}
 	emptyTile, err := img.DecodeImage(emptyTileEncode)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create empty tile: %w", err)
+		return fmt.Errorf("failed to create empty tile: %w", err)
 	}
 	emptyP, ok := emptyTile.(*image.Paletted)
 	if !ok {
-		return nil, fmt.Errorf("empty tile image is not paletted")
+		return fmt.Errorf("empty tile image is not paletted")
 	}
+	m.emptyTile = emptyP
+	return nil
+}
+
+// SetMode selects the merge mode, ModeMajority or ModeAverage
+func (m *Merger) SetMode(mode string) error {
+	switch mode {
+	case ModeMajority:
+	case ModeAverage:
+		if m.useDiff {
+			return fmt.Errorf("merge mode %s does not support diff", mode)
+		}
+	default:
+		return fmt.Errorf("invalid merge mode: %s", mode)
+	}
+	m.mode = mode
+	return nil
+}
+
+// Default count of tiles written between WAL checkpoints
+const DefaultCheckpointInterval = 1000
 
-	return &Merger{
-		initialZ:  initialZ,
-		store:     store,
-		workers:   workers,
-		metrics:   metrics,
-		emptyTile: emptyP,
-		force:     force,
-		base:      base,
-		useDiff:   base != nil,
-	}, nil
+// SetCheckpointInterval checkpoints the WAL every interval tiles written, 0 disables it.
+// Without checkpoints, the WAL grows during the whole merge, until the journal size limit stalls the writes.
+func (m *Merger) SetCheckpointInterval(interval int) {
+	m.checkpointInterval = int64(interval)
 }
 
-func (m *Merger) Merge() {
+// checkpointer is a store with a WAL to checkpoint, like store.TileDB
+type checkpointer interface {
+	Checkpoint() error
+}
+
+// putTile writes the tile, and checkpoints the WAL every checkpointInterval tiles, if the store has one
+func (m *Merger) putTile(z, x, y int, data []byte) error {
+	if err := m.store.PutTileAutoCRC(z, x, y, data); err != nil {
+		return err
+	}
+	c, ok := m.store.(checkpointer)
+	if n := m.written.Add(1); ok && m.checkpointInterval > 0 && n%m.checkpointInterval == 0 {
+		if err := c.Checkpoint(); err != nil {
+			// Not fatal, the next checkpoint may succeed
+			slog.Warn("failed to checkpoint", "err", err)
+		}
+	}
+	return nil
+}
+
+// SetCompressionLevel sets the PNG compression level of the merged tiles, see img.ParseCompressionLevel
+func (m *Merger) SetCompressionLevel(level png.CompressionLevel) {
+	m.compressionLevel = level
+}
+
+// SetCompactPalette encodes the merged tiles with the palette reduced to their colors, see img.CompactPalette.
+// Ignored with a base, diffs are computed on the indexes of the full palette.
+func (m *Merger) SetCompactPalette(compact bool) {
+	m.compact = compact
+}
+
+// SetDiffEncoding sets the encoding of the diff tiles, it must be the encoding of the ingested diff tiles.
+// See img.DiffEncoding.
+func (m *Merger) SetDiffEncoding(encoding img.DiffEncoding) {
+	m.diffEnc = encoding
+}
+
+// SetSparseMaxRuns stores the diff tiles of up to maxRuns runs of changed pixels sparse, 0 stores them as PNG.
+// See img.EncodeDiff.
+func (m *Merger) SetSparseMaxRuns(maxRuns int) {
+	m.sparseMax = maxRuns
+}
+
+// SetBarrier selects the level by level merge, waiting for a level to finish before starting the next.
+// By default, a parent is merged as soon as its children are.
+func (m *Merger) SetBarrier(barrier bool) {
+	m.barrier = barrier
+}
+
+// Merge builds the levels. Failing tiles are counted and skipped,
+// but a failure to read the DB stops the merge and is returned.
+func (m *Merger) Merge() error {
+	m.metrics.ticker = time.NewTicker(metricsTickRate * time.Second)
 	go m.reportMetrics()
 	defer m.stopMetrics()
 
+	if !m.barrier {
+		return m.mergePipelined()
+	}
+
 	// Traverse levels from "bottom" to "upper"
+	for _, z := range m.levels() {
+		if err := m.mergeLevel(z); err != nil {
+			return fmt.Errorf("failed to merge level %d: %w", z, err)
+		}
+		slog.Info("level finished", "z", z)
+	}
+	return nil
+}
+
+// levels returns the zoom levels to build, in merge order
+func (m *Merger) levels() []int {
+	levels := make([]int, 0, m.initialZ+1)
 	for z := m.initialZ; z >= 0; z-- {
-		m.mergeLevel(z)
-		fmt.Printf("Level %d finished\n", z)
+		levels = append(levels, z)
 	}
+	return levels
 }
 
-func (m *Merger) mergeLevel(z int) {
+func (m *Merger) mergeLevel(z int) error {
+	tiles, err := m.store.ListTiles(z + 1)
+	if err != nil {
+		return fmt.Errorf("failed to list tiles of level %d: %w", z+1, err)
+	}
+	present, err := m.presentTiles(z)
+	if err != nil {
+		return fmt.Errorf("failed to list tiles of level %d: %w", z, err)
+	}
 
 	jobChan := make(chan job)
 	wg := sync.WaitGroup{}
@@ -96,12 +255,8 @@ func (m *Merger) mergeLevel(z int) {
 		go m.worker(jobChan, &wg)
 	}
 
-	tiles, err := m.store.ListTiles(z + 1)
-	if err != nil {
-		panic(err)
-	}
-
 	jobSet := make(map[[2]uint16]bool)
+	preskipped := 0
 	// Enqueue jobs for current zoom level
 	for _, t := range tiles {
 		x, y := t[0]/2, t[1]/2
@@ -109,76 +264,242 @@ func (m *Merger) mergeLevel(z int) {
 		exists := jobSet[[2]uint16{x, y}]
 		if !exists {
 			jobSet[[2]uint16{x, y}] = true
+			if present[[2]uint16{x, y}] {
+				// Already merged, don't bother a worker
+				preskipped++
+				continue
+			}
 			job := job{z: z, x: int(x), y: int(y)}
 			jobChan <- job
 		}
 	}
-	fmt.Printf("Created %d jobs for level %d\n", len(jobSet), z)
+	slog.Info("created jobs", "jobs", len(jobSet)-preskipped, "z", z, "present", preskipped)
 	close(jobChan)
 	wg.Wait()
+	return m.abortErr()
 }
 
-func (m *Merger) reportMetrics() {
-	const tickRate = 10
+// presentTiles returns the set of tiles already in the store at level z.
+// The set is empty when forced, as existing tiles are merged again.
+func (m *Merger) presentTiles(z int) (map[[2]uint16]bool, error) {
+	present := make(map[[2]uint16]bool)
+	if m.force {
+		return present, nil
+	}
+	tiles, err := m.store.StatTiles(z)
+	if err != nil {
+		return nil, err
+	}
+	for t := range tiles {
+		present[t] = true
+	}
+	return present, nil
+}
+
+// parentTracker counts the children left to merge for each parent tile
+type parentTracker struct {
+	mu      sync.Mutex
+	pending map[[3]uint16]int
+}
+
+// done marks the tile merged, and returns its parent if it was the last child pending
+func (pt *parentTracker) done(j job) (job, bool) {
+	if j.z == 0 {
+		return job{}, false
+	}
+	parent := job{z: j.z - 1, x: j.x / 2, y: j.y / 2}
+	key := [3]uint16{uint16(parent.z), uint16(parent.x), uint16(parent.y)}
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.pending[key]--
+	if pt.pending[key] > 0 {
+		return job{}, false
+	}
+	delete(pt.pending, key)
+	return parent, true
+}
+
+// mortonCode interleaves x and y bits, sorting by it keeps the tiles of a subtree together
+func mortonCode(x, y uint16) uint32 {
+	var code uint32
+	for i := range 16 {
+		code |= uint32((x>>i)&1) << (2 * i)
+		code |= uint32((y>>i)&1) << (2*i + 1)
+	}
+	return code
+}
+
+// mergePipelined merges the whole pyramid without barrier between levels.
+// The worker merging the last child of a parent merges the parent right after.
+func (m *Merger) mergePipelined() error {
+	tiles, err := m.store.ListTiles(m.initialZ + 1)
+	if err != nil {
+		return fmt.Errorf("failed to list tiles of level %d: %w", m.initialZ+1, err)
+	}
+
+	// Jobs of the initial level, in quadtree order so siblings finish close together
+	seedSet := make(map[[2]uint16]bool)
+	for _, t := range tiles {
+		seedSet[[2]uint16{t[0] / 2, t[1] / 2}] = true
+	}
+	seeds := make([][2]uint16, 0, len(seedSet))
+	for s := range seedSet {
+		seeds = append(seeds, s)
+	}
+	sort.Slice(seeds, func(i, j int) bool {
+		return mortonCode(seeds[i][0], seeds[i][1]) < mortonCode(seeds[j][0], seeds[j][1])
+	})
+
+	// Count children of every upper level job
+	tracker := &parentTracker{pending: make(map[[3]uint16]int)}
+
+	// Tiles already merged are skipped, but still count as done children
+	present := make([]map[[2]uint16]bool, m.initialZ+1)
+	for z := range present {
+		present[z], err = m.presentTiles(z)
+		if err != nil {
+			return fmt.Errorf("failed to list tiles of level %d: %w", z, err)
+		}
+	}
+	preskipped := atomic.Int64{}
+	// skipPresent climbs up from j over the present tiles, returning the first tile to merge
+	skipPresent := func(j job) (job, bool) {
+		for present[j.z][[2]uint16{uint16(j.x), uint16(j.y)}] {
+			preskipped.Add(1)
+			var ok bool
+			if j, ok = tracker.done(j); !ok {
+				return job{}, false
+			}
+		}
+		return j, true
+	}
 
-	m.metrics.ticker = time.NewTicker(tickRate * time.Second)
+	current := seedSet
+	totalJobs := len(seedSet)
+	for z := m.initialZ; z > 0; z-- {
+		next := make(map[[2]uint16]bool)
+		for t := range current {
+			parent := [2]uint16{t[0] / 2, t[1] / 2}
+			tracker.pending[[3]uint16{uint16(z - 1), parent[0], parent[1]}]++
+			next[parent] = true
+		}
+		totalJobs += len(next)
+		current = next
+	}
+	slog.Info("created jobs", "jobs", totalJobs, "levels", fmt.Sprintf("%d to 0", m.initialZ))
 
+	jobChan := make(chan job)
+	wg := sync.WaitGroup{}
+	for range m.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobChan {
+				// Climb up as long as this worker completes the last child
+				for ok := true; ok; {
+					m.processJob(j)
+					if j, ok = tracker.done(j); ok {
+						j, ok = skipPresent(j)
+					}
+				}
+			}
+		}()
+	}
+	for _, s := range seeds {
+		if j, ok := skipPresent(job{z: m.initialZ, x: int(s[0]), y: int(s[1])}); ok {
+			jobChan <- j
+		}
+	}
+	close(jobChan)
+	wg.Wait()
+	slog.Info("jobs skipped, already present", "jobs", preskipped.Load())
+	return m.abortErr()
+}
+
+// Seconds between metrics reports
+const metricsTickRate = 10
+
+func (m *Merger) reportMetrics() {
 	go func() {
 		for range m.metrics.ticker.C {
 			merged := m.metrics.merged
-			rate := float64(merged-m.metrics.lastMerge) / tickRate
+			rate := float64(merged-m.metrics.lastMerge) / metricsTickRate
 			m.metrics.lastMerge = merged
-			fmt.Printf("Rate: %.2f/s, Merged: %d, Skipped: %d, Empty: %d, Failed: %d, Last Tile: %s\n", rate, m.metrics.merged, m.metrics.skipped, m.metrics.empty, m.metrics.failed, m.metrics.lastTile)
+			slog.Info("merge", "rate", fmt.Sprintf("%.2f/s", rate), "merged", m.metrics.merged, "skipped", m.metrics.skipped,
+				"empty", m.metrics.empty, "failed", m.metrics.failed, "last_tile", m.metrics.lastTile)
 		}
 	}()
 
+	defer close(m.metrics.done)
 	for res := range m.metrics.resChan {
 		m.metrics.lastTile = fmt.Sprintf("%d/%d/%d", res.z, res.x, res.y)
 		switch res.status {
-		case "success":
+		case statusMerged:
 			m.metrics.merged++
-		case "skip":
+		case statusSkipped:
 			m.metrics.skipped++
-		case "fail":
+		case statusFailed:
 			m.metrics.failed++
-		case "empty":
+		case statusEmpty:
 			m.metrics.empty++
 		}
 	}
 }
 
+// stopMetrics waits for the jobs sent to be counted
 func (m *Merger) stopMetrics() {
 	m.metrics.ticker.Stop()
 	close(m.metrics.resChan)
+	<-m.metrics.done
 }
 
 func (m *Merger) worker(jobChan chan job, wg *sync.WaitGroup) {
 	defer wg.Done()
 	for job := range jobChan {
-		err := m.mergeTile(job.z, job.x, job.y)
-		if err != nil {
-			fmt.Printf("Failed to merge tile %d/%d/%d: %v\n", job.z, job.x, job.y, err)
-			job.status = "fail"
-			m.metrics.resChan <- job
-		} else {
-			job.status = "success"
-			m.metrics.resChan <- job
-		}
+		m.processJob(job)
 	}
 }
 
-func (m *Merger) mergeTile(z, x, y int) error {
-	if z >= 11 {
-		return nil
+// processJob merges the tile of the job, and sends its status to the metrics, once per job.
+// Once a tile failed to read, the next jobs are counted failed without being merged, see abortErr.
+func (m *Merger) processJob(job job) {
+	var err error
+	if m.abortErr() != nil {
+		job.status = statusFailed
+		m.metrics.resChan <- job
+		return
+	}
+	if m.mode == ModeAverage {
+		job.status, err = m.mergeTileAvg(job.z, job.x, job.y)
+	} else {
+		job.status, err = m.mergeTile(job.z, job.x, job.y)
 	}
-	exists, _, err := m.store.StatTile(z, x, y)
 	if err != nil {
-		return fmt.Errorf("failed to stat tile %d/%d/%d: %w", z, x, y, err)
+		// Counted in the metrics
+		slog.Debug("failed to merge tile", "tile", fmt.Sprintf("%d/%d/%d", job.z, job.x, job.y), "err", err)
+		job.status = statusFailed
+		if errors.Is(err, errReadTile) {
+			m.readErrMu.Lock()
+			if m.readErr == nil {
+				m.readErr = err
+			}
+			m.readErrMu.Unlock()
+		}
 	}
-	if exists && !m.force {
-		// Tile already exists, skip
-		m.metrics.resChan <- job{z: z, x: x, y: y, status: "skip"}
-		return nil
+	m.metrics.resChan <- job
+}
+
+// abortErr returns the first errReadTile of the workers, nil while the merge goes on
+func (m *Merger) abortErr() error {
+	m.readErrMu.Lock()
+	defer m.readErrMu.Unlock()
+	return m.readErr
+}
+
+// mergeTile merges the children of the tile, and returns the status of the job
+func (m *Merger) mergeTile(z, x, y int) (string, error) {
+	if z >= SourceZoom {
+		return statusEmpty, nil
 	}
 	newZ := z + 1
 	newX := x * 2
@@ -187,167 +508,284 @@ func (m *Merger) mergeTile(z, x, y int) error {
 	emptyCount := 0
 	for i := range 4 {
 		xx, yy := (i % 2), (i / 2)
-		im, empty := m.getTile(newZ, newX+xx, newY+yy)
+		im, empty, err := m.getTile(newZ, newX+xx, newY+yy)
+		if err != nil {
+			return statusFailed, err
+		}
 		emptyCount += empty
 		images[i] = im
 	}
 	if emptyCount >= 4 {
-		// All tiles are empty, nothing to merge
-		m.metrics.resChan <- job{z: z, x: x, y: y, status: "empty"}
-		return nil
+		// All tiles are empty, nothing to merge.
+		// With diff, missing children are unchanged from base, so is the parent. A base tile gone from the archive
+		// is not missing with img.DiffErasures: the ingest writes its erasure, merged up as any change.
+		return statusEmpty, m.skipTile(z, x, y)
 	}
 	merged, err := img.FastPalettedResizeAndMerge(images[0], images[1], images[2], images[3], img.FastPaletteResize2)
 	if err != nil {
-		return fmt.Errorf("failed to merge tiles %d/%d/%d (empty %d): %w", z, x, y, emptyCount, err)
+		return statusFailed, fmt.Errorf("failed to merge tiles %d/%d/%d (empty %d): %w", z, x, y, emptyCount, err)
 	}
 
 	// If diff is enabled, compute the diff
 	if m.useDiff {
 		baseData, err := m.base.GetTile(z, x, y)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return statusFailed, fmt.Errorf("%w %d/%d/%d of the base: %w", errReadTile, z, x, y, err)
+		}
 		if err == nil {
 			bp, err := img.DecodePaletted(baseData)
 			if err == nil {
-				diff, changes, err := img.DiffPaletted(bp, merged)
+				diff, changes, err := img.DiffPaletted(bp, merged, m.diffEnc)
 				if err == nil {
-					if changes {
-						merged = diff
-					} else {
+					if !changes {
 						// Skip, no changes on the tile
-						m.metrics.resChan <- job{z: z, x: x, y: y, status: "empty"}
-						return nil
+						return statusSkipped, m.skipTile(z, x, y)
+					}
+					encoded, err := img.EncodeDiff(diff, m.sparseMax, m.compressionLevel)
+					if err != nil {
+						return statusFailed, err
 					}
+					return statusMerged, m.putTile(z, x, y, encoded)
 				}
 			}
 		}
 	}
 
-	encoded, err := img.EncodePng(merged)
+	if m.compact && !m.useDiff {
+		merged = img.CompactPalette(merged)
+	}
+	encoded, err := img.EncodePngLevel(merged, m.compressionLevel)
 	if err != nil {
-		return err
+		return statusFailed, err
+	}
+	return statusMerged, m.putTile(z, x, y, encoded)
+}
+
+// skipTile handles a tile with nothing to write.
+// When forced, the tile may exist from a previous merge, it is removed so it doesn't go stale.
+func (m *Merger) skipTile(z, x, y int) error {
+	if m.force {
+		if err := m.store.DeleteTile(z, x, y); err != nil {
+			return err
+		}
 	}
-	err = m.store.PutTileAutoCRC(z, x, y, encoded)
-	return err
+	return nil
 }
 
-func (m *Merger) getTile(z, x, y int) (*image.Paletted, int) {
+// getTile returns the tile to merge, and 1 if it is empty.
+// The error is an errReadTile, a missing or undecodable tile is empty.
+func (m *Merger) getTile(z, x, y int) (*image.Paletted, int, error) {
 	if m.useDiff {
 		return m.getDiffTile(z, x, y)
 	}
 	return m.getSingleTile(z, x, y)
 }
 
-func (m *Merger) getSingleTile(z, x, y int) (*image.Paletted, int) {
-	data, err := m.store.GetTile(z, x, y)
+func (m *Merger) getSingleTile(z, x, y int) (*image.Paletted, int, error) {
+	return m.readTile(m.store, z, x, y)
+}
+
+// getBaseTile returns the tile of the base, empty if missing
+func (m *Merger) getBaseTile(z, x, y int) (*image.Paletted, error) {
+	im, _, err := m.readTile(m.base, z, x, y)
+	return im, err
+}
+
+// getStoredTile returns the tile z/x/y of db, a missing tile is sql.ErrNoRows, any other failure an errReadTile
+func getStoredTile(db store.TileStore, z, x, y int) ([]byte, error) {
+	data, err := db.GetTile(z, x, y)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w %d/%d/%d: %w", errReadTile, z, x, y, err)
+	}
+	return data, err
+}
+
+func (m *Merger) readTile(db store.TileStore, z, x, y int) (*image.Paletted, int, error) {
+	data, err := getStoredTile(db, z, x, y)
+	if errors.Is(err, sql.ErrNoRows) {
+		return m.emptyTile, 1, nil
+	}
 	if err != nil {
-		return m.emptyTile, 1
+		return nil, 0, err
 	}
 	im, err := img.DecodePaletted(data)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to decode tile %d/%d/%d: %v", z, x, y, err)
-		return m.emptyTile, 1
+		slog.Warn("failed to decode tile, read as empty", "tile", fmt.Sprintf("%d/%d/%d", z, x, y), "err", err)
+		return m.emptyTile, 1, nil
 	}
-	return im, 0
+	// Tiles of compact palettes are merged on the full palette
+	return img.RemapPalette(im, m.emptyTile.Palette), 0, nil
 }
 
-func (m *Merger) getDiffTile(z, x, y int) (*image.Paletted, int) {
-	dataNew, err := m.store.GetTile(z, x, y)
+// getDiffTile returns the tile undiffed from base.
+// A tile missing from the diff is unchanged, it is returned empty: once merged and diffed, transparent pixels keep the base.
+// With img.DiffErasures, transparent pixels are erased, so the unchanged tile is the base tile, still counted as empty.
+func (m *Merger) getDiffTile(z, x, y int) (*image.Paletted, int, error) {
+	dataNew, err := getStoredTile(m.store, z, x, y)
+	if errors.Is(err, sql.ErrNoRows) {
+		if m.diffEnc == img.DiffErasures {
+			im, err := m.getBaseTile(z, x, y)
+			return im, 1, err
+		}
+		return m.emptyTile, 1, nil
+	}
 	if err != nil {
-		return m.emptyTile, 1
+		return nil, 0, err
 	}
 	imNew, err := img.DecodePaletted(dataNew)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to decode tile %d/%d/%d: %v", z, x, y, err)
-		return m.emptyTile, 1
+		slog.Warn("failed to decode tile, read as empty", "tile", fmt.Sprintf("%d/%d/%d", z, x, y), "err", err)
+		return m.emptyTile, 1, nil
+	}
+	dataBase, err := getStoredTile(m.base, z, x, y)
+	if errors.Is(err, sql.ErrNoRows) {
+		// New tile, the diff is the full tile
+		return imNew, 0, nil
 	}
-	dataBase, err := m.base.GetTile(z, x, y)
 	if err != nil {
-		return m.emptyTile, 1
+		return nil, 0, err
 	}
 	imBase, err := img.DecodePaletted(dataBase)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to decode tile %d/%d/%d: %v", z, x, y, err)
-		return m.emptyTile, 1
+		slog.Warn("failed to decode tile, read as empty", "tile", fmt.Sprintf("%d/%d/%d", z, x, y), "err", err)
+		return m.emptyTile, 1, nil
 	}
 	im, err := img.UnDiffPaletted(imBase, imNew)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to unDiff tile %d/%d/%d: %v", z, x, y, err)
-		return m.emptyTile, 1
+		slog.Warn("failed to unDiff tile, read as empty", "tile", fmt.Sprintf("%d/%d/%d", z, x, y), "err", err)
+		return m.emptyTile, 1, nil
 	}
-	return im, 0
+	return im, 0, nil
 }
 
-func (m *Merger) mergeTileAvg(z, x, y int) error {
-	if z >= 11 {
-		return nil
-	}
-	exists, _, err := m.store.StatTile(z, x, y)
-	if err != nil {
-		return fmt.Errorf("failed to stat tile %d/%d/%d: %w", z, x, y, err)
-	}
-	if exists {
-		// Tile already exists, skip
-		m.metrics.resChan <- job{z: z, x: x, y: y, status: "skip"}
-		return nil
+func (m *Merger) mergeTileAvg(z, x, y int) (string, error) {
+	if z >= SourceZoom {
+		return statusEmpty, nil
 	}
 	newZ := z + 1
 	newX := x * 2
 	newY := y * 2
 	images := make([]image.Image, 4)
+	emptyCount := 0
 	for i := range 4 {
 		xx, yy := (i % 2), (i / 2)
-		data, err := m.store.GetTile(newZ, newX+xx, newY+yy)
+		data, err := getStoredTile(m.store, newZ, newX+xx, newY+yy)
+		if errors.Is(err, sql.ErrNoRows) {
+			// Missing tile, use transparent
+			images[i] = m.emptyTile
+			emptyCount++
+			continue
+		}
 		if err != nil {
-			return fmt.Errorf("failed to get tile %d/%d/%d: %w", newZ, newX+xx, newY+yy, err)
+			return statusFailed, err
 		}
 		img, _, err := image.Decode(bytes.NewReader(data))
 		if err != nil {
-			return fmt.Errorf("failed to decode tile %d/%d/%d: %w", newZ, newX+xx, newY+yy, err)
+			return statusFailed, fmt.Errorf("failed to decode tile %d/%d/%d: %w", newZ, newX+xx, newY+yy, err)
 		}
 		images[i] = img
 	}
-	merged := img.FastResizeAndMerge(images[0], images[1], images[2], images[3], img.FastAvgResize2)
-	enc := png.Encoder{
-		CompressionLevel: png.DefaultCompression,
+	if emptyCount >= 4 {
+		// All tiles are empty, nothing to merge
+		return statusEmpty, m.skipTile(z, x, y)
 	}
-	data := bytes.Buffer{}
-	if err := enc.Encode(&data, merged); err != nil {
-		return err
+	merged := img.FastResizeAndMerge(images[0], images[1], images[2], images[3], img.FastAvgResize2)
+	data, err := img.EncodePngLevel(merged, m.compressionLevel)
+	if err != nil {
+		return statusFailed, err
 	}
-	err = m.store.PutTileAutoCRC(z, x, y, data.Bytes())
-	return err
+	return statusMerged, m.putTile(z, x, y, data)
+}
+
+// MergeOptions tunes Merge
+type MergeOptions struct {
+	InitZ              int                  // First level to build, from 0 to MaxInitialZ
+	Workers            int                  // Workers merging the tiles, 0 picks from the CPUs, see store.Workers
+	Barrier            bool                 // Merge levels one after the other, see Merger.SetBarrier
+	Force              bool                 // Merge again every level, rewriting the existing tiles
+	Mode               string               // ModeMajority or ModeAverage, see Merger.SetMode. Empty is ModeMajority
+	CheckpointInterval int                  // Tiles written between WAL checkpoints, see Merger.SetCheckpointInterval
+	CompressionLevel   png.CompressionLevel // PNG compression level of the tiles, see img.ParseCompressionLevel
+	DiffEncoding       img.DiffEncoding     // Encoding of the diff tiles, with a base, see Merger.SetDiffEncoding
+	SparseMaxRuns      int                  // Store the diff tiles of up to this many runs of changed pixels sparse, see img.EncodeDiff
+	CompactPalette     bool                 // Encode the tiles with the palette reduced to their colors, without base, see img.CompactPalette
 }
 
-func Merge(target, base string, initZ, workers int) error {
+// Merge builds the levels opts.InitZ to 0 of target, as diffs of base if not empty.
+func Merge(target, base string, opts MergeOptions) error {
+	initZ, workers := opts.InitZ, store.Workers(opts.Workers)
 	tileDB, err := store.NewTileDB(target, false)
 	if err != nil {
 		return fmt.Errorf("failed to create target tile database: %v", err)
 	}
-	defer tileDB.DB.Close()
+	defer tileDB.Close()
 
 	var baseDB *store.TileDB = nil
 	if base != "" {
+		if opts.CompactPalette {
+			return fmt.Errorf("compact palettes can't be used with a base")
+		}
 		db, err := store.NewTileDB(base, true)
 		if err != nil {
 			return fmt.Errorf("failed to create base tile database: %v", err)
 		}
+		defer db.Close()
+		if compact, err := db.CompactPalette(); err != nil || compact {
+			if err == nil {
+				err = fmt.Errorf("base %s has tiles of compact palettes, it can't be the base of a diff", base)
+			}
+			return err
+		}
 		baseDB = &db
 	}
+	if opts.CompactPalette {
+		if err := tileDB.SetMeta(store.MetaPalette, store.PaletteCompact); err != nil {
+			return err
+		}
+	}
 
 	if baseDB == nil {
-		fmt.Printf("Starting merging tiles from z=%d using %d workers.\n", initZ, workers)
+		slog.Info("starting merging tiles", "z", initZ, "workers", workers)
 	} else {
-		fmt.Printf("Starting merging tiles from z=%d using %d workers. Using %s as base.\n", initZ, workers, base)
+		slog.Info("starting merging tiles", "z", initZ, "workers", workers, "base", base)
 	}
 
-	merger, err := NewMerger(&tileDB, workers, initZ, false, baseDB)
+	// A nil *TileDB in the interface would not be a nil base
+	var baseStore store.TileStore
+	if baseDB != nil {
+		baseStore = baseDB
+	}
+	merger, err := NewMerger(&tileDB, workers, initZ, opts.Force, baseStore)
 	if err != nil {
 		return fmt.Errorf("failed to create merger: %v", err)
 	}
-	merger.Merge()
-	if baseDB != nil {
-		baseDB.Close()
+	// Recorded by the ingest, DBs without it have Wplace tiles
+	if size, found, err := tileDB.TileSize(); err != nil {
+		return err
+	} else if found {
+		if err := merger.SetTileSize(size); err != nil {
+			return err
+		}
+	}
+	merger.SetBarrier(opts.Barrier)
+	merger.SetCheckpointInterval(opts.CheckpointInterval)
+	merger.SetCompressionLevel(opts.CompressionLevel)
+	merger.SetDiffEncoding(opts.DiffEncoding)
+	merger.SetSparseMaxRuns(opts.SparseMaxRuns)
+	merger.SetCompactPalette(opts.CompactPalette)
+	mode := opts.Mode
+	if mode == "" {
+		mode = ModeMajority
+	}
+	if err := merger.SetMode(mode); err != nil {
+		return err
+	}
+	if err := merger.Merge(); err != nil {
+		return err
+	}
+	if err := tileDB.RecordTileCounts(); err != nil {
+		return err
 	}
-	tileDB.Close()
 	fmt.Println("Done")
 	return nil
 }
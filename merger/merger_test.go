@@ -0,0 +1,688 @@
+package merger
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand/v2"
+	"path"
+	"testing"
+
+	"github.com/Hugi-R/wplace-archive-world-map/img"
+	"github.com/Hugi-R/wplace-archive-world-map/store"
+)
+
+func TestInitialZBound(t *testing.T) {
+	for _, z := range []int{-1, MaxInitialZ + 1} {
+		if _, err := NewMerger(nil, 1, z, false, nil); err == nil {
+			t.Fatalf("expected error for initial zoom %d", z)
+		}
+	}
+
+	m, err := NewMerger(nil, 1, MaxInitialZ, false, nil)
+	if err != nil {
+		t.Fatalf("unexpected error for initial zoom %d: %v", MaxInitialZ, err)
+	}
+	levels := m.levels()
+	// The first merged level must consume the ingested tiles, and the last must be the root
+	if levels[0]+1 != SourceZoom {
+		t.Fatalf("expected first level to read z=%d, got z=%d", SourceZoom, levels[0]+1)
+	}
+	if levels[len(levels)-1] != 0 {
+		t.Fatalf("expected last level to be 0, got %d", levels[len(levels)-1])
+	}
+	if len(levels) != MaxInitialZ+1 {
+		t.Fatalf("expected %d levels, got %d", MaxInitialZ+1, len(levels))
+	}
+}
+
+func TestMergeBrokenDB(t *testing.T) {
+	for _, barrier := range []bool{false, true} {
+		db, err := store.NewTileDB(path.Join(t.TempDir(), "broken.db"), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Reading the tiles fails, as it would on a corrupt DB
+		if _, err := db.DB.Exec("DROP TABLE tiles"); err != nil {
+			t.Fatal(err)
+		}
+		m, err := NewMerger(&db, 2, 3, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.SetBarrier(barrier)
+		if err := m.Merge(); err == nil {
+			t.Fatalf("expected an error with barrier=%v", barrier)
+		}
+		db.DB.Close()
+	}
+}
+
+// failingReads is a TileDB whose tile reads fail, as on a locked or corrupt DB
+type failingReads struct {
+	*store.TileDB
+}
+
+func (s failingReads) GetTile(z, x, y int) ([]byte, error) {
+	return nil, fmt.Errorf("database disk image is malformed")
+}
+
+func TestMergeReadFailed(t *testing.T) {
+	for _, diff := range []bool{false, true} {
+		for _, barrier := range []bool{false, true} {
+			db, err := store.NewTileDB(path.Join(t.TempDir(), "tiles.db"), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := db.PutTileAutoCRC(4, 0, 0, filledTile(t, 1)); err != nil {
+				t.Fatal(err)
+			}
+			var tiles, base store.TileStore = failingReads{&db}, nil
+			if diff {
+				// The diff reads, its base fails
+				baseDB, err := store.NewTileDB(path.Join(t.TempDir(), "base.db"), false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				tiles, base = &db, failingReads{&baseDB}
+				defer baseDB.Close()
+			}
+			m, err := NewMerger(tiles, 2, 3, false, base)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.SetBarrier(barrier)
+			if err := m.Merge(); !errors.Is(err, errReadTile) {
+				t.Fatalf("expected a read error with diff=%v barrier=%v, got %v", diff, barrier, err)
+			}
+			// Not merged as an empty tile
+			if n, err := db.ListTiles(3); err != nil || len(n) != 0 {
+				t.Fatalf("expected no tile merged with diff=%v barrier=%v, got %v, %v", diff, barrier, n, err)
+			}
+			db.Close()
+		}
+	}
+}
+
+// filledTile encodes a tile filled with the palette color i
+func filledTile(t *testing.T, i uint8) []byte {
+	t.Helper()
+	p := img.EmptyImagePaletted(img.TileSize).(*image.Paletted)
+	for j := range p.Pix {
+		p.Pix[j] = i
+	}
+	data, err := img.EncodePng(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestMergeForce(t *testing.T) {
+	dbPath := path.Join(t.TempDir(), "force.db")
+	db, err := store.NewTileDB(dbPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutTileAutoCRC(4, 0, 0, filledTile(t, 5)); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if err := Merge(dbPath, "", MergeOptions{InitZ: 3, Workers: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = store.NewTileDB(dbPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := db.GetTile(3, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutTileAutoCRC(4, 0, 0, filledTile(t, 6)); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// Without force, existing tiles are kept
+	if err := Merge(dbPath, "", MergeOptions{InitZ: 3, Workers: 2}); err != nil {
+		t.Fatal(err)
+	}
+	db, err = store.NewTileDB(dbPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := db.GetTile(3, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if !bytes.Equal(before, after) {
+		t.Fatal("expected the tile to be kept without force")
+	}
+
+	if err := Merge(dbPath, "", MergeOptions{InitZ: 3, Workers: 2, Force: true}); err != nil {
+		t.Fatal(err)
+	}
+	db, err = store.NewTileDB(dbPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	after, err = db.GetTile(3, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(before, after) {
+		t.Fatal("expected the tile to be rewritten with force")
+	}
+}
+
+func TestMergePipelinedBarrier(t *testing.T) {
+	const size = 16
+	r := rand.New(rand.NewPCG(1, 2))
+	var tiles []store.Job
+	for x := range 32 {
+		for y := range 32 {
+			if r.IntN(10) != 0 {
+				continue
+			}
+			p := img.EmptyImagePaletted(size).(*image.Paletted)
+			for j := range p.Pix {
+				p.Pix[j] = uint8(r.IntN(len(p.Palette)))
+			}
+			data, err := img.EncodePng(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tiles = append(tiles, store.Job{Z: 5, X: x, Y: y, Data: data})
+		}
+	}
+	// A tile already merged, as by an interrupted merge, skipped by both
+	filled := img.EmptyImagePaletted(size).(*image.Paletted)
+	for j := range filled.Pix {
+		filled.Pix[j] = 3
+	}
+	data, err := img.EncodePng(filled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	present := store.Job{Z: 3, X: tiles[0].X / 4, Y: tiles[0].Y / 4, Data: data}
+
+	// merged merges the tiles, and returns the tiles of the merged levels
+	merged := func(barrier bool) map[[3]int][]byte {
+		db, err := store.NewTileDB(path.Join(t.TempDir(), "tiles.db"), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		for _, j := range append(tiles, present) {
+			if err := db.PutTileAutoCRC(j.Z, j.X, j.Y, j.Data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		m, err := NewMerger(&db, 4, 4, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.SetTileSize(size); err != nil {
+			t.Fatal(err)
+		}
+		m.SetBarrier(barrier)
+		if err := m.Merge(); err != nil {
+			t.Fatal(err)
+		}
+		out := make(map[[3]int][]byte)
+		for z := range 5 {
+			err := db.IterateTiles(z, func(x, y int, data []byte) error {
+				out[[3]int{z, x, y}] = data
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return out
+	}
+	pipelined, barrier := merged(false), merged(true)
+	if len(barrier) == 0 || len(pipelined) != len(barrier) {
+		t.Fatalf("expected the same tiles merged, got %d pipelined and %d with barrier", len(pipelined), len(barrier))
+	}
+	for k, data := range barrier {
+		if !bytes.Equal(pipelined[k], data) {
+			t.Fatalf("tile %v differs between the pipelined and barrier merges", k)
+		}
+	}
+	if !bytes.Equal(barrier[[3]int{present.Z, present.X, present.Y}], present.Data) {
+		t.Fatal("expected the present tile kept")
+	}
+}
+
+func TestMergeCheckpoint(t *testing.T) {
+	// walFrames merges 4 levels of tiles with the checkpoint interval, and returns the frames left in the WAL
+	walFrames := func(interval int) int {
+		db, err := store.NewTileDB(path.Join(t.TempDir(), "tiles.db"), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		for x := range 8 {
+			for y := range 8 {
+				if err := db.PutTileAutoCRC(4, x, y, filledTile(t, uint8(1+(x+y)%8))); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		m, err := NewMerger(&db, 2, 3, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.SetCheckpointInterval(interval)
+		if err := m.Merge(); err != nil {
+			t.Fatal(err)
+		}
+		var busy, log, checkpointed int
+		if err := db.DB.QueryRow("PRAGMA wal_checkpoint(PASSIVE)").Scan(&busy, &log, &checkpointed); err != nil {
+			t.Fatal(err)
+		}
+		return log
+	}
+	without, with := walFrames(0), walFrames(1)
+	if with >= without {
+		t.Fatalf("expected the checkpoints to shrink the WAL, got %d frames with, %d without", with, without)
+	}
+}
+
+func TestMergeDiffRegions(t *testing.T) {
+	dir := t.TempDir()
+	basePath := path.Join(dir, "base.db")
+	base, err := store.NewTileDB(basePath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := base.PutTileAutoCRC(4, 0, 0, filledTile(t, 5)); err != nil {
+		t.Fatal(err)
+	}
+	base.Close()
+	if err := Merge(basePath, "", MergeOptions{InitZ: 3, Workers: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The region of base is absent from the new archive, and a new region is drawn
+	targetPath := path.Join(dir, "target.db")
+	target, err := store.NewTileDB(targetPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := target.PutTileAutoCRC(4, 2, 2, filledTile(t, 6)); err != nil {
+		t.Fatal(err)
+	}
+	target.Close()
+	if err := Merge(targetPath, basePath, MergeOptions{InitZ: 3, Workers: 2, CheckpointInterval: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	target, err = store.NewTileDB(targetPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	// Without erasures, missing diff tiles are unchanged from base, the parent of the base region is not written
+	if exists, _, err := target.StatTile(3, 0, 0); err != nil || exists {
+		t.Fatalf("expected no diff for the base region, got exists=%v err=%v", exists, err)
+	}
+	// The new region has no base, it goes up the pyramid
+	for z := 3; z >= 0; z-- {
+		x := 2 >> (4 - z)
+		if exists, _, err := target.StatTile(z, x, x); err != nil || !exists {
+			t.Fatalf("expected the new region at %d/%d/%d, got exists=%v err=%v", z, x, x, exists, err)
+		}
+	}
+}
+
+func TestMergeDiffErasures(t *testing.T) {
+	dir := t.TempDir()
+	basePath := path.Join(dir, "base.db")
+	base, err := store.NewTileDB(basePath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for x := range 2 {
+		if err := base.PutTileAutoCRC(4, x, 0, filledTile(t, 5)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	base.Close()
+	if err := Merge(basePath, "", MergeOptions{InitZ: 3, Workers: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 4/0/0 is erased, 4/1/0 is unchanged
+	erased, err := img.EncodePng(img.EmptyImagePaletted(img.TileSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff, _, err := img.Diff(filledTile(t, 5), erased, img.DiffErasures, 0, png.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetPath := path.Join(dir, "target.db")
+	target, err := store.NewTileDB(targetPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := target.PutTileAutoCRC(4, 0, 0, diff); err != nil {
+		t.Fatal(err)
+	}
+	target.Close()
+	if err := Merge(targetPath, basePath, MergeOptions{InitZ: 3, Workers: 2, DiffEncoding: img.DiffErasures}); err != nil {
+		t.Fatal(err)
+	}
+
+	target, err = store.NewTileDB(targetPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	base, err = store.NewTileDB(basePath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer base.Close()
+	diffData, err := target.GetTile(3, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseData, err := base.GetTile(3, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffImg, err := img.DecodePaletted(diffData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseImg, err := img.DecodePaletted(baseData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged, err := img.UnDiffPaletted(baseImg, diffImg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := merged.ColorIndexAt(100, 100); got != 0 {
+		t.Errorf("expected the erased child transparent in the parent, got %d", got)
+	}
+	if got := merged.ColorIndexAt(600, 100); got != 5 {
+		t.Errorf("expected the unchanged child kept in the parent, got %d", got)
+	}
+}
+
+func TestMergeDiffGoneRegion(t *testing.T) {
+	dir := t.TempDir()
+	basePath := path.Join(dir, "base.db")
+	base, err := store.NewTileDB(basePath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, x := range []int{0, 2} {
+		if err := base.PutTileAutoCRC(4, x, x, filledTile(t, 5)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	base.Close()
+	if err := Merge(basePath, "", MergeOptions{InitZ: 3, Workers: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The region 4/0/0 of base is gone from the new archive, 4/2/2 is unchanged
+	targetPath := path.Join(dir, "target.db")
+	target, err := store.NewTileDB(targetPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, err = store.NewTileDB(basePath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer base.Close()
+	ingester := store.NewDiffIngester(&target, 2, false, &base)
+	ingester.SetDiffEncoding(img.DiffErasures)
+	jobs := []store.Job{{Z: 4, X: 2, Y: 2, Data: filledTile(t, 5)}}
+	read := func() (store.Job, bool, error) {
+		if len(jobs) == 0 {
+			return store.Job{}, false, nil
+		}
+		j := jobs[0]
+		jobs = jobs[1:]
+		return j, true, nil
+	}
+	if err := ingester.Ingest(context.Background(), read); err != nil {
+		t.Fatal(err)
+	}
+	target.Close()
+	if err := Merge(targetPath, basePath, MergeOptions{InitZ: 3, Workers: 2, DiffEncoding: img.DiffErasures}); err != nil {
+		t.Fatal(err)
+	}
+
+	target, err = store.NewTileDB(targetPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	// The erasure of the gone region goes up the pyramid
+	for z := 4; z >= 0; z-- {
+		diffData, err := target.GetTile(z, 0, 0)
+		if err != nil {
+			t.Fatalf("expected an erasure diff at %d/0/0: %v", z, err)
+		}
+		baseData, err := base.GetTile(z, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		diffImg, err := img.DecodePaletted(diffData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		baseImg, err := img.DecodePaletted(baseData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		merged, err := img.UnDiffPaletted(baseImg, diffImg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := merged.ColorIndexAt(0, 0); got != 0 {
+			t.Fatalf("expected the gone region transparent at %d/0/0, got %d", z, got)
+		}
+	}
+	// The unchanged region is not written
+	if exists, _, err := target.StatTile(3, 1, 1); err != nil || exists {
+		t.Fatalf("expected no diff for the unchanged region, got exists=%v err=%v", exists, err)
+	}
+}
+
+func TestMergeMetrics(t *testing.T) {
+	dir := t.TempDir()
+	basePath := path.Join(dir, "base.db")
+	base, err := store.NewTileDB(basePath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := base.PutTileAutoCRC(4, 0, 0, filledTile(t, 5)); err != nil {
+		t.Fatal(err)
+	}
+	base.Close()
+	if err := Merge(basePath, "", MergeOptions{InitZ: 3, Workers: 2}); err != nil {
+		t.Fatal(err)
+	}
+	// A tile of another palette can't be merged with its empty siblings
+	var badTile bytes.Buffer
+	bad := image.NewPaletted(image.Rect(0, 0, img.TileSize, img.TileSize), color.Palette{color.Transparent, color.White})
+	if err := png.Encode(&badTile, bad); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, barrier := range []bool{false, true} {
+		// Pipelined, parents are queued from the job tree: 3 jobs at level 3, 2 at level 2, then 1 per level.
+		// With barrier, they are queued from the tiles written below, 2/1/1 isn't queued as 3/2/2 failed.
+		jobs, empty := int64(7), int64(1)
+		if barrier {
+			jobs, empty = 6, 0
+		}
+		targetPath := path.Join(t.TempDir(), "target.db")
+		target, err := store.NewTileDB(targetPath, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tiles := []struct {
+			x, y int
+			data []byte
+		}{
+			{0, 0, filledTile(t, 0)}, // Unchanged from base, 3/0/0 is skipped
+			{2, 2, filledTile(t, 6)}, // New, merged up to the root
+			{4, 4, badTile.Bytes()},  // 3/2/2 fails, 2/1/1 has no non-empty child
+		}
+		for _, tile := range tiles {
+			if err := target.PutTileAutoCRC(4, tile.x, tile.y, tile.data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		baseDB, err := store.NewTileDB(basePath, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := NewMerger(&target, 2, 3, false, &baseDB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.SetBarrier(barrier)
+		if err := m.Merge(); err != nil {
+			t.Fatal(err)
+		}
+		target.Close()
+		baseDB.Close()
+
+		got := m.metrics
+		if got.merged != 4 || got.skipped != 1 || got.empty != empty || got.failed != 1 {
+			t.Fatalf("barrier=%v: expected 4 merged, 1 skipped, %d empty, 1 failed, got %d, %d, %d, %d",
+				barrier, empty, got.merged, got.skipped, got.empty, got.failed)
+		}
+		if total := got.merged + got.skipped + got.empty + got.failed; total != jobs {
+			t.Fatalf("barrier=%v: expected every job counted once, got %d for %d jobs", barrier, total, jobs)
+		}
+	}
+}
+
+func TestMergeTileSize(t *testing.T) {
+	dbPath := path.Join(t.TempDir(), "small.db")
+	db, err := store.NewTileDB(dbPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := img.EmptyImagePaletted(500).(*image.Paletted)
+	for j := range p.Pix {
+		p.Pix[j] = 5
+	}
+	tile, err := img.EncodePng(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutTileAutoCRC(4, 0, 0, tile); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetTileSize(500); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	// The missing siblings are empty tiles of the recorded size
+	if err := Merge(dbPath, "", MergeOptions{InitZ: 3, Workers: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = store.NewTileDB(dbPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for z := 3; z >= 0; z-- {
+		data, err := db.GetTile(z, 0, 0)
+		if err != nil {
+			t.Fatalf("expected tile %d/0/0 to be merged: %v", z, err)
+		}
+		merged, err := img.DecodeImage(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := merged.Bounds().Size(); size.X != 500 || size.Y != 500 {
+			t.Fatalf("expected a 500 pixels tile at level %d, got %v", z, size)
+		}
+	}
+}
+
+func sameColor(a, b color.Color) bool {
+	ar, ag, ab, aa := a.RGBA()
+	br, bg, bb, ba := b.RGBA()
+	return ar == br && ag == bg && ab == bb && aa == ba
+}
+
+func TestMergeCompactPalette(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := path.Join(dir, "compact.db")
+	db, err := store.NewTileDB(dbPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Children of compact palettes, of different colors
+	for i, c := range []uint8{5, 6} {
+		tile := img.EmptyImagePaletted(img.TileSize).(*image.Paletted)
+		for j := range tile.Pix {
+			tile.Pix[j] = c
+		}
+		data, err := img.EncodePng(img.CompactPalette(tile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutTileAutoCRC(4, i, 0, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+	if err := Merge(dbPath, "", MergeOptions{InitZ: 3, Workers: 2, CompactPalette: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = store.NewTileDB(dbPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if compact, err := db.CompactPalette(); err != nil || !compact {
+		t.Fatalf("expected the DB recorded compact, got %v, %v", compact, err)
+	}
+	data, err := db.GetTile(3, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged, err := img.DecodePaletted(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Transparent, 5 and 6
+	if len(merged.Palette) != 3 {
+		t.Fatalf("expected a compact palette of 3 colors, got %d", len(merged.Palette))
+	}
+	full := img.NewPaletter().Palette()
+	if left, right := merged.At(0, 0), merged.At(img.TileSize/2+1, 0); !sameColor(left, full[5]) || !sameColor(right, full[6]) {
+		t.Fatalf("expected the colors of the children, got %v and %v", left, right)
+	}
+
+	// A compact DB can't be a base
+	if err := Merge(path.Join(dir, "diff.db"), dbPath, MergeOptions{InitZ: 3, Workers: 2}); err == nil {
+		t.Fatal("expected an error with a compact base")
+	}
+}
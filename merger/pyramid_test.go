@@ -0,0 +1,219 @@
+package merger
+
+import (
+	"image"
+	"slices"
+	"testing"
+
+	"github.com/Hugi-R/wplace-archive-world-map/img"
+	"github.com/Hugi-R/wplace-archive-world-map/store"
+	"github.com/Hugi-R/wplace-archive-world-map/storetest"
+)
+
+// Size of the synthetic tiles, small to keep the tests fast
+const fixtureSize = 8
+
+// syntheticTile returns a paletted tile of the default palette, pixel x, y of color fill(x, y), 0 transparent
+func syntheticTile(fill func(x, y int) uint8) *image.Paletted {
+	tile := img.NewEmptyPaletted(fixtureSize)
+	for y := range fixtureSize {
+		for x := range fixtureSize {
+			tile.SetColorIndex(x, y, fill(x, y))
+		}
+	}
+	return tile
+}
+
+// Fills of the synthetic tiles
+var (
+	fillEmpty   = func(x, y int) uint8 { return 0 }
+	fillStripes = func(x, y int) uint8 { return uint8(2 + x%3) }
+	fillCorner  = func(x, y int) uint8 {
+		if x < 3 && y < 3 {
+			return 7
+		}
+		return 0
+	}
+	fillChecker = func(x, y int) uint8 { return uint8(5 * ((x + y) % 2)) }
+)
+
+// putTileT encodes the tile as PNG in s
+func putTileT(t *testing.T, s store.TileStore, z, x, y int, tile *image.Paletted) {
+	t.Helper()
+	data, err := img.EncodePng(tile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutTileAutoCRC(z, x, y, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// getTileT decodes the tile z/x/y of s
+func getTileT(t *testing.T, s store.TileStore, z, x, y int) *image.Paletted {
+	t.Helper()
+	data, err := s.GetTile(z, x, y)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tile, err := img.DecodePaletted(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tile
+}
+
+// expectedMerge is the parent of the 4 children, top-left, top-right, bottom-left, bottom-right, by FastPaletteResize2
+func expectedMerge(t *testing.T, children [4]*image.Paletted) *image.Paletted {
+	t.Helper()
+	merged, err := img.FastPalettedResizeAndMerge(children[0], children[1], children[2], children[3], img.FastPaletteResize2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return merged
+}
+
+// newMergerT creates a merger of fixture tiles on target, a diff of base if not nil
+func newMergerT(t *testing.T, target, base store.TileStore, force bool) *Merger {
+	t.Helper()
+	m, err := NewMerger(target, 1, MaxInitialZ, force, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetTileSize(fixtureSize); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestMergeTilePyramid(t *testing.T) {
+	tests := []struct {
+		name     string
+		children [4]func(x, y int) uint8 // nil for a missing child
+		status   string
+	}{
+		{"AllChildren", [4]func(x, y int) uint8{fillStripes, fillCorner, fillChecker, fillStripes}, statusMerged},
+		{"OneChild", [4]func(x, y int) uint8{nil, nil, fillChecker, nil}, statusMerged},
+		{"TransparentChildren", [4]func(x, y int) uint8{fillEmpty, nil, fillEmpty, nil}, statusMerged},
+		{"NoChild", [4]func(x, y int) uint8{}, statusEmpty},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := storetest.NewMemStore()
+			var children [4]*image.Paletted
+			for i, fill := range tt.children {
+				children[i] = syntheticTile(fillEmpty)
+				if fill != nil {
+					children[i] = syntheticTile(fill)
+					putTileT(t, s, SourceZoom, 6+i%2, 4+i/2, children[i])
+				}
+			}
+			m := newMergerT(t, s, nil, false)
+
+			status, err := m.mergeTile(MaxInitialZ, 3, 2)
+			if err != nil || status != tt.status {
+				t.Fatalf("expected status %s, got %s, %v", tt.status, status, err)
+			}
+			if status == statusEmpty {
+				if s.Len(MaxInitialZ) != 0 {
+					t.Fatal("expected nothing written without child")
+				}
+				return
+			}
+			if got, want := getTileT(t, s, MaxInitialZ, 3, 2), expectedMerge(t, children); !slices.Equal(got.Pix, want.Pix) {
+				t.Fatalf("expected pixels %v, got %v", want.Pix, got.Pix)
+			}
+		})
+	}
+}
+
+func TestMergeTileDiff(t *testing.T) {
+	// The base has the children of tile 0/0 and their parent, as merged
+	base := storetest.NewMemStore()
+	baseChildren := [4]*image.Paletted{syntheticTile(fillStripes), syntheticTile(fillCorner), syntheticTile(fillEmpty), syntheticTile(fillChecker)}
+	for i, child := range baseChildren {
+		putTileT(t, base, SourceZoom, i%2, i/2, child)
+	}
+	baseParent := expectedMerge(t, baseChildren)
+	putTileT(t, base, MaxInitialZ, 0, 0, baseParent)
+
+	t.Run("NoChange", func(t *testing.T) {
+		// A diff child fully transparent is unchanged from the base. The missing children are read empty,
+		// transparent over the base, erasures lost without DiffErasures: the parent is unchanged
+		target := storetest.NewMemStore()
+		putTileT(t, target, SourceZoom, 0, 0, syntheticTile(fillEmpty))
+		status, err := newMergerT(t, target, base, false).mergeTile(MaxInitialZ, 0, 0)
+		if err != nil || status != statusSkipped {
+			t.Fatalf("expected status %s, got %s, %v", statusSkipped, status, err)
+		}
+		if target.Len(MaxInitialZ) != 0 {
+			t.Fatal("expected no diff written without change")
+		}
+	})
+
+	t.Run("Change", func(t *testing.T) {
+		// The diff child paints the transparent bottom-left child
+		target := storetest.NewMemStore()
+		putTileT(t, target, SourceZoom, 0, 1, syntheticTile(fillCorner))
+		status, err := newMergerT(t, target, base, false).mergeTile(MaxInitialZ, 0, 0)
+		if err != nil || status != statusMerged {
+			t.Fatalf("expected status %s, got %s, %v", statusMerged, status, err)
+		}
+		diff := getTileT(t, target, MaxInitialZ, 0, 0)
+		undiff, err := img.UnDiffPaletted(baseParent, diff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		children := baseChildren
+		children[2] = syntheticTile(fillCorner)
+		if want := expectedMerge(t, children); !slices.Equal(undiff.Pix, want.Pix) {
+			t.Fatalf("expected the base with the diff to be %v, got %v", want.Pix, undiff.Pix)
+		}
+	})
+}
+
+func TestMergeTileForce(t *testing.T) {
+	// A parent left from a previous merge, its children since removed
+	s := storetest.NewMemStore()
+	putTileT(t, s, MaxInitialZ, 1, 1, syntheticTile(fillStripes))
+
+	status, err := newMergerT(t, s, nil, false).mergeTile(MaxInitialZ, 1, 1)
+	if err != nil || status != statusEmpty {
+		t.Fatalf("expected status %s, got %s, %v", statusEmpty, status, err)
+	}
+	if s.Len(MaxInitialZ) != 1 {
+		t.Fatal("expected the parent kept without force")
+	}
+
+	// Forced, the stale parent is removed
+	status, err = newMergerT(t, s, nil, true).mergeTile(MaxInitialZ, 1, 1)
+	if err != nil || status != statusEmpty {
+		t.Fatalf("expected status %s, got %s, %v", statusEmpty, status, err)
+	}
+	if s.Len(MaxInitialZ) != 0 {
+		t.Fatal("expected the stale parent removed with force")
+	}
+
+	// A whole merge keeps the present tiles, unless forced
+	child := syntheticTile(fillChecker)
+	putTileT(t, s, SourceZoom, 2, 2, child)
+	stale := syntheticTile(fillStripes)
+	putTileT(t, s, MaxInitialZ, 1, 1, stale)
+	if err := newMergerT(t, s, nil, false).Merge(); err != nil {
+		t.Fatal(err)
+	}
+	if got := getTileT(t, s, MaxInitialZ, 1, 1); !slices.Equal(got.Pix, stale.Pix) {
+		t.Fatal("expected the present tile kept without force")
+	}
+	if s.Len(0) != 1 {
+		t.Fatalf("expected the pyramid merged to the root, got %d tiles at level 0", s.Len(0))
+	}
+	if err := newMergerT(t, s, nil, true).Merge(); err != nil {
+		t.Fatal(err)
+	}
+	empty := syntheticTile(fillEmpty)
+	want := expectedMerge(t, [4]*image.Paletted{child, empty, empty, empty})
+	if got := getTileT(t, s, MaxInitialZ, 1, 1); !slices.Equal(got.Pix, want.Pix) {
+		t.Fatalf("expected the tile rewritten with force, got %v", got.Pix)
+	}
+}
@@ -1,11 +1,13 @@
-package main
+package plan
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path"
@@ -13,23 +15,27 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/Hugi-R/wplace-archive-world-map/img"
+	"github.com/Hugi-R/wplace-archive-world-map/logging"
 	"github.com/Hugi-R/wplace-archive-world-map/merger"
+	"github.com/Hugi-R/wplace-archive-world-map/releases"
 	"github.com/Hugi-R/wplace-archive-world-map/store"
+	"github.com/Hugi-R/wplace-archive-world-map/verify"
 )
 
-// Download downloads the sqlite file for the given HFFile into the workfolder
+// DefaultDownloadParallelism is the default count of concurrent chunk downloads
+const DefaultDownloadParallelism = 8
+
+// Size of the chunks downloaded in parallel, a variable so tests can lower it
+var downloadChunkSize int64 = 32 * 1024 * 1024 // 32 MB per chunk
+
+// Download downloads the archive file for the given HFFile into the workfolder
 // and returns the path to the downloaded file.
-// It uses parallel range requests, retries, and a buffered writer for speed.
-func Download(file HFFile, bucketURL, workFolder string) (string, error) {
-	const (
-		maxRetries   = 5
-		chunkSize    = 32 * 1024 * 1024 // 32 MB per chunk
-		parallelism  = 8                // concurrent chunk downloads
-		bufferSize   = 4 * 1024 * 1024  // 4 MB write buffer
-		totalTimeout = 30 * time.Minute
-	)
+// It uses up to parallelism concurrent range requests, retries, and a buffered writer for speed.
+func Download(file HFFile, workFolder string, parallelism int) (string, error) {
+	const totalTimeout = 30 * time.Minute
 
-	downloadURL := HFDownloadURL(bucketURL, file.Path)
+	downloadURL := file.URL
 	if downloadURL == "" {
 		return "", fmt.Errorf("empty download URL for file %s", file.Path)
 	}
@@ -53,10 +59,9 @@ func Download(file HFFile, bucketURL, workFolder string) (string, error) {
 	supportsRanges := headResp.Header.Get("Accept-Ranges") == "bytes"
 	contentLength := headResp.ContentLength
 
-	log.Printf("Downloading %s -> %s (%.2f MB, parallel=%v)",
-		downloadURL, outPath,
-		float64(contentLength)/1024/1024,
-		supportsRanges && contentLength > 0,
+	slog.Info("downloading", "url", downloadURL, "out", outPath,
+		"size", fmt.Sprintf("%.2f MB", float64(contentLength)/1024/1024),
+		"parallel", supportsRanges && contentLength > 0,
 	)
 
 	outFile, err := os.Create(outPath)
@@ -65,19 +70,45 @@ func Download(file HFFile, bucketURL, workFolder string) (string, error) {
 	}
 	defer outFile.Close()
 
+	if err := download(client, downloadURL, outFile, contentLength, supportsRanges, max(parallelism, 1)); err != nil {
+		// Never leave a partial archive behind, it would fail deep inside ingest
+		outFile.Close()
+		os.Remove(outPath)
+		return "", err
+	}
+	return outPath, nil
+}
+
+// download writes the file at url to out, and verifies its size against the announced contentLength
+func download(client *http.Client, url string, out *os.File, contentLength int64, supportsRanges bool, parallelism int) error {
+	const (
+		maxRetries = 5
+		bufferSize = 4 * 1024 * 1024 // 4 MB write buffer
+	)
+
 	// --- 2. Parallel chunked download (if server supports it) ---
-	if supportsRanges && contentLength > chunkSize {
-		if err := downloadParallel(client, downloadURL, outFile, contentLength, chunkSize, parallelism, maxRetries); err != nil {
-			return "", fmt.Errorf("parallel download %s: %w", downloadURL, err)
+	if supportsRanges && contentLength > downloadChunkSize {
+		if err := downloadParallel(client, url, out, contentLength, downloadChunkSize, parallelism, maxRetries); err != nil {
+			return fmt.Errorf("parallel download %s: %w", url, err)
+		}
+	} else {
+		// --- 3. Fallback: single-connection download with retries + buffered writer ---
+		if err := downloadWithRetry(client, url, out, maxRetries, bufferSize); err != nil {
+			return fmt.Errorf("download %s: %w", url, err)
 		}
-		return outPath, nil
 	}
 
-	// --- 3. Fallback: single-connection download with retries + buffered writer ---
-	if err := downloadWithRetry(client, downloadURL, outFile, maxRetries, bufferSize); err != nil {
-		return "", fmt.Errorf("download %s: %w", downloadURL, err)
+	// --- 4. Verify the size ---
+	if contentLength > 0 {
+		info, err := out.Stat()
+		if err != nil {
+			return fmt.Errorf("stat downloaded file: %w", err)
+		}
+		if info.Size() != contentLength {
+			return fmt.Errorf("download %s: got %d bytes, expected %d", url, info.Size(), contentLength)
+		}
 	}
-	return outPath, nil
+	return nil
 }
 
 // downloadParallel fetches non-overlapping byte ranges concurrently and writes
@@ -154,7 +185,7 @@ func downloadParallel(
 			}
 
 			n := downloaded.Add(int64(len(data)))
-			log.Printf("  progress: %.1f%%", float64(n)/float64(totalSize)*100)
+			slog.Debug("download progress", "percent", fmt.Sprintf("%.1f", float64(n)/float64(totalSize)*100))
 		}()
 	}
 
@@ -167,8 +198,8 @@ func fetchRangeWithRetry(client *http.Client, url string, start, end int64, maxR
 	var lastErr error
 	for attempt := range maxRetries {
 		if attempt > 0 {
-			backoff := time.Duration(1<<attempt) * 500 * time.Millisecond // 1s, 2s, 4s…
-			log.Printf("  retry %d for range %d-%d after %v", attempt, start, end, backoff)
+			backoff := time.Duration(1<<attempt) * retryBaseDelay / 2 // 1s, 2s, 4s…
+			slog.Warn("retrying range", "attempt", attempt, "start", start, "end", end, "backoff", backoff)
 			time.Sleep(backoff)
 		}
 
@@ -200,25 +231,36 @@ func fetchRangeWithRetry(client *http.Client, url string, start, end int64, maxR
 			lastErr = err
 			continue
 		}
+		if int64(len(data)) != end-start+1 {
+			lastErr = fmt.Errorf("got %d bytes for range %d-%d", len(data), start, end)
+			continue
+		}
 		return data, nil
 	}
 	return nil, fmt.Errorf("after %d retries: %w", maxRetries, lastErr)
 }
 
 // downloadWithRetry streams the full file with exponential-backoff retries.
+// A retry resumes after the bytes already written with a Range request,
+// or starts over if the server ignores it.
 func downloadWithRetry(client *http.Client, url string, out *os.File, maxRetries, bufferSize int) error {
 	var lastErr error
+	var written int64
 	for attempt := range maxRetries {
 		if attempt > 0 {
-			backoff := time.Duration(1<<attempt) * 500 * time.Millisecond
-			log.Printf("  retry %d for %s after %v", attempt, url, backoff)
+			backoff := time.Duration(1<<attempt) * retryBaseDelay / 2
+			slog.Warn("retrying download", "attempt", attempt, "url", url, "from", written, "backoff", backoff)
 			time.Sleep(backoff)
-			if _, err := out.Seek(0, io.SeekStart); err != nil {
-				return err
-			}
 		}
 
-		resp, err := client.Get(url)
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return err // non-retryable
+		}
+		if written > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", written))
+		}
+		resp, err := client.Do(req)
 		if err != nil {
 			lastErr = err
 			continue
@@ -231,15 +273,41 @@ func downloadWithRetry(client *http.Client, url string, out *os.File, maxRetries
 			}
 			continue
 		}
+		if written > 0 && resp.StatusCode != http.StatusPartialContent {
+			// Range ignored, the body is the whole file
+			written = 0
+			if _, err := out.Seek(0, io.SeekStart); err != nil {
+				resp.Body.Close()
+				return err
+			}
+			if err := out.Truncate(0); err != nil {
+				resp.Body.Close()
+				return err
+			}
+		}
 
 		w := bufio.NewWriterSize(out, bufferSize)
-		_, err = io.Copy(w, resp.Body)
+		n, err := io.Copy(w, resp.Body)
 		resp.Body.Close()
 		if err != nil {
 			lastErr = err
+			// Keep what was received, to resume after it. The flush can fail with the
+			// copy error, so the file offset is what was written.
+			w.Flush()
+			if written, err = out.Seek(0, io.SeekCurrent); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		written += n
+		if resp.ContentLength >= 0 && n != resp.ContentLength {
+			lastErr = fmt.Errorf("got %d bytes, expected %d", n, resp.ContentLength)
 			continue
 		}
-		return w.Flush()
+		return nil
 	}
 	return fmt.Errorf("after %d retries: %w", maxRetries, lastErr)
 }
@@ -284,8 +352,16 @@ func MoveFile(src, dst string) error {
 
 // ExecPlan executes the given plan of jobs.
 // Download, ingest, merge, move, for each job.
-func ExecPlan(plan []Job, bucketURL, workFolder, doneFolder string) error {
-	tmpProcessedFolder := path.Join(workFolder, "processed")
+// DBs are ingested and merged in tmpFolder, "processed" in the work folder if empty, then moved to the done folder.
+// parallelism is the count of concurrent chunk downloads.
+func ExecPlan(plan []Job, workFolder, tmpFolder, doneFolder string, parallelism int) error {
+	tmpProcessedFolder := tmpFolder
+	if tmpProcessedFolder == "" {
+		tmpProcessedFolder = path.Join(workFolder, "processed")
+	}
+	if err := os.MkdirAll(tmpProcessedFolder, 0o755); err != nil {
+		return fmt.Errorf("create tmp folder: %w", err)
+	}
 	archivesFolder := path.Join(workFolder, "archives")
 	for _, p := range plan {
 		start := time.Now()
@@ -295,62 +371,187 @@ func ExecPlan(plan []Job, bucketURL, workFolder, doneFolder string) error {
 		}
 		out := path.Join(tmpProcessedFolder, p.processedFile)
 
-		log.Printf("Processing archive %s", p.archive.Path)
-		archive, err := Download(p.archive, bucketURL, archivesFolder)
+		slog.Info("processing archive", "archive", p.archive.Path)
+		if p.isDiff {
+			// Fail before the download, the base may be missing or broken after a failed job
+			if err := store.CheckTileDB(base); err != nil {
+				return fmt.Errorf("base %s of %s: %w", p.base, p.processedFile, err)
+			}
+		}
+		archive, err := Download(p.archive, archivesFolder, parallelism)
 		if err != nil {
 			return fmt.Errorf("download archive: %w", err)
 		}
 
-		err = store.Ingest(archive, out, base, 10)
+		err = store.Ingest(context.Background(), archive, out, base, store.IngestOptions{
+			Workers:       0, // One per CPU, see store.Workers
+			Resume:        true,
+			SparseMaxRuns: img.DefaultSparseMaxRuns,
+			Meta: map[string]string{
+				store.MetaRelease:     p.archive.Path,
+				store.MetaReleaseTime: p.archive.Datetime.UTC().Format(time.RFC3339),
+				store.MetaVersion:     p.version.String(),
+			},
+		})
 		if err != nil {
 			return fmt.Errorf("ingest archive: %w", err)
 		}
 
 		// Merge from z=10 down to z=0
-		err = merger.Merge(out, base, 10, 10)
+		err = merger.Merge(out, base, merger.MergeOptions{
+			InitZ:              merger.MaxInitialZ,
+			Workers:            0,
+			Mode:               merger.ModeMajority,
+			CheckpointInterval: merger.DefaultCheckpointInterval,
+			SparseMaxRuns:      img.DefaultSparseMaxRuns,
+		})
 		if err != nil {
 			return fmt.Errorf("merge tiles: %w", err)
 		}
 
+		// Left in the tmp folder when broken, to investigate
+		if err := checkProcessed(out, p.isDiff); err != nil {
+			return fmt.Errorf("check processed file %s: %w", p.processedFile, err)
+		}
 		if err := MoveFile(out, path.Join(doneFolder, p.processedFile)); err != nil {
 			return fmt.Errorf("moving processed file: %w", err)
 		}
-		log.Printf("Done processing archive %s in %s", p.archive.Path, time.Since(start))
+		slog.Info("done processing archive", "archive", p.archive.Path, "elapsed", time.Since(start))
+	}
+	return nil
+}
+
+// checkProcessed verifies the DB out before it is published: it has tiles at verify.MaxZ,
+// and a base has a z=0 tile that decodes. A download short without error would make a truncated DB.
+// A diff has no z=0 tile when its changes leave the z=0 tile of its base unchanged, the merger skips it,
+// its z=0 tile is only decoded when present.
+func checkProcessed(out string, isDiff bool) error {
+	tileDB, err := store.NewTileDB(out, true)
+	if err != nil {
+		return err
+	}
+	defer tileDB.Close()
+	counts, err := tileDB.CountTiles()
+	if err != nil {
+		return err
+	}
+	if counts[verify.MaxZ] == 0 {
+		return fmt.Errorf("no tile at level %d", verify.MaxZ)
+	}
+	if counts[0] == 0 && !isDiff {
+		return fmt.Errorf("no tile at level 0")
+	}
+	if counts[0] > 0 {
+		data, err := tileDB.GetTile(0, 0, 0)
+		if err != nil {
+			return fmt.Errorf("failed to read tile 0/0/0: %w", err)
+		}
+		if _, err := img.DecodePaletted(data); err != nil {
+			return fmt.Errorf("invalid tile 0/0/0: %w", err)
+		}
 	}
+
+	attrs := []any{"file", path.Base(out)}
+	for z := verify.MaxZ; z >= 0; z-- {
+		attrs = append(attrs, fmt.Sprintf("z%d", z), counts[z])
+	}
+	slog.Info("checked processed file", attrs...)
 	return nil
 }
 
 func DisplayPlan(plan []Job) {
-	log.Printf("Planned %d jobs:", len(plan))
+	slog.Info("planned jobs", "jobs", len(plan))
 	for _, p := range plan {
-		diffStr := "FULL"
 		if p.isDiff {
-			diffStr = fmt.Sprintf("DIFF from %s", p.base)
+			slog.Info("planned job", "file", p.processedFile, "diff_from", p.base)
+		} else {
+			slog.Info("planned job", "file", p.processedFile, "full", true)
 		}
-		log.Printf("- %s %s", p.processedFile, diffStr)
 	}
 }
 
-func main() {
-	planType := flag.String("type", "daily", "Plan type: latest, daily, or all")
-	flag.Parse()
+// jobJSON is the JSON form of a Job, for orchestrators consuming the plan
+type jobJSON struct {
+	ProcessedFile string      `json:"processedFile"`
+	IsDiff        bool        `json:"isDiff"`
+	Base          string      `json:"base,omitempty"`
+	Archive       archiveJSON `json:"archive"`
+}
 
-	url := os.Getenv("WPLACE_ARCHIVES_URL")
-	if url == "" {
-		url = "https://huggingface.co/buckets/Hugi-R/wplace-archives/tree/full"
+type archiveJSON struct {
+	Name     string    `json:"name"`
+	Datetime time.Time `json:"datetime"`
+	Version  string    `json:"version"`
+	URL      string    `json:"url"`
+}
+
+// PlanToJSON encodes the plan as a JSON array of jobs
+func PlanToJSON(plan []Job) ([]byte, error) {
+	jobs := make([]jobJSON, 0, len(plan))
+	for _, p := range plan {
+		jobs = append(jobs, jobJSON{
+			ProcessedFile: p.processedFile,
+			IsDiff:        p.isDiff,
+			Base:          p.base,
+			Archive: archiveJSON{
+				Name:     p.archive.Path,
+				Datetime: p.archive.Datetime,
+				Version:  p.version.String(), // Of the processed file, the archive version is never a base
+				URL:      p.archive.URL,
+			},
+		})
 	}
-	workFolder := os.Getenv("WPLACE_WORK_FOLDER")
-	if workFolder == "" {
-		workFolder = "./wplace-work"
+	return json.MarshalIndent(jobs, "", "  ")
+}
+
+// Main runs the import command line, args without the program name:
+// it plans the jobs and executes them
+func Main(args []string) error {
+	return run("import", args, true)
+}
+
+// PlanMain is the dry run of Main, it only prints the plan
+func PlanMain(args []string) error {
+	return run("plan", args, false)
+}
+
+func run(name string, args []string, execute bool) error {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	planType := fs.String("type", "daily", "Plan type: latest, daily, or all")
+	since := fs.String("since", "", "Only plan archives from this day onward, as YYYY-MM-DD")
+	parallelism := fs.Int("parallelism", DefaultDownloadParallelism, "Concurrent chunk downloads per archive")
+	basePeriod := fs.Duration("base-period", releases.DefaultBasePeriod, "Period of the bases, the first archive of each period is a base and the others diffs, in whole hours like 24h or 720h")
+	format := fs.String("format", "", "Print the plan in this format and exit without executing it: json")
+	url := fs.String("url", envOr("WPLACE_ARCHIVES_URL", "https://huggingface.co/buckets/Hugi-R/wplace-archives/tree/full"), "Archives URL, a Hugging Face bucket or a JSON manifest (env WPLACE_ARCHIVES_URL)")
+	workFolder := fs.String("work", envOr("WPLACE_WORK_FOLDER", "./wplace-work"), "Work folder for the downloads (env WPLACE_WORK_FOLDER)")
+	tmpFolder := fs.String("tmp", envOr("WPLACE_TMP_FOLDER", ""), "Folder where DBs are ingested and merged before moving to the done folder, default processed in the work folder (env WPLACE_TMP_FOLDER)")
+	doneFolder := fs.String("done", envOr("WPLACE_DONE_FOLDER", "./wplace-done"), "Folder of the processed DBs (env WPLACE_DONE_FOLDER)")
+	fs.Parse(args)
+	if err := logging.Setup(); err != nil {
+		return err
+	}
+
+	if *format != "" && *format != "json" {
+		return fmt.Errorf("invalid format: %s. Must be: json", *format)
 	}
-	doneFolder := os.Getenv("WPLACE_DONE_FOLDER")
-	if doneFolder == "" {
-		doneFolder = "./wplace-done"
+	// Fail before listing the archives
+	if _, err := releases.ProcessedVersionFromDatePeriod(releases.Epoch, *basePeriod); err != nil {
+		return err
+	}
+	var sinceDay time.Time
+	if *since != "" {
+		var err error
+		sinceDay, err = time.Parse("2006-01-02", *since)
+		if err != nil {
+			return fmt.Errorf("invalid since %s, expected YYYY-MM-DD: %w", *since, err)
+		}
 	}
 
 	planner := Planner{
-		doneFolder:  doneFolder,
-		hfBucketURL: url,
+		doneFolder: *doneFolder,
+		source:     NewReleaseSource(*url),
+		since:      sinceDay,
+		basePeriod: *basePeriod,
 	}
 
 	var plan []Job
@@ -362,12 +563,32 @@ func main() {
 	case "all":
 		plan = planner.PlanAll()
 	default:
-		log.Fatalf("Invalid plan type: %s. Must be one of: latest, daily, all", *planType)
+		return fmt.Errorf("invalid plan type: %s. Must be one of: latest, daily, all", *planType)
+	}
+
+	if *format == "json" {
+		data, err := PlanToJSON(plan)
+		if err != nil {
+			return fmt.Errorf("PlanToJSON failed: %w", err)
+		}
+		fmt.Println(string(data))
+		return nil
 	}
 
 	DisplayPlan(plan)
-	err := ExecPlan(plan, url, workFolder, doneFolder)
-	if err != nil {
-		log.Fatalf("ExecPlan failed: %v", err)
+	if !execute {
+		return nil
+	}
+	if err := ExecPlan(plan, *workFolder, *tmpFolder, *doneFolder, *parallelism); err != nil {
+		return fmt.Errorf("ExecPlan failed: %w", err)
+	}
+	return nil
+}
+
+// envOr reads an environment variable, def when unset
+func envOr(name string, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
 	}
+	return def
 }
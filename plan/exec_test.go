@@ -0,0 +1,228 @@
+package plan
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Hugi-R/wplace-archive-world-map/img"
+	"github.com/Hugi-R/wplace-archive-world-map/store"
+)
+
+func TestDownload(t *testing.T) {
+	setRetryBaseDelay(t, time.Millisecond)
+	body := []byte("0123456789")
+
+	t.Run("Complete", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(body)
+		}))
+		defer srv.Close()
+
+		work := t.TempDir()
+		out, err := Download(HFFile{Path: "full/a.db", URL: srv.URL}, work, DefaultDownloadParallelism)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != string(body) {
+			t.Fatalf("expected %q, got %q", body, data)
+		}
+	})
+
+	t.Run("ShortBody", func(t *testing.T) {
+		// Announces the full length but closes the connection halfway
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			if r.Method == http.MethodHead {
+				return
+			}
+			w.Write(body[:len(body)/2])
+		}))
+		defer srv.Close()
+
+		work := t.TempDir()
+		if _, err := Download(HFFile{Path: "full/a.db", URL: srv.URL}, work, DefaultDownloadParallelism); err == nil {
+			t.Fatal("expected an error")
+		}
+		if _, err := os.Stat(path.Join(work, "a.db")); !os.IsNotExist(err) {
+			t.Fatalf("expected the partial file to be removed, got %v", err)
+		}
+	})
+
+	t.Run("Resume", func(t *testing.T) {
+		// Closes the connection halfway through the first request
+		var calls atomic.Int32
+		var ranges []string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodHead {
+				w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+				return
+			}
+			ranges = append(ranges, r.Header.Get("Range"))
+			if calls.Add(1) == 1 {
+				w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+				w.Write(body[:4])
+				return
+			}
+			http.ServeContent(w, r, "a.db", time.Time{}, bytes.NewReader(body))
+		}))
+		defer srv.Close()
+
+		work := t.TempDir()
+		out, err := Download(HFFile{Path: "full/a.db", URL: srv.URL}, work, DefaultDownloadParallelism)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, body) {
+			t.Fatalf("expected %q, got %q", body, data)
+		}
+		if len(ranges) != 2 || ranges[0] != "" || ranges[1] != "bytes=4-" {
+			t.Fatalf("expected a full request then a resume from byte 4, got %q", ranges)
+		}
+	})
+
+	t.Run("ShorterThanHead", func(t *testing.T) {
+		// A consistent GET, but shorter than announced by HEAD
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodHead {
+				w.Header().Set("Content-Length", strconv.Itoa(2*len(body)))
+				return
+			}
+			w.Write(body)
+		}))
+		defer srv.Close()
+
+		work := t.TempDir()
+		if _, err := Download(HFFile{Path: "full/a.db", URL: srv.URL}, work, DefaultDownloadParallelism); err == nil {
+			t.Fatal("expected an error")
+		}
+		if _, err := os.Stat(path.Join(work, "a.db")); !os.IsNotExist(err) {
+			t.Fatalf("expected the partial file to be removed, got %v", err)
+		}
+	})
+}
+
+func TestDownloadParallel(t *testing.T) {
+	setRetryBaseDelay(t, time.Millisecond)
+	oldChunkSize := downloadChunkSize
+	downloadChunkSize = 10
+	t.Cleanup(func() { downloadChunkSize = oldChunkSize })
+
+	body := bytes.Repeat([]byte("0123456789abcdef"), 20)
+	var inFlight, maxInFlight atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		http.ServeContent(w, r, "a.db", time.Time{}, bytes.NewReader(body))
+	}))
+	defer srv.Close()
+
+	work := t.TempDir()
+	out, err := Download(HFFile{Path: "full/a.db", URL: srv.URL}, work, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, body) {
+		t.Fatalf("expected %q, got %q", body, data)
+	}
+	if maxInFlight.Load() > 3 {
+		t.Fatalf("expected at most 3 concurrent requests, got %d", maxInFlight.Load())
+	}
+}
+
+func TestExecPlanMissingBase(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	job := Job{
+		isDiff:        true,
+		base:          "v1_2025-01-08T00.db",
+		archive:       HFFile{Path: "full/full_2025-01-09T00-00-00Z.7z", URL: srv.URL + "/archive.7z"},
+		processedFile: "v1.024_2025-01-09T00.db",
+	}
+	err := ExecPlan([]Job{job}, path.Join(dir, "work"), "", path.Join(dir, "done"), 1)
+	if err == nil || !strings.Contains(err.Error(), job.base) {
+		t.Fatalf("expected an error naming the missing base, got %v", err)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Fatalf("expected no download, got %d requests", n)
+	}
+}
+
+func TestCheckProcessed(t *testing.T) {
+	tile, err := img.EncodePng(img.EmptyImagePaletted(img.TileSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newDB := func(tiles map[int][]byte) string {
+		out := path.Join(t.TempDir(), "v1_2025-01-08T00.db")
+		tileDB, err := store.NewTileDB(out, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tileDB.Close()
+		for z, data := range tiles {
+			if err := tileDB.PutTileAutoCRC(z, 0, 0, data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return out
+	}
+
+	if err := checkProcessed(newDB(map[int][]byte{0: tile, 11: tile}), false); err != nil {
+		t.Fatal(err)
+	}
+	// Merge didn't run
+	if err := checkProcessed(newDB(map[int][]byte{11: tile}), false); err == nil {
+		t.Fatal("expected an error without tile at z=0")
+	}
+	// Nothing ingested
+	if err := checkProcessed(newDB(map[int][]byte{0: tile}), false); err == nil {
+		t.Fatal("expected an error without tile at z=11")
+	}
+	if err := checkProcessed(newDB(map[int][]byte{0: tile[:len(tile)/2], 11: tile}), false); err == nil {
+		t.Fatal("expected an error for a truncated tile at z=0")
+	}
+
+	// A small diff leaving the z=0 tile of its base unchanged
+	if err := checkProcessed(newDB(map[int][]byte{11: tile}), true); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkProcessed(newDB(map[int][]byte{0: tile}), true); err == nil {
+		t.Fatal("expected an error for a diff without tile at z=11")
+	}
+	if err := checkProcessed(newDB(map[int][]byte{0: tile[:len(tile)/2], 11: tile}), true); err == nil {
+		t.Fatal("expected an error for a diff with a truncated tile at z=0")
+	}
+}
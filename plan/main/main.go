@@ -0,0 +1,14 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/Hugi-R/wplace-archive-world-map/plan"
+)
+
+func main() {
+	if err := plan.Main(os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
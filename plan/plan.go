@@ -1,23 +1,29 @@
-package main
+package plan
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/Hugi-R/wplace-archive-world-map/releases"
 )
 
 // HFFile represents a file entry from the Hugging Face API response.
 type HFFile struct {
-	Path     string `json:"path"`
-	Size     int64  `json:"size"`
-	Type     string `json:"type"`
-	Datetime time.Time
-	ProcessedVersion ProcessedVersion
+	Path             string `json:"path"`
+	Size             int64  `json:"size"`
+	Type             string `json:"type"`
+	Datetime         time.Time
+	ProcessedVersion releases.ProcessedVersion
+	URL              string `json:"-"` // Download URL
 }
 
 // HFDownloadURL builds the direct download URL for a file from a Hugging Face bucket.
@@ -44,26 +50,13 @@ func GetHFFiles(bucketURL string) ([]HFFile, error) {
 
 	client := &http.Client{Timeout: 30 * time.Second}
 
-	req, err := http.NewRequest("GET", apiURL, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
-	}
-	req.Header.Set("Accept", "application/json")
-
-	resp, err := client.Do(req)
+	body, err := fetchWithRetry(client, apiURL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch Hugging Face files: %w", err)
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("Hugging Face API returned status %d: %s", resp.StatusCode, string(body))
-	}
 
 	var files []HFFile
-	dec := json.NewDecoder(resp.Body)
-	if err := dec.Decode(&files); err != nil {
+	if err := json.Unmarshal(body, &files); err != nil {
 		return nil, fmt.Errorf("failed to parse Hugging Face files response: %w", err)
 	}
 
@@ -86,133 +79,171 @@ func GetHFFiles(bucketURL string) ([]HFFile, error) {
 
 	// Parse Datetime and ProcessedVersion for each file
 	for i := range filtered {
-		dt, err := parseHFFileName(filtered[i].Path)
+		dt, err := releases.ParseReleaseTime(filtered[i].Path)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse file time for %s: %w", filtered[i].Path, err)
 		}
+		pv, err := releases.ProcessedVersionFromDate(dt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version for %s: %w", filtered[i].Path, err)
+		}
 		filtered[i].Datetime = dt
-		filtered[i].ProcessedVersion = ProcessedVersionFromDate(dt)
+		filtered[i].ProcessedVersion = pv
+		filtered[i].URL = HFDownloadURL(bucketURL, filtered[i].Path)
 	}
 
 	return filtered, nil
 }
 
-// parseHFFileName converts a file path like "full/full_2026-06-03T22-11-00Z.db" into a time.Time
-func parseHFFileName(path string) (time.Time, error) {
-	// Extract filename from path
-	filename := path
-	if idx := strings.LastIndex(path, "/"); idx != -1 {
-		filename = path[idx+1:]
-	}
+// ErrRateLimited is returned when the API rate limit is hit, and its reset is too far to wait for
+var ErrRateLimited = errors.New("rate limited")
 
-	// Remove prefix (e.g., "full_") and suffix (e.g., ".db")
-	s := strings.TrimSuffix(filename, ".db")
-	if idx := strings.Index(s, "_"); idx != -1 {
-		s = s[idx+1:]
-	}
+// First retry delay, doubled on each retry
+var retryBaseDelay = time.Second
 
-	// Find 'T' and convert the dashes between hour/minute/second back to colons
-	tIdx := strings.Index(s, "T")
-	if tIdx == -1 {
-		return time.Time{}, fmt.Errorf("invalid file time format: %s", s)
-	}
-	datePart := s[:tIdx]
-	timePart := s[tIdx+1:]
+// Longest wait for a rate limit reset before giving up
+const maxRateLimitWait = 5 * time.Minute
 
-	// timePart looks like 22-11-00Z; replace '-' with ':'
-	replaced := timePart
-	for i := 0; i < 2; i++ {
-		idx := strings.Index(replaced, "-")
-		if idx == -1 {
-			break
+// fetchWithRetry GETs the JSON at url, retrying with exponential backoff on network errors and 5xx.
+// When rate limited, it waits for the reset given by the Retry-After or X-RateLimit-Reset headers.
+func fetchWithRetry(client *http.Client, url string) ([]byte, error) {
+	const maxRetries = 5
+
+	var lastErr error
+	wait := time.Duration(0)
+	for attempt := range maxRetries {
+		if attempt > 0 {
+			slog.Warn("retrying", "attempt", attempt, "url", url, "wait", wait)
+			time.Sleep(wait)
 		}
-		replaced = replaced[:idx] + ":" + replaced[idx+1:]
-	}
-	full := datePart + "T" + replaced
+		backoff := retryBaseDelay << attempt // 1s, 2s, 4s…
+		wait = backoff
 
-	t, err := time.Parse(time.RFC3339, full)
-	if err != nil {
-		return time.Time{}, fmt.Errorf("failed to parse time %s: %w", full, err)
-	}
-	return t, nil
-}
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err // non-retryable
+		}
+		req.Header.Set("Accept", "application/json")
 
-// ProcessedVersion store version in the format vMajor.Minor where:
-// Major: week number since 1st Jan 2025
-// Minor: hour in the week (from 0 to 167) (zero-padded to 3 digits)
-// IsBase: true if base version (no minor when converted to string)
-type ProcessedVersion struct {
-	Major  int
-	Minor  int
-	IsBase bool
+		resp, err := client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		switch {
+		case resp.StatusCode == http.StatusOK:
+			return body, nil
+		case isRateLimited(resp):
+			reset, known := rateLimitReset(resp.Header, time.Now())
+			if reset > maxRateLimitWait {
+				return nil, fmt.Errorf("%w: status %d, resets in %v", ErrRateLimited, resp.StatusCode, reset.Round(time.Second))
+			}
+			lastErr = fmt.Errorf("%w: status %d", ErrRateLimited, resp.StatusCode)
+			if known {
+				wait = reset
+			}
+		case resp.StatusCode >= 500:
+			lastErr = fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
+		default:
+			return nil, fmt.Errorf("API returned status %d: %s", resp.StatusCode, string(body))
+		}
+	}
+	return nil, fmt.Errorf("after %d retries: %w", maxRetries, lastErr)
 }
 
-func ProcessedVersionFromDate(datetime time.Time) ProcessedVersion {
-	epoch := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
-	weeksSince := int(datetime.Sub(epoch).Hours() / (24 * 7))
-	hourInWeek := int(datetime.Sub(epoch).Hours()) % (24 * 7)
-	return ProcessedVersion{
-		Major:  weeksSince,
-		Minor:  hourInWeek,
-		IsBase: false,
+// isRateLimited reports a 429, or a 403 with no rate limit remaining
+func isRateLimited(resp *http.Response) bool {
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return true
 	}
+	return resp.StatusCode == http.StatusForbidden && resp.Header.Get("X-RateLimit-Remaining") == "0"
 }
 
-func ProcessedVersionFromString(s string) (ProcessedVersion, error) {
-	var major, minor int
-	isBase := false
-	s = strings.TrimPrefix(s, "v")
-	parts := strings.Split(s, ".")
-	if len(parts) == 1 {
-		isBase = true
-		_, err := fmt.Sscanf(parts[0], "%d", &major)
-		if err != nil {
-			return ProcessedVersion{}, fmt.Errorf("invalid processed version: %s", s)
+// rateLimitReset returns how long until the rate limit resets, from Retry-After (seconds or date)
+// or X-RateLimit-Reset (Unix time). known is false without usable headers.
+func rateLimitReset(h http.Header, now time.Time) (wait time.Duration, known bool) {
+	if v := h.Get("Retry-After"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil {
+			return time.Duration(secs) * time.Second, true
 		}
-	} else if len(parts) == 2 {
-		_, err := fmt.Sscanf(parts[0], "%d", &major)
-		if err != nil {
-			return ProcessedVersion{}, fmt.Errorf("invalid processed version: %s", s)
+		if t, err := http.ParseTime(v); err == nil {
+			return max(t.Sub(now), 0), true
 		}
-		_, err = fmt.Sscanf(parts[1], "%d", &minor)
-		if err != nil {
-			return ProcessedVersion{}, fmt.Errorf("invalid processed version: %s", s)
+	}
+	if v := h.Get("X-RateLimit-Reset"); v != "" {
+		if unix, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return max(time.Unix(unix, 0).Sub(now), 0), true
 		}
-	} else {
-		return ProcessedVersion{}, fmt.Errorf("invalid processed version: %s", s)
-	}
-	return ProcessedVersion{
-		Major:  major,
-		Minor:  minor,
-		IsBase: isBase,
-	}, nil
+	}
+	return 0, false
+}
+
+type Planner struct {
+	doneFolder string
+	source     ReleaseSource
+	since      time.Time     // Ignore archives before, zero for all
+	basePeriod time.Duration // A new base each period, releases.DefaultBasePeriod if zero
 }
 
-func (pv ProcessedVersion) String() string {
-	if pv.IsBase {
-		return fmt.Sprintf("v%d", pv.Major)
+// period is the base period of the planner
+func (p Planner) period() time.Duration {
+	if p.basePeriod == 0 {
+		return releases.DefaultBasePeriod
 	}
-	return fmt.Sprintf("v%d.%03d", pv.Major, pv.Minor)
+	return p.basePeriod
 }
 
-func ProcessedFileName(version ProcessedVersion, datetime time.Time) string {
-	return fmt.Sprintf("%s_%s.db", version.String(), datetime.Format("2006-01-02T15"))
+// listFiles lists the archives of the source, versioned with the base period of the planner
+func (p Planner) listFiles() ([]HFFile, error) {
+	files, err := p.source.ListFiles()
+	if err != nil {
+		return nil, err
+	}
+	for i := range files {
+		pv, err := releases.ProcessedVersionFromDatePeriod(files[i].Datetime, p.period())
+		if err != nil {
+			return nil, fmt.Errorf("invalid version for %s: %w", files[i].Path, err)
+		}
+		files[i].ProcessedVersion = pv
+	}
+	return files, nil
 }
 
-type Planner struct {
-	doneFolder string
-	hfBucketURL string
+// checkBasePeriod verifies the bases done were versioned with period.
+// Majors of other periods have the same numbers, a diff would be planned on an unrelated base.
+func checkBasePeriod(archivesDones *ArchivesDones, period time.Duration) error {
+	for major, done := range archivesDones.All {
+		if done.Base.Name == "" {
+			continue
+		}
+		pv, err := releases.ProcessedVersionFromDatePeriod(done.Base.Datetime, period)
+		if err != nil {
+			return err
+		}
+		if pv.Major != major {
+			return fmt.Errorf("base %s would be major %d with a base period of %v, the done folder was planned with another period", done.Base.Name, pv.Major, period)
+		}
+	}
+	return nil
 }
 
 type Job struct {
 	isDiff        bool
 	base          string
 	archive       HFFile
+	version       releases.ProcessedVersion
 	processedFile string
 }
 
 type ArchiveDone struct {
-	Version  ProcessedVersion
+	Version  releases.ProcessedVersion
 	Datetime time.Time
 	Name     string
 }
@@ -228,6 +259,34 @@ type ArchivesDones struct {
 	All      map[int]ArchiveDoneBase
 }
 
+// parseArchiveDone parses a processed file name, see releases.ProcessedFileName. ok is false for other files.
+func parseArchiveDone(name string) (ad ArchiveDone, isBase bool, ok bool) {
+	if !strings.HasSuffix(name, ".db") || !strings.HasPrefix(name, "v") {
+		return ArchiveDone{}, false, false
+	}
+	base := strings.TrimPrefix(strings.TrimSuffix(name, ".db"), "v")
+	index_ := strings.Index(base, "_")
+	if index_ == -1 {
+		return ArchiveDone{}, false, false
+	}
+	versionPart := base[:index_]
+	isBase = !strings.Contains(versionPart, ".")
+	pv, err := releases.ProcessedVersionFromString(versionPart)
+	if err != nil {
+		return ArchiveDone{}, false, false
+	}
+	datetimePart := base[index_+1:]
+	datetime, err := time.Parse("2006-01-02T15", datetimePart)
+	if err != nil {
+		return ArchiveDone{}, false, false
+	}
+	return ArchiveDone{
+		Version:  pv,
+		Datetime: datetime,
+		Name:     name,
+	}, isBase, true
+}
+
 func MakeArchiveDones(entries []os.DirEntry) *ArchivesDones {
 	latest := ArchiveDone{}
 	datesSet := make(map[time.Time]bool)
@@ -236,29 +295,8 @@ func MakeArchiveDones(entries []os.DirEntry) *ArchivesDones {
 		if e.IsDir() {
 			continue
 		}
-		name := e.Name()
-		if strings.HasSuffix(name, ".db") && strings.HasPrefix(name, "v") {
-			base := strings.TrimPrefix(strings.TrimSuffix(name, ".db"), "v")
-			index_ := strings.Index(base, "_")
-			if index_ == -1 {
-				continue
-			}
-			versionPart := base[:index_]
-			isBase := !strings.Contains(versionPart, ".")
-			pv, err := ProcessedVersionFromString(versionPart)
-			if err != nil {
-				continue
-			}
-			datetimePart := base[index_+1:]
-			datetime, err := time.Parse("2006-01-02T15", datetimePart)
-			if err != nil {
-				continue
-			}
-			ad := ArchiveDone{
-				Version:  pv,
-				Datetime: datetime,
-				Name:     name,
-			}
+		if ad, isBase, ok := parseArchiveDone(e.Name()); ok {
+			pv := ad.Version
 			// Update latest
 			if ad.Datetime.After(latest.Datetime) {
 				latest = ad
@@ -294,10 +332,22 @@ func (p Planner) ListArchiveDones() (*ArchivesDones, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to read done folder: %w", err)
 	}
-	return MakeArchiveDones(entries), nil
+	dones := MakeArchiveDones(entries)
+	// Days removed by the retention stay done, see Retain
+	deleted, err := readDeletedList(p.doneFolder)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range deleted {
+		if ad, _, ok := parseArchiveDone(name); ok {
+			dones.DatesSet[TimeAsDay(ad.Datetime)] = true
+		}
+	}
+	return dones, nil
 }
 
-func MakeJobs(files []HFFile, archivesDones *ArchivesDones) ([]Job, error) {
+// MakeJobs plans the archives not done yet, one per day, from since onward. A zero since keeps all archives.
+func MakeJobs(files []HFFile, archivesDones *ArchivesDones, since time.Time) ([]Job, error) {
 	// Sort files by Datetime ascending (oldest first)
 	for i := 0; i < len(files); i++ {
 		for j := i + 1; j < len(files); j++ {
@@ -311,6 +361,9 @@ func MakeJobs(files []HFFile, archivesDones *ArchivesDones) ([]Job, error) {
 	newDays := make(map[time.Time]bool)
 	newBases := make(map[int]string)
 	for _, archive := range files {
+		if archive.Datetime.Before(since) {
+			continue
+		}
 		// skip already done days
 		day := TimeAsDay(archive.Datetime)
 		if _, ok := newDays[day]; ok {
@@ -340,14 +393,15 @@ func MakeJobs(files []HFFile, archivesDones *ArchivesDones) ([]Job, error) {
 		pv.IsBase = !isDiff
 		// If not diff, record new base
 		if !isDiff {
-			newBases[pv.Major] = ProcessedFileName(pv, archive.Datetime)
+			newBases[pv.Major] = releases.ProcessedFileName(pv, archive.Datetime)
 		}
 
 		job := Job{
 			isDiff:        isDiff,
 			base:          baseName,
 			archive:       archive,
-			processedFile: ProcessedFileName(pv, archive.Datetime),
+			version:       pv,
+			processedFile: releases.ProcessedFileName(pv, archive.Datetime),
 		}
 		newDays[day] = true
 		jobs = append(jobs, job)
@@ -362,16 +416,19 @@ func (p Planner) PlanAll() []Job {
 	if err != nil {
 		log.Fatalf("Failed to list archive dones: %v", err)
 	}
+	if err := checkBasePeriod(archiveDone, p.period()); err != nil {
+		log.Fatalf("Failed to check archive dones: %v", err)
+	}
 
-	files, err := GetHFFiles(p.hfBucketURL)
+	files, err := p.listFiles()
 	if err != nil {
-		log.Fatalf("Failed to get Hugging Face files: %v", err)
+		log.Fatalf("Failed to list archives: %v", err)
 	}
 	if len(files) == 0 {
 		log.Fatalf("No files found")
 	}
 
-	jobs, err := MakeJobs(files, archiveDone)
+	jobs, err := MakeJobs(files, archiveDone, p.since)
 	if err != nil {
 		log.Fatalf("Failed to make jobs: %v", err)
 	}
@@ -384,16 +441,19 @@ func (p Planner) PlanDaily() []Job {
 	if err != nil {
 		log.Fatalf("Failed to list archive dones: %v", err)
 	}
+	if err := checkBasePeriod(archiveDone, p.period()); err != nil {
+		log.Fatalf("Failed to check archive dones: %v", err)
+	}
 
-	files, err := GetHFFiles(p.hfBucketURL)
+	files, err := p.listFiles()
 	if err != nil {
-		log.Fatalf("Failed to get Hugging Face files: %v", err)
+		log.Fatalf("Failed to list archives: %v", err)
 	}
 	if len(files) == 0 {
 		log.Fatalf("No files found")
 	}
 
-	jobs, err := MakeJobs(files, archiveDone)
+	jobs, err := MakeJobs(files, archiveDone, p.since)
 	if err != nil {
 		log.Fatalf("Failed to make jobs: %v", err)
 	}
@@ -402,9 +462,9 @@ func (p Planner) PlanDaily() []Job {
 
 // PlanLatest creates a job for the latest available file. Regardless of whether it's done or not.
 func (p Planner) PlanLatest() []Job {
-	files, err := GetHFFiles(p.hfBucketURL)
+	files, err := p.listFiles()
 	if err != nil {
-		log.Fatalf("Failed to get Hugging Face files: %v", err)
+		log.Fatalf("Failed to list archives: %v", err)
 	}
 	if len(files) == 0 {
 		log.Fatalf("No files found")
@@ -421,7 +481,8 @@ func (p Planner) PlanLatest() []Job {
 	job := Job{
 		isDiff:        false,
 		archive:       latest,
-		processedFile: ProcessedFileName(latest.ProcessedVersion, latest.Datetime),
+		version:       latest.ProcessedVersion,
+		processedFile: releases.ProcessedFileName(latest.ProcessedVersion, latest.Datetime),
 	}
 	return []Job{job}
 }
@@ -1,29 +1,18 @@
-package main
+package plan
 
 import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
-)
 
-func TestProcessedVersionFromDate(t *testing.T) {
-	res := ProcessedVersionFromDate(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
-	if res.String() != "v0.000" {
-		t.Fail()
-	}
-	res = ProcessedVersionFromDate(time.Date(2025, 1, 6, 0, 0, 0, 0, time.UTC))
-	if res.String() != "v0.120" {
-		t.Fail()
-	}
-	res = ProcessedVersionFromDate(time.Date(2025, 1, 7, 0, 0, 0, 0, time.UTC))
-	if res.String() != "v0.144" {
-		t.Fail()
-	}
-	res = ProcessedVersionFromDate(time.Date(2025, 1, 8, 0, 0, 0, 0, time.UTC))
-	if res.String() != "v1.000" {
-		t.Fail()
-	}
-}
+	"github.com/Hugi-R/wplace-archive-world-map/releases"
+)
 
 type mockDirEntry struct {
 	name  string
@@ -76,8 +65,8 @@ func TestMakeArchiveDones(t *testing.T) {
 	}
 }
 
-func PV(vStr string) ProcessedVersion {
-	pv, err := ProcessedVersionFromString(vStr)
+func PV(vStr string) releases.ProcessedVersion {
+	pv, err := releases.ProcessedVersionFromString(vStr)
 	if err != nil {
 		panic(err)
 	}
@@ -104,7 +93,7 @@ func TestMakeJobs(t *testing.T) {
 		mockDirEntry{name: "v0.048_2025-01-03T03.db", isDir: false},
 	})
 
-	jobs, err := MakeJobs(archives, archivesDones)
+	jobs, err := MakeJobs(archives, archivesDones, time.Time{})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -128,7 +117,7 @@ func TestMakeJobs(t *testing.T) {
 			if !job.isDiff {
 				t.Fatalf("expected job %d to be diff, got full", i)
 			}
-			if job.base != ProcessedFileName(PV("v1"), time.Date(2025, 1, 7, 0, 0, 0, 0, time.UTC)) {
+			if job.base != releases.ProcessedFileName(PV("v1"), time.Date(2025, 1, 7, 0, 0, 0, 0, time.UTC)) {
 				t.Fatalf("expected job %d base to be v1.000_2025-01-07T00, got %s", i, job.base)
 			}
 		}
@@ -137,3 +126,192 @@ func TestMakeJobs(t *testing.T) {
 		}
 	}
 }
+
+func TestMakeJobsSince(t *testing.T) {
+	archives := []HFFile{
+		{Datetime: time.Date(2025, 1, 9, 00, 0, 0, 0, time.UTC), ProcessedVersion: PV("v1.048")},
+		{Datetime: time.Date(2025, 1, 8, 00, 0, 0, 0, time.UTC), ProcessedVersion: PV("v1.024")},
+		{Datetime: time.Date(2025, 1, 7, 00, 0, 0, 0, time.UTC), ProcessedVersion: PV("v1")},
+		{Datetime: time.Date(2025, 1, 1, 00, 0, 0, 0, time.UTC), ProcessedVersion: PV("v0")},
+	}
+	since := MakeDay(2025, 1, 8)
+
+	jobs, err := MakeJobs(archives, MakeArchiveDones(nil), since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 {
+		t.Fatalf("expected 2 jobs, got %d", len(jobs))
+	}
+	if jobs[0].isDiff || jobs[0].processedFile != "v1_2025-01-08T00.db" {
+		t.Fatalf("expected the first job since to be a new base, got %+v", jobs[0])
+	}
+	if !jobs[1].isDiff || jobs[1].base != "v1_2025-01-08T00.db" {
+		t.Fatalf("expected the second job to be a diff from the first, got %+v", jobs[1])
+	}
+
+	// Re-running once the first job is done only plans the second
+	jobs, err = MakeJobs(archives, MakeArchiveDones([]os.DirEntry{
+		mockDirEntry{name: "v1_2025-01-08T00.db", isDir: false},
+	}), since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].processedFile != "v1.048_2025-01-09T00.db" || jobs[0].base != "v1_2025-01-08T00.db" {
+		t.Fatalf("expected a single diff job for 2025-01-09, got %+v", jobs)
+	}
+}
+
+// staticSource is a ReleaseSource of fixed files
+type staticSource []HFFile
+
+func (s staticSource) ListFiles() ([]HFFile, error) {
+	return append([]HFFile(nil), s...), nil
+}
+
+func TestPlanBasePeriod(t *testing.T) {
+	const month = 30 * 24 * time.Hour
+	var source staticSource
+	for day := 29; day <= 33; day++ {
+		// Sources version with the weekly default
+		dt := time.Date(2025, 1, day, 0, 0, 0, 0, time.UTC)
+		pv, err := releases.ProcessedVersionFromDate(dt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		source = append(source, HFFile{Path: dt.Format("2006-01-02"), Datetime: dt, ProcessedVersion: pv})
+	}
+	planner := Planner{doneFolder: t.TempDir(), source: source, basePeriod: month}
+
+	// 2025-01-31 starts the second period of 30 days
+	expected := []struct {
+		file string
+		base string
+	}{
+		{"v0_2025-01-29T00.db", ""},
+		{"v0.696_2025-01-30T00.db", "v0_2025-01-29T00.db"},
+		{"v1_2025-01-31T00.db", ""},
+		{"v1.024_2025-02-01T00.db", "v1_2025-01-31T00.db"},
+		{"v1.048_2025-02-02T00.db", "v1_2025-01-31T00.db"},
+	}
+	jobs := planner.PlanAll()
+	if len(jobs) != len(expected) {
+		t.Fatalf("expected %d jobs, got %d", len(expected), len(jobs))
+	}
+	for i, job := range jobs {
+		if job.processedFile != expected[i].file || job.base != expected[i].base || job.isDiff != (expected[i].base != "") {
+			t.Fatalf("expected job %d %s from %q, got %s from %q", i, expected[i].file, expected[i].base, job.processedFile, job.base)
+		}
+	}
+
+	// A done folder of weekly bases can't continue monthly
+	weekly := MakeArchiveDones([]os.DirEntry{
+		mockDirEntry{name: "v4_2025-01-29T00.db"},
+		mockDirEntry{name: "v4.024_2025-01-30T00.db"},
+	})
+	if err := checkBasePeriod(weekly, releases.DefaultBasePeriod); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkBasePeriod(weekly, month); err == nil {
+		t.Fatal("expected an error for bases of another period")
+	}
+}
+
+// setRetryBaseDelay sets retryBaseDelay for the test t, restored on cleanup
+func setRetryBaseDelay(t *testing.T, d time.Duration) {
+	old := retryBaseDelay
+	retryBaseDelay = d
+	t.Cleanup(func() { retryBaseDelay = old })
+}
+
+func TestGetHFFilesRateLimit(t *testing.T) {
+	setRetryBaseDelay(t, time.Millisecond)
+
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/buckets/owner/name/tree/full" {
+			http.NotFound(w, r)
+			return
+		}
+		if calls.Add(1) == 1 {
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`[{"path": "full/full_2026-06-03T22-11-00Z.db", "type": "file"}]`))
+	}))
+	defer srv.Close()
+
+	files, err := GetHFFiles(srv.URL + "/buckets/owner/name/tree/full")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || calls.Load() != 2 {
+		t.Fatalf("expected 1 file after 2 calls, got %d files after %d calls", len(files), calls.Load())
+	}
+
+	t.Run("ResetTooFar", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+			w.WriteHeader(http.StatusForbidden)
+		}))
+		defer srv.Close()
+
+		_, err := GetHFFiles(srv.URL + "/buckets/owner/name/tree/full")
+		if !errors.Is(err, ErrRateLimited) {
+			t.Fatalf("expected ErrRateLimited, got %v", err)
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		_, err := GetHFFiles(srv.URL + "/buckets/other/name/tree/full")
+		if err == nil || errors.Is(err, ErrRateLimited) {
+			t.Fatalf("expected a non rate limit error, got %v", err)
+		}
+	})
+}
+
+func TestPlanToJSON(t *testing.T) {
+	plan := []Job{
+		{
+			processedFile: "v1_2025-01-07T00.db",
+			version:       PV("v1"),
+			archive:       HFFile{Path: "full/full_2025-01-07T00-00-00Z.db", Datetime: time.Date(2025, 1, 7, 0, 0, 0, 0, time.UTC), ProcessedVersion: PV("v1.000"), URL: "https://example.com/a.db"},
+		},
+		{
+			processedFile: "v1.024_2025-01-08T00.db",
+			isDiff:        true,
+			base:          "v1_2025-01-07T00.db",
+			version:       PV("v1.024"),
+			archive:       HFFile{Path: "full/full_2025-01-08T00-00-00Z.db", Datetime: time.Date(2025, 1, 8, 0, 0, 0, 0, time.UTC), ProcessedVersion: PV("v1.024"), URL: "https://example.com/b.db"},
+		},
+	}
+	data, err := PlanToJSON(plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var res []map[string]any
+	if err := json.Unmarshal(data, &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 {
+		t.Fatalf("expected 2 jobs, got %d", len(res))
+	}
+	if _, ok := res[0]["base"]; ok {
+		t.Fatalf("expected no base for a full job, got %v", res[0]["base"])
+	}
+	// The version of the processed file, a base one
+	if archive := res[0]["archive"].(map[string]any); archive["version"] != "v1" {
+		t.Fatalf("expected the base version v1, got %v", archive["version"])
+	}
+	if res[1]["isDiff"] != true || res[1]["base"] != "v1_2025-01-07T00.db" || res[1]["processedFile"] != "v1.024_2025-01-08T00.db" {
+		t.Fatalf("unexpected diff job %v", res[1])
+	}
+	archive := res[1]["archive"].(map[string]any)
+	if archive["name"] != "full/full_2025-01-08T00-00-00Z.db" || archive["url"] != "https://example.com/b.db" || archive["version"] != "v1.024" {
+		t.Fatalf("unexpected archive %v", archive)
+	}
+}
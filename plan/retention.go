@@ -0,0 +1,159 @@
+package plan
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Hugi-R/wplace-archive-world-map/logging"
+	"github.com/Hugi-R/wplace-archive-world-map/releases"
+)
+
+// DeletedListFile lists the DBs removed from the done folder by Retain, one name per line.
+// Their days stay done, the planner doesn't import them again.
+const DeletedListFile = "deleted.txt"
+
+// DefaultKeepDays is the count of days all diffs are kept
+const DefaultKeepDays = 30
+
+// RetentionPolicy selects the DBs kept in the done folder. Bases are always kept.
+type RetentionPolicy struct {
+	KeepDays int // Diffs of the last KeepDays days are all kept, older ones one per week at most
+}
+
+// week is the number of the week of t since releases.Epoch
+func week(t time.Time) int {
+	return int(t.Sub(releases.Epoch) / (7 * 24 * time.Hour))
+}
+
+// Superseded lists the DBs of the done folder the policy removes, oldest first.
+// Only diffs are removed. A diff depends on the base of its major only, which is kept,
+// so a week before the kept days keeps its base, else its first diff.
+func Superseded(dones *ArchivesDones, policy RetentionPolicy, now time.Time) []ArchiveDone {
+	cutoff := TimeAsDay(now).AddDate(0, 0, -policy.KeepDays)
+	// Weeks with a DB kept
+	weeks := make(map[int]bool)
+	var diffs []ArchiveDone
+	for _, major := range dones.All {
+		if major.Base.Name != "" {
+			weeks[week(major.Base.Datetime)] = true
+		}
+		diffs = append(diffs, major.Diffs...)
+	}
+	slices.SortFunc(diffs, func(a, b ArchiveDone) int { return a.Datetime.Compare(b.Datetime) })
+
+	var superseded []ArchiveDone
+	for _, d := range diffs {
+		if !d.Datetime.Before(cutoff) {
+			continue
+		}
+		w := week(d.Datetime)
+		if weeks[w] {
+			superseded = append(superseded, d)
+			continue
+		}
+		weeks[w] = true
+	}
+	return superseded
+}
+
+// Retain lists the DBs of doneFolder superseded under the policy, see Superseded, with their total size.
+// With apply, they are recorded in DeletedListFile then deleted.
+func Retain(doneFolder string, policy RetentionPolicy, now time.Time, apply bool) ([]ArchiveDone, int64, error) {
+	entries, err := os.ReadDir(doneFolder)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read done folder: %w", err)
+	}
+	superseded := Superseded(MakeArchiveDones(entries), policy, now)
+	var size int64
+	names := make([]string, 0, len(superseded))
+	for _, d := range superseded {
+		info, err := os.Stat(path.Join(doneFolder, d.Name))
+		if err != nil {
+			return nil, 0, err
+		}
+		size += info.Size()
+		names = append(names, d.Name)
+	}
+	if !apply || len(names) == 0 {
+		return superseded, size, nil
+	}
+
+	// Recorded first, a DB deleted without record would be imported again
+	if err := appendDeletedList(doneFolder, names); err != nil {
+		return nil, 0, err
+	}
+	for _, name := range names {
+		if err := os.Remove(path.Join(doneFolder, name)); err != nil {
+			return nil, 0, fmt.Errorf("failed to delete %s: %w", name, err)
+		}
+	}
+	return superseded, size, nil
+}
+
+// readDeletedList reads the names of DeletedListFile of folder, none if it doesn't exist
+func readDeletedList(folder string) ([]string, error) {
+	data, err := os.ReadFile(path.Join(folder, DeletedListFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the deleted list: %w", err)
+	}
+	var names []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if name := strings.TrimSpace(line); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// appendDeletedList adds names to DeletedListFile of folder
+func appendDeletedList(folder string, names []string) error {
+	f, err := os.OpenFile(path.Join(folder, DeletedListFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open the deleted list: %w", err)
+	}
+	if _, err := f.WriteString(strings.Join(names, "\n") + "\n"); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write the deleted list: %w", err)
+	}
+	return f.Close()
+}
+
+// RetainMain runs the retention command line, args without the program name.
+// It is a dry run unless -apply is set.
+func RetainMain(args []string) error {
+	fs := flag.NewFlagSet("retain", flag.ExitOnError)
+	doneFolder := fs.String("done", envOr("WPLACE_DONE_FOLDER", "./wplace-done"), "Folder of the processed DBs (env WPLACE_DONE_FOLDER)")
+	keepDays := fs.Int("keep-days", DefaultKeepDays, "Days all diffs are kept, older diffs are kept one per week without base")
+	apply := fs.Bool("apply", false, "Delete the superseded DBs, else only list them")
+	fs.Parse(args)
+	if err := logging.Setup(); err != nil {
+		return err
+	}
+	if *keepDays < 0 {
+		return fmt.Errorf("invalid keep-days %d, must not be negative", *keepDays)
+	}
+
+	superseded, size, err := Retain(*doneFolder, RetentionPolicy{KeepDays: *keepDays}, time.Now(), *apply)
+	if err != nil {
+		return err
+	}
+	for _, d := range superseded {
+		slog.Info("superseded", "file", d.Name, "deleted", *apply)
+	}
+	slog.Info("retention done", "superseded", len(superseded),
+		"size", fmt.Sprintf("%.2f MB", float64(size)/1024/1024), "deleted", *apply)
+	if !*apply && len(superseded) > 0 {
+		slog.Info("dry run, add -apply to delete")
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package plan
+
+import (
+	"os"
+	"path"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSuperseded(t *testing.T) {
+	dones := MakeArchiveDones([]os.DirEntry{
+		// Week 0, with its base
+		mockDirEntry{name: "v0_2025-01-01T00.db"},
+		mockDirEntry{name: "v0.024_2025-01-02T00.db"},
+		mockDirEntry{name: "v0.048_2025-01-03T00.db"},
+		// Week 1, planned monthly: the diffs of the base of week 0
+		mockDirEntry{name: "v0.168_2025-01-08T00.db"},
+		mockDirEntry{name: "v0.192_2025-01-09T00.db"},
+		// Kept days
+		mockDirEntry{name: "v0.480_2025-01-21T00.db"},
+		mockDirEntry{name: "v0.504_2025-01-22T00.db"},
+	})
+	now := time.Date(2025, 1, 25, 12, 0, 0, 0, time.UTC)
+
+	var names []string
+	for _, d := range Superseded(dones, RetentionPolicy{KeepDays: 5}, now) {
+		names = append(names, d.Name)
+	}
+	expected := []string{"v0.024_2025-01-02T00.db", "v0.048_2025-01-03T00.db", "v0.192_2025-01-09T00.db"}
+	if !slices.Equal(names, expected) {
+		t.Fatalf("expected %v superseded, got %v", expected, names)
+	}
+
+	if superseded := Superseded(dones, RetentionPolicy{KeepDays: 30}, now); len(superseded) != 0 {
+		t.Fatalf("expected nothing superseded within the kept days, got %v", superseded)
+	}
+}
+
+func TestRetain(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{"v0_2025-01-01T00.db", "v0.024_2025-01-02T00.db", "v0.048_2025-01-03T00.db"}
+	for _, name := range files {
+		if err := os.WriteFile(path.Join(dir, name), []byte("db"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	// Dry run by default
+	superseded, size, err := Retain(dir, RetentionPolicy{KeepDays: 7}, now, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(superseded) != 2 || size != 4 {
+		t.Fatalf("expected 2 superseded DBs of 4 bytes, got %v, %d", superseded, size)
+	}
+	for _, name := range files {
+		if _, err := os.Stat(path.Join(dir, name)); err != nil {
+			t.Fatalf("expected %s kept by the dry run: %v", name, err)
+		}
+	}
+
+	if _, _, err := Retain(dir, RetentionPolicy{KeepDays: 7}, now, true); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if !slices.Equal(names, []string{DeletedListFile, "v0_2025-01-01T00.db"}) {
+		t.Fatalf("expected only the base and the deleted list left, got %v", names)
+	}
+
+	// The deleted days are still done for the planner
+	dones, err := Planner{doneFolder: dir}.ListArchiveDones()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for day := 1; day <= 3; day++ {
+		if !dones.DatesSet[MakeDay(2025, 1, day)] {
+			t.Fatalf("expected 2025-01-%02d done", day)
+		}
+	}
+	if len(dones.All[0].Diffs) != 0 {
+		t.Fatalf("expected no diff left, got %v", dones.All[0].Diffs)
+	}
+}
@@ -0,0 +1,111 @@
+package plan
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Hugi-R/wplace-archive-world-map/releases"
+)
+
+// ReleaseSource lists the archives available for download
+type ReleaseSource interface {
+	ListFiles() ([]HFFile, error)
+}
+
+// NewReleaseSource picks the source from the URL: a JSON manifest if it ends with .json,
+// else a Hugging Face bucket
+func NewReleaseSource(sourceURL string) ReleaseSource {
+	if strings.HasSuffix(sourceURL, ".json") {
+		return ManifestSource{URL: sourceURL}
+	}
+	return HFSource{BucketURL: sourceURL}
+}
+
+// HFSource lists the files of a Hugging Face bucket, see GetHFFiles
+type HFSource struct {
+	BucketURL string
+}
+
+func (s HFSource) ListFiles() ([]HFFile, error) {
+	return GetHFFiles(s.BucketURL)
+}
+
+// ManifestSource lists the archives of a JSON manifest, for self-hosted mirrors:
+//
+//	[{"name": "...", "datetime": "2025-08-29T18:00:00Z", "assets": [{"name": "archive.7z", "url": "..."}]}]
+//
+// Relative asset URLs are resolved from the manifest URL.
+type ManifestSource struct {
+	URL string
+}
+
+type manifestRelease struct {
+	Name     string          `json:"name"`
+	Datetime time.Time       `json:"datetime"`
+	Assets   []manifestAsset `json:"assets"`
+}
+
+type manifestAsset struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// Archive formats the ingester reads
+var archiveExtensions = []string{".db", ".7z", ".zip", ".tar.gz", ".tgz", ".tar.zst"}
+
+func isArchive(name string) bool {
+	for _, ext := range archiveExtensions {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s ManifestSource) ListFiles() ([]HFFile, error) {
+	base, err := url.Parse(s.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest URL %s: %w", s.URL, err)
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	body, err := fetchWithRetry(client, s.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch manifest: %w", err)
+	}
+	var manifest []manifestRelease
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+
+	files := make([]HFFile, 0, len(manifest))
+	for _, r := range manifest {
+		// One archive per release, the first asset the ingester can read
+		for _, a := range r.Assets {
+			if !isArchive(a.Name) {
+				continue
+			}
+			assetURL, err := base.Parse(a.URL)
+			if err != nil {
+				return nil, fmt.Errorf("invalid URL for asset %s of release %s: %w", a.Name, r.Name, err)
+			}
+			pv, err := releases.ProcessedVersionFromDate(r.Datetime)
+			if err != nil {
+				return nil, fmt.Errorf("invalid version for release %s: %w", r.Name, err)
+			}
+			files = append(files, HFFile{
+				Path:             path.Base(a.Name),
+				Type:             "file",
+				Datetime:         r.Datetime,
+				ProcessedVersion: pv,
+				URL:              assetURL.String(),
+			})
+			break
+		}
+	}
+	return files, nil
+}
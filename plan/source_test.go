@@ -0,0 +1,49 @@
+package plan
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestManifestSource(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[
+			{"name": "world-1", "datetime": "2025-01-08T12:00:00Z", "assets": [
+				{"name": "README.txt", "url": "https://example.com/README.txt"},
+				{"name": "world-1.7z", "url": "archives/world-1.7z"}
+			]},
+			{"name": "world-2", "datetime": "2025-01-09T00:00:00Z", "assets": [
+				{"name": "world-2.tar.gz", "url": "https://mirror.example.com/world-2.tar.gz"}
+			]},
+			{"name": "empty", "datetime": "2025-01-10T00:00:00Z", "assets": []}
+		]`))
+	}))
+	defer srv.Close()
+
+	source := NewReleaseSource(srv.URL + "/mirror/manifest.json")
+	if _, ok := source.(ManifestSource); !ok {
+		t.Fatalf("expected a ManifestSource, got %T", source)
+	}
+	files, err := source.ListFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected 2 archives, got %d", len(files))
+	}
+	if files[0].URL != srv.URL+"/mirror/archives/world-1.7z" || files[0].Path != "world-1.7z" {
+		t.Fatalf("unexpected first archive %+v", files[0])
+	}
+	if files[1].URL != "https://mirror.example.com/world-2.tar.gz" {
+		t.Fatalf("unexpected second archive URL %s", files[1].URL)
+	}
+	if !files[0].Datetime.Equal(time.Date(2025, 1, 8, 12, 0, 0, 0, time.UTC)) || files[0].ProcessedVersion.String() != "v1.012" {
+		t.Fatalf("unexpected first archive version %s at %v", files[0].ProcessedVersion, files[0].Datetime)
+	}
+
+	if _, ok := NewReleaseSource("https://huggingface.co/buckets/Hugi-R/wplace-archives/tree/full").(HFSource); !ok {
+		t.Fatal("expected a HFSource for a bucket URL")
+	}
+}
@@ -0,0 +1,41 @@
+// Package profiling serves the net/http/pprof profiles of the long-running commands, on their own listener.
+package profiling
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// Handler serves the pprof profiles under /debug/pprof/, like the net/http/pprof default registration
+// but on a mux of its own, so they are never served by the mux of another server
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// Start serves Handler on addr, like :6060, in the background until the process exits. An empty addr serves nothing.
+// Profiles expose the command line and the memory of the process, addr should not be reachable publicly.
+func Start(addr string) error {
+	if addr == "" {
+		return nil
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for pprof on %s: %w", addr, err)
+	}
+	slog.Info("serving pprof", "addr", ln.Addr().String())
+	go func() {
+		if err := http.Serve(ln, Handler()); err != nil {
+			slog.Error("pprof server stopped", "err", err)
+		}
+	}()
+	return nil
+}
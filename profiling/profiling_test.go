@@ -0,0 +1,28 @@
+package profiling
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	server := httptest.NewServer(Handler())
+	defer server.Close()
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/heap", "/debug/pprof/goroutine"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected %s served, got status %d", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestStartEmpty(t *testing.T) {
+	if err := Start(""); err != nil {
+		t.Fatalf("expected nothing served for an empty address, got %v", err)
+	}
+}
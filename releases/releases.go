@@ -0,0 +1,152 @@
+package releases
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Extensions of the archive files, removed before parsing the time
+var archiveExtensions = []string{".db", ".7z.001", ".7z", ".zip", ".tar.gz", ".tgz", ".tar.zst"}
+
+// ParseReleaseTime converts an archive path like "full/full_2026-06-03T22-11-00Z.db" into a time.Time.
+// The other archive extensions, like "full_2026-06-03T22-11-00Z.7z", are accepted too.
+func ParseReleaseTime(path string) (time.Time, error) {
+	// Extract filename from path
+	filename := path
+	if idx := strings.LastIndex(path, "/"); idx != -1 {
+		filename = path[idx+1:]
+	}
+
+	// Remove prefix (e.g., "full_") and suffix (e.g., ".db")
+	s := filename
+	for _, ext := range archiveExtensions {
+		if trimmed, found := strings.CutSuffix(s, ext); found {
+			s = trimmed
+			break
+		}
+	}
+	if idx := strings.Index(s, "_"); idx != -1 {
+		s = s[idx+1:]
+	}
+
+	// Find 'T' and convert the dashes between hour/minute/second back to colons
+	tIdx := strings.Index(s, "T")
+	if tIdx == -1 {
+		return time.Time{}, fmt.Errorf("invalid file time format: %s", s)
+	}
+	datePart := s[:tIdx]
+	timePart := s[tIdx+1:]
+
+	// timePart looks like 22-11-00Z, 22-11-00.104Z or 22-11Z; replace '-' with ':'
+	replaced := timePart
+	for i := 0; i < 2; i++ {
+		idx := strings.Index(replaced, "-")
+		if idx == -1 {
+			break
+		}
+		replaced = replaced[:idx] + ":" + replaced[idx+1:]
+	}
+	full := datePart + "T" + replaced
+
+	// Seconds and fractional seconds are sometimes omitted
+	var err error
+	for _, layout := range fileTimeLayouts {
+		var t time.Time
+		if t, err = time.Parse(layout, full); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("failed to parse time %s: %w", full, err)
+}
+
+// Layouts of the file times, once dashes are converted back to colons.
+// RFC3339 accepts an optional fractional second.
+var fileTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04Z07:00",
+}
+
+// ProcessedVersion store version in the format vMajor.Minor where:
+// Major: week number since 1st Jan 2025, or number of the base period, see ProcessedVersionFromDatePeriod
+// Minor: hour in the week (from 0 to 167) (zero-padded to 3 digits), or in the base period
+// IsBase: true if base version (no minor when converted to string)
+type ProcessedVersion struct {
+	Major  int
+	Minor  int
+	IsBase bool
+}
+
+// Epoch of the processed versions, v0.000
+var Epoch = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// ErrBeforeEpoch is returned for dates before Epoch. Mapping them to v0 would give
+// several archives the same version, so they are rejected instead.
+var ErrBeforeEpoch = errors.New("date is before the versions epoch")
+
+// DefaultBasePeriod is the period of the majors, a new base each week
+const DefaultBasePeriod = 7 * 24 * time.Hour
+
+func ProcessedVersionFromDate(datetime time.Time) (ProcessedVersion, error) {
+	return ProcessedVersionFromDatePeriod(datetime, DefaultBasePeriod)
+}
+
+// ProcessedVersionFromDatePeriod is ProcessedVersionFromDate with a major each period from Epoch,
+// like 720h for a base every 30 days. The period is a whole number of hours, the unit of the minors.
+func ProcessedVersionFromDatePeriod(datetime time.Time, period time.Duration) (ProcessedVersion, error) {
+	if period < time.Hour || period%time.Hour != 0 {
+		return ProcessedVersion{}, fmt.Errorf("invalid base period %v, must be a whole number of hours", period)
+	}
+	if datetime.Before(Epoch) {
+		return ProcessedVersion{}, fmt.Errorf("%w: %s", ErrBeforeEpoch, datetime.Format(time.RFC3339))
+	}
+	hoursSince := int(datetime.Sub(Epoch) / time.Hour)
+	hoursInPeriod := int(period / time.Hour)
+	return ProcessedVersion{
+		Major:  hoursSince / hoursInPeriod,
+		Minor:  hoursSince % hoursInPeriod,
+		IsBase: false,
+	}, nil
+}
+
+func ProcessedVersionFromString(s string) (ProcessedVersion, error) {
+	var major, minor int
+	isBase := false
+	s = strings.TrimPrefix(s, "v")
+	parts := strings.Split(s, ".")
+	if len(parts) == 1 {
+		isBase = true
+		_, err := fmt.Sscanf(parts[0], "%d", &major)
+		if err != nil {
+			return ProcessedVersion{}, fmt.Errorf("invalid processed version: %s", s)
+		}
+	} else if len(parts) == 2 {
+		_, err := fmt.Sscanf(parts[0], "%d", &major)
+		if err != nil {
+			return ProcessedVersion{}, fmt.Errorf("invalid processed version: %s", s)
+		}
+		_, err = fmt.Sscanf(parts[1], "%d", &minor)
+		if err != nil {
+			return ProcessedVersion{}, fmt.Errorf("invalid processed version: %s", s)
+		}
+	} else {
+		return ProcessedVersion{}, fmt.Errorf("invalid processed version: %s", s)
+	}
+	return ProcessedVersion{
+		Major:  major,
+		Minor:  minor,
+		IsBase: isBase,
+	}, nil
+}
+
+func (pv ProcessedVersion) String() string {
+	if pv.IsBase {
+		return fmt.Sprintf("v%d", pv.Major)
+	}
+	return fmt.Sprintf("v%d.%03d", pv.Major, pv.Minor)
+}
+
+func ProcessedFileName(version ProcessedVersion, datetime time.Time) string {
+	return fmt.Sprintf("%s_%s.db", version.String(), datetime.Format("2006-01-02T15"))
+}
@@ -0,0 +1,120 @@
+package releases
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestProcessedVersionFromDate(t *testing.T) {
+	tests := []struct {
+		date     time.Time
+		expected string
+	}{
+		{time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), "v0.000"},
+		{time.Date(2025, 1, 6, 0, 0, 0, 0, time.UTC), "v0.120"},
+		{time.Date(2025, 1, 7, 0, 0, 0, 0, time.UTC), "v0.144"},
+		{time.Date(2025, 1, 8, 0, 0, 0, 0, time.UTC), "v1.000"},
+	}
+	for _, tt := range tests {
+		res, err := ProcessedVersionFromDate(tt.date)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.String() != tt.expected {
+			t.Fatalf("expected %s for %v, got %s", tt.expected, tt.date, res)
+		}
+	}
+
+	_, err := ProcessedVersionFromDate(time.Date(2024, 12, 31, 0, 0, 0, 0, time.UTC))
+	if !errors.Is(err, ErrBeforeEpoch) {
+		t.Fatalf("expected ErrBeforeEpoch, got %v", err)
+	}
+}
+
+func TestProcessedVersionFromDatePeriod(t *testing.T) {
+	const month = 30 * 24 * time.Hour
+	tests := []struct {
+		date     time.Time
+		expected string
+	}{
+		{time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), "v0.000"},
+		{time.Date(2025, 1, 8, 0, 0, 0, 0, time.UTC), "v0.168"},
+		{time.Date(2025, 1, 30, 23, 59, 0, 0, time.UTC), "v0.719"},
+		{time.Date(2025, 1, 31, 0, 0, 0, 0, time.UTC), "v1.000"},
+		{time.Date(2025, 3, 2, 12, 0, 0, 0, time.UTC), "v2.012"},
+	}
+	for _, tt := range tests {
+		res, err := ProcessedVersionFromDatePeriod(tt.date, month)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.String() != tt.expected {
+			t.Fatalf("expected %s for %v, got %s", tt.expected, tt.date, res)
+		}
+		// Versions must survive the processed file names
+		parsed, err := ProcessedVersionFromString(res.String())
+		if err != nil || parsed != res {
+			t.Fatalf("expected %s to parse back, got %+v, %v", res, parsed, err)
+		}
+	}
+
+	for _, period := range []time.Duration{0, 30 * time.Minute, 90 * time.Minute} {
+		if _, err := ProcessedVersionFromDatePeriod(Epoch, period); err == nil {
+			t.Fatalf("expected an error for period %v", period)
+		}
+	}
+}
+
+func TestProcessedVersionFromString(t *testing.T) {
+	for _, s := range []string{"v0", "v1", "v0.024", "v12.167"} {
+		pv, err := ProcessedVersionFromString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pv.String() != s {
+			t.Fatalf("expected %s, got %s", s, pv)
+		}
+	}
+	for _, s := range []string{"", "vx", "v1.2.3", "v1.x"} {
+		if _, err := ProcessedVersionFromString(s); err == nil {
+			t.Fatalf("expected an error for %q", s)
+		}
+	}
+}
+
+func TestParseReleaseTime(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		expected time.Time
+		wantErr  bool
+	}{
+		{"Seconds", "full/full_2025-11-01T11-47-58Z.db", time.Date(2025, 11, 1, 11, 47, 58, 0, time.UTC), false},
+		{"Milliseconds", "full/full_2025-11-01T11-47-58.104Z.db", time.Date(2025, 11, 1, 11, 47, 58, 104000000, time.UTC), false},
+		{"NoSeconds", "full/full_2025-11-01T11-47Z.db", time.Date(2025, 11, 1, 11, 47, 0, 0, time.UTC), false},
+		{"NoPrefix", "2025-11-01T11-47-58Z.db", time.Date(2025, 11, 1, 11, 47, 58, 0, time.UTC), false},
+		{"Archive", "full_2025-11-01T11-47-58.104Z.7z.001", time.Date(2025, 11, 1, 11, 47, 58, 104000000, time.UTC), false},
+		{"NoTime", "full/full_2025-11-01.db", time.Time{}, true},
+		{"BadMonth", "full/full_2025-13-01T11-47-58Z.db", time.Time{}, true},
+		{"NoZone", "full/full_2025-11-01T11-47-58.db", time.Time{}, true},
+		{"Garbage", "full/full_latest.db", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := ParseReleaseTime(tt.path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", res)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !res.Equal(tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, res)
+			}
+		})
+	}
+}
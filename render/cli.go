@@ -0,0 +1,49 @@
+package render
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Hugi-R/wplace-archive-world-map/store"
+)
+
+// Main runs the export command line, args without the program name
+func Main(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	dbPath := fs.String("db", "", "Mandatory DB path")
+	z := fs.Int("z", 4, "Optional zoom level to export. Level z is 1000*2^z pixels wide at most (default 4)")
+	out := fs.String("out", "", "Mandatory output PNG path")
+
+	fs.Parse(args)
+
+	// Check mandatory flags
+	if *dbPath == "" {
+		return fmt.Errorf("missing required flag: --db")
+	}
+	if *out == "" {
+		return fmt.Errorf("missing required flag: --out")
+	}
+
+	tileDB, err := store.NewTileDB(*dbPath, true)
+	if err != nil {
+		return fmt.Errorf("failed to open tile database %s: %w", *dbPath, err)
+	}
+	defer tileDB.Close()
+
+	f, err := os.Create(*out)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", *out, err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	if err := Export(tileDB, *z, w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Hugi-R/wplace-archive-world-map/render"
+)
+
+func main() {
+	start := time.Now()
+	err := render.Main(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	elapsed := time.Since(start)
+	fmt.Printf("Elapsed time: %s\n", elapsed)
+}
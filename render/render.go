@@ -0,0 +1,139 @@
+package render
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+
+	"github.com/Hugi-R/wplace-archive-world-map/img"
+	"github.com/Hugi-R/wplace-archive-world-map/store"
+)
+
+// Distance covering the whole RGB cube, so averaged RGBA tiles always map to a palette color
+const maxRGBDistance = 442
+
+// levelImage is a paletted image of a whole zoom level, decoding tiles lazily.
+// Only the tile row being read is kept in memory, so it must be read row by row, as png.Encode does.
+type levelImage struct {
+	db       store.TileDB
+	z        int
+	tileSize int
+	bounds   image.Rectangle
+	paletter img.Paletter
+	rows     map[int][]int // Present tiles, tile y -> tile xs
+
+	bandY int                     // Tile y of the loaded row
+	band  map[int]*image.Paletted // Tile x -> decoded tile
+	err   error                   // First error met while decoding, At cannot return it
+}
+
+func (l *levelImage) ColorModel() color.Model {
+	return l.paletter.Palette()
+}
+
+func (l *levelImage) Bounds() image.Rectangle {
+	return l.bounds
+}
+
+func (l *levelImage) At(x, y int) color.Color {
+	return l.paletter.Palette()[l.ColorIndexAt(x, y)]
+}
+
+// ColorIndexAt returns the palette index of a pixel, missing tiles are transparent
+func (l *levelImage) ColorIndexAt(x, y int) uint8 {
+	ty := y / l.tileSize
+	if ty != l.bandY || l.band == nil {
+		l.loadBand(ty)
+	}
+	tile, ok := l.band[x/l.tileSize]
+	if !ok {
+		return 0
+	}
+	return tile.ColorIndexAt(x%l.tileSize, y%l.tileSize)
+}
+
+// loadBand decodes the tiles of row ty, releasing the previous row
+func (l *levelImage) loadBand(ty int) {
+	l.bandY = ty
+	l.band = make(map[int]*image.Paletted, len(l.rows[ty]))
+	for _, tx := range l.rows[ty] {
+		tile, err := l.readTile(tx, ty)
+		if err != nil {
+			if l.err == nil {
+				l.err = err
+			}
+			continue
+		}
+		l.band[tx] = tile
+	}
+}
+
+func (l *levelImage) readTile(x, y int) (*image.Paletted, error) {
+	data, err := l.db.GetTile(l.z, x, y)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := img.DecodeImage(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode tile %d/%d/%d: %w", l.z, x, y, err)
+	}
+	if decoded.Bounds().Dx() != l.tileSize || decoded.Bounds().Dy() != l.tileSize {
+		return nil, fmt.Errorf("tile %d/%d/%d is %v, expected %dx%d", l.z, x, y, decoded.Bounds().Size(), l.tileSize, l.tileSize)
+	}
+	// Remap to the reference palette, in case tiles are RGBA or have a different palette
+	return l.paletter.ToPalette(decoded).(*image.Paletted), nil
+}
+
+// newLevelImage lists the tiles of level z, the image is cropped to the populated tiles
+func newLevelImage(db store.TileDB, z int) (*levelImage, error) {
+	tiles, err := db.ListTiles(z)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tiles of level %d: %w", z, err)
+	}
+	if len(tiles) == 0 {
+		return nil, fmt.Errorf("no tiles at level %d", z)
+	}
+
+	l := &levelImage{
+		db:       db,
+		z:        z,
+		paletter: img.NewNearestPaletter(maxRGBDistance),
+		rows:     make(map[int][]int),
+	}
+	minX, minY := int(tiles[0][0]), int(tiles[0][1])
+	maxX, maxY := minX, minY
+	for _, t := range tiles {
+		x, y := int(t[0]), int(t[1])
+		l.rows[y] = append(l.rows[y], x)
+		minX, minY = min(minX, x), min(minY, y)
+		maxX, maxY = max(maxX, x), max(maxY, y)
+	}
+
+	// Tiles are square, the first one gives the size
+	data, err := db.GetTile(z, int(tiles[0][0]), int(tiles[0][1]))
+	if err != nil {
+		return nil, err
+	}
+	first, err := img.DecodeImage(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode tile: %w", err)
+	}
+	l.tileSize = first.Bounds().Dx()
+	l.bounds = image.Rect(minX*l.tileSize, minY*l.tileSize, (maxX+1)*l.tileSize, (maxY+1)*l.tileSize)
+	return l, nil
+}
+
+// Export writes level z of the DB as a single paletted PNG, cropped to the populated tiles.
+// Missing tiles are transparent. Tiles are decoded one row at a time, so the whole level is never in memory.
+func Export(db store.TileDB, z int, out io.Writer) error {
+	l, err := newLevelImage(db, z)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(out, l); err != nil {
+		return fmt.Errorf("failed to encode level %d: %w", z, err)
+	}
+	return l.err
+}
@@ -0,0 +1,80 @@
+package render
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"path"
+	"testing"
+
+	"github.com/Hugi-R/wplace-archive-world-map/img"
+	"github.com/Hugi-R/wplace-archive-world-map/store"
+)
+
+// putTileT stores a tileSize square tile filled with c
+func putTileT(db store.TileDB, z, x, y, tileSize int, c color.Color, t *testing.T) {
+	tile := image.NewRGBA(image.Rect(0, 0, tileSize, tileSize))
+	for i := range tileSize {
+		for j := range tileSize {
+			tile.Set(i, j, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := img.NewPaletter().PngPack(tile, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutTileAutoCRC(z, x, y, buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExport(t *testing.T) {
+	db, err := store.NewTileDB(path.Join(t.TempDir(), "tiles.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	red := color.RGBA{237, 28, 36, 255}
+	blue := color.RGBA{64, 147, 228, 255}
+	// Level 2 is 4x4 tiles, only tiles (1,1) and (2,2) are present
+	putTileT(db, 2, 1, 1, 4, red, t)
+	putTileT(db, 2, 2, 2, 4, blue, t)
+
+	var out bytes.Buffer
+	if err := Export(db, 2, &out); err != nil {
+		t.Fatal(err)
+	}
+	res, err := img.DecodePaletted(out.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cropped to the tiles (1,1) to (2,2)
+	if res.Bounds().Dx() != 8 || res.Bounds().Dy() != 8 {
+		t.Fatalf("expected 8x8, got %v", res.Bounds().Size())
+	}
+	expected := map[image.Point]color.Color{
+		{0, 0}: red,
+		{3, 3}: red,
+		{4, 4}: blue,
+		{7, 7}: blue,
+		{4, 0}: color.RGBA{0, 0, 0, 0}, // Missing tile (2,1)
+		{0, 4}: color.RGBA{0, 0, 0, 0}, // Missing tile (1,2)
+	}
+	for p, c := range expected {
+		if !sameColor(res.At(p.X, p.Y), c) {
+			t.Errorf("pixel %v: expected %v, got %v", p, c, res.At(p.X, p.Y))
+		}
+	}
+
+	if err := Export(db, 3, &out); err == nil {
+		t.Fatal("expected an error for an empty level")
+	}
+}
+
+func sameColor(a, b color.Color) bool {
+	r1, g1, b1, a1 := a.RGBA()
+	r2, g2, b2, a2 := b.RGBA()
+	return r1 == r2 && g1 == g2 && b1 == b2 && a1 == a2
+}
@@ -0,0 +1,38 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// BBox is an inclusive range of tile coordinates, in the stored XYZ scheme
+type BBox struct {
+	MinX, MinY, MaxX, MaxY int
+}
+
+// ParseBBox parses a range like minX,minY,maxX,maxY
+func ParseBBox(s string) (BBox, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return BBox{}, fmt.Errorf("invalid bbox %s, expected minX,minY,maxX,maxY", s)
+	}
+	var values [4]int
+	for i, p := range parts {
+		v, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil {
+			return BBox{}, fmt.Errorf("invalid bbox %s: %w", s, err)
+		}
+		values[i] = v
+	}
+	b := BBox{MinX: values[0], MinY: values[1], MaxX: values[2], MaxY: values[3]}
+	if b.MinX < 0 || b.MinY < 0 || b.MinX > b.MaxX || b.MinY > b.MaxY {
+		return BBox{}, fmt.Errorf("invalid bbox %s, min must be positive and at most max", s)
+	}
+	return b, nil
+}
+
+// Contains is true when the tile x, y is in the range
+func (b BBox) Contains(x, y int) bool {
+	return x >= b.MinX && x <= b.MaxX && y >= b.MinY && y <= b.MaxY
+}
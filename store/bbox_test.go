@@ -0,0 +1,21 @@
+package store
+
+import "testing"
+
+func TestParseBBox(t *testing.T) {
+	b, err := ParseBBox("10, 20,30,40")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b != (BBox{MinX: 10, MinY: 20, MaxX: 30, MaxY: 40}) {
+		t.Fatalf("unexpected bbox %+v", b)
+	}
+	if !b.Contains(10, 40) || !b.Contains(30, 20) || b.Contains(9, 20) || b.Contains(10, 41) {
+		t.Fatal("expected an inclusive range")
+	}
+	for _, s := range []string{"", "1,2,3", "1,2,3,x", "-1,0,1,1", "5,0,4,1", "0,5,1,4"} {
+		if _, err := ParseBBox(s); err == nil {
+			t.Fatalf("ParseBBox(%q): expected an error", s)
+		}
+	}
+}
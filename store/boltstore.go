@@ -0,0 +1,229 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	hcrc "hash/crc32"
+	"log/slog"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltTileStore is a TileStore in a bbolt key-value file, for write-heavy ingests.
+// Bolt has a single writer too, but concurrent PutTile calls are coalesced in shared transactions
+// instead of retrying on a locked DB, see bolt.DB.Batch.
+//
+// Each level is a bucket named by z. Keys are x then y, as big-endian uint16, values the CRC32, big-endian, then the data.
+// Only the tiles are stored, without the meta of a TileDB: the tools read TileDBs only.
+type BoltTileStore struct {
+	db *bolt.DB
+}
+
+// NewBoltTileStore opens the bolt file at path, created if missing unless readOnly
+func NewBoltTileStore(path string, readOnly bool) (*BoltTileStore, error) {
+	// The freelist is rebuilt on open instead of written on every commit, faster writes for a slower open
+	db, err := bolt.Open(path, 0o644, &bolt.Options{Timeout: defaultBusyTimeout, ReadOnly: readOnly,
+		NoFreelistSync: true, FreelistType: bolt.FreelistMapType})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bolt store %s: %w", path, err)
+	}
+	return &BoltTileStore{db: db}, nil
+}
+
+func boltLevel(z int) []byte {
+	return []byte(strconv.Itoa(z))
+}
+
+func boltKey(x, y int) []byte {
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint16(key, uint16(x))
+	binary.BigEndian.PutUint16(key[2:], uint16(y))
+	return key
+}
+
+func boltValue(data []byte, crc32 uint32) []byte {
+	value := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(value, crc32)
+	copy(value[4:], data)
+	return value
+}
+
+// put writes a tile in the transaction, creating its level
+func boltPut(tx *bolt.Tx, z, x, y int, data []byte, crc32 uint32) error {
+	level, err := tx.CreateBucketIfNotExists(boltLevel(z))
+	if err != nil {
+		return err
+	}
+	return level.Put(boltKey(x, y), boltValue(data, crc32))
+}
+
+func (s *BoltTileStore) PutTile(z, x, y int, data []byte, crc32 uint32) error {
+	err := s.db.Batch(func(tx *bolt.Tx) error {
+		return boltPut(tx, z, x, y, data, crc32)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write tile (%d, %d, %d): %w", z, x, y, err)
+	}
+	return nil
+}
+
+func (s *BoltTileStore) PutTileAutoCRC(z, x, y int, data []byte) error {
+	return s.PutTile(z, x, y, data, hcrc.ChecksumIEEE(data))
+}
+
+// PutTileBatch writes all tiles in a single transaction
+func (s *BoltTileStore) PutTileBatch(tiles []Job) error {
+	if len(tiles) == 0 {
+		return nil
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, t := range tiles {
+			if err := boltPut(tx, t.Z, t.X, t.Y, t.Data, t.Crc32); err != nil {
+				return fmt.Errorf("tile (%d, %d, %d): %w", t.Z, t.X, t.Y, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write batch of %d tiles: %w", len(tiles), err)
+	}
+	return nil
+}
+
+// get returns the value of a tile, nil if missing. It is only valid during the transaction.
+func boltGet(tx *bolt.Tx, z, x, y int) []byte {
+	level := tx.Bucket(boltLevel(z))
+	if level == nil {
+		return nil
+	}
+	return level.Get(boltKey(x, y))
+}
+
+func (s *BoltTileStore) GetTile(z, x, y int) ([]byte, error) {
+	var data []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := boltGet(tx, z, x, y)
+		if value == nil {
+			return sql.ErrNoRows
+		}
+		data = append([]byte(nil), value[4:]...)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tile (%d, %d, %d): %w", z, x, y, err)
+	}
+	return data, nil
+}
+
+// DeleteTile removes a tile, doing nothing if it doesn't exist
+func (s *BoltTileStore) DeleteTile(z, x, y int) error {
+	err := s.db.Batch(func(tx *bolt.Tx) error {
+		level := tx.Bucket(boltLevel(z))
+		if level == nil {
+			return nil
+		}
+		return level.Delete(boltKey(x, y))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete tile (%d, %d, %d): %w", z, x, y, err)
+	}
+	return nil
+}
+
+func (s *BoltTileStore) StatTile(z, x, y int) (exists bool, crc uint32, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		if value := boltGet(tx, z, x, y); value != nil {
+			exists, crc = true, binary.BigEndian.Uint32(value)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to stat tile (%d, %d, %d): %w", z, x, y, err)
+	}
+	return exists, crc, nil
+}
+
+// each calls fn on the key and value of every tile of level z, in x then y order
+func (s *BoltTileStore) each(z int, fn func(x, y uint16, value []byte)) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		level := tx.Bucket(boltLevel(z))
+		if level == nil {
+			return nil
+		}
+		return level.ForEach(func(k, v []byte) error {
+			fn(binary.BigEndian.Uint16(k), binary.BigEndian.Uint16(k[2:]), v)
+			return nil
+		})
+	})
+}
+
+func (s *BoltTileStore) StatTiles(z int) (map[[2]uint16]uint32, error) {
+	res := make(map[[2]uint16]uint32)
+	err := s.each(z, func(x, y uint16, value []byte) {
+		res[[2]uint16{x, y}] = binary.BigEndian.Uint32(value)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat tiles of level %d: %w", z, err)
+	}
+	return res, nil
+}
+
+func (s *BoltTileStore) ListTiles(z int) ([][2]uint16, error) {
+	res := make([][2]uint16, 0)
+	err := s.each(z, func(x, y uint16, _ []byte) {
+		res = append(res, [2]uint16{x, y})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tiles of level %d: %w", z, err)
+	}
+	return res, nil
+}
+
+// CopyTo writes the tiles of level z to db, in transactions of batch tiles, returning the count copied.
+// Ingested in a bolt store, the tiles are then loaded in a TileDB for the merger and the tileserver.
+func (s *BoltTileStore) CopyTo(db *TileDB, z, batch int) (int, error) {
+	start := time.Now()
+	buffer := make([]Job, 0, max(batch, 1))
+	copied := 0
+	flush := func() error {
+		if err := db.PutTileBatch(buffer); err != nil {
+			return err
+		}
+		copied += len(buffer)
+		buffer = buffer[:0]
+		return nil
+	}
+	var err error
+	each := s.each(z, func(x, y uint16, value []byte) {
+		if err != nil {
+			return
+		}
+		// The value is only valid during the transaction
+		data := append([]byte(nil), value[4:]...)
+		buffer = append(buffer, Job{Z: z, X: int(x), Y: int(y), Data: data, Crc32: binary.BigEndian.Uint32(value)})
+		if len(buffer) == cap(buffer) {
+			err = flush()
+		}
+	})
+	if each != nil {
+		return copied, fmt.Errorf("failed to read tiles of level %d: %w", z, each)
+	}
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return copied, err
+	}
+	slog.Info("copied bolt tiles", "z", z, "tiles", copied, "duration", time.Since(start).Round(time.Millisecond))
+	return copied, nil
+}
+
+// Close closes the file, logging a failure like TileDB.Close
+func (s *BoltTileStore) Close() {
+	if err := s.db.Close(); err != nil {
+		slog.Warn("failed to close bolt store", "err", err)
+	}
+}
@@ -0,0 +1,166 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path"
+	"runtime"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func newBoltTileStoreT(tb testing.TB) *BoltTileStore {
+	s, err := NewBoltTileStore(path.Join(tb.TempDir(), "tiles.bolt"), false)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(s.Close)
+	return s
+}
+
+func TestBoltTileStore(t *testing.T) {
+	s := newBoltTileStoreT(t)
+	if err := s.PutTile(11, 300, 2, []byte("tile"), 42); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutTileBatch([]Job{{Z: 11, X: 1, Y: 700, Data: []byte("a"), Crc32: 1}, {Z: 10, X: 1, Y: 1, Data: []byte("b"), Crc32: 2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := s.GetTile(11, 300, 2)
+	if err != nil || string(data) != "tile" {
+		t.Fatalf("expected the tile, got %q, %v", data, err)
+	}
+	// Missing tiles are sql.ErrNoRows, like a TileDB, at an existing and a missing level
+	for _, z := range []int{11, 3} {
+		if _, err := s.GetTile(z, 0, 0); !errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("expected sql.ErrNoRows at level %d, got %v", z, err)
+		}
+	}
+	if exists, crc, err := s.StatTile(11, 300, 2); !exists || crc != 42 || err != nil {
+		t.Fatalf("expected the tile of CRC 42, got %v, %d, %v", exists, crc, err)
+	}
+	if exists, _, err := s.StatTile(11, 2, 300); exists || err != nil {
+		t.Fatalf("expected no tile, got %v, %v", exists, err)
+	}
+
+	tiles, err := s.ListTiles(11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(tiles, [][2]uint16{{1, 700}, {300, 2}}) {
+		t.Fatalf("expected the 2 tiles of level 11 by x then y, got %v", tiles)
+	}
+	stats, err := s.StatTiles(11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 || stats[[2]uint16{1, 700}] != 1 {
+		t.Fatalf("expected the CRCs of the 2 tiles, got %v", stats)
+	}
+
+	tileDB, err := NewTileDB(path.Join(t.TempDir(), "tiles.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tileDB.Close()
+	if n, err := s.CopyTo(&tileDB, 11, 1); n != 2 || err != nil {
+		t.Fatalf("expected 2 tiles copied, got %d, %v", n, err)
+	}
+	if exists, crc, _ := tileDB.StatTile(11, 1, 700); !exists || crc != 1 {
+		t.Fatalf("expected the copied tile of CRC 1, got %v, %d", exists, crc)
+	}
+
+	if err := s.DeleteTile(11, 300, 2); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _, err := s.StatTile(11, 300, 2); exists || err != nil {
+		t.Fatalf("expected the tile deleted, got %v, %v", exists, err)
+	}
+	// A missing tile, at a missing level
+	if err := s.DeleteTile(3, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIngestBoltTileStore(t *testing.T) {
+	const n = 12
+	s := newBoltTileStoreT(t)
+	ingester := NewIngester(s, 4, false)
+	ingester.SetBatchSize(5)
+	if snapshot := ingestTiles(ingester, paintedTilesT(n, t), t); snapshot.Success != n {
+		t.Fatalf("expected %d tiles written, got %+v", n, snapshot)
+	}
+	tiles, err := s.ListTiles(11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tiles) != n {
+		t.Fatalf("expected %d tiles stored, got %d", n, len(tiles))
+	}
+}
+
+// Tiles written per second by a goroutine per CPU, one by one and in batches, to a TileDB and a bolt store.
+func BenchmarkTileStoreWrites(b *testing.B) {
+	const n = 1000
+	data := make([]byte, 2200) // About an empty tile
+	stores := []struct {
+		name string
+		open func(b *testing.B) TileStore
+	}{
+		{"TileDB", func(b *testing.B) TileStore {
+			tileDB, err := NewTileDB(path.Join(b.TempDir(), "tiles.db"), false)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Cleanup(tileDB.Close)
+			return &tileDB
+		}},
+		{"Bolt", func(b *testing.B) TileStore { return newBoltTileStoreT(b) }},
+	}
+	for _, st := range stores {
+		for _, batch := range []int{1, 100} {
+			b.Run(fmt.Sprintf("%s/Batch%d", st.name, batch), func(b *testing.B) {
+				for b.Loop() {
+					b.StopTimer()
+					s := st.open(b)
+					b.StartTimer()
+					writeTilesB(s, n, batch, data, b)
+				}
+				b.ReportMetric(float64(n*b.N)/b.Elapsed().Seconds(), "tiles/s")
+			})
+		}
+	}
+}
+
+// writeTilesB writes n tiles from a goroutine per CPU, in batches of batch tiles
+func writeTilesB(s TileStore, n, batch int, data []byte, b *testing.B) {
+	workers := runtime.NumCPU()
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buffer := make([]Job, 0, batch)
+			for i := w; i < n; i += workers {
+				j := Job{Z: 11, X: i % 100, Y: i / 100, Data: data, Crc32: uint32(i)}
+				var err error
+				if batch <= 1 {
+					err = s.PutTile(j.Z, j.X, j.Y, j.Data, j.Crc32)
+				} else if buffer = append(buffer, j); len(buffer) == batch {
+					err, buffer = s.PutTileBatch(buffer), buffer[:0]
+				}
+				if err != nil {
+					b.Error(err)
+					return
+				}
+			}
+			if err := s.PutTileBatch(buffer); err != nil {
+				b.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
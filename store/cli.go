@@ -0,0 +1,134 @@
+package store
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+
+	"github.com/Hugi-R/wplace-archive-world-map/img"
+	"github.com/Hugi-R/wplace-archive-world-map/logging"
+	"github.com/Hugi-R/wplace-archive-world-map/profiling"
+	"github.com/Hugi-R/wplace-archive-world-map/releases"
+)
+
+// Main runs the ingest command line, args without the program name
+func Main(args []string) error {
+	fs := flag.NewFlagSet("ingest", flag.ExitOnError)
+	base := fs.String("base", "", "Optional base DB path")
+	from := fs.String("from", "", "Mandatory from path (folder or 7z)")
+	out := fs.String("out", "", "Mandatory out DB path")
+	workers := fs.Int("workers", 10, "Optional number of workers, 0 picks one per CPU, up to 32 (default 10)")
+	optimize := fs.Bool("optimize", false, "Optional, vacuum the DB after ingest. Temporarily needs up to twice the DB size of free disk space")
+	metricsJSON := fs.Bool("metrics-json", false, "Optional, print metrics as JSON lines instead of human readable lines")
+	fit := fs.Bool("fit", false, "Optional, pad or crop tiles that aren't of the tile size of the DB, 1000x1000 for a new DB, instead of failing them")
+	resume := fs.Bool("resume", false, "Optional, skip the archive if already ingested in the out DB, or continue from where a previous ingest stopped")
+	compression := fs.String("compression", img.CompressionDefault, "Optional PNG compression level: default, speed, best, or none. best is smaller but much slower (default default)")
+	diffEncoding := fs.String("diff-encoding", img.DiffTransparentName, "Optional encoding of the diff tiles, with --base: transparent, or erasures to also record the pixels turned transparent (default transparent)")
+	sparseMaxRuns := fs.Int("sparse-max-runs", img.DefaultSparseMaxRuns, "Optional, with --base, store the diff tiles of up to this many runs of changed pixels in the sparse format instead of PNG. 0 stores them all as PNG (default 1000)")
+	folderChunk := fs.Int("folder-chunk", 0, "Optional, list the directories of a folder input this many entries at a time, in directory order, bounding memory on huge directories. 0 lists whole directories, sorted by name (default 0)")
+	skipEmpty := fs.Bool("skip-empty", false, "Optional, don't store the fully transparent tiles, read as empty anyway. Keep them as placeholders by default")
+	scheme := fs.String("scheme", SchemeXYZName, "Optional y axis convention of the input tiles: xyz, y from the north edge like Wplace, or tms, y from the south edge, flipped to the stored xyz (default xyz)")
+	compactPalette := fs.Bool("compact-palette", false, "Optional, encode the tiles with a palette of only their colors, at 1, 2 or 4 bits per pixel when few. Smaller tiles, but the DB can't be used as --base")
+	dedup := fs.Bool("dedup", false, "Optional, create the out DB with the content-addressed schema, storing identical tiles once. An existing DB keeps its schema")
+	limit := fs.Int("limit", 0, "Optional, stop after reading this many tiles, to test on a part of a large archive. Continue later with --resume. 0 reads all (default 0)")
+	failures := fs.String("failures", "", "Optional, write the tiles that failed to this file, as JSON lines of z, x, y, crc32 and error")
+	bbox := fs.String("bbox", "", "Optional, only ingest the tiles in the range minX,minY,maxX,maxY, inclusive, at the zoom of the archive. The merged levels will be partial")
+	crcManifest := fs.String("crc-manifest", "", "Optional, SFV file of the CRC32 of the tiles of a folder --from, as lines of path and hex CRC. Tiles not matching it are failed")
+	layer := fs.String("layer", "", "Optional, ingest as a diff layer of this version, like v1.024, appended to --out, a layered DB holding the base tiles")
+	layerTime := fs.String("layer-time", "", "Optional release time of the --layer, RFC 3339. Parsed from the --from file name by default")
+	maxColorDistance := fs.Float64("max-color-distance", 0, "Optional, map unknown colors to the nearest palette color within this RGB distance. 0 turns unknown colors transparent")
+	singleWriter := fs.Bool("single-writer", false, "Optional, write the tiles from a single goroutine, the workers only decoding and packing them, instead of each worker writing its batches. Avoids the DB lock retries with many workers")
+	pprofAddr := fs.String("pprof", "", "Optional address to serve the pprof profiles on during the ingest, like localhost:6060. Off by default")
+
+	fs.Parse(args)
+	if err := logging.Setup(); err != nil {
+		return err
+	}
+	if err := profiling.Start(*pprofAddr); err != nil {
+		return err
+	}
+
+	// Check mandatory flags
+	if *from == "" {
+		return fmt.Errorf("missing required flag: --from")
+	}
+	if *out == "" {
+		return fmt.Errorf("missing required flag: --out")
+	}
+
+	level, err := img.ParseCompressionLevel(*compression)
+	if err != nil {
+		return err
+	}
+	encoding, err := img.ParseDiffEncoding(*diffEncoding)
+	if err != nil {
+		return err
+	}
+	tileScheme, err := ParseTileScheme(*scheme)
+	if err != nil {
+		return err
+	}
+
+	var region *BBox
+	if *bbox != "" {
+		b, err := ParseBBox(*bbox)
+		if err != nil {
+			return err
+		}
+		region = &b
+	}
+
+	// Stop cleanly on Ctrl-C, letting the DB close
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	opts := IngestOptions{
+		Workers:          *workers,
+		Optimize:         *optimize,
+		MaxColorDistance: *maxColorDistance,
+		Resume:           *resume,
+		Fit:              *fit,
+		MetricsJSON:      *metricsJSON,
+		FailuresPath:     *failures,
+		CompressionLevel: level,
+		DiffEncoding:     encoding,
+		SparseMaxRuns:    *sparseMaxRuns,
+		FolderChunkSize:  *folderChunk,
+		SkipEmpty:        *skipEmpty,
+		Scheme:           tileScheme,
+		Dedup:            *dedup,
+		CompactPalette:   *compactPalette,
+		Limit:            *limit,
+		BBox:             region,
+		CrcManifest:      *crcManifest,
+		SingleWriter:     *singleWriter,
+	}
+	if *layer != "" {
+		if *base != "" {
+			return fmt.Errorf("--layer is a diff from the base tiles of --out, it can't have a --base")
+		}
+		var datetime time.Time
+		if *layerTime != "" {
+			datetime, err = time.Parse(time.RFC3339, *layerTime)
+		} else {
+			datetime, err = releases.ParseReleaseTime(filepath.Base(*from))
+		}
+		if err != nil {
+			return fmt.Errorf("invalid layer time, set --layer-time: %w", err)
+		}
+		if err := IngestLayer(ctx, *from, *out, Layer{Version: *layer, Datetime: datetime}, opts); err != nil {
+			return err
+		}
+	} else if err := Ingest(ctx, *from, *out, *base, opts); err != nil {
+		return err
+	}
+
+	// Logged, stdout is left to the metrics of --metrics-json
+	slog.Info("done")
+	return nil
+}
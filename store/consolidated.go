@@ -0,0 +1,184 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+)
+
+// ConsolidatedDB holds the tiles of many versions in a single DB, instead of a DB per version.
+//
+// The tiles table has a version column leading its primary key (version, z, x, y), next to the z, x, y, crc32
+// and data columns of a TileDB. The versions table lists the versions with their description and tile size,
+// and the version_meta table holds the meta table of each version DB.
+// Each version is copied as is, a diff version stays a diff of its base version.
+type ConsolidatedDB struct {
+	DB       *sql.DB
+	dbPath   string
+	readOnly bool
+}
+
+// ConsolidatedVersion is a version of a ConsolidatedDB
+type ConsolidatedVersion struct {
+	Version     string            // Like v1 or v1.024
+	Description string            // Part of the version DB file name after the version, its date
+	TileSize    int               // Width and height of the tiles in pixels, see ReadTileSize
+	Meta        map[string]string // Meta table of the version DB, see ReadMeta
+}
+
+// NewConsolidatedDB opens the consolidated DB at dbPath.
+// Opened for write, the tables are created if missing; read-only, they must exist.
+func NewConsolidatedDB(dbPath string, readOnly bool) (*ConsolidatedDB, error) {
+	params := url.Values{"_busy_timeout": {strconv.FormatInt(defaultBusyTimeout.Milliseconds(), 10)}}
+	if readOnly {
+		params.Set("mode", "ro")
+	}
+	db, err := sql.Open("sqlite3", FileDSN(dbPath, params))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database %s: %w", dbPath, err)
+	}
+	if readOnly {
+		_, err = ReadConsolidatedVersions(db)
+	} else {
+		_, err = db.Exec(`CREATE TABLE IF NOT EXISTS versions (version TEXT PRIMARY KEY, description TEXT NOT NULL, tile_size INTEGER NOT NULL);
+			CREATE TABLE IF NOT EXISTS version_meta (version TEXT NOT NULL, key TEXT NOT NULL, value TEXT NOT NULL,
+				PRIMARY KEY (version, key));
+			CREATE TABLE IF NOT EXISTS tiles (version TEXT NOT NULL, z INTEGER NOT NULL, x INTEGER NOT NULL, y INTEGER NOT NULL, crc32 INTEGER, data BLOB NOT NULL,
+				PRIMARY KEY (version, z, x, y));`)
+	}
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize consolidated database %s: %w", dbPath, err)
+	}
+	return &ConsolidatedDB{DB: db, dbPath: dbPath, readOnly: readOnly}, nil
+}
+
+// Close closes the DB
+func (c *ConsolidatedDB) Close() error {
+	return c.DB.Close()
+}
+
+// Versions lists the versions, sorted by name
+func (c *ConsolidatedDB) Versions() ([]ConsolidatedVersion, error) {
+	return ReadConsolidatedVersions(c.DB)
+}
+
+// ReadConsolidatedVersions lists the versions of a consolidated DB, sorted by name, for readers outside ConsolidatedDB.
+// It fails if db is not a consolidated DB.
+func ReadConsolidatedVersions(db *sql.DB) ([]ConsolidatedVersion, error) {
+	rows, err := db.Query(`SELECT version, description, tile_size FROM versions ORDER BY version`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list versions: %w", err)
+	}
+	var versions []ConsolidatedVersion
+	for rows.Next() {
+		var v ConsolidatedVersion
+		if err := rows.Scan(&v.Version, &v.Description, &v.TileSize); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to list versions: %w", err)
+		}
+		v.Meta = make(map[string]string)
+		versions = append(versions, v)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list versions: %w", err)
+	}
+
+	index := make(map[string]int, len(versions))
+	for i, v := range versions {
+		index[v.Version] = i
+	}
+	rows, err = db.Query(`SELECT version, key, value FROM version_meta`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the meta of the versions: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version, key, value string
+		if err := rows.Scan(&version, &key, &value); err != nil {
+			return nil, fmt.Errorf("failed to read the meta of the versions: %w", err)
+		}
+		if i, found := index[version]; found {
+			versions[i].Meta[key] = value
+		}
+	}
+	return versions, rows.Err()
+}
+
+// AddVersion copies the tiles and meta of the version DB at dbPath as the version.
+// A version already consolidated is left as is, it returns false, so running it again adds the new versions only.
+func (c *ConsolidatedDB) AddVersion(version, description, dbPath string) (bool, error) {
+	if c.readOnly {
+		return false, fmt.Errorf("database is read-only")
+	}
+	var exists bool
+	if err := c.DB.QueryRow(`SELECT EXISTS (SELECT 1 FROM versions WHERE version = ?)`, version).Scan(&exists); err != nil {
+		return false, fmt.Errorf("failed to read versions: %w", err)
+	}
+	if exists {
+		return false, nil
+	}
+
+	src, err := NewTileDB(dbPath, true)
+	if err != nil {
+		return false, fmt.Errorf("failed to open version database %s: %w", dbPath, err)
+	}
+	defer src.Close()
+	size, err := ReadTileSize(src.DB)
+	if err != nil {
+		return false, err
+	}
+	meta, err := ReadMeta(src.DB)
+	if err != nil {
+		return false, err
+	}
+
+	tx, err := c.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`INSERT INTO versions (version, description, tile_size) VALUES (?, ?, ?)`, version, description, size); err != nil {
+		return false, fmt.Errorf("failed to add version %s: %w", version, err)
+	}
+	for key, value := range meta {
+		if _, err := tx.Exec(`INSERT INTO version_meta (version, key, value) VALUES (?, ?, ?)`, version, key, value); err != nil {
+			return false, fmt.Errorf("failed to write meta %s of version %s: %w", key, version, err)
+		}
+	}
+	insert, err := tx.Prepare(`INSERT INTO tiles (version, z, x, y, crc32, data) VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return false, err
+	}
+	defer insert.Close()
+
+	rows, err := src.DB.Query(`SELECT z, x, y, crc32, data FROM ` + TilesFrom(src.dedup))
+	if err != nil {
+		return false, fmt.Errorf("failed to read tiles of %s: %w", dbPath, err)
+	}
+	defer rows.Close()
+	tiles := 0
+	for rows.Next() {
+		var z, x, y int
+		var crc32 sql.NullInt64
+		var data []byte
+		if err := rows.Scan(&z, &x, &y, &crc32, &data); err != nil {
+			return false, fmt.Errorf("failed to read tiles of %s: %w", dbPath, err)
+		}
+		if _, err := insert.Exec(version, z, x, y, crc32, data); err != nil {
+			return false, fmt.Errorf("failed to write tile %d/%d/%d of version %s: %w", z, x, y, version, err)
+		}
+		tiles++
+	}
+	if err := rows.Err(); err != nil {
+		return false, fmt.Errorf("failed to read tiles of %s: %w", dbPath, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	slog.Info("consolidated version", "version", version, "file", dbPath, "tiles", tiles)
+	return true, nil
+}
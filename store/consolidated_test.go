@@ -0,0 +1,61 @@
+package store
+
+import (
+	"bytes"
+	"path"
+	"testing"
+)
+
+func TestConsolidatedDB(t *testing.T) {
+	dir := t.TempDir()
+	versionPath := path.Join(dir, "v1.db")
+	tileDB, err := NewTileDB(versionPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tileDB.PutTile(0, 0, 0, []byte("tile"), 7); err != nil {
+		t.Fatal(err)
+	}
+	tileDB.Close()
+
+	// A version DB is not a consolidated DB
+	if _, err := NewConsolidatedDB(versionPath, true); err == nil {
+		t.Fatal("expected an error opening a version DB as consolidated")
+	}
+
+	outPath := path.Join(dir, "all.db")
+	out, err := NewConsolidatedDB(outPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, version := range []string{"v1", "v1", "v2"} {
+		if _, err := out.AddVersion(version, "2025-01-07T00", versionPath); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out.Close()
+
+	out, err = NewConsolidatedDB(outPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	versions, err := out.Versions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[1].Version != "v2" || versions[0].Meta[MetaScheme] != SchemeXYZName {
+		t.Fatalf("expected v1 and v2 with the meta of the version DB, got %+v", versions)
+	}
+	var data []byte
+	var crc uint32
+	if err := out.DB.QueryRow(`SELECT data, crc32 FROM tiles WHERE version = 'v2' AND z = 0 AND x = 0 AND y = 0`).Scan(&data, &crc); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte("tile")) || crc != 7 {
+		t.Fatalf("expected the tile copied with its CRC, got %q, %d", data, crc)
+	}
+	if _, err := out.AddVersion("v3", "", versionPath); err == nil {
+		t.Fatal("expected an error adding a version to a read-only DB")
+	}
+}
@@ -2,28 +2,122 @@ package store
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log/slog"
+	"maps"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/Hugi-R/wplace-archive-world-map/img"
+	"github.com/Hugi-R/wplace-archive-world-map/releases"
 )
 
 type Ingester struct {
-	db       TileDB
-	force    bool
-	paletter img.Paletter
-	metrics  *metrics
-	workers  int
-	useDiff  bool
-	baseDB   TileDB
+	db        TileStore
+	force     bool
+	paletter  img.Paletter
+	metrics   *metrics
+	workers   int
+	useDiff   bool
+	diffEnc   img.DiffEncoding
+	sparseMax int
+	level     png.CompressionLevel // PNG compression level of the diff tiles, the paletter has the one of the full tiles
+	baseDB    TileStore
+	batch     int
+	stats     *statCache
+	baseStats *statCache
+	progress  *checkpoint
+	fit       bool
+	skipEmpty bool
+	failures  *failures
+	tileSize  *atomic.Int64 // Size of the tiles, 0 until detected, see SetTileSize
+	limit     int64         // Jobs read before stopping, 0 reads all, see SetLimit
+	bbox      *BBox         // Tiles outside are skipped, nil ingests all, see SetBBox
+	oneWriter bool          // Workers only prepare the tiles, a single goroutine writes them, see SetSingleWriter
 }
 
+// Failure is a tile that could not be ingested
+type Failure struct {
+	Z     int    `json:"z"`
+	X     int    `json:"x"`
+	Y     int    `json:"y"`
+	Crc32 uint32 `json:"crc32"`
+	Error string `json:"error"`
+}
+
+// failures collects the failed tiles of the workers
+type failures struct {
+	mu   sync.Mutex
+	list []Failure
+}
+
+func (f *failures) add(j Job, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.list = append(f.list, Failure{Z: j.Z, X: j.X, Y: j.Y, Crc32: j.Crc32, Error: err.Error()})
+}
+
+// writeFailures writes the failures as JSON lines to path
+func writeFailures(path string, list []Failure) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create failures file %s: %w", path, err)
+	}
+	enc := json.NewEncoder(f)
+	for _, failure := range list {
+		if err := enc.Encode(failure); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to write failures file %s: %w", path, err)
+		}
+	}
+	return f.Close()
+}
+
+// statCache holds the CRCs of one level of a DB, loaded with a single StatTiles query.
+// Input tiles share a zoom level, so one level is kept at a time to bound memory.
+type statCache struct {
+	db    TileStore
+	mu    sync.Mutex
+	z     int
+	level map[[2]uint16]uint32
+}
+
+func newStatCache(db TileStore) *statCache {
+	return &statCache{db: db, z: -1}
+}
+
+// stat is StatTile, from the cached level
+func (c *statCache) stat(z, x, y int) (exists bool, crc uint32, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if z != c.z {
+		level, err := c.db.StatTiles(z)
+		if err != nil {
+			return false, 0, err
+		}
+		c.z, c.level = z, level
+	}
+	crc, exists = c.level[[2]uint16{uint16(x), uint16(y)}]
+	return exists, crc, nil
+}
+
+// Number of tiles buffered per worker, or by the single writer, before writing them in one transaction
+const defaultBatchSize = 500
+
 type metrics struct {
-	ticker  *time.Ticker
+	ticker   *time.Ticker
 	read     atomic.Int64
 	lastRead atomic.Int64
 	done     atomic.Int64
@@ -31,13 +125,100 @@ type metrics struct {
 	fail     atomic.Int64
 	skip     atomic.Int64
 	crcskip  atomic.Int64
+	crcBad   atomic.Int64
+	empty    atomic.Int64
 	lastDone atomic.Int64
+	mu       sync.Mutex // Serializes reports
+	lastTime time.Time
+	jsonOut  bool
+}
+
+// MetricsSnapshot holds the ingest counters at a point in time
+type MetricsSnapshot struct {
+	Read        int64 `json:"read"`
+	Done        int64 `json:"done"`
+	Success     int64 `json:"success"`
+	Skip        int64 `json:"skip"`
+	Fail        int64 `json:"fail"`
+	CrcSkip     int64 `json:"crcskip"`
+	CrcMismatch int64 `json:"crc_mismatch"`
+	Empty       int64 `json:"empty"`
+}
+
+// metricsReport is a JSON metrics line
+type metricsReport struct {
+	Time     time.Time `json:"time"`
+	Rate     float64   `json:"rate"`
+	ReadRate float64   `json:"read_rate"`
+	MetricsSnapshot
 }
 
 type Job struct {
 	Z, X, Y int
 	Data    []byte
 	Crc32   uint32
+
+	seq      int64 // Read order, set by Ingester.Ingest
+	position int   // Reader position after this job, for checkpoints
+	readErr  error // Set by the reader for a tile read but invalid, failed by the Ingester, like ErrCrcMismatch
+}
+
+// Zoom level of the Wplace tiles, assumed when the path has no zoom
+const defaultZoom = 11
+
+// Highest zoom a path segment can be parsed as
+const maxZoom = 22
+
+// Largest tile entry read from an archive, gunzipped
+const maxEntrySize = 10 * 1024 * 1024
+
+// Suffix of the tile entries compressed with gzip, like 704.png.gz, see gunzipEntry
+const gzipSuffix = ".gz"
+
+// gunzipEntry returns the data of the archive entry name, gunzipped when the name has gzipSuffix.
+// gunzipped tells the CRC of the archive is of the compressed data, not of the tile.
+func gunzipEntry(name string, data []byte) (tile []byte, gunzipped bool, err error) {
+	if !strings.HasSuffix(name, gzipSuffix) {
+		return data, false, nil
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to gunzip file %s: %w", name, err)
+	}
+	defer gz.Close()
+	tile, err = io.ReadAll(io.LimitReader(gz, maxEntrySize+1))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to gunzip file %s: %w", name, err)
+	}
+	if len(tile) > maxEntrySize {
+		return nil, false, fmt.Errorf("file %s size too large once gunzipped, over %d bytes", name, maxEntrySize)
+	}
+	return tile, true, nil
+}
+
+// parseTilePath parses a path like `*/[Z/]X/Y.png`, or `*/[Z/]X/Y.png.gz` for a gzipped tile.
+// Z is optional, a segment that is not a zoom level is ignored and z defaults to 11.
+func parseTilePath(name string) (z, x, y int, err error) {
+	pathParts := strings.Split(name, "/")
+	size := len(pathParts)
+	if size < 2 {
+		return 0, 0, 0, fmt.Errorf("unexpected file path structure: %s", name)
+	}
+	x, err = strconv.Atoi(pathParts[size-2])
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to parse x coordinate from path: %w", err)
+	}
+	y, err = strconv.Atoi(strings.TrimSuffix(strings.TrimSuffix(pathParts[size-1], gzipSuffix), ".png"))
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to parse y coordinate from path: %w", err)
+	}
+	z = defaultZoom
+	if size >= 3 {
+		if pz, err := strconv.Atoi(pathParts[size-3]); err == nil && pz >= 0 && pz <= maxZoom {
+			z = pz
+		}
+	}
+	return z, x, y, nil
 }
 
 type Reader interface {
@@ -69,117 +250,454 @@ func (m *metrics) CrcSkip() {
 	m.crcskip.Add(1)
 }
 
+func (m *metrics) CrcMismatch() {
+	m.crcBad.Add(1)
+}
+
+func (m *metrics) Empty() {
+	m.empty.Add(1)
+}
+
+func (m *metrics) Snapshot() MetricsSnapshot {
+	return MetricsSnapshot{
+		Read:        m.read.Load(),
+		Done:        m.done.Load(),
+		Success:     m.success.Load(),
+		Skip:        m.skip.Load(),
+		Fail:        m.fail.Load(),
+		CrcSkip:     m.crcskip.Load(),
+		CrcMismatch: m.crcBad.Load(),
+		Empty:       m.empty.Load(),
+	}
+}
+
+// ReportMetrics starts printing metrics periodically, until Stop is called
 func (m *metrics) ReportMetrics() {
 	const tickRate = 5
 
+	m.lastTime = time.Now()
 	m.ticker = time.NewTicker(tickRate * time.Second)
+	go func() {
+		for range m.ticker.C {
+			m.report()
+		}
+	}()
+}
 
-	for range m.ticker.C {
-		read := m.read.Load()
-		lastRead := m.lastRead.Swap(read)
-		readRate := float64(read-lastRead) / tickRate
-		done := m.done.Load()
-		success := m.success.Load()
-		skip := m.skip.Load()
-		fail := m.fail.Load()
-		lastDone := m.lastDone.Swap(done)
-		rate := float64(done-lastDone) / tickRate
-		crcskip := m.crcskip.Load()
-		fmt.Printf("Rate: %.2f/s, Done: %d, Success: %d, Skip: %d, Fail: %d. Read rate: %.2f, Read: %d, CrcSkip: %d\n", rate, done, success, skip, fail, readRate, read, crcskip)
+// report prints the metrics and the rates since the previous report
+func (m *metrics) report() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	elapsed := now.Sub(m.lastTime).Seconds()
+	m.lastTime = now
+	s := m.Snapshot()
+	readRate := float64(s.Read-m.lastRead.Swap(s.Read)) / elapsed
+	rate := float64(s.Done-m.lastDone.Swap(s.Done)) / elapsed
+	if m.jsonOut {
+		line, err := json.Marshal(metricsReport{Time: now, Rate: rate, ReadRate: readRate, MetricsSnapshot: s})
+		if err != nil {
+			slog.Error("failed to encode metrics", "err", err)
+			return
+		}
+		fmt.Println(string(line))
+		return
 	}
+	slog.Info("ingest", "rate", fmt.Sprintf("%.2f/s", rate), "done", s.Done, "success", s.Success, "skip", s.Skip, "fail", s.Fail,
+		"read_rate", fmt.Sprintf("%.2f/s", readRate), "read", s.Read, "crcskip", s.CrcSkip, "crc_mismatch", s.CrcMismatch, "empty", s.Empty)
 }
 
+// Stop stops the periodic report, and prints a last one
 func (m *metrics) Stop() {
 	m.ticker.Stop()
+	m.report()
 }
 
-func (g *Ingester) processData(j Job) (bool, error) {
-	exists, _, err := g.db.StatTile(j.Z, j.X, j.Y)
+// prepareData converts a job to the stored format, without writing it.
+// The returned job holds the packed (and possibly diffed) data.
+func (g *Ingester) prepareData(j Job) (Job, bool, error) {
+	if j.readErr != nil {
+		return Job{}, false, j.readErr
+	}
+	if g.bbox != nil && !g.bbox.Contains(j.X, j.Y) {
+		// Skip, out of the region
+		return Job{}, true, nil
+	}
+	exists, _, err := g.stats.stat(j.Z, j.X, j.Y)
 	if (exists || err != nil) && !g.force {
 		// Skip
-		return true, nil
+		return Job{}, true, nil
 	}
 
 	// If diff is enabled, check CRC to quickly known if there's any change
+	inBase := false
 	if g.useDiff {
-		exists, crc32, err := g.baseDB.StatTile(j.Z, j.X, j.Y)
-		if (err == nil) && exists && (crc32 == j.Crc32) {
+		exists, crc32, err := g.baseStats.stat(j.Z, j.X, j.Y)
+		inBase = err == nil && exists
+		if inBase && (crc32 == j.Crc32) {
 			// Skip, no change on tile
 			g.metrics.CrcSkip()
-			return true, nil
+			return Job{}, true, nil
 		}
 	}
 
 	pngImg, err := img.DecodeImage(j.Data)
 	if err != nil {
-		return false, fmt.Errorf("failed to decode tile %d/%d/%d: %w", j.Z, j.X, j.Y, err)
+		return Job{}, false, fmt.Errorf("failed to decode tile %d/%d/%d: %w", j.Z, j.X, j.Y, err)
+	}
+	// The merger assumes all tiles have the same size
+	size := pngImg.Bounds().Size()
+	if expected := g.expectedSize(size); size.X != expected || size.Y != expected {
+		if !g.fit {
+			return Job{}, false, fmt.Errorf("tile %d/%d/%d is %dx%d, expected %dx%d", j.Z, j.X, j.Y, size.X, size.Y, expected, expected)
+		}
+		pngImg = img.FitTile(pngImg, expected)
+	}
+
+	paletted := g.paletter.ToPalette(pngImg)
+	// A transparent tile over a base tile is an erasure, it is kept
+	if g.skipEmpty && !inBase && img.IsAllTransparent(paletted.(*image.Paletted)) {
+		// Skip, a missing tile is empty
+		g.metrics.Empty()
+		return Job{}, true, nil
 	}
 
 	packed := bytes.Buffer{}
-	g.paletter.PngPack(pngImg, &packed)
+	g.paletter.EncodePng(paletted, &packed)
 	packedData := packed.Bytes()
 
 	// If diff is enabled, compute the diff
 	if g.useDiff {
 		baseData, err := g.baseDB.GetTile(j.Z, j.X, j.Y)
 		if err == nil {
-			diff, changes, err := img.Diff(baseData, packedData)
+			diff, changes, err := img.Diff(baseData, packedData, g.diffEnc, g.sparseMax, g.level)
 			if err == nil {
 				if changes {
 					packedData = diff
 				} else {
 					// Skip, no changes on the tile
-					return true, nil
+					return Job{}, true, nil
 				}
 			}
 		}
 	}
 
-	err = g.db.PutTile(j.Z, j.X, j.Y, packedData, j.Crc32)
-	return false, err
+	return Job{Z: j.Z, X: j.X, Y: j.Y, Data: packedData, Crc32: j.Crc32}, false, nil
 }
 
-func (g *Ingester) worker(jobChan chan Job, wg *sync.WaitGroup) {
+// nextJob waits for the next job, it returns false when the channel is closed or the context cancelled
+func nextJob(ctx context.Context, jobChan chan Job) (Job, bool) {
+	select {
+	case <-ctx.Done():
+		return Job{}, false
+	case j, ok := <-jobChan:
+		return j, ok
+	}
+}
+
+func (g *Ingester) worker(ctx context.Context, jobChan chan Job, wg *sync.WaitGroup) {
 	defer wg.Done()
-	for j := range jobChan {
-		skip, err := g.processData(j)
-		if err != nil {
-			fmt.Printf("Failed job %d/%d/%d (CRC: %d) : %v\n", j.Z, j.X, j.Y, j.Crc32, err)
-			g.metrics.Fail()
-		} else {
-			if skip {
-				g.metrics.Skip()
-			} else {
-				g.metrics.Success()
+	if g.batch > 1 {
+		g.batchWorker(ctx, jobChan)
+		return
+	}
+	for j, ok := nextJob(ctx, jobChan); ok; j, ok = nextJob(ctx, jobChan) {
+		packed, skip, err := g.prepareData(j)
+		switch {
+		case err != nil:
+			g.fail(j, err)
+		case skip:
+			g.metrics.Skip()
+		default:
+			if err := g.db.PutTile(packed.Z, packed.X, packed.Y, packed.Data, packed.Crc32); err != nil {
+				g.fail(j, err)
+				g.writeFailed(j)
+				continue
 			}
+			g.metrics.Success()
+		}
+		g.done(j)
+	}
+}
+
+// fail logs and records a failed job.
+// Failures are counted in the metrics, and listed with IngestOptions.FailuresPath, so they are only logged at debug.
+func (g *Ingester) fail(j Job, err error) {
+	slog.Debug("failed job", "tile", fmt.Sprintf("%d/%d/%d", j.Z, j.X, j.Y), "crc", j.Crc32, "err", err)
+	g.metrics.Fail()
+	if errors.Is(err, ErrCrcMismatch) {
+		g.metrics.CrcMismatch()
+	}
+	g.failures.add(j, err)
+}
+
+// Failures returns the tiles that failed, with their error, once Ingest returned
+func (g *Ingester) Failures() []Failure {
+	g.failures.mu.Lock()
+	defer g.failures.mu.Unlock()
+	return append([]Failure(nil), g.failures.list...)
+}
+
+// done records the job finished for the checkpoint, if any
+func (g *Ingester) done(j Job) {
+	if g.progress != nil {
+		g.progress.done(j)
+	}
+}
+
+// writeFailed records the job not written for the checkpoint, if any, so resuming processes it again
+func (g *Ingester) writeFailed(j Job) {
+	if g.progress != nil {
+		g.progress.fail(j)
+	}
+}
+
+// writeBatch writes the prepared tiles in one transaction and records them done, or not written if it failed
+func (g *Ingester) writeBatch(buffer []Job) {
+	if err := g.db.PutTileBatch(buffer); err != nil {
+		slog.Error("failed batch", "jobs", len(buffer), "err", err)
+		for _, j := range buffer {
+			g.metrics.Fail()
+			g.failures.add(j, err)
+			g.writeFailed(j)
+		}
+		return
+	}
+	for _, j := range buffer {
+		g.metrics.Success()
+		g.done(j)
+	}
+}
+
+// batchWorker buffers prepared tiles and writes them every g.batch tiles
+func (g *Ingester) batchWorker(ctx context.Context, jobChan chan Job) {
+	buffer := make([]Job, 0, g.batch)
+	flush := func() {
+		g.writeBatch(buffer)
+		buffer = buffer[:0]
+	}
+	for j, ok := nextJob(ctx, jobChan); ok; j, ok = nextJob(ctx, jobChan) {
+		packed, skip, err := g.prepareData(j)
+		if err != nil {
+			g.fail(j, err)
+			g.done(j)
+			continue
+		}
+		if skip {
+			g.metrics.Skip()
+			g.done(j)
+			continue
+		}
+		packed.seq, packed.position = j.seq, j.position
+		buffer = append(buffer, packed)
+		if len(buffer) >= g.batch {
+			flush()
 		}
 	}
+	flush()
 }
 
-func (g *Ingester) Ingest(read func() (Job, bool, error)) {
-	go g.metrics.ReportMetrics()
+// SetBatchSize enables batched writes of n tiles per transaction. n <= 1 writes tiles one by one.
+func (g *Ingester) SetBatchSize(n int) {
+	g.batch = n
+}
+
+// prepareWorker prepares the tiles, decoding, packing and diffing them, and sends them to the writer
+func (g *Ingester) prepareWorker(ctx context.Context, jobChan chan Job, writeChan chan<- Job, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for j, ok := nextJob(ctx, jobChan); ok; j, ok = nextJob(ctx, jobChan) {
+		packed, skip, err := g.prepareData(j)
+		if err != nil {
+			g.fail(j, err)
+			g.done(j)
+			continue
+		}
+		if skip {
+			g.metrics.Skip()
+			g.done(j)
+			continue
+		}
+		packed.seq, packed.position = j.seq, j.position
+		writeChan <- packed
+	}
+}
+
+// writer writes the prepared tiles in transactions of g.batch tiles, until writeChan is closed.
+// Tiles already prepared are written even once the context is cancelled.
+func (g *Ingester) writer(writeChan <-chan Job, done chan<- struct{}) {
+	defer close(done)
+	buffer := make([]Job, 0, max(g.batch, 1))
+	for j := range writeChan {
+		buffer = append(buffer, j)
+		if len(buffer) >= cap(buffer) {
+			g.writeBatch(buffer)
+			buffer = buffer[:0]
+		}
+	}
+	if len(buffer) > 0 {
+		g.writeBatch(buffer)
+	}
+}
+
+// SetSingleWriter splits the ingest in two stages: the workers only decode, pack and diff the tiles,
+// and a single goroutine writes them, in transactions of the batch size, see SetBatchSize.
+// The DB is never written concurrently, without the lock contention of the workers writing their own batches.
+func (g *Ingester) SetSingleWriter(single bool) {
+	g.oneWriter = single
+}
+
+// Ingest reads jobs until exhaustion and processes them with the workers.
+// When ctx is cancelled, reading stops and workers return after their in-flight tile.
+func (g *Ingester) Ingest(ctx context.Context, read func() (Job, bool, error)) error {
+	g.metrics.ReportMetrics()
 	defer g.metrics.Stop()
 
 	jobChan := make(chan Job, 200)
 	var wg sync.WaitGroup
+	var writeChan chan Job
+	writerDone := make(chan struct{})
+	if g.oneWriter {
+		// Buffered for a batch, the workers keep preparing while the writer commits
+		writeChan = make(chan Job, max(g.batch, 200))
+		go g.writer(writeChan, writerDone)
+	}
 	for range g.workers {
 		wg.Add(1)
-		go g.worker(jobChan, &wg)
+		if g.oneWriter {
+			go g.prepareWorker(ctx, jobChan, writeChan, &wg)
+		} else {
+			go g.worker(ctx, jobChan, &wg)
+		}
+	}
+
+	if g.progress != nil {
+		g.progress.start()
 	}
 
-	for j, ok, err := read(); ok; j, ok, err = read() {
+	zoom := -1
+	var zoomErr error
+	var seq int64
+	complete := false
+	// Tiles read, to erase the base tiles gone from the archive, see eraseGone
+	var seen map[[2]uint16]bool
+	if g.useDiff && g.diffEnc == img.DiffErasures {
+		if g.progress != nil && g.progress.position > 0 {
+			slog.Warn("resumed ingest, the base tiles gone from the archive are not erased")
+		} else {
+			seen = make(map[[2]uint16]bool)
+		}
+	}
+readLoop:
+	for j, ok, err := read(); ctx.Err() == nil; j, ok, err = read() {
+		if !ok {
+			complete = err == nil
+			break
+		}
 		if err != nil {
-			fmt.Printf("failed read: %v\n", err)
+			slog.Debug("failed read", "err", err)
+			if seen != nil {
+				// The tile of the entry is unknown, it must not be erased
+				slog.Warn("failed read, the base tiles gone from the archive are not erased", "err", err)
+				seen = nil
+			}
 			continue
 		}
-		jobChan <- j
-		g.metrics.Read()
+		if zoom < 0 {
+			zoom = j.Z
+			if zoom != defaultZoom {
+				slog.Warn("ingesting tiles at an unexpected zoom, the merger expects another one", "zoom", zoom, "expected", defaultZoom)
+			}
+		} else if j.Z != zoom {
+			// The merger builds all levels from a single one
+			zoomErr = fmt.Errorf("archive mixes zoom levels %d and %d, at tile %d/%d/%d", zoom, j.Z, j.Z, j.X, j.Y)
+			break readLoop
+		}
+		if seen != nil {
+			seen[[2]uint16{uint16(j.X), uint16(j.Y)}] = true
+		}
+		j.seq = seq
+		seq++
+		select {
+		case <-ctx.Done():
+			break readLoop
+		case jobChan <- j:
+			g.metrics.Read()
+		}
+		if g.limit > 0 && seq >= g.limit {
+			slog.Info("limit reached, stopping", "jobs", seq)
+			break
+		}
 	}
 	close(jobChan)
 	wg.Wait()
+	if g.oneWriter {
+		close(writeChan)
+		<-writerDone
+	}
+
+	if complete && zoomErr == nil && seen != nil && zoom >= 0 {
+		if err := g.eraseGone(zoom, seen); err != nil {
+			slog.Error("failed to erase the base tiles gone from the archive", "err", err)
+			complete = false
+		}
+	}
+
+	if g.progress != nil {
+		g.progress.stop()
+		if err := g.progress.save(complete && zoomErr == nil); err != nil {
+			slog.Error("failed to save progress", "err", err)
+		}
+	}
+	if zoomErr != nil {
+		return zoomErr
+	}
+	return ctx.Err()
 }
 
-func NewIngester(tileDB TileDB, workers int, force bool) Ingester {
+// eraseGone writes an erasure diff, see img.DiffErasures, for the base tiles of level z missing from the archive,
+// seen holding the tiles read. A tile missing from a diff is unchanged, so a region gone from the archive
+// would otherwise be served from the base. With a bbox, only the base tiles inside are erased.
+func (g *Ingester) eraseGone(z int, seen map[[2]uint16]bool) error {
+	tiles, err := g.baseDB.ListTiles(z)
+	if err != nil {
+		return err
+	}
+	erased := 0
+	for _, t := range tiles {
+		x, y := int(t[0]), int(t[1])
+		if seen[t] || (g.bbox != nil && !g.bbox.Contains(x, y)) {
+			continue
+		}
+		baseData, err := g.baseDB.GetTile(z, x, y)
+		if err != nil {
+			return err
+		}
+		base, err := img.DecodePaletted(baseData)
+		if err != nil {
+			return fmt.Errorf("failed to decode base tile %d/%d/%d: %w", z, x, y, err)
+		}
+		diff, changes, err := img.DiffPaletted(base, img.NewEmptyPaletted(base.Bounds().Dx()), img.DiffErasures)
+		if err != nil {
+			return fmt.Errorf("failed to diff base tile %d/%d/%d: %w", z, x, y, err)
+		}
+		if !changes {
+			// Already transparent
+			continue
+		}
+		data, err := img.EncodeDiff(diff, g.sparseMax, g.level)
+		if err != nil {
+			return err
+		}
+		if err := g.db.PutTileAutoCRC(z, x, y, data); err != nil {
+			return err
+		}
+		erased++
+	}
+	slog.Info("erased the base tiles gone from the archive", "tiles", erased)
+	return nil
+}
+
+func NewIngester(tileDB TileStore, workers int, force bool) Ingester {
 	m := metrics{}
 	p := img.NewPaletter()
 	g := Ingester{
@@ -189,17 +707,36 @@ func NewIngester(tileDB TileDB, workers int, force bool) Ingester {
 		metrics:  &m,
 		paletter: p,
 		useDiff:  false,
+		stats:    newStatCache(tileDB),
+		failures: &failures{},
+		tileSize: &atomic.Int64{},
 	}
+	g.SetTileSize(img.TileSize)
 	return g
 }
 
-func NewDiffIngester(tileDB TileDB, workers int, force bool, baseDb TileDB) Ingester {
+func NewDiffIngester(tileDB TileStore, workers int, force bool, baseDb TileStore) Ingester {
 	g := NewIngester(tileDB, workers, force)
 	g.useDiff = true
 	g.baseDB = baseDb
+	g.baseStats = newStatCache(baseDb)
 	return g
 }
 
+// resume fast-forwards the reader to position, as returned by Seeker.Position,
+// or else as a count of jobs read
+func resume(reader Reader, position int) error {
+	if seeker, ok := reader.(Seeker); ok {
+		return seeker.Seek(position)
+	}
+	for range position {
+		if _, ok, err := reader.ReadNextGood(); !ok {
+			return fmt.Errorf("input ends before entry %d: %v", position, err)
+		}
+	}
+	return nil
+}
+
 func isDir(path string) bool {
 	fileInfo, err := os.Stat(path)
 	if err != nil {
@@ -211,41 +748,362 @@ func isDir(path string) bool {
 	return false
 }
 
-func Ingest(in, out, base string, workers int) error {
-	tileDB, err := NewTileDB(out, false)
+// Snapshot returns the current ingest counters
+func (g *Ingester) Snapshot() MetricsSnapshot {
+	return g.metrics.Snapshot()
+}
+
+// SetMetricsJSON prints metrics as JSON lines instead of a human readable line
+func (g *Ingester) SetMetricsJSON(jsonOut bool) {
+	g.metrics.jsonOut = jsonOut
+}
+
+// SetFit pads or crops tiles of unexpected size to the tile size, instead of failing them
+func (g *Ingester) SetFit(fit bool) {
+	g.fit = fit
+}
+
+// SetTileSize sets the width and height of the tiles, img.TileSize by default.
+// 0 detects it from the first tile prepared, or uses img.TileSize with SetFit, as a tile of any size is fitted.
+func (g *Ingester) SetTileSize(size int) {
+	g.tileSize.Store(int64(size))
+}
+
+// TileSize returns the width and height of the tiles, 0 if still to be detected
+func (g *Ingester) TileSize() int {
+	return int(g.tileSize.Load())
+}
+
+// expectedSize returns the tile size, detected from size, the size of a decoded tile, when unknown.
+// A single tile wins the detection, the tiles prepared concurrently are checked against it.
+func (g *Ingester) expectedSize(size image.Point) int {
+	if expected := g.tileSize.Load(); expected > 0 {
+		return int(expected)
+	}
+	detected := int64(size.X)
+	if g.fit || size.X != size.Y {
+		detected = img.TileSize
+	}
+	g.tileSize.CompareAndSwap(0, detected)
+	return int(g.tileSize.Load())
+}
+
+// SetCompressionLevel sets the PNG compression level of the packed and diff tiles, see img.ParseCompressionLevel
+func (g *Ingester) SetCompressionLevel(level png.CompressionLevel) {
+	g.paletter = g.paletter.WithCompressionLevel(level)
+	g.level = level
+}
+
+// SetDiffEncoding sets the encoding of the diff tiles, see img.DiffEncoding
+func (g *Ingester) SetDiffEncoding(encoding img.DiffEncoding) {
+	g.diffEnc = encoding
+}
+
+// SetSparseMaxRuns stores the diff tiles of up to maxRuns runs of changed pixels sparse, 0 stores them as PNG.
+// See img.EncodeDiff.
+func (g *Ingester) SetSparseMaxRuns(maxRuns int) {
+	g.sparseMax = maxRuns
+}
+
+// SetSkipEmpty doesn't store the fully transparent tiles, the merger reads a missing tile as empty.
+// With a base, a transparent tile over a base tile is still stored, it erases the base tile.
+func (g *Ingester) SetSkipEmpty(skip bool) {
+	g.skipEmpty = skip
+}
+
+// SetCompactPalette encodes the tiles with the palette reduced to their colors, see img.CompactPalette.
+// Set after SetPaletter.
+func (g *Ingester) SetCompactPalette(compact bool) {
+	g.paletter = g.paletter.WithCompactPalette(compact)
+}
+
+// SetLimit stops reading after n jobs, 0 reads all. For quick test runs on a part of a large archive:
+// the archive isn't checkpointed complete, so a run with IngestOptions.Resume continues after the jobs read.
+func (g *Ingester) SetLimit(n int) {
+	g.limit = int64(n)
+}
+
+// SetBBox only ingests the tiles in b, the others are skipped before decoding. nil ingests all.
+// The levels merged from a partial DB are partial too.
+func (g *Ingester) SetBBox(b *BBox) {
+	g.bbox = b
+}
+
+// SetPaletter replaces the paletter used to pack tiles
+func (g *Ingester) SetPaletter(p img.Paletter) {
+	g.paletter = p
+}
+
+// IngestOptions tunes Ingest
+type IngestOptions struct {
+	Workers          int                  // Workers preparing and writing the tiles, 0 picks from the CPUs, see Workers
+	Optimize         bool                 // Vacuum the DB after ingest, see TileDB.Optimize
+	MaxColorDistance float64              // Map unknown colors to the nearest palette color within this RGB distance, 0 for strict
+	Resume           bool                 // Continue from the checkpoint of a previous ingest of the same archive
+	Fit              bool                 // Pad or crop tiles to img.TileSize instead of failing them
+	MetricsJSON      bool                 // Print metrics as JSON lines, see MetricsSnapshot
+	FailuresPath     string               // Write the failed tiles as JSON lines of Failure to this file, if not empty
+	CompressionLevel png.CompressionLevel // PNG compression level of the tiles, see img.ParseCompressionLevel
+	DiffEncoding     img.DiffEncoding     // Encoding of the diff tiles, with a base, see img.DiffEncoding
+	SparseMaxRuns    int                  // Store the diff tiles of up to this many runs of changed pixels sparse, see img.EncodeDiff
+	FolderChunkSize  int                  // List the directories of a folder input this many entries at a time, see ReaderFolder.SetChunkSize
+	SkipEmpty        bool                 // Don't store the fully transparent tiles, see Ingester.SetSkipEmpty
+	Scheme           TileScheme           // Scheme of the input tile coordinates, TMS rows are flipped to the stored XYZ
+	Dedup            bool                 // Create the out DB with the content-addressed schema, see TileDBOptions.Dedup
+	Meta             map[string]string    // Recorded in the meta table of the out DB once ingested, like MetaRelease
+	CompactPalette   bool                 // Encode the tiles with the palette reduced to their colors, without base, see img.CompactPalette
+	Limit            int                  // Stop after reading this many tiles, 0 reads all, see Ingester.SetLimit
+	BBox             *BBox                // Only ingest the tiles in this range, nil for all, see Ingester.SetBBox
+	SingleWriter     bool                 // Write the tiles from a single goroutine, the workers only preparing them, see Ingester.SetSingleWriter
+	CrcManifest      string               // Check the tiles of a folder input against this CRC manifest, see ReadCrcManifest
+}
+
+// releaseTime returns the capture time of the archive in, from meta as set by the import plan,
+// else from the archive file name, see releases.ParseReleaseTime. found is false when unknown.
+func releaseTime(in string, meta map[string]string) (t time.Time, found bool, err error) {
+	if value, ok := meta[MetaReleaseTime]; ok {
+		t, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			return t, false, fmt.Errorf("invalid release time %q: %w", value, err)
+		}
+		return t, true, nil
+	}
+	t, err = releases.ParseReleaseTime(filepath.Base(in))
+	if err != nil {
+		return t, false, nil
+	}
+	return t, true, nil
+}
+
+// checkReleaseOrder refuses an archive captured before the release of the base DB, its diff would go backwards.
+// Bases without a recorded release time, ingested before it was, can't be checked.
+func checkReleaseOrder(baseDB TileDB, base, in string, release time.Time, releaseFound bool) error {
+	value, found, err := baseDB.GetMeta(MetaReleaseTime)
+	if err != nil {
+		return err
+	}
+	if !found {
+		slog.Warn("base has no release time, can't check the archive is newer", "base", base)
+		return nil
+	}
+	baseRelease, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return fmt.Errorf("invalid release time %q of base %s: %w", value, base, err)
+	}
+	if !releaseFound {
+		slog.Warn("archive has no release time, can't check it is newer than the base", "source", in, "base_release", value)
+		return nil
+	}
+	if release.Before(baseRelease) {
+		return fmt.Errorf("archive %s, released %s, predates base %s, released %s: the diff would go backwards",
+			in, release.UTC().Format(time.RFC3339), base, value)
+	}
+	return nil
+}
+
+// Ingest reads the archive in into the DB out, as a diff of base if not empty.
+//
+// Progress is checkpointed in the DB every few seconds and at the end, keyed by the archive file name.
+// A checkpoint is only moved past a tile once it and all the tiles read before are written,
+// so resuming never misses a tile, but may process again the tiles written after the last checkpoint.
+// A failed write keeps the checkpoint behind the tile, and the archive is not checkpointed complete.
+// With opts.Resume, an archive fully ingested is skipped, and a partial one continues from its checkpoint.
+// The 7z, zip and tar readers seek to the checkpoint, other readers read again the entries before it.
+func Ingest(ctx context.Context, in, out, base string, opts IngestOptions) error {
+	opts.Workers = Workers(opts.Workers)
+	tileDB, err := NewTileDBWithOptions(out, TileDBOptions{Dedup: opts.Dedup})
 	if err != nil {
 		return fmt.Errorf("failed to create tile database %s: %w", out, err)
 	}
 	defer tileDB.DB.Close()
 
 	var reader Reader
-	if strings.HasSuffix(in, ".7z") {
-		reader = &Reader7z{}
+	if strings.HasSuffix(in, ".7z") || strings.HasSuffix(in, ".7z.001") {
+		// The first volume of a split 7z opens the whole volume set
+		reader = &Reader7z{workers: opts.Workers}
+	} else if strings.HasSuffix(in, ".zip") {
+		reader = &ReaderZip{}
 	} else if isDir(in) {
-		reader = &ReaderFolder{}
+		folder := &ReaderFolder{chunk: opts.FolderChunkSize}
+		if opts.CrcManifest != "" {
+			manifest, err := ReadCrcManifest(opts.CrcManifest)
+			if err != nil {
+				return err
+			}
+			slog.Info("checking tiles against CRC manifest", "manifest", opts.CrcManifest, "tiles", len(manifest))
+			folder.SetManifest(manifest)
+		}
+		reader = folder
 	} else if strings.HasSuffix(in, ".tar.gz") || strings.HasSuffix(in, ".tgz") {
 		reader = &ReaderTarGz{}
+	} else if strings.HasSuffix(in, ".tar.zst") {
+		reader = &ReaderTarZst{}
 	} else if strings.HasSuffix(in, ".db") {
 		reader = &ReaderSqlite{}
 	} else {
 		return fmt.Errorf("unsupported input format: %s", in)
 	}
+	if _, isFolder := reader.(*ReaderFolder); opts.CrcManifest != "" && !isFolder {
+		return fmt.Errorf("a CRC manifest can only check a folder input, not %s", in)
+	}
 	if err := reader.Open(in); err != nil {
 		return fmt.Errorf("failed to open input %s: %w", in, err)
 	}
 	defer reader.Close()
+	slog.Info("ingesting", "source", in, "workers", opts.Workers)
 
+	// The tile size of the DB, else of its base, else detected from the first tile and recorded
+	tileSize, sizeFound, err := tileDB.TileSize()
+	if err != nil {
+		return err
+	}
+	release, releaseFound, err := releaseTime(in, opts.Meta)
+	if err != nil {
+		return err
+	}
+	var ingester Ingester
 	if base != "" {
+		// Diffs are computed on the indexes of the full palette
+		if opts.CompactPalette {
+			return fmt.Errorf("compact palettes can't be used with a base")
+		}
 		baseDB, err := NewTileDB(base, true)
 		if err != nil {
 			return fmt.Errorf("failed to open base tile database %s: %w", base, err)
 		}
 		defer baseDB.DB.Close()
-		ingester := NewDiffIngester(tileDB, workers, false, baseDB)
-		ingester.Ingest(reader.ReadNextGood)
+		if compact, err := baseDB.CompactPalette(); err != nil {
+			return err
+		} else if compact {
+			return fmt.Errorf("base %s has tiles of compact palettes, it can't be the base of a diff", base)
+		}
+		baseSize, baseFound, err := baseDB.TileSize()
+		if err != nil {
+			return err
+		}
+		if err := checkReleaseOrder(baseDB, base, in, release, releaseFound); err != nil {
+			return err
+		}
+		if sizeFound && baseFound && baseSize != tileSize {
+			return fmt.Errorf("tiles of %s are %d pixels, but %d in base %s", out, tileSize, baseSize, base)
+		}
+		if !sizeFound && baseFound {
+			tileSize = baseSize
+			if err := tileDB.SetTileSize(tileSize); err != nil {
+				return err
+			}
+			sizeFound = true
+		}
+		ingester = NewDiffIngester(&tileDB, opts.Workers, false, &baseDB)
 	} else {
-		ingester := NewIngester(tileDB, workers, false)
-		ingester.Ingest(reader.ReadNextGood)
+		ingester = NewIngester(&tileDB, opts.Workers, false)
+	}
+	ingester.SetTileSize(tileSize)
+	ingester.SetBatchSize(defaultBatchSize)
+	ingester.SetSingleWriter(opts.SingleWriter)
+	ingester.SetFit(opts.Fit)
+	ingester.SetMetricsJSON(opts.MetricsJSON)
+	if opts.MaxColorDistance > 0 {
+		ingester.SetPaletter(img.NewNearestPaletter(opts.MaxColorDistance))
+	}
+	ingester.SetCompressionLevel(opts.CompressionLevel)
+	ingester.SetCompactPalette(opts.CompactPalette)
+	if opts.CompactPalette {
+		// Recorded first, an interrupted ingest has some compact tiles too
+		if err := tileDB.SetMeta(MetaPalette, PaletteCompact); err != nil {
+			return err
+		}
+	}
+	ingester.SetDiffEncoding(opts.DiffEncoding)
+	ingester.SetSparseMaxRuns(opts.SparseMaxRuns)
+	ingester.SetSkipEmpty(opts.SkipEmpty)
+	ingester.SetLimit(opts.Limit)
+	ingester.SetBBox(opts.BBox)
+
+	source := filepath.Base(in)
+	position := 0
+	if opts.Resume {
+		saved, complete, found, err := tileDB.GetProgress(source)
+		if err != nil {
+			return err
+		}
+		if complete {
+			slog.Info("already ingested, skipping", "source", source)
+			return nil
+		}
+		if found && saved > 0 {
+			slog.Info("resuming", "source", source, "entry", saved)
+			if err := resume(reader, saved); err != nil {
+				return fmt.Errorf("failed to resume %s: %w", in, err)
+			}
+			position = saved
+		}
+	}
+	ingester.progress = newCheckpoint(tileDB, source, position)
+
+	// Tag jobs with the reader position, for checkpoints
+	seeker, seekable := reader.(Seeker)
+	read := func() (Job, bool, error) {
+		j, ok, err := reader.ReadNextGood()
+		if ok && err == nil {
+			position++
+		}
+		if seekable {
+			j.position = seeker.Position()
+		} else {
+			j.position = position
+		}
+		if ok && err == nil && opts.Scheme == SchemeTMS {
+			if j.Y < 0 || j.Y >= 1<<j.Z {
+				return j, ok, fmt.Errorf("tile %d/%d/%d: y out of level %d, can't flip it", j.Z, j.X, j.Y, j.Z)
+			}
+			j.Y = FlipY(j.Z, j.Y)
+		}
+		return j, ok, err
+	}
+	err = ingester.Ingest(ctx, read)
+	if size := ingester.TileSize(); !sizeFound && size > 0 {
+		if serr := tileDB.SetTileSize(size); serr != nil && err == nil {
+			err = serr
+		}
+	}
+	if unknown := ingester.paletter.UnknownColors(); unknown > 0 {
+		slog.Warn("unknown colors", "pixels", unknown)
+	}
+	if opts.FailuresPath != "" {
+		// Written even when interrupted, the failures so far can be retried
+		if ferr := writeFailures(opts.FailuresPath, ingester.Failures()); ferr != nil && err == nil {
+			err = ferr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// Provenance of the DB, see meta.go
+	meta := map[string]string{
+		MetaSource:     source,
+		MetaIngestedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	if releaseFound {
+		// Checked by the ingest of the next diff, see checkReleaseOrder
+		meta[MetaReleaseTime] = release.UTC().Format(time.RFC3339)
+	}
+	maps.Copy(meta, opts.Meta)
+	for key, value := range meta {
+		if err := tileDB.SetMeta(key, value); err != nil {
+			return err
+		}
+	}
+	if err := tileDB.RecordTileCounts(); err != nil {
+		return err
+	}
+
+	if opts.Optimize {
+		slog.Info("optimizing database", "db", out)
+		if err := tileDB.Optimize(); err != nil {
+			return fmt.Errorf("failed to optimize tile database %s: %w", out, err)
+		}
 	}
 	return nil
 }
@@ -0,0 +1,648 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Hugi-R/wplace-archive-world-map/img"
+)
+
+func TestIngestCancel(t *testing.T) {
+	tileDB, err := NewTileDB(path.Join(t.TempDir(), "tiles.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tileDB.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reads := 0
+	// Endless reader, cancelling after a few jobs
+	read := func() (Job, bool, error) {
+		reads++
+		if reads == 10 {
+			cancel()
+		}
+		return Job{Z: 11, X: reads, Y: 0, Data: []byte("invalid")}, true, nil
+	}
+
+	ingester := NewIngester(&tileDB, 2, false)
+	done := make(chan error)
+	go func() {
+		done <- ingester.Ingest(ctx, read)
+	}()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ingest did not return after cancellation")
+	}
+	if reads > 20 {
+		t.Fatalf("expected reading to stop after cancellation, got %d reads", reads)
+	}
+}
+
+func TestIngestMixedZoom(t *testing.T) {
+	tileDB, err := NewTileDB(path.Join(t.TempDir(), "tiles.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tileDB.Close()
+
+	jobs := []Job{{Z: 11, X: 1}, {Z: 11, X: 2}, {Z: 10, X: 3}}
+	read := func() (Job, bool, error) {
+		if len(jobs) == 0 {
+			return Job{}, false, nil
+		}
+		j := jobs[0]
+		jobs = jobs[1:]
+		return j, true, nil
+	}
+
+	ingester := NewIngester(&tileDB, 2, false)
+	if err := ingester.Ingest(context.Background(), read); err == nil {
+		t.Fatal("expected an error for mixed zoom levels")
+	}
+}
+
+func TestIngestTileSize(t *testing.T) {
+	small, err := img.EncodePng(img.EmptyImagePaletted(500))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readOne := func() func() (Job, bool, error) {
+		done := false
+		return func() (Job, bool, error) {
+			if done {
+				return Job{}, false, nil
+			}
+			done = true
+			return Job{Z: 11, X: 1, Y: 2, Data: small}, true, nil
+		}
+	}
+
+	t.Run("Reject", func(t *testing.T) {
+		tileDB, err := NewTileDB(path.Join(t.TempDir(), "tiles.db"), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tileDB.Close()
+		ingester := NewIngester(&tileDB, 1, false)
+		if err := ingester.Ingest(context.Background(), readOne()); err != nil {
+			t.Fatal(err)
+		}
+		if s := ingester.Snapshot(); s.Fail != 1 || s.Read != 1 || s.Done != 1 {
+			t.Fatalf("expected 1 read and failed job, got %+v", s)
+		}
+		if exists, _, _ := tileDB.StatTile(11, 1, 2); exists {
+			t.Fatal("rejected tile was stored")
+		}
+	})
+
+	t.Run("Fit", func(t *testing.T) {
+		tileDB, err := NewTileDB(path.Join(t.TempDir(), "tiles.db"), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tileDB.Close()
+		ingester := NewIngester(&tileDB, 1, false)
+		ingester.SetFit(true)
+		if err := ingester.Ingest(context.Background(), readOne()); err != nil {
+			t.Fatal(err)
+		}
+		data, err := tileDB.GetTile(11, 1, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tile, err := img.DecodeImage(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := tile.Bounds().Size(); size.X != img.TileSize || size.Y != img.TileSize {
+			t.Fatalf("expected a %d square tile, got %v", img.TileSize, size)
+		}
+	})
+}
+
+func TestIngestFailures(t *testing.T) {
+	tile, err := img.EncodePng(img.EmptyImagePaletted(img.TileSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, batch := range []int{1, defaultBatchSize} {
+		tileDB, err := NewTileDB(path.Join(t.TempDir(), "tiles.db"), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jobs := []Job{{Z: 11, X: 1, Data: tile}, {Z: 11, X: 2, Data: []byte("invalid")}, {Z: 11, X: 3, Data: tile}}
+		read := func() (Job, bool, error) {
+			if len(jobs) == 0 {
+				return Job{}, false, nil
+			}
+			j := jobs[0]
+			jobs = jobs[1:]
+			return j, true, nil
+		}
+		ingester := NewIngester(&tileDB, 2, false)
+		ingester.SetBatchSize(batch)
+		if err := ingester.Ingest(context.Background(), read); err != nil {
+			t.Fatal(err)
+		}
+		tileDB.Close()
+		failures := ingester.Failures()
+		if len(failures) != 1 || failures[0].X != 2 || failures[0].Error == "" {
+			t.Fatalf("expected the invalid tile to fail with batch %d, got %+v", batch, failures)
+		}
+	}
+}
+
+func TestWriteFailures(t *testing.T) {
+	failuresPath := path.Join(t.TempDir(), "failures.jsonl")
+	list := []Failure{{Z: 11, X: 1, Y: 2, Crc32: 3, Error: "bad png"}, {Z: 11, X: 4, Y: 5, Error: "write failed"}}
+	if err := writeFailures(failuresPath, list); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(failuresPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", data)
+	}
+	var f Failure
+	if err := json.Unmarshal([]byte(lines[0]), &f); err != nil {
+		t.Fatal(err)
+	}
+	if f != list[0] {
+		t.Fatalf("expected %+v, got %+v", list[0], f)
+	}
+}
+
+func TestIngestSkipEmpty(t *testing.T) {
+	empty, err := img.EncodePng(img.EmptyImagePaletted(img.TileSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	painted := img.EmptyImagePaletted(img.TileSize).(*image.Paletted)
+	painted.Pix[0] = 5
+	tile, err := img.EncodePng(painted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ingest := func(ingester Ingester, jobs []Job) {
+		t.Helper()
+		read := func() (Job, bool, error) {
+			if len(jobs) == 0 {
+				return Job{}, false, nil
+			}
+			j := jobs[0]
+			jobs = jobs[1:]
+			return j, true, nil
+		}
+		if err := ingester.Ingest(context.Background(), read); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := t.TempDir()
+	baseDB, err := NewTileDB(path.Join(dir, "base.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer baseDB.Close()
+	ingester := NewIngester(&baseDB, 2, false)
+	ingester.SetSkipEmpty(true)
+	ingest(ingester, []Job{{Z: 11, X: 1, Data: empty, Crc32: 1}, {Z: 11, X: 2, Data: tile, Crc32: 2}})
+	if _, err := baseDB.GetTile(11, 1, 0); err == nil {
+		t.Fatal("expected the transparent tile to be skipped")
+	}
+	if _, err := baseDB.GetTile(11, 2, 0); err != nil {
+		t.Fatalf("expected the painted tile to be stored: %v", err)
+	}
+	if s := ingester.metrics.Snapshot(); s.Empty != 1 || s.Skip != 1 {
+		t.Fatalf("expected 1 empty skipped tile, got %+v", s)
+	}
+
+	// Over a base tile, a transparent tile erases it
+	diffDB, err := NewTileDB(path.Join(dir, "diff.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer diffDB.Close()
+	ingester = NewDiffIngester(&diffDB, 2, false, &baseDB)
+	ingester.SetSkipEmpty(true)
+	ingester.SetDiffEncoding(img.DiffErasures)
+	ingest(ingester, []Job{{Z: 11, X: 2, Data: empty, Crc32: 3}, {Z: 11, X: 3, Data: empty, Crc32: 4}})
+	if _, err := diffDB.GetTile(11, 2, 0); err != nil {
+		t.Fatalf("expected the erasure to be stored: %v", err)
+	}
+	if _, err := diffDB.GetTile(11, 3, 0); err == nil {
+		t.Fatal("expected the transparent tile without base to be skipped")
+	}
+}
+
+func TestIngestEraseGone(t *testing.T) {
+	painted := img.EmptyImagePaletted(img.TileSize).(*image.Paletted)
+	painted.Pix[0] = 5
+	tile, err := img.EncodePng(painted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ingest := func(ingester Ingester, jobs []Job) {
+		t.Helper()
+		read := func() (Job, bool, error) {
+			if len(jobs) == 0 {
+				return Job{}, false, nil
+			}
+			j := jobs[0]
+			jobs = jobs[1:]
+			return j, true, nil
+		}
+		if err := ingester.Ingest(context.Background(), read); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := t.TempDir()
+	baseDB, err := NewTileDB(path.Join(dir, "base.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer baseDB.Close()
+	ingest(NewIngester(&baseDB, 2, false), []Job{{Z: 11, X: 1, Data: tile, Crc32: 1}, {Z: 11, X: 2, Data: tile, Crc32: 2}})
+
+	// The tile 1 of the base is gone from the new archive
+	for _, encoding := range []img.DiffEncoding{img.DiffTransparent, img.DiffErasures} {
+		diffDB, err := NewTileDB(path.Join(t.TempDir(), "diff.db"), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ingester := NewDiffIngester(&diffDB, 2, false, &baseDB)
+		ingester.SetDiffEncoding(encoding)
+		ingest(ingester, []Job{{Z: 11, X: 2, Data: tile, Crc32: 2}})
+		data, err := diffDB.GetTile(11, 1, 0)
+		diffDB.Close()
+		if encoding == img.DiffTransparent {
+			if err == nil {
+				t.Fatal("expected no erasure without the erasures encoding")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("expected the gone tile erased: %v", err)
+		}
+		diff, err := img.DecodePaletted(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		undiffed, err := img.UnDiffPaletted(painted, diff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !img.IsAllTransparent(undiffed) {
+			t.Fatal("expected the gone tile reconstructed transparent")
+		}
+	}
+}
+
+func TestIngestDiffCompression(t *testing.T) {
+	base, err := img.EncodePng(img.EmptyImagePaletted(img.TileSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	painted := img.EmptyImagePaletted(img.TileSize).(*image.Paletted)
+	for i := range painted.Pix {
+		painted.Pix[i] = uint8(1 + i%7)
+	}
+	tile, err := img.EncodePng(painted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	baseDB, err := NewTileDB(path.Join(dir, "base.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer baseDB.Close()
+	if err := baseDB.PutTileAutoCRC(11, 0, 0, base); err != nil {
+		t.Fatal(err)
+	}
+
+	// diffSize ingests the painted tile as a diff at the level, and returns the size of the diff tile
+	diffSize := func(level png.CompressionLevel) int {
+		diffDB, err := NewTileDB(path.Join(t.TempDir(), "diff.db"), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer diffDB.Close()
+		ingester := NewDiffIngester(&diffDB, 1, false, &baseDB)
+		ingester.SetCompressionLevel(level)
+		done := false
+		read := func() (Job, bool, error) {
+			if done {
+				return Job{}, false, nil
+			}
+			done = true
+			return Job{Z: 11, Data: tile}, true, nil
+		}
+		if err := ingester.Ingest(context.Background(), read); err != nil {
+			t.Fatal(err)
+		}
+		data, err := diffDB.GetTile(11, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(data)
+	}
+	if none, best := diffSize(png.NoCompression), diffSize(png.BestCompression); none <= best {
+		t.Fatalf("expected the diff tile compressed at the level, got %d bytes uncompressed, %d at best", none, best)
+	}
+}
+
+func TestIngestDetectTileSize(t *testing.T) {
+	dir := t.TempDir()
+	small, err := img.EncodePng(img.EmptyImagePaletted(500))
+	if err != nil {
+		t.Fatal(err)
+	}
+	large, err := img.EncodePng(img.EmptyImagePaletted(img.TileSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := path.Join(dir, "first.tar.gz")
+	writeTarGzT(first, map[string][]byte{"tiles/0/0.png": small, "tiles/1/0.png": small}, t)
+	second := path.Join(dir, "second.tar.gz")
+	writeTarGzT(second, map[string][]byte{"tiles/2/0.png": large}, t)
+	out := path.Join(dir, "out.db")
+
+	// The size of the first tile is recorded, then the tiles of another size are failed
+	for _, archive := range []string{first, second} {
+		if err := Ingest(context.Background(), archive, out, "", IngestOptions{Workers: 2}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tileDB, err := NewTileDB(out, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tileDB.Close()
+	size, found, err := tileDB.TileSize()
+	if err != nil || !found || size != 500 {
+		t.Fatalf("expected a recorded tile size of 500, got %d, %v, %v", size, found, err)
+	}
+	tiles, err := tileDB.ListTiles(11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tiles) != 2 {
+		t.Fatalf("expected the 2 tiles of 500 pixels, got %v", tiles)
+	}
+	if scheme, err := tileDB.Scheme(); err != nil || scheme != SchemeXYZ {
+		t.Fatalf("expected the xyz scheme, got %v, %v", scheme, err)
+	}
+	// The provenance of the last ingest
+	if source, _, err := tileDB.GetMeta(MetaSource); err != nil || source != "second.tar.gz" {
+		t.Fatalf("expected the last archive as source, got %q, %v", source, err)
+	}
+	if count, _, err := tileDB.GetMeta(MetaTiles(11)); err != nil || count != "2" {
+		t.Fatalf("expected 2 tiles recorded at level 11, got %q, %v", count, err)
+	}
+}
+
+func TestIngestCompactPalette(t *testing.T) {
+	dir := t.TempDir()
+	painted := img.EmptyImagePaletted(img.TileSize).(*image.Paletted)
+	painted.Pix[0] = 5
+	tile, err := img.EncodePng(painted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := path.Join(dir, "tiles.tar.gz")
+	writeTarGzT(archive, map[string][]byte{"tiles/0/0.png": tile}, t)
+	out := path.Join(dir, "out.db")
+	if err := Ingest(context.Background(), archive, out, "", IngestOptions{Workers: 2, CompactPalette: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	tileDB, err := NewTileDB(out, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tileDB.Close()
+	if compact, err := tileDB.CompactPalette(); err != nil || !compact {
+		t.Fatalf("expected the DB recorded compact, got %v, %v", compact, err)
+	}
+	data, err := tileDB.GetTile(11, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := img.DecodePaletted(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.Palette) != 2 || stored.Pix[0] != 1 {
+		t.Fatalf("expected a tile of 2 colors, got %d colors", len(stored.Palette))
+	}
+
+	// Diffs need the full palette, on both sides
+	if err := Ingest(context.Background(), archive, path.Join(dir, "diff.db"), out, IngestOptions{Workers: 2}); err == nil {
+		t.Fatal("expected an error with a compact base")
+	}
+	if err := Ingest(context.Background(), archive, path.Join(dir, "other.db"), out, IngestOptions{Workers: 2, CompactPalette: true}); err == nil {
+		t.Fatal("expected an error with a base")
+	}
+}
+
+func TestIngestReleaseOrder(t *testing.T) {
+	dir := t.TempDir()
+	tile, err := img.EncodePng(img.EmptyImagePaletted(img.TileSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := func(name string) string {
+		p := path.Join(dir, name)
+		writeTarGzT(p, map[string][]byte{"tiles/0/0.png": tile}, t)
+		return p
+	}
+	older := archive("full_2025-11-01T11-47-58Z.tar.gz")
+	newer := archive("full_2025-11-02T11-47-58Z.tar.gz")
+
+	// The release time is taken from the file name, and recorded
+	base := path.Join(dir, "base.db")
+	if err := Ingest(context.Background(), newer, base, "", IngestOptions{Workers: 2}); err != nil {
+		t.Fatal(err)
+	}
+	baseDB, err := NewTileDB(base, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, found, err := baseDB.GetMeta(MetaReleaseTime)
+	baseDB.Close()
+	if err != nil || !found || value != "2025-11-02T11:47:58Z" {
+		t.Fatalf("expected the release time recorded, got %q, %v, %v", value, found, err)
+	}
+
+	err = Ingest(context.Background(), older, path.Join(dir, "backwards.db"), base, IngestOptions{Workers: 2})
+	if err == nil || !strings.Contains(err.Error(), "predates base") {
+		t.Fatalf("expected an error for an archive older than the base, got %v", err)
+	}
+	// The release time set by the import plan wins over the file name
+	err = Ingest(context.Background(), older, path.Join(dir, "planned.db"), base, IngestOptions{
+		Workers: 2,
+		Meta:    map[string]string{MetaReleaseTime: "2025-11-03T00:00:00Z"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Unknown release times can't be checked
+	if err := Ingest(context.Background(), archive("tiles.tar.gz"), path.Join(dir, "unknown.db"), base, IngestOptions{Workers: 2}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIngestBBox(t *testing.T) {
+	dir := t.TempDir()
+	tile, err := img.EncodePng(img.EmptyImagePaletted(img.TileSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := path.Join(dir, "tiles.tar.gz")
+	writeTarGzT(archive, map[string][]byte{
+		"tiles/1/1.png": tile,
+		"tiles/2/1.png": tile,
+		"tiles/1/3.png": tile,
+		"tiles/9/9.png": tile,
+	}, t)
+	out := path.Join(dir, "out.db")
+	if err := Ingest(context.Background(), archive, out, "", IngestOptions{Workers: 2, BBox: &BBox{MinX: 1, MinY: 1, MaxX: 2, MaxY: 2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tileDB, err := NewTileDB(out, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tileDB.Close()
+	tiles, err := tileDB.ListTiles(11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tiles) != 2 {
+		t.Fatalf("expected the 2 tiles in the bbox, got %v", tiles)
+	}
+	for _, tl := range tiles {
+		if tl[1] != 1 {
+			t.Fatalf("expected only tiles of row 1, got %v", tiles)
+		}
+	}
+}
+
+// paintedTilesT returns n distinct PNG tiles, tile i with its pixel i painted
+func paintedTilesT(n int, tb testing.TB) [][]byte {
+	tiles := make([][]byte, n)
+	for i := range tiles {
+		tile := img.NewEmptyPaletted(img.TileSize)
+		tile.Pix[i] = 5
+		data, err := img.EncodePng(tile)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		tiles[i] = data
+	}
+	return tiles
+}
+
+// ingestTiles ingests the tiles in rows of 10 at z=11, returning the metrics
+func ingestTiles(ingester Ingester, tiles [][]byte, tb testing.TB) MetricsSnapshot {
+	i := 0
+	read := func() (Job, bool, error) {
+		if i == len(tiles) {
+			return Job{}, false, nil
+		}
+		j := Job{Z: 11, X: i % 10, Y: i / 10, Data: tiles[i], Crc32: crc32.ChecksumIEEE(tiles[i])}
+		i++
+		return j, true, nil
+	}
+	if err := ingester.Ingest(context.Background(), read); err != nil {
+		tb.Fatal(err)
+	}
+	return ingester.Snapshot()
+}
+
+func TestIngestSingleWriter(t *testing.T) {
+	const n = 45
+	tiles := paintedTilesT(n, t)
+	tileDB, err := NewTileDB(path.Join(t.TempDir(), "tiles.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tileDB.Close()
+	ingester := NewIngester(&tileDB, 4, false)
+	// Not a divisor of n, the last batch is partial
+	ingester.SetBatchSize(7)
+	ingester.SetSingleWriter(true)
+	if s := ingestTiles(ingester, tiles, t); s.Success != n || s.Done != n {
+		t.Fatalf("expected %d tiles written, got %+v", n, s)
+	}
+	list, err := tileDB.ListTiles(11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != n {
+		t.Fatalf("expected %d tiles stored, got %d", n, len(list))
+	}
+	data, err := tileDB.GetTile(11, 2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tile, err := img.DecodePaletted(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tile.Pix[42] != 5 {
+		t.Fatal("expected tile 42 to have its pixel painted")
+	}
+}
+
+// Tiles per second of an ingest with a worker per CPU, each worker writing its batches versus a single writer.
+// The gap grows with the CPUs, as the workers contend for the DB lock.
+func BenchmarkIngestWriters(b *testing.B) {
+	const n = 400
+	tiles := paintedTilesT(n, b)
+	for _, single := range []bool{false, true} {
+		name := "Workers"
+		if single {
+			name = "SingleWriter"
+		}
+		b.Run(name, func(b *testing.B) {
+			for b.Loop() {
+				b.StopTimer()
+				tileDB, err := NewTileDB(path.Join(b.TempDir(), "tiles.db"), false)
+				if err != nil {
+					b.Fatal(err)
+				}
+				ingester := NewIngester(&tileDB, runtime.NumCPU(), false)
+				ingester.SetBatchSize(defaultBatchSize / 10)
+				ingester.SetSingleWriter(single)
+				b.StartTimer()
+				if s := ingestTiles(ingester, tiles, b); s.Success != n {
+					b.Fatalf("expected %d tiles written, got %+v", n, s)
+				}
+				tileDB.Close()
+			}
+			b.ReportMetric(float64(n*b.N)/b.Elapsed().Seconds(), "tiles/s")
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Hugi-R/wplace-archive-world-map/img"
+)
+
+// LayeredTileDB is a base DB holding its diffs as layers, instead of a DB per diff.
+//
+// The tiles table holds the base tiles, as a TileDB. Each layer is a diff from the base, like a diff DB,
+// its tiles in the tiles_diff table and its release time in the layers table.
+// A tile missing from a layer is unchanged from the base.
+type LayeredTileDB struct {
+	TileDB
+}
+
+// layeredZ is the level of the layers, the level of the ingested tiles. The lower levels are only in the base.
+const layeredZ = defaultZoom
+
+// Layer is a diff layer of a LayeredTileDB
+type Layer struct {
+	Version  string    // Processed version of the diff, like v1.024
+	Datetime time.Time // Release time of the diff, orders the layers
+}
+
+// NewLayeredTileDB opens the layered DB at dbPath, a base DB.
+// Opened for write, the layer tables are created if missing; read-only, they must exist.
+func NewLayeredTileDB(dbPath string, readOnly bool) (*LayeredTileDB, error) {
+	tileDB, err := NewTileDB(dbPath, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	l := &LayeredTileDB{TileDB: tileDB}
+	if readOnly {
+		var count int
+		err = tileDB.DB.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name IN ('layers', 'tiles_diff')`).Scan(&count)
+		if err == nil && count != 2 {
+			err = fmt.Errorf("%s is not a layered database", dbPath)
+		}
+	} else {
+		_, err = tileDB.DB.Exec(`CREATE TABLE IF NOT EXISTS layers (version TEXT PRIMARY KEY, datetime INTEGER NOT NULL);
+			CREATE TABLE IF NOT EXISTS tiles_diff (version TEXT NOT NULL, z INTEGER NOT NULL, x INTEGER NOT NULL, y INTEGER NOT NULL, data BLOB,
+				PRIMARY KEY (z, x, y, version));`)
+	}
+	if err != nil {
+		tileDB.Close()
+		return nil, fmt.Errorf("failed to initialize layers of %s: %w", dbPath, err)
+	}
+	return l, nil
+}
+
+// Layers lists the layers, oldest first
+func (l *LayeredTileDB) Layers() ([]Layer, error) {
+	rows, err := l.DB.Query(`SELECT version, datetime FROM layers ORDER BY datetime`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list layers: %w", err)
+	}
+	defer rows.Close()
+	var layers []Layer
+	for rows.Next() {
+		var layer Layer
+		var unix int64
+		if err := rows.Scan(&layer.Version, &unix); err != nil {
+			return nil, fmt.Errorf("failed to list layers: %w", err)
+		}
+		layer.Datetime = time.Unix(unix, 0).UTC()
+		layers = append(layers, layer)
+	}
+	return layers, rows.Err()
+}
+
+// AppendLayer copies the tiles of the diff DB at diffPath as a new layer, at the layered level only.
+// The diff must be made from the base tiles of this DB, like ingest with it as base.
+func (l *LayeredTileDB) AppendLayer(layer Layer, diffPath string) error {
+	if l.readOnly {
+		return fmt.Errorf("database is read-only")
+	}
+	diffDB, err := NewTileDB(diffPath, true)
+	if err != nil {
+		return fmt.Errorf("failed to open diff database %s: %w", diffPath, err)
+	}
+	defer diffDB.Close()
+
+	tx, err := l.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`INSERT INTO layers (version, datetime) VALUES (?, ?)`, layer.Version, layer.Datetime.Unix()); err != nil {
+		return fmt.Errorf("failed to add layer %s: %w", layer.Version, err)
+	}
+	insert, err := tx.Prepare(`INSERT INTO tiles_diff (version, z, x, y, data) VALUES (?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+	tiles := 0
+	err = diffDB.IterateTiles(layeredZ, func(x, y int, data []byte) error {
+		if _, err := insert.Exec(layer.Version, layeredZ, x, y, data); err != nil {
+			return fmt.Errorf("failed to write tile %d/%d/%d of layer %s: %w", layeredZ, x, y, layer.Version, err)
+		}
+		tiles++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	slog.Info("appended layer", "version", layer.Version, "datetime", layer.Datetime.Format(time.RFC3339), "tiles", tiles)
+	return nil
+}
+
+// GetTileAsOf returns the tile as of datetime, as PNG: the tile of the newest layer released
+// at or before datetime, applied on the base tile, else the base tile.
+// Layers are diffs from the base, so only that layer is read, older layers are superseded by it.
+// A missing tile is sql.ErrNoRows. Only the layered level is read, the lower levels have no layer.
+func (l *LayeredTileDB) GetTileAsOf(z, x, y int, datetime time.Time) ([]byte, error) {
+	if z != layeredZ {
+		return nil, fmt.Errorf("level %d is not layered, only level %d is", z, layeredZ)
+	}
+	// Walk the layers newest-first to the first at or before datetime
+	var version string
+	err := l.DB.QueryRow(`SELECT version FROM layers WHERE datetime <= ? ORDER BY datetime DESC LIMIT 1`, datetime.Unix()).Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return l.getBaseTile(z, x, y)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the layer as of %s: %w", datetime.Format(time.RFC3339), err)
+	}
+
+	var diffData []byte
+	err = l.DB.QueryRow(`SELECT data FROM tiles_diff WHERE z = ? AND x = ? AND y = ? AND version = ?`, z, x, y, version).Scan(&diffData)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Unchanged from the base
+		return l.getBaseTile(z, x, y)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tile (%d, %d, %d) of layer %s: %w", z, x, y, version, err)
+	}
+	baseData, err := l.getBaseTile(z, x, y)
+	if errors.Is(err, sql.ErrNoRows) {
+		// New tile, the diff is the full tile
+		return diffData, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	baseImg, err := img.DecodePaletted(baseData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode base tile (%d, %d, %d): %w", z, x, y, err)
+	}
+	diffImg, err := img.DecodePaletted(diffData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode tile (%d, %d, %d) of layer %s: %w", z, x, y, version, err)
+	}
+	undiff, err := img.UnDiffPaletted(baseImg, diffImg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to undiff tile (%d, %d, %d) of layer %s: %w", z, x, y, version, err)
+	}
+	return img.EncodePng(undiff)
+}
+
+// getBaseTile is GetTile returning sql.ErrNoRows unwrapped for a missing tile
+func (l *LayeredTileDB) getBaseTile(z, x, y int) ([]byte, error) {
+	data, err := l.GetTile(z, x, y)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, sql.ErrNoRows
+	}
+	return data, err
+}
+
+// IngestLayer ingests the archive in as a diff from the base tiles of the layered DB at layered,
+// then appends it as the layer. The diff is ingested in a temporary DB next to layered, removed once appended.
+// Like Ingest, only the tiles of the archive are ingested, the lower levels of the layer are left to the base.
+// opts.Limit is refused, a partial layer would be appended as complete.
+func IngestLayer(ctx context.Context, in, layered string, layer Layer, opts IngestOptions) error {
+	if opts.Limit > 0 {
+		return fmt.Errorf("a layer can't be ingested with a limit, it must hold the whole archive")
+	}
+	l, err := NewLayeredTileDB(layered, false)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	var exists bool
+	if err := l.DB.QueryRow(`SELECT EXISTS (SELECT 1 FROM layers WHERE version = ?)`, layer.Version).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to read layers: %w", err)
+	}
+	if exists {
+		return fmt.Errorf("layer %s already exists in %s", layer.Version, layered)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(layered), "layer-*.db")
+	if err != nil {
+		return fmt.Errorf("failed to create the layer database: %w", err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	// The caller's map is left as is
+	opts.Meta = maps.Clone(opts.Meta)
+	if opts.Meta == nil {
+		opts.Meta = map[string]string{}
+	}
+	if _, found := opts.Meta[MetaReleaseTime]; !found {
+		opts.Meta[MetaReleaseTime] = layer.Datetime.UTC().Format(time.RFC3339)
+	}
+	if err := Ingest(ctx, in, tmp.Name(), layered, opts); err != nil {
+		return err
+	}
+	return l.AppendLayer(layer, tmp.Name())
+}
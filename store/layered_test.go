@@ -0,0 +1,128 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"image"
+	"path"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Hugi-R/wplace-archive-world-map/img"
+)
+
+func TestLayeredTileDB(t *testing.T) {
+	dir := t.TempDir()
+	// paint returns a tile with the pixels at the indexes set to color 5
+	paint := func(pixels ...int) []byte {
+		tile := img.EmptyImagePaletted(img.TileSize).(*image.Paletted)
+		for _, p := range pixels {
+			tile.Pix[p] = 5
+		}
+		data, err := img.EncodePng(tile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	archive := func(name string, files map[string][]byte) string {
+		p := path.Join(dir, name)
+		writeTarGzT(p, files, t)
+		return p
+	}
+
+	layered := path.Join(dir, "v1_2025-01-08T00.db")
+	base := archive("base.tar.gz", map[string][]byte{"tiles/0/0.png": paint(0)})
+	if err := Ingest(context.Background(), base, layered, "", IngestOptions{Workers: 2}); err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Date(2025, 1, 8, 0, 0, 0, 0, time.UTC)
+	t1, t2 := t0.Add(24*time.Hour), t0.Add(48*time.Hour)
+	// The first layer changes a pixel, the second reverts it and adds a tile
+	layers := []struct {
+		layer Layer
+		files map[string][]byte
+	}{
+		{Layer{Version: "v1.024", Datetime: t1}, map[string][]byte{"tiles/0/0.png": paint(0, 1)}},
+		{Layer{Version: "v1.048", Datetime: t2}, map[string][]byte{"tiles/0/0.png": paint(0), "tiles/1/0.png": paint(2)}},
+	}
+	for _, l := range layers {
+		in := archive(l.layer.Version+".tar.gz", l.files)
+		if err := IngestLayer(context.Background(), in, layered, l.layer, IngestOptions{Workers: 2}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := NewLayeredTileDB(layered, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	list, err := db.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Version != "v1.024" || !list[1].Datetime.Equal(t2) {
+		t.Fatalf("expected the 2 layers in order, got %+v", list)
+	}
+
+	// painted returns the pixels of color 5 among the first 3 of the tile as of the time
+	painted := func(x int, asOf time.Time) []int {
+		data, err := db.GetTileAsOf(11, x, 0, asOf)
+		if err != nil {
+			t.Fatalf("tile %d as of %v: %v", x, asOf, err)
+		}
+		tile, err := img.DecodePaletted(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var pixels []int
+		for p := range 3 {
+			if tile.Pix[p] == 5 {
+				pixels = append(pixels, p)
+			}
+		}
+		return pixels
+	}
+	tests := []struct {
+		asOf     time.Time
+		expected []int
+	}{
+		{t0, []int{0}},
+		{t1, []int{0, 1}},
+		{t1.Add(time.Hour), []int{0, 1}},
+		// Reverted to the base, the newest layer wins over the older one
+		{t2, []int{0}},
+	}
+	for _, tt := range tests {
+		if pixels := painted(0, tt.asOf); !slices.Equal(pixels, tt.expected) {
+			t.Fatalf("expected pixels %v as of %v, got %v", tt.expected, tt.asOf, pixels)
+		}
+	}
+
+	// The new tile only exists from its layer
+	if _, err := db.GetTileAsOf(11, 1, 0, t1); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected no tile before its layer, got %v", err)
+	}
+	if pixels := painted(1, t2); len(pixels) != 1 || pixels[0] != 2 {
+		t.Fatalf("expected the new tile of the second layer, got %v", pixels)
+	}
+
+	// Only the ingested level is layered
+	if _, err := db.GetTileAsOf(10, 0, 0, t2); err == nil {
+		t.Fatal("expected an error below the layered level")
+	}
+
+	// A partial layer is refused
+	if err := IngestLayer(context.Background(), archive("partial.tar.gz", layers[0].files), layered, Layer{Version: "v1.072", Datetime: t2}, IngestOptions{Workers: 2, Limit: 1}); err == nil {
+		t.Fatal("expected an error ingesting a layer with a limit")
+	}
+
+	// A version is a single layer
+	in := archive("again.tar.gz", layers[0].files)
+	if err := IngestLayer(context.Background(), in, layered, layers[0].layer, IngestOptions{Workers: 2}); err == nil {
+		t.Fatal("expected an error appending a layer twice")
+	}
+}
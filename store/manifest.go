@@ -0,0 +1,64 @@
+package store
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrCrcMismatch fails a tile whose CRC differs from the one of the CRC manifest, see ReadCrcManifest
+var ErrCrcMismatch = errors.New("CRC mismatch")
+
+// CrcManifest is the expected CRC of the tiles, by z, x, y
+type CrcManifest map[[3]int]uint32
+
+// ReadCrcManifest reads a manifest of the CRC32 of the tiles, as SFV lines of a tile path and its CRC in hexadecimal:
+//
+//	tiles/12/34.png 1a2b3c4d
+//
+// Lines starting with ; are comments. Tile paths are parsed like the archive entries, see parseTilePath.
+func ReadCrcManifest(path string) (CrcManifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open CRC manifest: %w", err)
+	}
+	defer f.Close()
+	manifest := make(CrcManifest)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, ";") {
+			continue
+		}
+		// Paths may hold spaces, the CRC is the last field
+		i := strings.LastIndexAny(text, " \t")
+		if i == -1 {
+			return nil, fmt.Errorf("invalid CRC manifest line %d: %q", line, text)
+		}
+		crc, err := strconv.ParseUint(text[i+1:], 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CRC manifest line %d: %w", line, err)
+		}
+		z, x, y, err := parseTilePath(strings.TrimSpace(text[:i]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid CRC manifest line %d: %w", line, err)
+		}
+		manifest[[3]int{z, x, y}] = uint32(crc)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read CRC manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+// check returns ErrCrcMismatch when the manifest has another CRC for the tile. Tiles it doesn't list pass.
+func (m CrcManifest) check(z, x, y int, crc uint32) error {
+	expected, found := m[[3]int{z, x, y}]
+	if !found || expected == crc {
+		return nil
+	}
+	return fmt.Errorf("%w: tile %d/%d/%d has CRC %08x, the manifest %08x", ErrCrcMismatch, z, x, y, crc, expected)
+}
@@ -0,0 +1,190 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/Hugi-R/wplace-archive-world-map/img"
+)
+
+// Keys of the meta table, see GetMeta
+const (
+	MetaTileSize    = "tile_size"    // Width and height of the tiles in pixels, set by the first ingest
+	MetaScheme      = "scheme"       // Scheme of the stored tile rows, always xyz, see TileScheme
+	MetaSource      = "source"       // File name of the last archive ingested
+	MetaIngestedAt  = "ingested_at"  // End of the last ingest, RFC 3339
+	MetaRelease     = "release"      // Path of the source release, set by the import plan, see IngestOptions.Meta
+	MetaReleaseTime = "release_time" // Capture time of the source release, RFC 3339, which identifies it
+	MetaVersion     = "version"      // Processed version of the DB, see releases.ProcessedVersion
+	MetaPalette     = "palette"      // PaletteCompact when tiles are encoded with img.CompactPalette
+)
+
+// PaletteCompact is the MetaPalette of a DB with tiles of compact palettes, which can't be the base of a diff
+const PaletteCompact = "compact"
+
+// MetaTiles is the key of the count of tiles of level z, see RecordTileCounts
+func MetaTiles(z int) string {
+	return fmt.Sprintf("tiles_z%d", z)
+}
+
+// hasMeta tells whether db has a meta table, the DBs created before it don't
+func hasMeta(db *sql.DB) (bool, error) {
+	var tables int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'meta'`).Scan(&tables); err != nil {
+		return false, fmt.Errorf("failed to read meta: %w", err)
+	}
+	return tables > 0, nil
+}
+
+// readMeta returns the value of key in the meta table of db.
+// found is false when missing, or when db has no meta table, as the DBs created before it.
+func readMeta(db *sql.DB, key string) (value string, found bool, err error) {
+	if exists, err := hasMeta(db); err != nil || !exists {
+		return "", false, err
+	}
+	if err := db.QueryRow(`SELECT value FROM meta WHERE key = ?`, key).Scan(&value); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("failed to read meta %s: %w", key, err)
+	}
+	return value, true, nil
+}
+
+// ReadMeta returns the whole meta table of db, empty for a DB without it, for readers outside TileDB
+func ReadMeta(db *sql.DB) (map[string]string, error) {
+	meta := make(map[string]string)
+	if exists, err := hasMeta(db); err != nil || !exists {
+		return meta, err
+	}
+	rows, err := db.Query(`SELECT key, value FROM meta`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read meta: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, fmt.Errorf("failed to read meta: %w", err)
+		}
+		meta[key] = value
+	}
+	return meta, rows.Err()
+}
+
+// GetMeta returns the value of key in the meta table, found is false if missing
+func (db *TileDB) GetMeta(key string) (value string, found bool, err error) {
+	return readMeta(db.DB, key)
+}
+
+// SetMeta sets the value of key in the meta table
+func (db *TileDB) SetMeta(key, value string) error {
+	if db.readOnly {
+		return fmt.Errorf("database is read-only")
+	}
+	_, err := db.DB.Exec(`INSERT INTO meta (key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value=excluded.value`, key, value)
+	if err != nil {
+		return fmt.Errorf("failed to write meta %s: %w", key, err)
+	}
+	return nil
+}
+
+// TileSize returns the width and height of the tiles of the DB, found is false before the first ingest
+func (db *TileDB) TileSize() (size int, found bool, err error) {
+	return readTileSize(db.DB)
+}
+
+func readTileSize(db *sql.DB) (size int, found bool, err error) {
+	value, found, err := readMeta(db, MetaTileSize)
+	if err != nil || !found {
+		return 0, false, err
+	}
+	size, err = strconv.Atoi(value)
+	if err != nil || size <= 0 {
+		return 0, false, fmt.Errorf("invalid tile size %q in meta", value)
+	}
+	return size, true, nil
+}
+
+// SetTileSize records the width and height of the tiles of the DB
+func (db *TileDB) SetTileSize(size int) error {
+	if size <= 0 {
+		return fmt.Errorf("invalid tile size %d", size)
+	}
+	return db.SetMeta(MetaTileSize, strconv.Itoa(size))
+}
+
+// CompactPalette tells whether tiles of the DB are encoded with img.CompactPalette, see MetaPalette
+func (db *TileDB) CompactPalette() (bool, error) {
+	value, _, err := readMeta(db.DB, MetaPalette)
+	return value == PaletteCompact, err
+}
+
+// Scheme returns the scheme of the stored tile rows. The DBs are always XYZ, TMS archives are flipped at ingest.
+func (db *TileDB) Scheme() (TileScheme, error) {
+	value, _, err := readMeta(db.DB, MetaScheme)
+	if err != nil {
+		return SchemeXYZ, err
+	}
+	return ParseTileScheme(value)
+}
+
+// ReadTileSize returns the tile size recorded in the meta table of db, see TileDB.TileSize,
+// or img.TileSize for a DB without it, for readers outside TileDB
+func ReadTileSize(db *sql.DB) (int, error) {
+	size, found, err := readTileSize(db)
+	if err == nil && !found {
+		return img.TileSize, nil
+	}
+	return size, err
+}
+
+// CountTiles counts the tiles of every level, levels without tiles are absent
+func (db *TileDB) CountTiles() (map[int]int, error) {
+	rows, err := db.DB.Query(`SELECT z, COUNT(*) FROM tiles GROUP BY z`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count tiles: %w", err)
+	}
+	defer rows.Close()
+	counts := make(map[int]int)
+	for rows.Next() {
+		var z, count int
+		if err := rows.Scan(&z, &count); err != nil {
+			return nil, fmt.Errorf("failed to count tiles: %w", err)
+		}
+		counts[z] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to count tiles: %w", err)
+	}
+	return counts, nil
+}
+
+// RecordTileCounts records the count of tiles of every level in the meta table, see MetaTiles.
+// The counts of the levels without tiles are removed.
+func (db *TileDB) RecordTileCounts() error {
+	if db.readOnly {
+		return fmt.Errorf("database is read-only")
+	}
+	counts, err := db.CountTiles()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM meta WHERE key LIKE 'tiles\_z%' ESCAPE '\'`); err != nil {
+		return fmt.Errorf("failed to record tile counts: %w", err)
+	}
+	for z, count := range counts {
+		if _, err := tx.Exec(`INSERT INTO meta (key, value) VALUES (?, ?)`, MetaTiles(z), strconv.Itoa(count)); err != nil {
+			return fmt.Errorf("failed to record tile counts: %w", err)
+		}
+	}
+	return tx.Commit()
+}
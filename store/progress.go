@@ -0,0 +1,100 @@
+package store
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Seeker is implemented by readers able to fast-forward without reading the entries before.
+// Position is an entry index in the archive, after the last entry read.
+type Seeker interface {
+	Position() int
+	Seek(position int) error
+}
+
+// checkpoint tracks the jobs finished, in read order, to record how far ingest can be resumed from.
+// Workers finish jobs out of order, so the checkpoint is the position of the last job
+// such that all jobs read before are finished.
+type checkpoint struct {
+	db       TileDB
+	source   string
+	mu       sync.Mutex
+	next     int64         // Sequence of the next job to finish for the checkpoint to move
+	finished map[int64]int // Jobs finished after a pending one, sequence -> position
+	position int
+	failed   bool // A write failed, see fail
+	ticker   *time.Ticker
+	quit     chan struct{}
+	stopped  chan struct{}
+}
+
+func newCheckpoint(db TileDB, source string, position int) *checkpoint {
+	return &checkpoint{
+		db:       db,
+		source:   source,
+		finished: make(map[int64]int),
+		position: position,
+	}
+}
+
+// done marks the job finished: written, skipped or failed before its write
+func (c *checkpoint) done(j Job) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.finished[j.seq] = j.position
+	for {
+		position, ok := c.finished[c.next]
+		if !ok {
+			break
+		}
+		delete(c.finished, c.next)
+		c.next++
+		c.position = position
+	}
+}
+
+// fail marks the job not written, the checkpoint never moves past it
+func (c *checkpoint) fail(Job) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failed = true
+}
+
+// save records the checkpoint in the DB, never complete once a write failed
+func (c *checkpoint) save(complete bool) error {
+	c.mu.Lock()
+	position := c.position
+	complete = complete && !c.failed
+	c.mu.Unlock()
+	return c.db.SetProgress(c.source, position, complete)
+}
+
+// start saves the checkpoint periodically, until stop is called
+func (c *checkpoint) start() {
+	const saveRate = 5
+
+	c.ticker = time.NewTicker(saveRate * time.Second)
+	c.quit = make(chan struct{})
+	c.stopped = make(chan struct{})
+	go func() {
+		defer close(c.stopped)
+		for {
+			select {
+			case <-c.quit:
+				return
+			case <-c.ticker.C:
+				if err := c.save(false); err != nil {
+					slog.Error("failed to save progress", "err", err)
+				}
+			}
+		}
+	}()
+}
+
+// stop waits for an ongoing save, so a final save cannot be overwritten
+func (c *checkpoint) stop() {
+	c.ticker.Stop()
+	close(c.quit)
+	<-c.stopped
+}
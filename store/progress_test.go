@@ -0,0 +1,167 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"testing"
+
+	"github.com/Hugi-R/wplace-archive-world-map/img"
+)
+
+func TestCheckpointOrder(t *testing.T) {
+	c := newCheckpoint(TileDB{}, "archive", 0)
+	c.done(Job{seq: 1, position: 20})
+	c.done(Job{seq: 2, position: 30})
+	if c.position != 0 {
+		t.Fatalf("checkpoint moved past the pending job 0, at %d", c.position)
+	}
+	c.done(Job{seq: 0, position: 10})
+	if c.position != 30 {
+		t.Fatalf("expected checkpoint at 30, got %d", c.position)
+	}
+	c.done(Job{seq: 4, position: 50})
+	if c.position != 30 {
+		t.Fatalf("checkpoint moved past the pending job 3, at %d", c.position)
+	}
+}
+
+// failingStore is a TileDB whose writes fail
+type failingStore struct {
+	*TileDB
+}
+
+func (s failingStore) PutTile(z, x, y int, data []byte, crc32 uint32) error {
+	return fmt.Errorf("disk full")
+}
+
+func (s failingStore) PutTileBatch(tiles []Job) error {
+	return fmt.Errorf("disk full")
+}
+
+func TestCheckpointWriteFailed(t *testing.T) {
+	tile, err := img.EncodePng(img.EmptyImagePaletted(img.TileSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		batch  int
+		single bool
+	}{{1, false}, {defaultBatchSize, false}, {defaultBatchSize, true}} {
+		tileDB, err := NewTileDB(path.Join(t.TempDir(), "tiles.db"), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seq := 0
+		read := func() (Job, bool, error) {
+			if seq == 3 {
+				return Job{}, false, nil
+			}
+			seq++
+			return Job{Z: 11, X: seq, Data: tile, position: seq}, true, nil
+		}
+		ingester := NewIngester(failingStore{&tileDB}, 2, false)
+		ingester.SetBatchSize(c.batch)
+		ingester.SetSingleWriter(c.single)
+		ingester.progress = newCheckpoint(tileDB, "archive", 0)
+		if err := ingester.Ingest(context.Background(), read); err != nil {
+			t.Fatal(err)
+		}
+		position, complete, _, err := tileDB.GetProgress("archive")
+		tileDB.Close()
+		if err != nil || position != 0 || complete {
+			t.Fatalf("expected the checkpoint left at 0 incomplete with %+v, got %d complete %v, %v", c, position, complete, err)
+		}
+		if failures := ingester.Failures(); len(failures) != 3 {
+			t.Fatalf("expected 3 failures with %+v, got %+v", c, failures)
+		}
+	}
+}
+
+func TestIngestResume(t *testing.T) {
+	dir := t.TempDir()
+	archive := path.Join(dir, "archive.tar.gz")
+	tile := img.EmptyImage(img.TileSize)
+	files := make(map[string][]byte)
+	for i := range 5 {
+		files[fmt.Sprintf("tiles/%d/0.png", i)] = tile
+	}
+	writeTarGzT(archive, files, t)
+	out := path.Join(dir, "out.db")
+
+	// A previous ingest stopped after 3 entries
+	tileDB, err := NewTileDB(out, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tileDB.SetProgress("archive.tar.gz", 3, false); err != nil {
+		t.Fatal(err)
+	}
+	tileDB.Close()
+
+	if err := Ingest(context.Background(), archive, out, "", IngestOptions{Workers: 2, Resume: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	tileDB, err = NewTileDB(out, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tileDB.Close()
+	tiles, err := tileDB.ListTiles(11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tiles) != 2 {
+		t.Fatalf("expected the 2 tiles after the checkpoint, got %v", tiles)
+	}
+	position, complete, found, err := tileDB.GetProgress("archive.tar.gz")
+	if err != nil || !found {
+		t.Fatalf("expected progress, found %v err %v", found, err)
+	}
+	if position != 5 || !complete {
+		t.Fatalf("expected complete at 5, got %d complete %v", position, complete)
+	}
+}
+
+func TestIngestLimit(t *testing.T) {
+	dir := t.TempDir()
+	archive := path.Join(dir, "archive.tar.gz")
+	tile := img.EmptyImage(img.TileSize)
+	files := make(map[string][]byte)
+	for i := range 5 {
+		files[fmt.Sprintf("tiles/%d/0.png", i)] = tile
+	}
+	writeTarGzT(archive, files, t)
+	out := path.Join(dir, "out.db")
+
+	check := func(tiles, position int, complete bool) {
+		t.Helper()
+		tileDB, err := NewTileDB(out, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tileDB.Close()
+		list, err := tileDB.ListTiles(11)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != tiles {
+			t.Fatalf("expected %d tiles, got %v", tiles, list)
+		}
+		saved, done, _, err := tileDB.GetProgress("archive.tar.gz")
+		if err != nil || saved != position || done != complete {
+			t.Fatalf("expected progress %d complete %v, got %d complete %v, %v", position, complete, saved, done, err)
+		}
+	}
+
+	if err := Ingest(context.Background(), archive, out, "", IngestOptions{Workers: 2, Limit: 2}); err != nil {
+		t.Fatal(err)
+	}
+	check(2, 2, false)
+	// A limited run is continued with resume
+	if err := Ingest(context.Background(), archive, out, "", IngestOptions{Workers: 2, Resume: true}); err != nil {
+		t.Fatal(err)
+	}
+	check(5, 5, true)
+}
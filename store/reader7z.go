@@ -2,17 +2,42 @@ package store
 
 import (
 	"fmt"
+	"hash/crc32"
 	"io"
-	"strconv"
-	"strings"
+	"sort"
+	"sync"
 
 	"github.com/bodgit/sevenzip"
 )
 
+// Reader7z reads the tiles of a 7z archive.
+//
+// A solid 7z archive compresses its files in folders, each a single stream that can only be decoded in order,
+// so a folder is decoded by a single goroutine, and up to workers folders are decoded concurrently.
+// Tiles of different folders are returned interleaved.
 type Reader7z struct {
 	z          *sevenzip.ReadCloser
 	state      int
 	totalFiles int
+	workers    int      // Folders decoded concurrently, see SetWorkers
+	segments   [][2]int // Ranges of files of a single folder, in file order
+	read       *read7z  // Running concurrent decode, started by ReadOne
+}
+
+// read7z is a concurrent decode of the segments, from a position
+type read7z struct {
+	results chan result7z
+	quit    chan struct{}
+	wg      sync.WaitGroup
+	next    []int // Next file returned of each segment
+	current int   // First segment not fully returned
+}
+
+// result7z is a decoded file
+type result7z struct {
+	index int
+	job   Job
+	err   error
 }
 
 func readJob(file *sevenzip.File) (Job, error) {
@@ -21,28 +46,25 @@ func readJob(file *sevenzip.File) (Job, error) {
 		return Job{}, err
 	}
 	defer rc.Close()
-	pathParts := strings.Split(file.Name, "/")
-	size := len(pathParts)
-	if size < 2 {
-		return Job{}, fmt.Errorf("unexpected file path structure: %s", file.Name)
-	}
-	z := 11
-	x, err := strconv.Atoi(pathParts[size-2])
+	z, x, y, err := parseTilePath(file.Name)
 	if err != nil {
-		return Job{}, fmt.Errorf("failed to parse x coordinate from path: %w", err)
-	}
-	y, err := strconv.Atoi(strings.TrimSuffix(pathParts[size-1], ".png"))
-	if err != nil {
-		return Job{}, fmt.Errorf("failed to parse y coordinate from path: %w", err)
+		return Job{}, err
 	}
 
-	crc32 := file.CRC32
+	crc := file.CRC32
 	data, err := io.ReadAll(rc)
 	if err != nil {
 		return Job{}, fmt.Errorf("failed to read file %s: %w", file.Name, err)
 	}
+	data, gunzipped, err := gunzipEntry(file.Name, data)
+	if err != nil {
+		return Job{}, err
+	}
+	if gunzipped {
+		crc = crc32.ChecksumIEEE(data)
+	}
 
-	return Job{Z: z, X: x, Y: y, Data: data, Crc32: crc32}, nil
+	return Job{Z: z, X: x, Y: y, Data: data, Crc32: crc}, nil
 }
 
 func (rz *Reader7z) Open(archivePath string) error {
@@ -53,10 +75,36 @@ func (rz *Reader7z) Open(archivePath string) error {
 	rz.z = r
 	rz.state = 0
 	rz.totalFiles = len(r.File)
+	rz.segments = folderSegments(r.File)
 	return nil
 }
 
+// folderSegments splits the files in ranges of a single folder.
+// Empty files and directories have no folder, they go with the files before them.
+func folderSegments(files []*sevenzip.File) [][2]int {
+	var segments [][2]int
+	folder := -1
+	for i, f := range files {
+		empty := f.UncompressedSize == 0 || f.FileInfo().IsDir()
+		if len(segments) == 0 || (!empty && folder >= 0 && f.Stream != folder) {
+			segments = append(segments, [2]int{i, i + 1})
+		} else {
+			segments[len(segments)-1][1] = i + 1
+		}
+		if !empty {
+			folder = f.Stream
+		}
+	}
+	return segments
+}
+
+// SetWorkers sets the count of folders decoded concurrently, 1 decodes the files one by one on the caller
+func (rz *Reader7z) SetWorkers(workers int) {
+	rz.workers = workers
+}
+
 func (rz *Reader7z) Close() error {
+	rz.stop()
 	return rz.z.Close()
 }
 
@@ -64,19 +112,112 @@ func (rz *Reader7z) ReadOne() (Job, bool, error) {
 	if rz.state >= rz.totalFiles {
 		return Job{}, false, nil
 	}
-	f := rz.z.File[rz.state]
-	rz.state++
-	j, err := readJob(f)
-	return j, true, err
+	if rz.workers <= 1 {
+		f := rz.z.File[rz.state]
+		rz.state++
+		j, err := readJob(f)
+		return j, true, err
+	}
+
+	if rz.read == nil {
+		rz.start()
+	}
+	res, ok := <-rz.read.results
+	if !ok {
+		return Job{}, false, fmt.Errorf("7z decode stopped at file %d of %d", rz.state, rz.totalFiles)
+	}
+	rz.returned(res.index)
+	return res.job, true, res.err
+}
+
+// start decodes the files from rz.state, each segment in order, up to rz.workers segments at a time
+func (rz *Reader7z) start() {
+	read := &read7z{
+		results: make(chan result7z, 2*rz.workers),
+		quit:    make(chan struct{}),
+		next:    make([]int, len(rz.segments)),
+	}
+	// Segments to decode, with their first file
+	segments := make(chan [2]int, len(rz.segments))
+	for i, s := range rz.segments {
+		read.next[i] = min(max(s[0], rz.state), s[1])
+		if read.next[i] < s[1] {
+			segments <- [2]int{read.next[i], s[1]}
+		}
+	}
+	close(segments)
+	read.current = sort.Search(len(rz.segments), func(i int) bool { return read.next[i] < rz.segments[i][1] })
+
+	for range rz.workers {
+		read.wg.Add(1)
+		go func() {
+			defer read.wg.Done()
+			for s := range segments {
+				for i := s[0]; i < s[1]; i++ {
+					j, err := readJob(rz.z.File[i])
+					select {
+					case read.results <- result7z{index: i, job: j, err: err}:
+					case <-read.quit:
+						return
+					}
+				}
+			}
+		}()
+	}
+	go func() {
+		read.wg.Wait()
+		close(read.results)
+	}()
+	rz.read = read
+}
+
+// returned moves the position past the files of the segments fully returned.
+// Each segment returns its files in order, so the files before the position are all returned.
+func (rz *Reader7z) returned(index int) {
+	read := rz.read
+	s := sort.Search(len(rz.segments), func(i int) bool { return rz.segments[i][1] > index })
+	read.next[s] = index + 1
+	for read.current < len(rz.segments) && read.next[read.current] >= rz.segments[read.current][1] {
+		read.current++
+	}
+	if read.current < len(rz.segments) {
+		rz.state = read.next[read.current]
+	} else {
+		rz.state = rz.totalFiles
+	}
+}
+
+// stop ends the running decode, if any
+func (rz *Reader7z) stop() {
+	if rz.read == nil {
+		return
+	}
+	close(rz.read.quit)
+	rz.read.wg.Wait()
+	rz.read = nil
 }
 
 func (rz *Reader7z) ReadNextGood() (Job, bool, error) {
-	j, ok, err := rz.ReadOne()
-	if !ok {
-		return j, ok, err
+	for {
+		j, ok, err := rz.ReadOne()
+		if !ok || err == nil {
+			return j, ok, err
+		}
 	}
-	if err != nil {
-		return rz.ReadNextGood()
+}
+
+// Position returns the index of the next file, all the files before it are read.
+// With concurrent decode, some files after it may be read too.
+func (rz *Reader7z) Position() int {
+	return rz.state
+}
+
+// Seek moves to the file at index position
+func (rz *Reader7z) Seek(position int) error {
+	if position < 0 || position > rz.totalFiles {
+		return fmt.Errorf("position %d out of the %d files", position, rz.totalFiles)
 	}
-	return j, ok, err
+	rz.stop()
+	rz.state = position
+	return nil
 }
@@ -0,0 +1,297 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"os"
+	"path"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/Hugi-R/wplace-archive-world-map/img"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// write7zNumber writes a 7z number: the count of leading one bits of the first byte
+// is the count of extra little endian bytes, the first byte holds the high bits
+func write7zNumber(buf *bytes.Buffer, v uint64) {
+	var first byte
+	mask := byte(0x80)
+	n := 0
+	for ; n < 8; n++ {
+		if v < uint64(1)<<(7*(n+1)) {
+			first |= byte(v >> (8 * n))
+			break
+		}
+		first |= mask
+		mask >>= 1
+	}
+	buf.WriteByte(first)
+	for i := range n {
+		buf.WriteByte(byte(v >> (8 * i)))
+	}
+}
+
+// make7zT builds a 7z archive of non empty files, stored without compression in a single folder
+func make7zT(names []string, files [][]byte, t *testing.T) []byte {
+	t.Helper()
+	return make7z(names, files, 1, false, t)
+}
+
+// make7z builds a 7z archive of non empty files, split in folders of consecutive files,
+// each stored without compression, or LZMA compressed
+func make7z(names []string, files [][]byte, folders int, compress bool, t testing.TB) []byte {
+	t.Helper()
+	// Files of each folder
+	var groups [][][]byte
+	per := (len(files) + folders - 1) / folders
+	for i := 0; i < len(files); i += per {
+		groups = append(groups, files[i:min(i+per, len(files))])
+	}
+
+	var packed bytes.Buffer
+	var packSizes, unpackSizes []int
+	var props [][]byte
+	for _, group := range groups {
+		var unpacked bytes.Buffer
+		for _, data := range group {
+			if len(data) == 0 {
+				t.Fatal("empty files are not supported")
+			}
+			unpacked.Write(data)
+		}
+		unpackSizes = append(unpackSizes, unpacked.Len())
+		stream := unpacked.Bytes()
+		if compress {
+			var buf bytes.Buffer
+			w, err := lzma.WriterConfig{SizeInHeader: true, Size: int64(unpacked.Len())}.NewWriter(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write(stream)
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			// The .lzma header is the properties and the size, 7z keeps the properties in the coder
+			props = append(props, buf.Bytes()[:5])
+			stream = buf.Bytes()[13:]
+		}
+		packSizes = append(packSizes, len(stream))
+		packed.Write(stream)
+	}
+
+	var h bytes.Buffer
+	h.WriteByte(0x01) // Header
+	h.WriteByte(0x04) // MainStreamsInfo
+	h.WriteByte(0x06) // PackInfo
+	write7zNumber(&h, 0)
+	write7zNumber(&h, uint64(len(groups)))
+	h.WriteByte(0x09) // Size
+	for _, size := range packSizes {
+		write7zNumber(&h, uint64(size))
+	}
+	h.WriteByte(0x00)
+	h.WriteByte(0x07) // UnPackInfo
+	h.WriteByte(0x0B) // Folder
+	write7zNumber(&h, uint64(len(groups)))
+	h.WriteByte(0x00) // Not external
+	for i := range groups {
+		write7zNumber(&h, 1)
+		if compress {
+			h.WriteByte(0x23)                 // Simple coder with properties, 3 bytes ID
+			h.Write([]byte{0x03, 0x01, 0x01}) // LZMA
+			write7zNumber(&h, uint64(len(props[i])))
+			h.Write(props[i])
+		} else {
+			h.WriteByte(0x01) // Simple coder, 1 byte ID
+			h.WriteByte(0x00) // Copy
+		}
+	}
+	h.WriteByte(0x0C) // CodersUnPackSize
+	for _, size := range unpackSizes {
+		write7zNumber(&h, uint64(size))
+	}
+	h.WriteByte(0x00)
+	h.WriteByte(0x08) // SubStreamsInfo
+	h.WriteByte(0x0D) // NumUnPackStream
+	for _, group := range groups {
+		write7zNumber(&h, uint64(len(group)))
+	}
+	h.WriteByte(0x09) // Size, all but the last of each folder
+	for _, group := range groups {
+		for _, data := range group[:len(group)-1] {
+			write7zNumber(&h, uint64(len(data)))
+		}
+	}
+	h.WriteByte(0x0A) // CRC
+	h.WriteByte(0x01) // All defined
+	for _, data := range files {
+		binary.Write(&h, binary.LittleEndian, crc32.ChecksumIEEE(data))
+	}
+	h.WriteByte(0x00)
+	h.WriteByte(0x00)
+	h.WriteByte(0x05) // FilesInfo
+	write7zNumber(&h, uint64(len(files)))
+	var namesData bytes.Buffer
+	namesData.WriteByte(0x00) // Not external
+	for _, name := range names {
+		for _, c := range utf16.Encode([]rune(name)) {
+			binary.Write(&namesData, binary.LittleEndian, c)
+		}
+		binary.Write(&namesData, binary.LittleEndian, uint16(0))
+	}
+	h.WriteByte(0x11) // Name
+	write7zNumber(&h, uint64(namesData.Len()))
+	h.Write(namesData.Bytes())
+	h.WriteByte(0x00)
+	h.WriteByte(0x00)
+
+	var start bytes.Buffer
+	binary.Write(&start, binary.LittleEndian, uint64(packed.Len()))
+	binary.Write(&start, binary.LittleEndian, uint64(h.Len()))
+	binary.Write(&start, binary.LittleEndian, crc32.ChecksumIEEE(h.Bytes()))
+
+	var out bytes.Buffer
+	out.Write([]byte{'7', 'z', 0xBC, 0xAF, 0x27, 0x1C, 0x00, 0x04})
+	binary.Write(&out, binary.LittleEndian, crc32.ChecksumIEEE(start.Bytes()))
+	out.Write(start.Bytes())
+	out.Write(packed.Bytes())
+	out.Write(h.Bytes())
+	return out.Bytes()
+}
+
+func TestIngest7zVolumes(t *testing.T) {
+	tile, err := img.EncodePng(img.EmptyImagePaletted(img.TileSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	var files [][]byte
+	for i := range 4 {
+		names = append(names, fmt.Sprintf("tiles/%d/%d.png", i, i))
+		files = append(files, tile)
+	}
+	archive := make7zT(names, files, t)
+
+	// Split in two volumes, the second holding the last tiles and the header
+	dir := t.TempDir()
+	half := len(archive) / 2
+	if err := os.WriteFile(path.Join(dir, "archive.7z.001"), archive[:half], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(dir, "archive.7z.002"), archive[half:], 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := path.Join(dir, "tiles.db")
+	if err := Ingest(context.Background(), path.Join(dir, "archive.7z.001"), out, "", IngestOptions{Workers: 2}); err != nil {
+		t.Fatal(err)
+	}
+	tileDB, err := NewTileDB(out, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tileDB.Close()
+	stats, err := tileDB.StatTiles(11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != len(files) {
+		t.Fatalf("expected %d tiles across the volumes, got %d", len(files), len(stats))
+	}
+}
+
+// tiles7z writes a 7z archive of n distinct tiles, LZMA compressed in folders
+func tiles7z(n, folders int, t testing.TB) string {
+	t.Helper()
+	var names []string
+	var files [][]byte
+	for i := range n {
+		tile := img.EmptyImagePaletted(img.TileSize).(*image.Paletted)
+		for j := range tile.Pix[:1000*(i+1)] {
+			tile.Pix[j] = uint8(1 + j%7)
+		}
+		data, err := img.EncodePng(tile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, fmt.Sprintf("tiles/%d/%d.png", i, i))
+		files = append(files, data)
+	}
+	archive := path.Join(t.TempDir(), "archive.7z")
+	if err := os.WriteFile(archive, make7z(names, files, folders, true, t), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return archive
+}
+
+func TestReader7zConcurrent(t *testing.T) {
+	const n = 12
+	archive := tiles7z(n, 4, t)
+	reader := &Reader7z{}
+	reader.SetWorkers(3)
+	if err := reader.Open(archive); err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if len(reader.segments) != 4 {
+		t.Fatalf("expected 4 folders, got %v", reader.segments)
+	}
+
+	seen := make(map[int]bool)
+	for i := 0; ; i++ {
+		j, ok, err := reader.ReadNextGood()
+		if !ok {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[j.X] = true
+		if i == 5 {
+			// All the files before the position are read
+			for x := range reader.Position() {
+				if !seen[x] {
+					t.Fatalf("file %d before position %d not read", x, reader.Position())
+				}
+			}
+			// Resume from the position, as ingest does
+			position := reader.Position()
+			if err := reader.Seek(position); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if len(seen) != n {
+		t.Fatalf("expected %d tiles, got %d", n, len(seen))
+	}
+	if reader.Position() != n {
+		t.Fatalf("expected position %d at the end, got %d", n, reader.Position())
+	}
+}
+
+// BenchmarkReader7z reads a LZMA archive of 8 folders, decoding one or 8 folders at a time
+func BenchmarkReader7z(b *testing.B) {
+	archive := tiles7z(64, 8, b)
+	for _, workers := range []int{1, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for b.Loop() {
+				reader := &Reader7z{}
+				reader.SetWorkers(workers)
+				if err := reader.Open(archive); err != nil {
+					b.Fatal(err)
+				}
+				for _, ok, err := reader.ReadNextGood(); ok; _, ok, err = reader.ReadNextGood() {
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+				reader.Close()
+			}
+		})
+	}
+}
@@ -5,82 +5,141 @@ import (
 	"hash/crc32"
 	"io"
 	"os"
-	"strconv"
 	"strings"
 )
 
 type ReaderFolder struct {
 	folder      string
-	stack       [][]os.DirEntry
-	state       []int
+	chunk       int         // Directory entries listed at a time, 0 lists whole directories, see SetChunkSize
+	manifest    CrcManifest // Expected CRC of the tiles, nil checks none, see SetManifest
+	stack       []*dirReader
 	stackLevel  int
 	currentPath []string
 }
 
+// dirReader lists the entries of a directory, whole and sorted by name,
+// or chunk entries at a time in directory order
+type dirReader struct {
+	f       *os.File // Open until the directory is fully listed, when listed by chunks
+	entries []os.DirEntry
+	state   int
+}
+
+func openDirReader(path string, chunk int) (*dirReader, error) {
+	if chunk <= 0 {
+		items, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		return &dirReader{entries: items}, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &dirReader{f: f}, nil
+}
+
+// next returns the next entry of the directory, nil at its end
+func (d *dirReader) next(chunk int) (os.DirEntry, error) {
+	if d.state >= len(d.entries) && d.f != nil {
+		entries, err := d.f.ReadDir(chunk)
+		if len(entries) == 0 {
+			d.close()
+			if err == io.EOF {
+				err = nil
+			}
+			return nil, err
+		}
+		d.entries, d.state = entries, 0
+	}
+	if d.state >= len(d.entries) {
+		return nil, nil
+	}
+	entry := d.entries[d.state]
+	d.state++
+	return entry, nil
+}
+
+func (d *dirReader) close() {
+	if d.f != nil {
+		d.f.Close()
+		d.f = nil
+	}
+}
+
 func (rf *ReaderFolder) readJob(file os.DirEntry) (Job, error) {
 	if file.IsDir() {
 		return Job{}, fmt.Errorf("%s is dir", file.Name())
 	}
 	pathParts := append(rf.currentPath, file.Name())
 	fullPath := strings.Join(pathParts, "/")
-	size := len(pathParts)
-	if size < 2 {
-		return Job{}, fmt.Errorf("unexpected file path structure: %s", fullPath)
-	}
-	z := 11
-	x, err := strconv.Atoi(pathParts[size-2])
-	if err != nil {
-		return Job{}, fmt.Errorf("failed to parse x coordinate from path: %w", err)
-	}
-	y, err := strconv.Atoi(strings.TrimSuffix(pathParts[size-1], ".png"))
+	// Only the path inside the folder can hold the zoom
+	z, x, y, err := parseTilePath(strings.Join(pathParts[1:], "/"))
 	if err != nil {
-		return Job{}, fmt.Errorf("failed to parse y coordinate from path: %w", err)
+		return Job{}, err
 	}
 
 	f, err := os.Open(fullPath)
 	if err != nil {
 		return Job{}, fmt.Errorf("failed to open file %s: %w", fullPath, err)
 	}
+	defer f.Close()
 	data, err := io.ReadAll(f)
 	if err != nil {
 		return Job{}, fmt.Errorf("failed to read file %s: %w", fullPath, err)
 	}
+	data, _, err = gunzipEntry(fullPath, data)
+	if err != nil {
+		return Job{}, err
+	}
 	crc := crc32.ChecksumIEEE(data)
 
-	return Job{Z: z, X: x, Y: y, Data: data, Crc32: crc}, nil
+	// A mismatch is read, so the Ingester fails it instead of ReadNextGood skipping it
+	return Job{Z: z, X: x, Y: y, Data: data, Crc32: crc, readErr: rf.manifest.check(z, x, y, crc)}, nil
+}
+
+// SetChunkSize lists directories n entries at a time, in directory order instead of sorted by name,
+// so the memory used doesn't grow with the size of the directories. 0 lists whole directories.
+// Set before Open.
+func (rf *ReaderFolder) SetChunkSize(n int) {
+	rf.chunk = n
+}
+
+// SetManifest checks the CRC of the tiles against the manifest, of the tile data once gunzipped.
+// Mismatches are failed with ErrCrcMismatch, tiles missing from the manifest are not checked.
+// The manifest is only read, it may be shared. Set before Open.
+func (rf *ReaderFolder) SetManifest(manifest CrcManifest) {
+	rf.manifest = manifest
 }
 
 func (rf *ReaderFolder) Open(folder string) error {
 	rf.folder = folder
-	items, err := os.ReadDir(folder)
+	root, err := openDirReader(folder, rf.chunk)
 	if err != nil {
 		return err
 	}
 	rf.stackLevel = 0
-	rf.stack = make([][]os.DirEntry, 1)
-	rf.stack[rf.stackLevel] = items
-	rf.state = make([]int, 1)
-	rf.state[rf.stackLevel] = 0
-	rf.currentPath = make([]string, 1)
-	rf.currentPath[rf.stackLevel] = folder
+	rf.stack = []*dirReader{root}
+	rf.currentPath = []string{folder}
 	return nil
 }
 
 func (rf *ReaderFolder) Close() error {
+	for _, d := range rf.stack {
+		d.close()
+	}
 	return nil
 }
 
 func (rf *ReaderFolder) ReadOne() (job Job, ok bool, err error) {
-	state := rf.state[rf.stackLevel]
-	if state >= len(rf.stack[rf.stackLevel]) {
+	entry, err := rf.stack[rf.stackLevel].next(rf.chunk)
+	if entry == nil {
 		rf.closeDir()
-		return Job{}, false, nil
+		return Job{}, false, err
 	}
-	entry := rf.stack[rf.stackLevel][state]
-	rf.state[rf.stackLevel]++
 	if entry.IsDir() {
-		rf.openDir(entry)
-		return Job{}, false, nil
+		return Job{}, false, rf.openDir(entry)
 	}
 	j, err := rf.readJob(entry)
 	return j, true, err
@@ -89,34 +148,34 @@ func (rf *ReaderFolder) ReadOne() (job Job, ok bool, err error) {
 func (rf *ReaderFolder) openDir(dir os.DirEntry) error {
 	pathParts := append(rf.currentPath, dir.Name())
 	fullPath := strings.Join(pathParts, "/")
-	// fmt.Printf("Open dir: %s\n", fullPath)
-	items, err := os.ReadDir(fullPath)
+	d, err := openDirReader(fullPath, rf.chunk)
 	if err != nil {
 		return err
 	}
-	rf.stack = append(rf.stack, items)
-	rf.state = append(rf.state, 0)
+	rf.stack = append(rf.stack, d)
 	rf.currentPath = append(rf.currentPath, dir.Name())
 	rf.stackLevel++
 	return nil
 }
 
 func (rf *ReaderFolder) closeDir() {
-	// fmt.Println("close dir")
+	rf.stack[rf.stackLevel].close()
 	rf.stack = rf.stack[:rf.stackLevel]
-	rf.state = rf.state[:rf.stackLevel]
 	rf.currentPath = rf.currentPath[:rf.stackLevel]
 	rf.stackLevel--
 }
 
+// ReadNextGood reads entries until a good tile or the end of the folder.
+// Directories and bad entries are skipped in a loop, the stack doesn't grow with their count.
 func (rf *ReaderFolder) ReadNextGood() (j Job, ok bool, err error) {
-	j, ok, err = rf.ReadOne()
-	if !ok && (rf.stackLevel == -1) {
-		// end
-		return j, ok, err
-	}
-	if err != nil || !ok {
-		return rf.ReadNextGood()
+	for {
+		j, ok, err = rf.ReadOne()
+		if !ok && (rf.stackLevel == -1) {
+			// end
+			return j, ok, err
+		}
+		if ok && err == nil {
+			return j, ok, err
+		}
 	}
-	return j, ok, err
 }
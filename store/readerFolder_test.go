@@ -0,0 +1,192 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path"
+	"runtime/debug"
+	"strconv"
+	"testing"
+
+	"github.com/Hugi-R/wplace-archive-world-map/img"
+)
+
+func TestReaderFolderZoom(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		z, x, y int
+	}{
+		{"NoZoom", "tiles/12/34.png", 11, 12, 34},
+		{"Zoom", "tiles/10/12/34.png", 10, 12, 34},
+		{"NotZoom", "2025/12/34.png", 11, 12, 34},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A numeric input folder must not be taken for a zoom
+			dir := path.Join(t.TempDir(), "5")
+			file := path.Join(dir, tt.file)
+			if err := os.MkdirAll(path.Dir(file), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(file, []byte("not really a png"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			r := ReaderFolder{}
+			if err := r.Open(dir); err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			j, ok, err := r.ReadNextGood()
+			if err != nil || !ok {
+				t.Fatalf("expected a job, got ok=%v err=%v", ok, err)
+			}
+			if j.Z != tt.z || j.X != tt.x || j.Y != tt.y {
+				t.Fatalf("expected %d/%d/%d, got %d/%d/%d", tt.z, tt.x, tt.y, j.Z, j.X, j.Y)
+			}
+		})
+	}
+}
+
+func TestReaderFolderChunks(t *testing.T) {
+	const files, chunk = 2000, 64
+	dir := t.TempDir()
+	for _, x := range []string{"1", "2"} {
+		if err := os.MkdirAll(path.Join(dir, "tiles", x), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range files {
+		x := 1 + i%2
+		if err := os.WriteFile(path.Join(dir, "tiles", strconv.Itoa(x), strconv.Itoa(i)+".png"), []byte("not really a png"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := ReaderFolder{}
+	r.SetChunkSize(chunk)
+	if err := r.Open(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	seen := make(map[[2]int]bool)
+	for j, ok, err := r.ReadNextGood(); ok; j, ok, err = r.ReadNextGood() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[[2]int{j.X, j.Y}] = true
+		// Only a chunk of each directory is held
+		for level, d := range r.stack {
+			if len(d.entries) > chunk {
+				t.Fatalf("level %d holds %d entries, expected at most %d", level, len(d.entries), chunk)
+			}
+		}
+	}
+	if len(seen) != files {
+		t.Fatalf("expected %d tiles, got %d", files, len(seen))
+	}
+	for i := range files {
+		if !seen[[2]int{1 + i%2, i}] {
+			t.Fatalf("tile %d/%d missing", 1+i%2, i)
+		}
+	}
+}
+
+// limitStack makes the test crash with a stack overflow if a goroutine stack grows past max bytes
+func limitStack(t *testing.T, max int) {
+	previous := debug.SetMaxStack(max)
+	t.Cleanup(func() { debug.SetMaxStack(previous) })
+}
+
+func TestReaderFolderSkipsInLoop(t *testing.T) {
+	const dirs, bad = 2000, 5000
+	dir := t.TempDir()
+	for i := range dirs {
+		if err := os.Mkdir(path.Join(dir, fmt.Sprintf("a%05d", i)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range bad {
+		if err := os.WriteFile(path.Join(dir, fmt.Sprintf("b%05d.txt", i)), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(path.Join(dir, "tiles", "12"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(dir, "tiles", "12", "34.png"), []byte("not really a png"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := ReaderFolder{}
+	if err := r.Open(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	// Recursing on each of the skipped entries takes megabytes of stack
+	limitStack(t, 256*1024)
+	j, ok, err := r.ReadNextGood()
+	if err != nil || !ok {
+		t.Fatalf("expected a job, got ok=%v err=%v", ok, err)
+	}
+	if j.X != 12 || j.Y != 34 {
+		t.Fatalf("unexpected coordinates %d/%d", j.X, j.Y)
+	}
+	if _, ok, _ := r.ReadNextGood(); ok {
+		t.Fatal("expected end of folder")
+	}
+}
+
+func TestReaderFolderCrcManifest(t *testing.T) {
+	dir := t.TempDir()
+	tile, err := img.EncodePng(img.EmptyImagePaletted(img.TileSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(path.Join(dir, "tiles", "1"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, y := range []string{"1", "2", "3"} {
+		if err := os.WriteFile(path.Join(dir, "tiles", "1", y+".png"), tile, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 1/1 matches, 1/2 is corrupted, 1/3 is not listed
+	manifestPath := path.Join(t.TempDir(), "tiles.sfv")
+	sfv := fmt.Sprintf("; tiles of the archive\n\ntiles/1/1.png %08X\ntiles/1/2.png %08x\n", crc32.ChecksumIEEE(tile), crc32.ChecksumIEEE(tile)+1)
+	if err := os.WriteFile(manifestPath, []byte(sfv), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := ReadCrcManifest(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest) != 2 {
+		t.Fatalf("expected 2 tiles in the manifest, got %v", manifest)
+	}
+
+	tileDB, err := NewTileDB(path.Join(t.TempDir(), "tiles.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tileDB.Close()
+	r := ReaderFolder{}
+	r.SetManifest(manifest)
+	if err := r.Open(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	ingester := NewIngester(&tileDB, 2, false)
+	if err := ingester.Ingest(context.Background(), r.ReadNextGood); err != nil {
+		t.Fatal(err)
+	}
+	if s := ingester.Snapshot(); s.Read != 3 || s.Success != 2 || s.Fail != 1 || s.CrcMismatch != 1 {
+		t.Fatalf("expected 1 CRC mismatch failed out of 3 tiles, got %+v", s)
+	}
+	if exists, _, _ := tileDB.StatTile(11, 1, 2); exists {
+		t.Fatal("tile mismatching the manifest was stored")
+	}
+}
@@ -46,7 +46,11 @@ func (rs *ReaderSqlite) ReadOne() (Job, bool, error) {
 	}
 
 	if rs.state == 1 {
-		rows, err := rs.db.Query("SELECT x, y, data FROM tiles ORDER BY x, y")
+		dedup, err := DetectDedup(rs.db)
+		if err != nil {
+			return Job{}, false, err
+		}
+		rows, err := rs.db.Query("SELECT x, y, data FROM " + TilesFrom(dedup) + " ORDER BY x, y")
 		if err != nil {
 			return Job{}, false, fmt.Errorf("failed to query tiles: %w", err)
 		}
@@ -79,12 +83,10 @@ func (rs *ReaderSqlite) ReadOne() (Job, bool, error) {
 }
 
 func (rs *ReaderSqlite) ReadNextGood() (Job, bool, error) {
-	j, ok, err := rs.ReadOne()
-	if !ok {
-		return j, ok, err
-	}
-	if err != nil {
-		return rs.ReadNextGood()
+	for {
+		j, ok, err := rs.ReadOne()
+		if !ok || err == nil {
+			return j, ok, err
+		}
 	}
-	return j, ok, err
 }
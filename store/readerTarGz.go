@@ -7,13 +7,12 @@ import (
 	"hash/crc32"
 	"io"
 	"os"
-	"strconv"
-	"strings"
 )
 
 type ReaderTarGz struct {
-	tar  *tar.Reader
-	file *os.File
+	tar     *tar.Reader
+	file    *os.File
+	entries int
 }
 
 func (rtgz *ReaderTarGz) Open(archivePath string) error {
@@ -36,7 +35,36 @@ func (rtgz *ReaderTarGz) Close() error {
 }
 
 func (rtgz *ReaderTarGz) ReadOne() (Job, bool, error) {
-	header, err := rtgz.tar.Next()
+	j, ok, err := readTarEntry(rtgz.tar)
+	if ok {
+		rtgz.entries++
+	}
+	return j, ok, err
+}
+
+// Position returns the number of file entries read
+func (rtgz *ReaderTarGz) Position() int {
+	return rtgz.entries
+}
+
+// Seek skips file entries up to position, without reading their content
+func (rtgz *ReaderTarGz) Seek(position int) error {
+	if position < rtgz.entries {
+		return fmt.Errorf("cannot seek backward to %d from %d", position, rtgz.entries)
+	}
+	err := skipTarEntries(rtgz.tar, position-rtgz.entries)
+	rtgz.entries = position
+	return err
+}
+
+// readTarEntry reads the next regular file of a tar stream as a Job.
+// Shared by the tar readers, whatever the compression.
+func readTarEntry(tr *tar.Reader) (Job, bool, error) {
+	header, err := tr.Next()
+	// Skip directories and links
+	for err == nil && (header.Typeflag == tar.TypeDir || header.Typeflag == tar.TypeSymlink) {
+		header, err = tr.Next()
+	}
 
 	if err == io.EOF {
 		return Job{}, false, nil
@@ -47,54 +75,58 @@ func (rtgz *ReaderTarGz) ReadOne() (Job, bool, error) {
 	}
 
 	switch header.Typeflag {
-	case tar.TypeDir:
-		return rtgz.ReadOne()
-	case tar.TypeSymlink:
-		return rtgz.ReadOne()
 	case tar.TypeReg:
-		pathParts := strings.Split(header.Name, "/")
-		size := len(pathParts)
-		if size < 2 {
-			return Job{}, true, fmt.Errorf("unexpected file path structure: %s", header.Name)
-		}
-		z := 11
-		x, err := strconv.Atoi(pathParts[size-2])
+		z, x, y, err := parseTilePath(header.Name)
 		if err != nil {
-			return Job{}, true, fmt.Errorf("failed to parse x coordinate from path: %w", err)
+			return Job{}, true, err
 		}
-		y, err := strconv.Atoi(strings.TrimSuffix(pathParts[size-1], ".png"))
-		if err != nil {
-			return Job{}, true, fmt.Errorf("failed to parse y coordinate from path: %w", err)
-		}
-		if header.Size > int64(10*1024*1024) {
+		if header.Size > maxEntrySize {
 			return Job{}, true, fmt.Errorf("file %s size too large: %d bytes", header.Name, header.Size)
 		}
 		data := make([]byte, header.Size)
-		_, err = io.ReadFull(rtgz.tar, data)
+		_, err = io.ReadFull(tr, data)
 		if err != nil {
 			return Job{}, true, fmt.Errorf("failed to read file %s: %w", header.Name, err)
 		}
+		data, _, err = gunzipEntry(header.Name, data)
+		if err != nil {
+			return Job{}, true, err
+		}
 		crc := crc32.ChecksumIEEE(data)
-
-		f, _ := os.Create("img.png")
-		f.Write(data)
-		f.Close()
-
 		return Job{Z: z, X: x, Y: y, Data: data, Crc32: crc}, true, nil
 	default:
 		return Job{}, true, fmt.Errorf("unknown type: %v in %s", header.Typeflag, header.Name)
 	}
 }
 
-func (rtgz *ReaderTarGz) ReadNextGood() (Job, bool, error) {
-	j, cont, err := rtgz.ReadOne()
-	if !cont {
-		// Cannot continue
-		return j, cont, err
+// skipTarEntries skips n entries, counted like readTarEntry
+func skipTarEntries(tr *tar.Reader, n int) error {
+	for n > 0 {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("archive ends %d entries early", n)
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag == tar.TypeDir || header.Typeflag == tar.TypeSymlink {
+			continue
+		}
+		n--
 	}
-	if err != nil {
+	return nil
+}
+
+func (rtgz *ReaderTarGz) ReadNextGood() (Job, bool, error) {
+	for {
+		j, cont, err := rtgz.ReadOne()
+		if !cont {
+			// Cannot continue
+			return j, cont, err
+		}
+		if err == nil {
+			return j, cont, err
+		}
 		// Skip bad entry
-		return rtgz.ReadNextGood()
 	}
-	return j, cont, err
 }
@@ -0,0 +1,190 @@
+package store
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func writeTarGzT(archivePath string, files map[string][]byte, t *testing.T) {
+	f, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for name, data := range files {
+		hdr := &tar.Header{Name: name, Mode: 0o644, Size: int64(len(data)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReaderTarGz(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	archive := path.Join(dir, "archive.tar.gz")
+	writeTarGzT(archive, map[string][]byte{"tiles/12/34.png": []byte("not really a png")}, t)
+
+	r := ReaderTarGz{}
+	if err := r.Open(archive); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	j, ok, err := r.ReadNextGood()
+	if err != nil || !ok {
+		t.Fatalf("expected a job, got ok=%v err=%v", ok, err)
+	}
+	if j.Z != 11 || j.X != 12 || j.Y != 34 {
+		t.Fatalf("unexpected coordinates %d/%d/%d", j.Z, j.X, j.Y)
+	}
+	if _, ok, _ := r.ReadNextGood(); ok {
+		t.Fatal("expected end of archive")
+	}
+
+	t.Run("NoStrayFile", func(t *testing.T) {
+		if _, err := os.Stat(path.Join(dir, "img.png")); !os.IsNotExist(err) {
+			t.Fatalf("reader wrote img.png to the working directory")
+		}
+	})
+}
+
+// gzipT compresses data, like the gzipped tile entries of some archives
+func gzipT(data []byte, t *testing.T) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReaderTarGzGzippedEntry(t *testing.T) {
+	tile := []byte("not really a png")
+	archive := path.Join(t.TempDir(), "archive.tar.gz")
+	writeTarGzT(archive, map[string][]byte{
+		"tiles/10/12/704.png.gz": gzipT(tile, t),
+		"tiles/10/12/705.png.gz": tile, // Not gzipped
+	}, t)
+
+	r := ReaderTarGz{}
+	if err := r.Open(archive); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var jobs []Job
+	for {
+		j, ok, err := r.ReadOne()
+		if !ok {
+			if err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+		if err != nil {
+			if !strings.Contains(err.Error(), "705.png.gz") {
+				t.Fatalf("expected an error for the bad gzip entry, got %v", err)
+			}
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+	if len(jobs) != 1 {
+		t.Fatalf("expected 1 tile, got %d", len(jobs))
+	}
+	j := jobs[0]
+	if j.Z != 10 || j.X != 12 || j.Y != 704 {
+		t.Fatalf("unexpected coordinates %d/%d/%d", j.Z, j.X, j.Y)
+	}
+	// The CRC is of the tile, as for a plain entry
+	if !bytes.Equal(j.Data, tile) || j.Crc32 != crc32.ChecksumIEEE(tile) {
+		t.Fatalf("expected the gunzipped tile, got %q, crc %d", j.Data, j.Crc32)
+	}
+}
+
+func TestReaderTarGzZoom(t *testing.T) {
+	archive := path.Join(t.TempDir(), "archive.tar.gz")
+	writeTarGzT(archive, map[string][]byte{"tiles/10/12/34.png": []byte("not really a png")}, t)
+
+	r := ReaderTarGz{}
+	if err := r.Open(archive); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	j, ok, err := r.ReadNextGood()
+	if err != nil || !ok {
+		t.Fatalf("expected a job, got ok=%v err=%v", ok, err)
+	}
+	if j.Z != 10 || j.X != 12 || j.Y != 34 {
+		t.Fatalf("unexpected coordinates %d/%d/%d", j.Z, j.X, j.Y)
+	}
+}
+
+func TestReaderTarGzSkipsInLoop(t *testing.T) {
+	const dirs, bad = 20000, 20000
+	archive := path.Join(t.TempDir(), "archive.tar.gz")
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for i := range dirs {
+		if err := tw.WriteHeader(&tar.Header{Name: fmt.Sprintf("d%d/", i), Mode: 0o755, Typeflag: tar.TypeDir}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range bad {
+		if err := tw.WriteHeader(&tar.Header{Name: fmt.Sprintf("b%d.txt", i), Mode: 0o644, Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := []byte("not really a png")
+	if err := tw.WriteHeader(&tar.Header{Name: "tiles/12/34.png", Mode: 0o644, Size: int64(len(data)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []interface{ Close() error }{tw, gz, f} {
+		if err := c.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := ReaderTarGz{}
+	if err := r.Open(archive); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	limitStack(t, 256*1024)
+	j, ok, err := r.ReadNextGood()
+	if err != nil || !ok {
+		t.Fatalf("expected a job, got ok=%v err=%v", ok, err)
+	}
+	if j.X != 12 || j.Y != 34 {
+		t.Fatalf("unexpected coordinates %d/%d", j.X, j.Y)
+	}
+}
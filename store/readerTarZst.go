@@ -0,0 +1,77 @@
+package store
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type ReaderTarZst struct {
+	tar     *tar.Reader
+	zstd    *zstd.Decoder
+	file    *os.File
+	entries int
+}
+
+func (rtz *ReaderTarZst) Open(archivePath string) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	rtz.file = f
+	dec, err := zstd.NewReader(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rtz.zstd = dec
+	rtz.tar = tar.NewReader(dec)
+	return nil
+}
+
+func (rtz *ReaderTarZst) Close() error {
+	// The decoder owns goroutines, it must be closed as well as the file
+	if rtz.zstd != nil {
+		rtz.zstd.Close()
+	}
+	return rtz.file.Close()
+}
+
+func (rtz *ReaderTarZst) ReadOne() (Job, bool, error) {
+	j, ok, err := readTarEntry(rtz.tar)
+	if ok {
+		rtz.entries++
+	}
+	return j, ok, err
+}
+
+// Position returns the number of file entries read
+func (rtz *ReaderTarZst) Position() int {
+	return rtz.entries
+}
+
+// Seek skips file entries up to position, without reading their content
+func (rtz *ReaderTarZst) Seek(position int) error {
+	if position < rtz.entries {
+		return fmt.Errorf("cannot seek backward to %d from %d", position, rtz.entries)
+	}
+	err := skipTarEntries(rtz.tar, position-rtz.entries)
+	rtz.entries = position
+	return err
+}
+
+func (rtz *ReaderTarZst) ReadNextGood() (Job, bool, error) {
+	for {
+		j, cont, err := rtz.ReadOne()
+		if !cont {
+			// Cannot continue
+			return j, cont, err
+		}
+		if err == nil {
+			return j, cont, err
+		}
+		// Skip bad entry
+	}
+}
@@ -0,0 +1,101 @@
+package store
+
+import (
+	"archive/zip"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+type ReaderZip struct {
+	z          *zip.ReadCloser
+	state      int
+	totalFiles int
+}
+
+func (rz *ReaderZip) readJob(file *zip.File) (Job, error) {
+	if file.FileInfo().IsDir() {
+		return Job{}, fmt.Errorf("%s is dir", file.Name)
+	}
+	z, x, y, err := parseTilePath(file.Name)
+	if err != nil {
+		return Job{}, err
+	}
+
+	if file.UncompressedSize64 > maxEntrySize {
+		return Job{}, fmt.Errorf("file %s size too large: %d bytes", file.Name, file.UncompressedSize64)
+	}
+	rc, err := file.Open()
+	if err != nil {
+		return Job{}, err
+	}
+	defer rc.Close()
+
+	// CRC is already known from the zip central directory
+	crc := file.CRC32
+	// The size of the central directory may lie, as in a zip bomb
+	data, err := io.ReadAll(io.LimitReader(rc, maxEntrySize+1))
+	if err != nil {
+		return Job{}, fmt.Errorf("failed to read file %s: %w", file.Name, err)
+	}
+	if len(data) > maxEntrySize {
+		return Job{}, fmt.Errorf("file %s size too large, over %d bytes", file.Name, maxEntrySize)
+	}
+	data, gunzipped, err := gunzipEntry(file.Name, data)
+	if err != nil {
+		return Job{}, err
+	}
+	if gunzipped {
+		crc = crc32.ChecksumIEEE(data)
+	}
+
+	return Job{Z: z, X: x, Y: y, Data: data, Crc32: crc}, nil
+}
+
+func (rz *ReaderZip) Open(archivePath string) error {
+	r, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+	rz.z = r
+	rz.state = 0
+	rz.totalFiles = len(r.File)
+	return nil
+}
+
+func (rz *ReaderZip) Close() error {
+	return rz.z.Close()
+}
+
+func (rz *ReaderZip) ReadOne() (Job, bool, error) {
+	if rz.state >= rz.totalFiles {
+		return Job{}, false, nil
+	}
+	f := rz.z.File[rz.state]
+	rz.state++
+	j, err := rz.readJob(f)
+	return j, true, err
+}
+
+func (rz *ReaderZip) ReadNextGood() (Job, bool, error) {
+	for {
+		j, ok, err := rz.ReadOne()
+		if !ok || err == nil {
+			return j, ok, err
+		}
+	}
+}
+
+// Position returns the index of the next file
+func (rz *ReaderZip) Position() int {
+	return rz.state
+}
+
+// Seek moves to the file at index position
+func (rz *ReaderZip) Seek(position int) error {
+	if position < 0 || position > rz.totalFiles {
+		return fmt.Errorf("position %d out of the %d files", position, rz.totalFiles)
+	}
+	rz.state = position
+	return nil
+}
@@ -0,0 +1,138 @@
+package store
+
+import (
+	"archive/zip"
+	"bytes"
+	"hash/crc32"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// zipEntry is a file of writeZipT, a directory if its name ends with a slash
+type zipEntry struct {
+	name string
+	data []byte
+}
+
+func writeZipT(archivePath string, entries []zipEntry, t *testing.T) {
+	f, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReaderZip(t *testing.T) {
+	tile := []byte("not really a png")
+	archive := path.Join(t.TempDir(), "archive.zip")
+	writeZipT(archive, []zipEntry{
+		{"tiles/", nil},
+		{"tiles/12/34.png", tile},
+		{"tiles/readme.txt", []byte("not a tile")},
+		{"tiles/10/12/704.png.gz", gzipT(tile, t)},
+		{"tiles/12/35.png", bytes.Repeat([]byte{0}, maxEntrySize+1)},
+		{"tiles/12/36.png", tile},
+	}, t)
+
+	r := ReaderZip{}
+	if err := r.Open(archive); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var jobs []Job
+	var errs []string
+	for {
+		j, ok, err := r.ReadOne()
+		if !ok {
+			break
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+	if len(jobs) != 3 {
+		t.Fatalf("expected 3 tiles, got %d", len(jobs))
+	}
+	// The directory, the bad path and the oversized entry
+	if len(errs) != 3 || !strings.Contains(errs[0], "is dir") || !strings.Contains(errs[1], "x coordinate") || !strings.Contains(errs[2], "too large") {
+		t.Fatalf("expected errors for the directory, bad path and oversized entries, got %v", errs)
+	}
+	for i, expected := range []Job{
+		{Z: 11, X: 12, Y: 34, Data: tile},
+		{Z: 10, X: 12, Y: 704, Data: tile},
+		{Z: 11, X: 12, Y: 36, Data: tile},
+	} {
+		j := jobs[i]
+		if j.Z != expected.Z || j.X != expected.X || j.Y != expected.Y || !bytes.Equal(j.Data, expected.Data) {
+			t.Fatalf("tile %d: expected %d/%d/%d, got %d/%d/%d %q", i, expected.Z, expected.X, expected.Y, j.Z, j.X, j.Y, j.Data)
+		}
+		// The CRC is of the tile, gunzipped or not
+		if j.Crc32 != crc32.ChecksumIEEE(tile) {
+			t.Fatalf("tile %d: expected the CRC of the tile", i)
+		}
+	}
+}
+
+func TestReaderZipSeek(t *testing.T) {
+	archive := path.Join(t.TempDir(), "archive.zip")
+	writeZipT(archive, []zipEntry{
+		{"tiles/1/1.png", []byte("a")},
+		{"tiles/1/2.png", []byte("b")},
+		{"tiles/1/3.png", []byte("c")},
+	}, t)
+
+	r := ReaderZip{}
+	if err := r.Open(archive); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := r.ReadNextGood(); !ok || err != nil {
+		t.Fatalf("expected a job, got ok=%v err=%v", ok, err)
+	}
+	position := r.Position()
+	r.Close()
+	if position != 1 {
+		t.Fatalf("expected position 1, got %d", position)
+	}
+
+	// Resumed from the position, as after an interrupted ingest
+	r = ReaderZip{}
+	if err := r.Open(archive); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if err := r.Seek(position); err != nil {
+		t.Fatal(err)
+	}
+	j, ok, err := r.ReadNextGood()
+	if !ok || err != nil || j.Y != 2 {
+		t.Fatalf("expected tile 1/2, got %+v ok=%v err=%v", j, ok, err)
+	}
+	for _, p := range []int{-1, 4} {
+		if err := r.Seek(p); err == nil {
+			t.Fatalf("expected an error seeking to %d", p)
+		}
+	}
+	if err := r.Seek(3); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := r.ReadNextGood(); ok {
+		t.Fatal("expected end of archive")
+	}
+}
@@ -0,0 +1,36 @@
+package store
+
+import "fmt"
+
+// TileScheme is the convention of the y axis of tile coordinates.
+// The DBs store tiles in the XYZ scheme, as served to slippy map clients.
+type TileScheme int
+
+const (
+	// SchemeXYZ has y increasing southward, from the north edge of the map, as Wplace and slippy maps
+	SchemeXYZ TileScheme = iota
+	// SchemeTMS has y increasing northward, from the south edge of the map
+	SchemeTMS
+)
+
+// Tile scheme names, for ParseTileScheme
+const (
+	SchemeXYZName = "xyz"
+	SchemeTMSName = "tms"
+)
+
+// ParseTileScheme parses a tile scheme name
+func ParseTileScheme(name string) (TileScheme, error) {
+	switch name {
+	case SchemeXYZName, "":
+		return SchemeXYZ, nil
+	case SchemeTMSName:
+		return SchemeTMS, nil
+	}
+	return SchemeXYZ, fmt.Errorf("invalid tile scheme %s, must be one of: xyz, tms", name)
+}
+
+// FlipY converts the row y of level z between the XYZ and TMS schemes, both ways
+func FlipY(z, y int) int {
+	return 1<<z - 1 - y
+}
@@ -0,0 +1,36 @@
+package store
+
+import "testing"
+
+func TestFlipY(t *testing.T) {
+	tests := []struct {
+		z, y, flipped int
+	}{
+		{0, 0, 0},
+		{1, 0, 1},
+		{1, 1, 0},
+		{11, 0, 2047},
+		{11, 1000, 1047},
+		{11, 2047, 0},
+	}
+	for _, tt := range tests {
+		if got := FlipY(tt.z, tt.y); got != tt.flipped {
+			t.Fatalf("FlipY(%d, %d): expected %d, got %d", tt.z, tt.y, tt.flipped, got)
+		}
+		if back := FlipY(tt.z, FlipY(tt.z, tt.y)); back != tt.y {
+			t.Fatalf("FlipY(%d, %d) twice: expected %d, got %d", tt.z, tt.y, tt.y, back)
+		}
+	}
+}
+
+func TestParseTileScheme(t *testing.T) {
+	for name, want := range map[string]TileScheme{"": SchemeXYZ, "xyz": SchemeXYZ, "tms": SchemeTMS} {
+		got, err := ParseTileScheme(name)
+		if err != nil || got != want {
+			t.Fatalf("ParseTileScheme(%q): expected %v, got %v, %v", name, want, got, err)
+		}
+	}
+	if _, err := ParseTileScheme("google"); err == nil {
+		t.Fatal("expected an error for an unknown scheme")
+	}
+}
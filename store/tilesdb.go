@@ -1,10 +1,18 @@
 package store
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"errors"
 	"fmt"
 	hcrc "hash/crc32"
+	"log/slog"
+	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -12,18 +20,68 @@ import (
 
 const defaultDbPath = "./tiles.db"
 
-// Busy timeout for SQLite (in seconds)
-const sqliteBusyTimeout = 20
+// TileDBOptions configures how a TileDB is opened. Zero values use the defaults.
+type TileDBOptions struct {
+	ReadOnly         bool
+	BusyTimeout      time.Duration // How long to wait on a locked DB, default 20s
+	JournalMode      string        // SQLite journal mode while writing, default WAL. Reverted to DELETE on Close
+	JournalSizeLimit int64         // Max size of the journal in bytes, default 500MB
+	Dedup            bool          // Create a new DB with the content-addressed schema, see TilesFrom. An existing DB keeps its schema
+}
+
+const (
+	defaultBusyTimeout      = 20 * time.Second
+	defaultJournalMode      = "WAL"
+	defaultJournalSizeLimit = 500 * 1024 * 1024
+)
+
+// FileDSN returns the SQLite file: URI of dbPath with the params.
+// Each path segment is escaped, so a '?', '#' or '%' in the path is not read as the query or fragment.
+func FileDSN(dbPath string, params url.Values) string {
+	segments := strings.Split(filepath.ToSlash(dbPath), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return "file:" + strings.Join(segments, "/") + "?" + params.Encode()
+}
+
+// journalModes are the SQLite journal modes, the only values of JournalMode written in the PRAGMA
+var journalModes = []string{"DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF"}
+
+// withDefaults fills the zero values with the defaults, and validates the journal mode
+func (o TileDBOptions) withDefaults() (TileDBOptions, error) {
+	if o.BusyTimeout <= 0 {
+		o.BusyTimeout = defaultBusyTimeout
+	}
+	if o.JournalMode == "" {
+		o.JournalMode = defaultJournalMode
+	}
+	o.JournalMode = strings.ToUpper(o.JournalMode)
+	if !slices.Contains(journalModes, o.JournalMode) {
+		return o, fmt.Errorf("invalid journal mode %q, must be one of %s", o.JournalMode, strings.Join(journalModes, ", "))
+	}
+	if o.JournalSizeLimit <= 0 {
+		o.JournalSizeLimit = defaultJournalSizeLimit
+	}
+	return o, nil
+}
 
 type TileDB struct {
 	dbPath   string
 	readOnly bool
+	opts     TileDBOptions
+	dedup    bool // Content-addressed schema, see TilesFrom
 	DB       *sql.DB
 	stmtPut  *sql.Stmt
+	stmtBlob *sql.Stmt // Insert a blob if new, with dedup
 	stmtGet  *sql.Stmt
 	stmtStat *sql.Stmt
 	stmtCrc  *sql.Stmt
+	stmtDel  *sql.Stmt
 	stmList  *sql.Stmt
+	stmStats *sql.Stmt
+	stmIter  *sql.Stmt
+	stmts    []*sql.Stmt // All prepared statements, closed by Close
 }
 
 func (db *TileDB) PutTile(z, x, y int, data []byte, crc32 uint32) error {
@@ -41,16 +99,79 @@ func (db *TileDB) PutTileAutoCRC(z, x, y int, data []byte) error {
 	return db.putWithRetry(z, x, y, data, crc32, 5)
 }
 
+// PutTileBatch writes all tiles in a single transaction, reducing lock contention and fsyncs.
+func (db *TileDB) PutTileBatch(tiles []Job) error {
+	if db.readOnly {
+		return fmt.Errorf("database is read-only")
+	}
+	if len(tiles) == 0 {
+		return nil
+	}
+	const retries = 5
+	var err error
+	for i := 0; i < retries; i++ {
+		err = db.putBatch(tiles)
+		if err == nil {
+			return nil
+		}
+		slog.Warn("DB batch write error", "tiles", len(tiles), "attempt", i+1, "retries", retries, "err", err)
+		time.Sleep(300 * time.Millisecond)
+	}
+	return fmt.Errorf("failed to write batch of %d tiles after %d attempts: %w", len(tiles), retries, err)
+}
+
+func (db *TileDB) putBatch(tiles []Job) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	stmt := tx.Stmt(db.stmtPut)
+	defer stmt.Close()
+	var blob *sql.Stmt
+	if db.dedup {
+		blob = tx.Stmt(db.stmtBlob)
+		defer blob.Close()
+	}
+	for _, t := range tiles {
+		if err := execPut(stmt, blob, t); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("tile (%d, %d, %d): %w", t.Z, t.X, t.Y, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// execPut writes a tile with the put statement, and its data with the blob statement, nil without dedup.
+// With dedup, the blob is keyed by the SHA-256 of the data, so identical tiles share it.
+func execPut(put, blob *sql.Stmt, t Job) error {
+	if blob == nil {
+		_, err := put.Exec(t.Z, t.X, t.Y, t.Crc32, t.Data)
+		return err
+	}
+	hash := sha256.Sum256(t.Data)
+	if _, err := blob.Exec(hash[:], t.Data); err != nil {
+		return err
+	}
+	_, err := put.Exec(t.Z, t.X, t.Y, t.Crc32, hash[:])
+	return err
+}
+
 func (db *TileDB) putWithRetry(z, x, y int, data []byte, crc32 uint32, retries int) error {
 	if db.readOnly {
 		return fmt.Errorf("database is read-only")
 	}
 	for i := 0; i < retries; i++ {
-		_, err := db.stmtPut.Exec(z, x, y, crc32, data)
+		var err error
+		if db.dedup {
+			// The blob and the tile are written in one transaction, PruneBlobs never sees the blob unreferenced
+			err = db.putBatch([]Job{{Z: z, X: x, Y: y, Data: data, Crc32: crc32}})
+		} else {
+			_, err = db.stmtPut.Exec(z, x, y, crc32, data)
+		}
 		if err == nil {
 			return nil
 		}
-		fmt.Printf("DB write error for tile (%d, %d, %d) (attempt %d/%d): %v\n", z, x, y, i+1, retries, err)
+		slog.Warn("DB write error", "tile", fmt.Sprintf("%d/%d/%d", z, x, y), "attempt", i+1, "retries", retries, "err", err)
 		time.Sleep(300 * time.Millisecond)
 	}
 	return fmt.Errorf("failed to write tile (%d, %d, %d) after %d attempts", z, x, y, retries)
@@ -87,6 +208,18 @@ func (db *TileDB) SetCRC(z, x, y int, crc32 uint32) error {
 	return nil
 }
 
+// DeleteTile removes a tile, doing nothing if it doesn't exist.
+// With dedup, its blob is kept until PruneBlobs.
+func (db *TileDB) DeleteTile(z, x, y int) error {
+	if db.readOnly {
+		return fmt.Errorf("database is read-only")
+	}
+	if _, err := db.stmtDel.Exec(z, x, y); err != nil {
+		return fmt.Errorf("failed to delete tile (%d, %d, %d): %w", z, x, y, err)
+	}
+	return nil
+}
+
 // Worst case returns 4^11 tiles, ~16MiB. Acceptable
 func (db *TileDB) ListTiles(z int) ([][2]uint16, error) {
 	rows, err := db.stmList.Query(z)
@@ -106,15 +239,132 @@ func (db *TileDB) ListTiles(z int) ([][2]uint16, error) {
 	return res, nil
 }
 
-func (db *TileDB) init() error {
-	var err error
+// IterateTiles calls fn on every tile of level z, in no particular order, reading the tiles as the query goes
+// instead of listing the level first. fn owns data. Iteration stops at the first error of fn, which is returned.
+// ListTiles and GetTile are still needed for random access.
+func (db *TileDB) IterateTiles(z int, fn func(x, y int, data []byte) error) error {
+	rows, err := db.stmIter.Query(z)
+	if err != nil {
+		return fmt.Errorf("failed to iterate tiles of level %d: %w", z, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var x, y int
+		var data []byte
+		if err := rows.Scan(&x, &y, &data); err != nil {
+			return fmt.Errorf("failed to iterate tiles of level %d: %w", z, err)
+		}
+		if err := fn(x, y, data); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
 
-	// Set busy timeout
-	busyTimeoutMs := sqliteBusyTimeout * 1000
-	_, err = db.DB.Exec(fmt.Sprintf("PRAGMA busy_timeout = %d", busyTimeoutMs))
+// StatTiles returns the CRC of every tile of level z, in a single query.
+// Worst case 4^11 tiles, like ListTiles, so only load one level at a time.
+func (db *TileDB) StatTiles(z int) (map[[2]uint16]uint32, error) {
+	rows, err := db.stmStats.Query(z)
 	if err != nil {
-		return fmt.Errorf("failed to set busy_timeout: %w", err)
+		return nil, fmt.Errorf("failed to stat tiles of level %d: %w", z, err)
 	}
+	defer rows.Close()
+	res := make(map[[2]uint16]uint32)
+	for rows.Next() {
+		var x, y uint16
+		var crc uint32
+		if err := rows.Scan(&x, &y, &crc); err != nil {
+			return nil, fmt.Errorf("failed to stat tiles of level %d: %w", z, err)
+		}
+		res[[2]uint16{x, y}] = crc
+	}
+	return res, rows.Err()
+}
+
+// GetProgress returns the ingest checkpoint of source, found is false if source was never ingested
+func (db *TileDB) GetProgress(source string) (position int, complete bool, found bool, err error) {
+	row := db.DB.QueryRow(`SELECT position, complete FROM ingest_progress WHERE source = ?`, source)
+	if err := row.Scan(&position, &complete); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, false, false, nil
+		}
+		return 0, false, false, fmt.Errorf("failed to get progress of %s: %w", source, err)
+	}
+	return position, complete, true, nil
+}
+
+// SetProgress records the ingest checkpoint of source
+func (db *TileDB) SetProgress(source string, position int, complete bool) error {
+	if db.readOnly {
+		return fmt.Errorf("database is read-only")
+	}
+	_, err := db.DB.Exec(`INSERT INTO ingest_progress (source, position, complete) VALUES (?, ?, ?) ON CONFLICT(source) DO UPDATE SET position=excluded.position,complete=excluded.complete`, source, position, complete)
+	if err != nil {
+		return fmt.Errorf("failed to set progress of %s: %w", source, err)
+	}
+	return nil
+}
+
+// Checkpoint copies the WAL content into the DB without blocking readers nor writers,
+// so the WAL can be reused instead of growing during a long write.
+func (db *TileDB) Checkpoint() error {
+	if db.readOnly {
+		return fmt.Errorf("database is read-only")
+	}
+	if _, err := db.DB.Exec("PRAGMA wal_checkpoint(PASSIVE)"); err != nil {
+		return fmt.Errorf("failed to checkpoint WAL: %w", err)
+	}
+	return nil
+}
+
+// PruneBlobs deletes the blobs no tile references anymore, left by overwritten and deleted tiles,
+// and returns their count. Nothing to do without dedup.
+func (db *TileDB) PruneBlobs() (int64, error) {
+	if db.readOnly {
+		return 0, fmt.Errorf("database is read-only")
+	}
+	if !db.dedup {
+		return 0, nil
+	}
+	res, err := db.DB.Exec(`DELETE FROM blobs WHERE hash NOT IN (SELECT hash FROM tiles)`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune blobs: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// Optimize prunes the unreferenced blobs, merges the WAL and rebuilds the DB file to reclaim fragmented pages.
+// VACUUM writes a full copy of the DB, so up to twice the DB size of free disk space is temporarily needed.
+func (db *TileDB) Optimize() error {
+	if db.readOnly {
+		return fmt.Errorf("database is read-only")
+	}
+	if pruned, err := db.PruneBlobs(); err != nil {
+		return err
+	} else if pruned > 0 {
+		slog.Info("pruned unreferenced blobs", "blobs", pruned)
+	}
+	if _, err := db.DB.Exec("PRAGMA optimize"); err != nil {
+		return fmt.Errorf("failed to optimize: %w", err)
+	}
+	if _, err := db.DB.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		return fmt.Errorf("failed to checkpoint WAL: %w", err)
+	}
+	if _, err := db.DB.Exec("VACUUM"); err != nil {
+		return fmt.Errorf("failed to vacuum: %w", err)
+	}
+	return nil
+}
+
+func (db *TileDB) init() error {
+	exists, dedup, err := tilesSchema(db.DB)
+	if err != nil {
+		return err
+	}
+	if exists && db.opts.Dedup && !dedup {
+		return fmt.Errorf("database %s has the single table schema, can't dedup it", db.dbPath)
+	}
+	db.dedup = dedup || (!exists && db.opts.Dedup)
 
 	if !db.readOnly {
 		// Initialize for write
@@ -131,98 +381,247 @@ func (db *TileDB) init() error {
 func (db *TileDB) initWrite() error {
 	var err error
 
-	// Enable WAL mode for better concurrency
-	_, err = db.DB.Exec("PRAGMA journal_mode = WAL")
+	// WAL by default, for better concurrency
+	_, err = db.DB.Exec(fmt.Sprintf("PRAGMA journal_mode = %s", db.opts.JournalMode))
 	if err != nil {
-		return fmt.Errorf("failed to enable WAL mode: %w", err)
+		return fmt.Errorf("failed to set journal mode %s: %w", db.opts.JournalMode, err)
 	}
 
-	// Set WAL journal size limit to 500MB
-	if _, err := db.DB.Exec("PRAGMA journal_size_limit = 524288000"); err != nil {
+	if _, err := db.DB.Exec(fmt.Sprintf("PRAGMA journal_size_limit = %d", db.opts.JournalSizeLimit)); err != nil {
 		return fmt.Errorf("failed to set journal_size_limit: %w", err)
 	}
 
 	// Ensure schema
-	_, err = db.DB.Exec(`CREATE TABLE IF NOT EXISTS tiles (
-		z INTEGER NOT NULL,
-		x INTEGER NOT NULL,
-		y INTEGER NOT NULL,
-		crc32 INTEGER,
-		data BLOB NOT NULL,
-		PRIMARY KEY (z, x, y)
-	)`)
+	if db.dedup {
+		_, err = db.DB.Exec(`CREATE TABLE IF NOT EXISTS blobs (
+			hash BLOB PRIMARY KEY,
+			data BLOB NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS tiles (
+			z INTEGER NOT NULL,
+			x INTEGER NOT NULL,
+			y INTEGER NOT NULL,
+			crc32 INTEGER,
+			hash BLOB NOT NULL,
+			PRIMARY KEY (z, x, y)
+		)`)
+	} else {
+		_, err = db.DB.Exec(`CREATE TABLE IF NOT EXISTS tiles (
+			z INTEGER NOT NULL,
+			x INTEGER NOT NULL,
+			y INTEGER NOT NULL,
+			crc32 INTEGER,
+			data BLOB NOT NULL,
+			PRIMARY KEY (z, x, y)
+		)`)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to ensure schema: %w", err)
 	}
+
+	// Metadata of the DB, see meta.go
+	_, err = db.DB.Exec(`CREATE TABLE IF NOT EXISTS meta (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to ensure meta schema: %w", err)
+	}
+	_, err = db.DB.Exec(`INSERT INTO meta (key, value) VALUES (?, ?) ON CONFLICT(key) DO NOTHING`, MetaScheme, SchemeXYZName)
+	if err != nil {
+		return fmt.Errorf("failed to write meta %s: %w", MetaScheme, err)
+	}
+
+	// Ingest checkpoints, see Ingest
+	_, err = db.DB.Exec(`CREATE TABLE IF NOT EXISTS ingest_progress (
+		source TEXT PRIMARY KEY,
+		position INTEGER NOT NULL,
+		complete INTEGER NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to ensure progress schema: %w", err)
+	}
 	return nil
 }
 
+// tilesSchema returns whether db has a tiles table, and whether it is the content-addressed one
+func tilesSchema(db *sql.DB) (exists, dedup bool, err error) {
+	var columns, hash int
+	err = db.QueryRow(`SELECT COUNT(*), COUNT(CASE WHEN name = 'hash' THEN 1 END) FROM pragma_table_info('tiles')`).Scan(&columns, &hash)
+	if err != nil {
+		return false, false, fmt.Errorf("failed to read schema: %w", err)
+	}
+	return columns > 0, hash > 0, nil
+}
+
+// DetectDedup returns whether the tiles of db use the content-addressed schema, see TilesFrom
+func DetectDedup(db *sql.DB) (bool, error) {
+	_, dedup, err := tilesSchema(db)
+	return dedup, err
+}
+
+// TilesFrom is the table to select the tiles with their data from, for queries outside TileDB.
+//
+// The single table schema stores the data in the tiles table. The content-addressed schema, see TileDBOptions.Dedup,
+// stores each distinct data once in the blobs table, keyed by its SHA-256, and the tiles reference it by hash.
+// Both have the z, x, y, crc32 and data columns.
+func TilesFrom(dedup bool) string {
+	if dedup {
+		return "tiles JOIN blobs USING (hash)"
+	}
+	return "tiles"
+}
+
+// prepare prepares query and tracks the statement to close it in Close
+func (db *TileDB) prepare(query string) (*sql.Stmt, error) {
+	stmt, err := db.DB.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	db.stmts = append(db.stmts, stmt)
+	return stmt, nil
+}
+
 func (db *TileDB) prepareStmt() error {
 	var err error
-	db.stmtGet, err = db.DB.Prepare(`SELECT data FROM tiles WHERE z = ? AND x = ? AND y = ?`)
+	from := TilesFrom(db.dedup)
+	db.stmtGet, err = db.prepare(`SELECT data FROM ` + from + ` WHERE z = ? AND x = ? AND y = ?`)
 	if err != nil {
 		return fmt.Errorf("failed to prepare get statement: %w", err)
 	}
-	db.stmtStat, err = db.DB.Prepare(`SELECT crc32 FROM tiles WHERE z = ? AND x = ? AND y = ?`)
+	db.stmtStat, err = db.prepare(`SELECT crc32 FROM tiles WHERE z = ? AND x = ? AND y = ?`)
 	if err != nil {
 		return fmt.Errorf("failed to prepare stat statement: %w", err)
 	}
-	db.stmList, err = db.DB.Prepare(`SELECT x, y FROM tiles WHERE z = ?`)
+	db.stmList, err = db.prepare(`SELECT x, y FROM tiles WHERE z = ?`)
 	if err != nil {
 		return fmt.Errorf("failed to prepare stat statement: %w", err)
 	}
-	if !db.readOnly {
-		db.stmtPut, err = db.DB.Prepare(`INSERT INTO tiles (z, x, y, crc32, data) VALUES (?, ?, ?, ?, ?) ON CONFLICT(z, x, y) DO UPDATE SET data=excluded.data,crc32=excluded.crc32`)
+	db.stmStats, err = db.prepare(`SELECT x, y, COALESCE(crc32, 0) FROM tiles WHERE z = ?`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare stats statement: %w", err)
+	}
+	db.stmIter, err = db.prepare(`SELECT x, y, data FROM ` + from + ` WHERE z = ?`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare iterate statement: %w", err)
+	}
+	if !db.readOnly && db.dedup {
+		db.stmtBlob, err = db.prepare(`INSERT INTO blobs (hash, data) VALUES (?, ?) ON CONFLICT(hash) DO NOTHING`)
+		if err != nil {
+			return fmt.Errorf("failed to prepare blob statement: %w", err)
+		}
+		db.stmtPut, err = db.prepare(`INSERT INTO tiles (z, x, y, crc32, hash) VALUES (?, ?, ?, ?, ?) ON CONFLICT(z, x, y) DO UPDATE SET hash=excluded.hash,crc32=excluded.crc32`)
 		if err != nil {
 			return fmt.Errorf("failed to prepare put statement: %w", err)
 		}
-		db.stmtCrc, err = db.DB.Prepare(`UPDATE tiles SET crc32 = ? WHERE z = ? AND x = ? AND y = ?`)
+	} else if !db.readOnly {
+		db.stmtPut, err = db.prepare(`INSERT INTO tiles (z, x, y, crc32, data) VALUES (?, ?, ?, ?, ?) ON CONFLICT(z, x, y) DO UPDATE SET data=excluded.data,crc32=excluded.crc32`)
+		if err != nil {
+			return fmt.Errorf("failed to prepare put statement: %w", err)
+		}
+	}
+	if !db.readOnly {
+		db.stmtCrc, err = db.prepare(`UPDATE tiles SET crc32 = ? WHERE z = ? AND x = ? AND y = ?`)
 		if err != nil {
 			return fmt.Errorf("failed to prepare stat statement: %w", err)
 		}
+		db.stmtDel, err = db.prepare(`DELETE FROM tiles WHERE z = ? AND x = ? AND y = ?`)
+		if err != nil {
+			return fmt.Errorf("failed to prepare delete statement: %w", err)
+		}
 	}
 	return nil
 }
 
 func (db *TileDB) Close() {
-	if !db.readOnly {
+	for _, stmt := range db.stmts {
+		_ = stmt.Close()
+	}
+	db.stmts = nil
+	if !db.readOnly && strings.EqualFold(db.opts.JournalMode, "WAL") {
 		_, err := db.DB.Exec("PRAGMA wal_checkpoint(TRUNCATE)") // ensure WAL is merged
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "failed to checkpoint WAL: %v\n", err)
+			slog.Warn("failed to checkpoint WAL", "err", err)
 		}
 
 		// Close and reopen to disable WAL
 		// WAL cannot be disabled if there's statements or handles open
-        _ = db.DB.Close()
-        db2, err := sql.Open("sqlite3", db.dbPath)
-        if err != nil {
-            fmt.Fprintf(os.Stderr, "failed to reopen database to revert WAL: %v\n", err)
-        } else {
-            _, err = db2.Exec("PRAGMA journal_mode = DELETE")
-            if err != nil {
-                fmt.Fprintf(os.Stderr, "failed to revert journaling to non WAL after reopen: %v\n", err)
-            } else {
-                fmt.Fprintln(os.Stderr, "successfully reverted WAL after reopen")
-            }
-            _ = db2.Close()
-        }
-	}
-    // ensure original DB handle is closed if not already
-    if db.DB != nil {
-        _ = db.DB.Close()
-    }
+		_ = db.DB.Close()
+		db2, err := sql.Open("sqlite3", FileDSN(db.dbPath, url.Values{"_busy_timeout": {strconv.FormatInt(db.opts.BusyTimeout.Milliseconds(), 10)}}))
+		if err != nil {
+			slog.Warn("failed to reopen database to revert WAL", "err", err)
+		} else {
+			_, err = db2.Exec("PRAGMA journal_mode = DELETE")
+			if err != nil {
+				slog.Warn("failed to revert journaling to non WAL after reopen", "err", err)
+			} else {
+				slog.Debug("successfully reverted WAL after reopen")
+			}
+			_ = db2.Close()
+		}
+	}
+	// ensure original DB handle is closed if not already
+	if db.DB != nil {
+		_ = db.DB.Close()
+	}
 }
 
+// CheckTileDB verifies dbPath is an existing DB with a tiles table, without creating it
+func CheckTileDB(dbPath string) error {
+	info, err := os.Stat(dbPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("tile database %s does not exist", dbPath)
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("tile database %s is a directory", dbPath)
+	}
+	db, err := sql.Open("sqlite3", FileDSN(dbPath, url.Values{"mode": {"ro"}}))
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer db.Close()
+	exists, _, err := tilesSchema(db)
+	if err != nil {
+		return fmt.Errorf("%s is not a valid tile database: %w", dbPath, err)
+	}
+	if !exists {
+		return fmt.Errorf("%s is not a tile database, it has no tiles table", dbPath)
+	}
+	return nil
+}
+
+// NewTileDB opens the DB at dbPath with the default options
 func NewTileDB(dbPath string, readOnly bool) (TileDB, error) {
+	return NewTileDBWithOptions(dbPath, TileDBOptions{ReadOnly: readOnly})
+}
+
+func NewTileDBWithOptions(dbPath string, opts TileDBOptions) (TileDB, error) {
 	if dbPath == "" {
 		dbPath = defaultDbPath
 	}
-	db, err := sql.Open("sqlite3", dbPath)
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return TileDB{}, err
+	}
+	// The busy timeout is set on every connection of the pool
+	params := url.Values{"_busy_timeout": {strconv.FormatInt(opts.BusyTimeout.Milliseconds(), 10)}}
+	if opts.ReadOnly {
+		// SQLite refuses writes too, and doesn't create a missing DB.
+		// Only honored for file: URIs.
+		params.Set("mode", "ro")
+	}
+	db, err := sql.Open("sqlite3", FileDSN(dbPath, params))
 	if err != nil {
 		return TileDB{}, fmt.Errorf("failed to open database: %w", err)
 	}
-	tileDB := TileDB{DB: db, readOnly: readOnly, dbPath: dbPath}
+	tileDB := TileDB{DB: db, readOnly: opts.ReadOnly, dbPath: dbPath, opts: opts}
 	if err := tileDB.init(); err != nil {
+		for _, stmt := range tileDB.stmts {
+			_ = stmt.Close()
+		}
 		db.Close()
 		return TileDB{}, err
 	}
@@ -0,0 +1,489 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTileDBT creates a DB holding n tiles at z=11, in rows of 100 tiles
+func newTileDBT(n int, tb testing.TB) TileDB {
+	tileDB, err := NewTileDB(path.Join(tb.TempDir(), "tiles.db"), false)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tiles := make([]Job, 0, n)
+	for i := range n {
+		tiles = append(tiles, Job{Z: 11, X: i % 100, Y: i / 100, Data: []byte("tile"), Crc32: uint32(i)})
+	}
+	if err := tileDB.PutTileBatch(tiles); err != nil {
+		tb.Fatal(err)
+	}
+	return tileDB
+}
+
+func TestStatTiles(t *testing.T) {
+	tileDB := newTileDBT(250, t)
+	defer tileDB.Close()
+
+	stats, err := tileDB.StatTiles(11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 250 {
+		t.Fatalf("expected 250 tiles, got %d", len(stats))
+	}
+	for i := range 250 {
+		exists, crc, err := tileDB.StatTile(11, i%100, i/100)
+		if err != nil || !exists {
+			t.Fatalf("tile %d: exists %v, err %v", i, exists, err)
+		}
+		if stats[[2]uint16{uint16(i % 100), uint16(i / 100)}] != crc {
+			t.Fatalf("tile %d: expected CRC %d, got %d", i, crc, stats[[2]uint16{uint16(i % 100), uint16(i / 100)}])
+		}
+	}
+
+	stats, err = tileDB.StatTiles(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 0 {
+		t.Fatalf("expected no tiles at level 10, got %d", len(stats))
+	}
+}
+
+// Stat all tiles of a level, one query per tile versus a single query
+func BenchmarkStat(b *testing.B) {
+	const n = 20000
+	tileDB := newTileDBT(n, b)
+	defer tileDB.Close()
+
+	b.Run("StatTile", func(b *testing.B) {
+		for b.Loop() {
+			for i := range n {
+				if _, _, err := tileDB.StatTile(11, i%100, i/100); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("StatTiles", func(b *testing.B) {
+		for b.Loop() {
+			stats, err := tileDB.StatTiles(11)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for i := range n {
+				_ = stats[[2]uint16{uint16(i % 100), uint16(i / 100)}]
+			}
+		}
+	})
+}
+
+func TestIterateTiles(t *testing.T) {
+	tileDB := newTileDBT(250, t)
+	defer tileDB.Close()
+
+	seen := make(map[[2]int]bool)
+	err := tileDB.IterateTiles(11, func(x, y int, data []byte) error {
+		if string(data) != "tile" {
+			t.Fatalf("tile %d/%d: unexpected data %q", x, y, data)
+		}
+		seen[[2]int{x, y}] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 250 {
+		t.Fatalf("expected 250 tiles, got %d", len(seen))
+	}
+
+	// The error of fn stops the iteration
+	stop := errors.New("stop")
+	calls := 0
+	err = tileDB.IterateTiles(11, func(x, y int, data []byte) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Fatalf("expected to stop after 1 call, got %d calls and %v", calls, err)
+	}
+	// The DB is still usable, the rows are closed
+	if _, err := tileDB.GetTile(11, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Read all tiles of a dense level, listing the level then getting each tile versus streaming them.
+// Compare B/op and allocs/op: the list and one query per tile against a single query.
+func BenchmarkIterateTiles(b *testing.B) {
+	const n = 20000
+	tileDB := newTileDBT(n, b)
+	defer tileDB.Close()
+
+	b.Run("ListTiles", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			tiles, err := tileDB.ListTiles(11)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, t := range tiles {
+				if _, err := tileDB.GetTile(11, int(t[0]), int(t[1])); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("IterateTiles", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			err := tileDB.IterateTiles(11, func(x, y int, data []byte) error { return nil })
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestTileDBOptions(t *testing.T) {
+	dbPath := path.Join(t.TempDir(), "tiles.db")
+	tileDB, err := NewTileDBWithOptions(dbPath, TileDBOptions{BusyTimeout: 45 * time.Second, JournalMode: "DELETE"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mode string
+	var timeout int
+	if err := tileDB.DB.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+		t.Fatal(err)
+	}
+	if err := tileDB.DB.QueryRow("PRAGMA busy_timeout").Scan(&timeout); err != nil {
+		t.Fatal(err)
+	}
+	if mode != "delete" || timeout != 45000 {
+		t.Fatalf("expected journal mode delete and busy timeout 45000, got %s and %d", mode, timeout)
+	}
+	if err := tileDB.PutTile(11, 1, 2, []byte("tile"), 0); err != nil {
+		t.Fatal(err)
+	}
+	tileDB.Close()
+
+	readDB, err := NewTileDBWithOptions(dbPath, TileDBOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readDB.Close()
+	if err := readDB.PutTile(11, 1, 2, []byte("other"), 0); err == nil {
+		t.Fatal("expected an error writing a read-only DB")
+	}
+	if err := readDB.SetProgress("archive", 1, false); err == nil {
+		t.Fatal("expected an error writing a read-only DB")
+	}
+	data, err := readDB.GetTile(11, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "tile" {
+		t.Fatalf("expected the tile to be unchanged, got %q", data)
+	}
+}
+
+func TestTileDBOptionsJournalMode(t *testing.T) {
+	dir := t.TempDir()
+	for _, mode := range []string{"wal; DROP TABLE tiles", "FAST"} {
+		if _, err := NewTileDBWithOptions(path.Join(dir, "invalid.db"), TileDBOptions{JournalMode: mode}); err == nil {
+			t.Fatalf("expected an error for the journal mode %q", mode)
+		}
+	}
+	tileDB, err := NewTileDBWithOptions(path.Join(dir, "tiles.db"), TileDBOptions{JournalMode: "truncate"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tileDB.Close()
+	var mode string
+	if err := tileDB.DB.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+		t.Fatal(err)
+	}
+	if mode != "truncate" {
+		t.Fatalf("expected journal mode truncate, got %s", mode)
+	}
+}
+
+func TestTileDBPathEscape(t *testing.T) {
+	dir := path.Join(t.TempDir(), "a?b#c%20d")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	dbPath := path.Join(dir, "tiles 1.db")
+	tileDB, err := NewTileDBWithOptions(dbPath, TileDBOptions{BusyTimeout: 45 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var timeout int
+	if err := tileDB.DB.QueryRow("PRAGMA busy_timeout").Scan(&timeout); err != nil {
+		t.Fatal(err)
+	}
+	if timeout != 45000 {
+		t.Fatalf("expected busy timeout 45000, got %d", timeout)
+	}
+	if err := tileDB.PutTile(11, 1, 2, []byte("tile"), 0); err != nil {
+		t.Fatal(err)
+	}
+	tileDB.Close()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "tiles 1.db" {
+		t.Fatalf("expected only the DB file in %s, got %v", dir, entries)
+	}
+	if err := CheckTileDB(dbPath); err != nil {
+		t.Fatal(err)
+	}
+	readDB, err := NewTileDB(dbPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readDB.Close()
+	if _, err := readDB.GetTile(11, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	// Reverted by the reopen of Close
+	var mode string
+	if err := readDB.DB.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+		t.Fatal(err)
+	}
+	if mode != "delete" {
+		t.Fatalf("expected the WAL reverted on close, got journal mode %s", mode)
+	}
+}
+
+func TestTileDBReadOnly(t *testing.T) {
+	dbPath := path.Join(t.TempDir(), "tiles.db")
+	if _, err := NewTileDB(dbPath, true); err == nil {
+		t.Fatal("expected an error opening a missing DB read-only")
+	}
+
+	tileDB := newTileDBT(1, t)
+	dbPath = tileDB.dbPath
+	tileDB.Close()
+
+	readDB, err := NewTileDB(dbPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readDB.Close()
+	if err := readDB.PutTile(11, 0, 0, []byte("other"), 0); err == nil {
+		t.Fatal("expected PutTile to fail on a read-only DB")
+	}
+	if _, err := readDB.DB.Exec(`DELETE FROM tiles`); err == nil {
+		t.Fatal("expected SQLite to refuse writes on a read-only DB")
+	}
+	if exists, _, err := readDB.StatTile(11, 0, 0); err != nil || !exists {
+		t.Fatalf("expected the tile to still exist, got %v, %v", exists, err)
+	}
+}
+
+func TestCheckTileDB(t *testing.T) {
+	dir := t.TempDir()
+	missing := path.Join(dir, "missing.db")
+	if err := CheckTileDB(missing); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Fatalf("expected a missing DB error, got %v", err)
+	}
+	if _, err := os.Stat(missing); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("expected the check not to create the DB")
+	}
+	garbage := path.Join(dir, "garbage.db")
+	if err := os.WriteFile(garbage, []byte("not a database, but long enough to have a header"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckTileDB(garbage); err == nil {
+		t.Fatal("expected an error for a file that isn't a DB")
+	}
+
+	tileDB := newTileDBT(1, t)
+	tileDB.Close()
+	if err := CheckTileDB(tileDB.dbPath); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTileDBCloseStatements(t *testing.T) {
+	tileDB := newTileDBT(1, t)
+	dbPath := tileDB.dbPath
+	tileDB.Close()
+
+	for i := range 20 {
+		readOnly := i%2 == 0
+		tileDB, err := NewTileDB(dbPath, readOnly)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stmts := tileDB.stmts
+		if len(stmts) == 0 {
+			t.Fatal("expected tracked statements")
+		}
+		tileDB.Close()
+		for _, stmt := range stmts {
+			if _, err := stmt.Exec(); err == nil || !strings.Contains(err.Error(), "statement is closed") {
+				t.Fatalf("expected statement to be closed, got %v", err)
+			}
+		}
+	}
+}
+
+func TestTileDBCheckpoint(t *testing.T) {
+	tileDB := newTileDBT(50, t)
+	defer tileDB.Close()
+
+	if err := tileDB.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	// Every frame of the WAL is already in the DB
+	var busy, log, checkpointed int
+	if err := tileDB.DB.QueryRow("PRAGMA wal_checkpoint(PASSIVE)").Scan(&busy, &log, &checkpointed); err != nil {
+		t.Fatal(err)
+	}
+	if busy != 0 || log != checkpointed {
+		t.Fatalf("expected a complete checkpoint, got busy=%d log=%d checkpointed=%d", busy, log, checkpointed)
+	}
+
+	readDB, err := NewTileDB(tileDB.dbPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readDB.Close()
+	if err := readDB.Checkpoint(); err == nil {
+		t.Fatal("expected an error checkpointing a read-only DB")
+	}
+}
+
+func TestTileDBDedup(t *testing.T) {
+	dbPath := path.Join(t.TempDir(), "tiles.db")
+	tileDB, err := NewTileDBWithOptions(dbPath, TileDBOptions{Dedup: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiles := make([]Job, 0, 10)
+	for i := range 10 {
+		tiles = append(tiles, Job{Z: 11, X: i, Y: 0, Data: []byte("empty"), Crc32: uint32(i)})
+	}
+	if err := tileDB.PutTileBatch(tiles); err != nil {
+		t.Fatal(err)
+	}
+	if err := tileDB.PutTile(11, 0, 1, []byte("solid"), 42); err != nil {
+		t.Fatal(err)
+	}
+	countBlobs := func() int {
+		var n int
+		if err := tileDB.DB.QueryRow("SELECT COUNT(*) FROM blobs").Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if n := countBlobs(); n != 2 {
+		t.Fatalf("expected the 11 tiles to share 2 blobs, got %d", n)
+	}
+
+	data, err := tileDB.GetTile(11, 3, 0)
+	if err != nil || string(data) != "empty" {
+		t.Fatalf("expected the shared blob, got %q, %v", data, err)
+	}
+	exists, crc, err := tileDB.StatTile(11, 3, 0)
+	if err != nil || !exists || crc != 3 {
+		t.Fatalf("expected the CRC of the tile, got %v, %d, %v", exists, crc, err)
+	}
+	iterated := 0
+	err = tileDB.IterateTiles(11, func(x, y int, data []byte) error {
+		iterated++
+		if (y == 0 && string(data) != "empty") || (y == 1 && string(data) != "solid") {
+			t.Errorf("unexpected data %q for tile %d/%d", data, x, y)
+		}
+		return nil
+	})
+	if err != nil || iterated != 11 {
+		t.Fatalf("expected to iterate 11 tiles, got %d, %v", iterated, err)
+	}
+
+	// The solid blob is no longer referenced once overwritten
+	if err := tileDB.PutTileAutoCRC(11, 0, 1, []byte("empty")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tileDB.DeleteTile(11, 5, 0); err != nil {
+		t.Fatal(err)
+	}
+	pruned, err := tileDB.PruneBlobs()
+	if err != nil || pruned != 1 {
+		t.Fatalf("expected to prune 1 blob, got %d, %v", pruned, err)
+	}
+	if n := countBlobs(); n != 1 {
+		t.Fatalf("expected 1 blob left, got %d", n)
+	}
+	tileDB.Close()
+
+	// The schema is detected on open
+	readDB, err := NewTileDB(dbPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readDB.Close()
+	if !readDB.dedup {
+		t.Fatal("expected the content-addressed schema to be detected")
+	}
+	if data, err := readDB.GetTile(11, 0, 1); err != nil || string(data) != "empty" {
+		t.Fatalf("expected the overwritten tile, got %q, %v", data, err)
+	}
+
+	// A single table DB can't be opened for dedup
+	plain := newTileDBT(1, t)
+	plain.Close()
+	if _, err := NewTileDBWithOptions(plain.dbPath, TileDBOptions{Dedup: true}); err == nil {
+		t.Fatal("expected an error opening a single table DB for dedup")
+	}
+}
+
+func TestTileDBMeta(t *testing.T) {
+	tileDB := newTileDBT(250, t)
+	defer tileDB.Close()
+
+	if _, found, err := tileDB.GetMeta(MetaRelease); err != nil || found {
+		t.Fatalf("expected no release, got found=%v err=%v", found, err)
+	}
+	if err := tileDB.SetMeta(MetaRelease, "full/full_2025-08-09T20-01-14Z.7z"); err != nil {
+		t.Fatal(err)
+	}
+	if value, found, err := tileDB.GetMeta(MetaRelease); err != nil || !found || value != "full/full_2025-08-09T20-01-14Z.7z" {
+		t.Fatalf("expected the release, got %q, %v, %v", value, found, err)
+	}
+
+	if err := tileDB.SetMeta(MetaTiles(3), "12"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tileDB.PutTileAutoCRC(10, 0, 0, []byte("tile")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tileDB.RecordTileCounts(); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := ReadMeta(tileDB.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The stale count of level 3 is removed
+	expected := map[string]string{
+		MetaScheme:    SchemeXYZName,
+		MetaRelease:   "full/full_2025-08-09T20-01-14Z.7z",
+		MetaTiles(11): "250",
+		MetaTiles(10): "1",
+	}
+	if !reflect.DeepEqual(meta, expected) {
+		t.Fatalf("expected %v, got %v", expected, meta)
+	}
+}
@@ -0,0 +1,22 @@
+package store
+
+// TileStore holds the tiles of levels z, by x and y, with their CRC32. The ingester and the merger write through it.
+// TileDB, on SQLite, is the store of the DBs of the tools. BoltTileStore is a key-value alternative,
+// and storetest.MemStore an in-memory fake for tests.
+// GetTile of a missing tile returns an error wrapping sql.ErrNoRows, for every store.
+type TileStore interface {
+	PutTile(z, x, y int, data []byte, crc32 uint32) error
+	PutTileAutoCRC(z, x, y int, data []byte) error
+	PutTileBatch(tiles []Job) error
+	GetTile(z, x, y int) ([]byte, error)
+	StatTile(z, x, y int) (exists bool, crc uint32, err error)
+	StatTiles(z int) (map[[2]uint16]uint32, error)
+	ListTiles(z int) ([][2]uint16, error)
+	DeleteTile(z, x, y int) error
+	Close()
+}
+
+var (
+	_ TileStore = (*TileDB)(nil)
+	_ TileStore = (*BoltTileStore)(nil)
+)
@@ -0,0 +1,18 @@
+package store
+
+import "runtime"
+
+// MaxAutoWorkers caps the workers picked by Workers. Every worker writes to the DB,
+// past this count they mostly wait on the single SQLite writer.
+const MaxAutoWorkers = 32
+
+// Workers returns n, or a count picked from the usable CPUs when n is 0 or less.
+//
+// Ingest and merge workers spend most of their time decoding, palettizing and encoding tiles, so one worker per CPU
+// keeps them busy. At least 2, so a worker waiting on a write doesn't idle the CPU, and at most MaxAutoWorkers.
+func Workers(n int) int {
+	if n > 0 {
+		return n
+	}
+	return min(max(runtime.GOMAXPROCS(0), 2), MaxAutoWorkers)
+}
@@ -0,0 +1,28 @@
+package store
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestWorkers(t *testing.T) {
+	if n := Workers(7); n != 7 {
+		t.Fatalf("expected an explicit count to be kept, got %d", n)
+	}
+	tests := []struct {
+		procs    int
+		expected int
+	}{
+		{1, 2},
+		{4, 4},
+		{64, MaxAutoWorkers},
+	}
+	for _, tt := range tests {
+		prev := runtime.GOMAXPROCS(tt.procs)
+		n := Workers(0)
+		runtime.GOMAXPROCS(prev)
+		if n != tt.expected {
+			t.Fatalf("expected %d workers with GOMAXPROCS=%d, got %d", tt.expected, tt.procs, n)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// Package storetest provides an in-memory store.TileStore, to test the ingester and the merger without SQLite.
+package storetest
+
+import (
+	"database/sql"
+	"fmt"
+	"hash/crc32"
+	"slices"
+	"sync"
+
+	"github.com/Hugi-R/wplace-archive-world-map/store"
+)
+
+type tile struct {
+	data []byte
+	crc  uint32
+}
+
+// MemStore is a store.TileStore in a map, safe for concurrent use. Tiles are copied in and out.
+type MemStore struct {
+	mu     sync.RWMutex
+	tiles  map[[3]int]tile
+	closed bool
+}
+
+var _ store.TileStore = (*MemStore)(nil)
+
+// NewMemStore returns an empty store
+func NewMemStore() *MemStore {
+	return &MemStore{tiles: make(map[[3]int]tile)}
+}
+
+func (s *MemStore) PutTile(z, x, y int, data []byte, crc uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return fmt.Errorf("store is closed")
+	}
+	s.tiles[[3]int{z, x, y}] = tile{data: slices.Clone(data), crc: crc}
+	return nil
+}
+
+func (s *MemStore) PutTileAutoCRC(z, x, y int, data []byte) error {
+	return s.PutTile(z, x, y, data, crc32.ChecksumIEEE(data))
+}
+
+func (s *MemStore) PutTileBatch(tiles []store.Job) error {
+	for _, t := range tiles {
+		if err := s.PutTile(t.Z, t.X, t.Y, t.Data, t.Crc32); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetTile returns a copy of the tile, an error wrapping sql.ErrNoRows if missing
+func (s *MemStore) GetTile(z, x, y int) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.tiles[[3]int{z, x, y}]
+	if !ok {
+		return nil, fmt.Errorf("failed to get tile (%d, %d, %d): %w", z, x, y, sql.ErrNoRows)
+	}
+	return slices.Clone(t.data), nil
+}
+
+func (s *MemStore) StatTile(z, x, y int) (exists bool, crc uint32, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.tiles[[3]int{z, x, y}]
+	return ok, t.crc, nil
+}
+
+func (s *MemStore) StatTiles(z int) (map[[2]uint16]uint32, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	res := make(map[[2]uint16]uint32)
+	for k, t := range s.tiles {
+		if k[0] == z {
+			res[[2]uint16{uint16(k[1]), uint16(k[2])}] = t.crc
+		}
+	}
+	return res, nil
+}
+
+// ListTiles returns the tiles of level z, sorted by x then y
+func (s *MemStore) ListTiles(z int) ([][2]uint16, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	res := make([][2]uint16, 0)
+	for k := range s.tiles {
+		if k[0] == z {
+			res = append(res, [2]uint16{uint16(k[1]), uint16(k[2])})
+		}
+	}
+	slices.SortFunc(res, func(a, b [2]uint16) int {
+		if a[0] != b[0] {
+			return int(a[0]) - int(b[0])
+		}
+		return int(a[1]) - int(b[1])
+	})
+	return res, nil
+}
+
+func (s *MemStore) DeleteTile(z, x, y int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tiles, [3]int{z, x, y})
+	return nil
+}
+
+// Close makes the writes fail, the tiles can still be read
+func (s *MemStore) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+}
+
+// Len returns the count of tiles of level z
+func (s *MemStore) Len(z int) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n := 0
+	for k := range s.tiles {
+		if k[0] == z {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,72 @@
+package storetest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"hash/crc32"
+	"slices"
+	"testing"
+
+	"github.com/Hugi-R/wplace-archive-world-map/img"
+	"github.com/Hugi-R/wplace-archive-world-map/store"
+)
+
+func TestMemStore(t *testing.T) {
+	s := NewMemStore()
+	data := []byte("tile")
+	if err := s.PutTileAutoCRC(11, 3, 1, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutTileBatch([]store.Job{{Z: 11, X: 1, Y: 2, Data: []byte("a"), Crc32: 7}, {Z: 10, X: 0, Y: 0, Data: []byte("b")}}); err != nil {
+		t.Fatal(err)
+	}
+	// The store keeps its copy
+	data[0] = 'x'
+	if got, err := s.GetTile(11, 3, 1); err != nil || string(got) != "tile" {
+		t.Fatalf("expected the tile, got %q, %v", got, err)
+	}
+	if _, err := s.GetTile(11, 0, 0); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected sql.ErrNoRows, got %v", err)
+	}
+	if exists, crc, _ := s.StatTile(11, 3, 1); !exists || crc != crc32.ChecksumIEEE([]byte("tile")) {
+		t.Fatalf("expected the tile with its CRC, got %v, %d", exists, crc)
+	}
+	if tiles, _ := s.ListTiles(11); !slices.Equal(tiles, [][2]uint16{{1, 2}, {3, 1}}) {
+		t.Fatalf("expected the 2 tiles of level 11 sorted, got %v", tiles)
+	}
+	if stats, _ := s.StatTiles(11); len(stats) != 2 || stats[[2]uint16{1, 2}] != 7 {
+		t.Fatalf("expected the CRCs of level 11, got %v", stats)
+	}
+	if err := s.DeleteTile(11, 1, 2); err != nil || s.Len(11) != 1 {
+		t.Fatalf("expected 1 tile left, got %d, %v", s.Len(11), err)
+	}
+	s.Close()
+	if err := s.PutTile(11, 0, 0, nil, 0); err == nil {
+		t.Fatal("expected writes to fail once closed")
+	}
+}
+
+func TestMemStoreIngest(t *testing.T) {
+	s := NewMemStore()
+	tile, err := img.EncodePng(img.NewEmptyPaletted(img.TileSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs := []store.Job{{Z: 11, X: 1, Y: 1, Data: tile, Crc32: 1}, {Z: 11, X: 2, Y: 1, Data: tile, Crc32: 2}}
+	read := func() (store.Job, bool, error) {
+		if len(jobs) == 0 {
+			return store.Job{}, false, nil
+		}
+		j := jobs[0]
+		jobs = jobs[1:]
+		return j, true, nil
+	}
+	ingester := store.NewIngester(s, 2, false)
+	if err := ingester.Ingest(context.Background(), read); err != nil {
+		t.Fatal(err)
+	}
+	if s.Len(11) != 2 {
+		t.Fatalf("expected the 2 tiles ingested, got %d", s.Len(11))
+	}
+}
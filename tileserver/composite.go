@@ -0,0 +1,149 @@
+package tileserver
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/jpeg" // Basemap tiles may be JPEG
+	"image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Hugi-R/wplace-archive-world-map/img"
+	"github.com/gorilla/mux"
+)
+
+// Timeout of a basemap tile request
+const basemapTimeout = 10 * time.Second
+
+// Largest basemap tile read, a bigger response is an error
+const maxBasemapSize = 8 << 20
+
+// errBasemap wraps the failures to get a basemap tile, answered 502
+var errBasemap = errors.New("basemap unavailable")
+
+// basemapTileURL fills the {z}, {x} and {y} of the template, XYZ coordinates like the DBs
+func basemapTileURL(template string, z, x, y int) string {
+	return strings.NewReplacer("{z}", strconv.Itoa(z), "{x}", strconv.Itoa(x), "{y}", strconv.Itoa(y)).Replace(template)
+}
+
+// fetchBasemap downloads and decodes the basemap tile z/x/y
+func (ts *TileServer) fetchBasemap(ctx context.Context, z, x, y int) (image.Image, error) {
+	url := basemapTileURL(ts.basemapURL, z, x, y)
+	ctx, cancel := context.WithTimeout(ctx, basemapTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid basemap URL %s: %w", url, err)
+	}
+	// Tile providers like OpenStreetMap require an identifying User-Agent
+	req.Header.Set("User-Agent", "wplace-archive-world-map tileserver")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch basemap tile %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch basemap tile %s: status %d", url, resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBasemapSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch basemap tile %s: %w", url, err)
+	}
+	if len(data) > maxBasemapSize {
+		return nil, fmt.Errorf("basemap tile %s is larger than %d bytes", url, maxBasemapSize)
+	}
+	basemap, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode basemap tile %s: %w", url, err)
+	}
+	return basemap, nil
+}
+
+// CompositeTile returns the tile of the version drawn over the basemap tile, as PNG.
+// Transparent pixels of the tile show the basemap, which is resized to the tile size.
+// A missing tile returns the basemap alone.
+func (ts *TileServer) CompositeTile(ctx context.Context, z, x, y int, version string) ([]byte, error) {
+	key := version + "/" + GetTileKey(z, x, y)
+	if data, ok := ts.compositeTiles.Get(key); ok {
+		return data, nil
+	}
+	ts.mu.RLock()
+	size, exists := ts.tileSizes[version]
+	ts.mu.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("requested version %s not found", version)
+	}
+	tile, err := ts.getImage(z, x, y, version)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	basemap, err := ts.fetchBasemap(ctx, z, x, y)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errBasemap, err)
+	}
+	if tile != nil {
+		size = tile.Bounds().Dx()
+	}
+	if basemap.Bounds().Dx() != size || basemap.Bounds().Dy() != size {
+		basemap = img.ResizeNearest(basemap, size, size)
+	}
+
+	// Like the preview, tile pixels are either transparent or opaque
+	out := image.NewNRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(out, out.Bounds(), basemap, basemap.Bounds().Min, draw.Src)
+	if tile != nil {
+		draw.Draw(out, out.Bounds(), tile, tile.Bounds().Min, draw.Over)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, out); err != nil {
+		return nil, err
+	}
+	data := buf.Bytes()
+	ts.compositeTiles.Put(key, data)
+	return data, nil
+}
+
+// serveComposite serves the tile of the version drawn over the basemap tile, see CompositeTile
+func (ts *TileServer) serveComposite(w http.ResponseWriter, r *http.Request) {
+	if ts.basemapURL == "" {
+		http.Error(w, "Compositing is disabled, no basemap URL configured", http.StatusNotFound)
+		return
+	}
+	version := mux.Vars(r)["version"]
+	ts.mu.RLock()
+	_, exists := ts.versionDescriptions[version]
+	ts.mu.RUnlock()
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+	z, x, y, ok := ts.requestCoords(w, r)
+	if !ok {
+		return
+	}
+	data, err := ts.CompositeTile(r.Context(), z, x, y, version)
+	if err != nil {
+		slog.Error("failed to composite tile", "version", version, "tile", GetTileKey(z, x, y), "err", err)
+		if errors.Is(err, errBasemap) {
+			http.Error(w, "Basemap unavailable", http.StatusBadGateway)
+		} else if errors.Is(err, errMissingBase) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		} else {
+			http.Error(w, "Compositing error", http.StatusInternalServerError)
+		}
+		return
+	}
+	setTileHeaders(w, "png", fmt.Sprintf(`"%s-%s.composite"`, version, GetTileKey(z, x, y)))
+	modTime := ts.versionTime(version)
+	setTileDate(w, modTime)
+	http.ServeContent(w, r, "", modTime, bytes.NewReader(data))
+}
@@ -0,0 +1,74 @@
+package tileserver
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+
+	"github.com/Hugi-R/wplace-archive-world-map/logging"
+	"github.com/Hugi-R/wplace-archive-world-map/store"
+)
+
+// Consolidate copies the version DBs of dataPath, the v*.db files served by default, into the consolidated DB at out,
+// served with -single-db, see store.ConsolidatedDB. The versions already in out are skipped, so it can be run
+// again to add the new versions. It returns the count of versions added.
+func Consolidate(dataPath, out string) (int, error) {
+	files, err := os.ReadDir(dataPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read directory: %w", err)
+	}
+	var names []string
+	for _, file := range files {
+		if _, _, ok := parseDBFileName(file.Name()); ok && !file.IsDir() {
+			names = append(names, file.Name())
+		}
+	}
+	if len(names) == 0 {
+		return 0, fmt.Errorf("no database files found in %s (looking for v*.db files)", dataPath)
+	}
+	slices.Sort(names)
+
+	db, err := store.NewConsolidatedDB(out, false)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	added := 0
+	for _, name := range names {
+		version, description, _ := parseDBFileName(name)
+		ok, err := db.AddVersion(version, description, path.Join(dataPath, name))
+		if err != nil {
+			return added, err
+		}
+		if !ok {
+			slog.Info("skipped version, already consolidated", "version", version, "file", name)
+			continue
+		}
+		added++
+	}
+	return added, nil
+}
+
+// ConsolidateMain runs the consolidate command line, args without the program name
+func ConsolidateMain(args []string) error {
+	fs := flag.NewFlagSet("consolidate", flag.ExitOnError)
+	dataPath := fs.String("data", envString("DATA_PATH", "."), "Folder of the version DBs (env DATA_PATH)")
+	out := fs.String("out", "", "Mandatory path of the consolidated DB, created if missing, new versions are added to an existing one")
+	fs.Parse(args)
+	if err := logging.Setup(); err != nil {
+		return err
+	}
+	if *out == "" {
+		return fmt.Errorf("missing required flag: --out")
+	}
+
+	added, err := Consolidate(*dataPath, *out)
+	if err != nil {
+		return err
+	}
+	slog.Info("consolidation done", "out", *out, "added", added)
+	return nil
+}
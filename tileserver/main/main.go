@@ -0,0 +1,14 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/Hugi-R/wplace-archive-world-map/tileserver"
+)
+
+func main() {
+	if err := tileserver.Main(os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,286 @@
+package tileserver
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Hugi-R/wplace-archive-world-map/store"
+	"github.com/gorilla/mux"
+)
+
+// Highest zoom level of the DBs
+const maxZoom = 11
+
+// exportRegion is an inclusive range of tiles at level Z.
+// The export holds the tiles of every level overlapping it.
+type exportRegion struct {
+	Z, MinX, MinY, MaxX, MaxY int
+}
+
+// worldRegion is the whole map
+var worldRegion = exportRegion{}
+
+// parseRegion parses a region like z/minX/minY/maxX/maxY, the whole map if empty
+func parseRegion(s string) (exportRegion, error) {
+	if s == "" {
+		return worldRegion, nil
+	}
+	parts := strings.Split(s, "/")
+	if len(parts) != 5 {
+		return exportRegion{}, fmt.Errorf("invalid region %s, expected z/minX/minY/maxX/maxY", s)
+	}
+	var values [5]int
+	for i, p := range parts {
+		v, err := strconv.Atoi(p)
+		if err != nil {
+			return exportRegion{}, fmt.Errorf("invalid region %s: %w", s, err)
+		}
+		values[i] = v
+	}
+	r := exportRegion{Z: values[0], MinX: values[1], MinY: values[2], MaxX: values[3], MaxY: values[4]}
+	if r.Z < 0 || r.Z > maxZoom || r.MinX < 0 || r.MinY < 0 || r.MinX > r.MaxX || r.MinY > r.MaxY || r.MaxX >= 1<<r.Z || r.MaxY >= 1<<r.Z {
+		return exportRegion{}, fmt.Errorf("invalid region %s, tiles out of level %d", s, r.Z)
+	}
+	return r, nil
+}
+
+// flipY returns the region with its rows flipped between the TMS and XYZ schemes, see store.FlipY
+func (r exportRegion) flipY() exportRegion {
+	if r == worldRegion {
+		return r
+	}
+	r.MinY, r.MaxY = store.FlipY(r.Z, r.MaxY), store.FlipY(r.Z, r.MinY)
+	return r
+}
+
+// level returns the inclusive range of the tiles of level z overlapping the region
+func (r exportRegion) level(z int) (minX, minY, maxX, maxY int) {
+	if z <= r.Z {
+		shift := r.Z - z
+		return r.MinX >> shift, r.MinY >> shift, r.MaxX >> shift, r.MaxY >> shift
+	}
+	shift := z - r.Z
+	return r.MinX << shift, r.MinY << shift, (r.MaxX+1)<<shift - 1, (r.MaxY+1)<<shift - 1
+}
+
+// bounds returns the region in degrees: west, south, east, north
+func (r exportRegion) bounds() [4]float64 {
+	return [4]float64{
+		tileLon(r.MinX, r.Z), tileLat(r.MaxY+1, r.Z),
+		tileLon(r.MaxX+1, r.Z), tileLat(r.MinY, r.Z),
+	}
+}
+
+// tileLon is the longitude of the west edge of the tiles of column x
+func tileLon(x, z int) float64 {
+	return float64(x)/float64(int(1)<<z)*360 - 180
+}
+
+// tileLat is the latitude of the north edge of the tiles of row y, Web Mercator
+func tileLat(y, z int) float64 {
+	n := math.Pi - 2*math.Pi*float64(y)/float64(int(1)<<z)
+	return math.Atan(math.Sinh(n)) * 180 / math.Pi
+}
+
+// listRegion lists the tiles of the version in the region, with the tiles of the base for a diff version
+func (ts *TileServer) listRegion(version string, region exportRegion) ([][3]int, error) {
+	versions := []string{version}
+	if base, _, isDiff := strings.Cut(version, "."); isDiff {
+		versions = append(versions, base)
+	}
+	var tiles [][3]int
+	for z := 0; z <= maxZoom; z++ {
+		minX, minY, maxX, maxY := region.level(z)
+		level := make(map[[2]int]bool)
+		for _, v := range versions {
+			if err := ts.listLevel(v, z, minX, minY, maxX, maxY, level); err != nil {
+				return nil, err
+			}
+		}
+		for t := range level {
+			tiles = append(tiles, [3]int{z, t[0], t[1]})
+		}
+	}
+	return tiles, nil
+}
+
+// listLevel adds the tiles of level z of the version in the range to level
+func (ts *TileServer) listLevel(version string, z, minX, minY, maxX, maxY int, level map[[2]int]bool) error {
+	// Hold the lock during the query, so a rescan doesn't close the DB meanwhile
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	db, exists := ts.dbPool[version]
+	if !exists {
+		return fmt.Errorf("requested version %s not found", version)
+	}
+	query := "SELECT x, y FROM tiles WHERE z = ? AND x BETWEEN ? AND ? AND y BETWEEN ? AND ?"
+	args := []any{z, minX, maxX, minY, maxY}
+	if ts.singleDB != "" {
+		query += " AND version = ?"
+		args = append(args, version)
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to list tiles of %s level %d: %w", version, z, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var x, y int
+		if err := rows.Scan(&x, &y); err != nil {
+			return fmt.Errorf("failed to list tiles of %s level %d: %w", version, z, err)
+		}
+		level[[2]int{x, y}] = true
+	}
+	return rows.Err()
+}
+
+// exportTile is GetTile without the caches, an export would evict the tiles being served
+func (ts *TileServer) exportTile(z, x, y int, version string) ([]byte, error) {
+	if !strings.Contains(version, ".") {
+		return ts.readRawTile(z, x, y, version)
+	}
+	data, _, err := ts.undiffTile(z, x, y, version, ts.readRawTile)
+	return data, err
+}
+
+// writeMBTiles writes the tiles of the version in the region to a new MBTiles file, see https://github.com/mapbox/mbtiles-spec.
+// Diff versions are reconstructed from their base. MBTiles rows follow the TMS scheme, y is flipped.
+func (ts *TileServer) writeMBTiles(ctx context.Context, filename, version string, region exportRegion) error {
+	ts.mu.RLock()
+	date, exists := ts.versionDescriptions[version]
+	ts.mu.RUnlock()
+	if !exists {
+		return fmt.Errorf("requested version %s not found", version)
+	}
+	tiles, err := ts.listRegion(version, region)
+	if err != nil {
+		return err
+	}
+
+	db, err := sql.Open("sqlite3", filename+"?_journal_mode=OFF&_synchronous=OFF")
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", filename, err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(`CREATE TABLE metadata (name TEXT, value TEXT);
+		CREATE TABLE tiles (zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_data BLOB);
+		CREATE UNIQUE INDEX tile_index ON tiles (zoom_level, tile_column, tile_row);`)
+	if err != nil {
+		return fmt.Errorf("failed to create the MBTiles schema: %w", err)
+	}
+	bounds := region.bounds()
+	metadata := [][2]string{
+		{"name", "Wplace " + version},
+		{"format", "png"},
+		{"type", "overlay"},
+		{"version", "1.0.0"},
+		{"description", date},
+		{"attribution", "Wplace (wplace.live)"},
+		{"minzoom", "0"},
+		{"maxzoom", strconv.Itoa(maxZoom)},
+		{"bounds", fmt.Sprintf("%f,%f,%f,%f", bounds[0], bounds[1], bounds[2], bounds[3])},
+	}
+	for _, m := range metadata {
+		if _, err := db.Exec("INSERT INTO metadata (name, value) VALUES (?, ?)", m[0], m[1]); err != nil {
+			return fmt.Errorf("failed to write the MBTiles metadata: %w", err)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	insert, err := tx.Prepare("INSERT INTO tiles (zoom_level, tile_column, tile_row, tile_data) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+	for _, t := range tiles {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		z, x, y := t[0], t[1], t[2]
+		data, err := ts.exportTile(z, x, y, version)
+		if errors.Is(err, sql.ErrNoRows) {
+			// Removed by a rescan since listed
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := insert.Exec(z, x, (1<<z)-1-y, data); err != nil {
+			return fmt.Errorf("failed to write tile %d/%d/%d: %w", z, x, y, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// serveMBTiles exports a version, or the region of the region query parameter, as an MBTiles file.
+// The file is built on disk then streamed, so it is never held in memory.
+func (ts *TileServer) serveMBTiles(w http.ResponseWriter, r *http.Request) {
+	version := mux.Vars(r)["version"]
+	ts.mu.RLock()
+	_, exists := ts.versionDescriptions[version]
+	ts.mu.RUnlock()
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+	region, err := parseRegion(r.URL.Query().Get("region"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if ts.scheme == store.SchemeTMS {
+		// The rows of the region follow the scheme of the tile URLs
+		region = region.flipY()
+	}
+	if !ts.exportMu.TryLock() {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "An export is already running", http.StatusServiceUnavailable)
+		return
+	}
+	defer ts.exportMu.Unlock()
+	// An export outlasts the write timeout of the tile requests
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	tmp, err := os.CreateTemp(ts.exportDir, "export-*.mbtiles")
+	if err != nil {
+		slog.Error("failed to create export file", "err", err)
+		http.Error(w, "Export error", http.StatusInternalServerError)
+		return
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if err := ts.writeMBTiles(r.Context(), tmp.Name(), version, region); err != nil {
+		if errors.Is(err, errMissingBase) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		slog.Error("failed to export", "version", version, "err", err)
+		http.Error(w, "Export error", http.StatusInternalServerError)
+		return
+	}
+
+	f, err := os.Open(tmp.Name())
+	if err != nil {
+		slog.Error("failed to open export file", "err", err)
+		http.Error(w, "Export error", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/vnd.sqlite3")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.mbtiles"`, version))
+	http.ServeContent(w, r, "", time.Now(), f)
+}
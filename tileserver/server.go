@@ -1,45 +1,213 @@
-// A single file tile server reading from a pre-computed SQlite DB.
-package main
+// Package tileserver is a tile server reading from pre-computed SQlite DBs.
+package tileserver
 
 import (
 	"bytes"
+	"compress/gzip"
+	"container/list"
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"image"
-	"image/color"
+	"image/draw"
 	"image/png"
 	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/Hugi-R/wplace-archive-world-map/img"
+	"github.com/Hugi-R/wplace-archive-world-map/logging"
+	"github.com/Hugi-R/wplace-archive-world-map/profiling"
+	"github.com/Hugi-R/wplace-archive-world-map/releases"
+	"github.com/Hugi-R/wplace-archive-world-map/store"
 	"github.com/gorilla/mux"
 	_ "github.com/mattn/go-sqlite3"
 )
 
 type TileServer struct {
-	dataPath            string
-	dbPool              map[string]*sql.DB
-	stmts               map[string]*sql.Stmt
+	dataPath string
+	singleDB string // Path of the consolidated DB serving every version, see store.ConsolidatedDB. Empty serves the DB files of dataPath
+	// mu guards the versions, they change when the data folder is rescanned
+	mu                  sync.RWMutex
+	dbFiles             map[string]string  // Version to DB file name
+	dbPool              map[string]*sql.DB // With singleDB, every version shares the consolidated DB
+	stmts               map[string]dbStmts
+	single              *sql.DB // Consolidated DB with singleDB, nil until opened
+	singleStmts         dbStmts // Statements of the consolidated DB, shared by the versions
 	versionDescriptions map[string]string
+	tileSizes           map[string]int               // Version to width and height of its tiles, see store.ReadTileSize
+	versionMeta         map[string]map[string]string // Version to the meta table of its DB, see store.ReadMeta
 	indexHtml           string
 	latestVersion       string
+	previewZoom         int // Zoom of the preview image
 	previewImage        []byte
+	previewVersion      string       // Latest version when previewImage was rendered
+	previewRenders      atomic.Int64 // Count of preview images rendered, see refreshPreview
 	faviconData         []byte
+	rawTiles            *tileCache
+	webpTiles           *tileCache
+	undiffTiles         *tileCache
+	compositeTiles      *tileCache
+	basemapURL          string           // Template of the basemap tile URLs, with {z}, {x} and {y}, see CompositeTile
+	scheme              store.TileScheme // Scheme of the requested tile coordinates, the DBs are XYZ
+	exportDir           string           // Folder of the temporary MBTiles exports, the system temp folder if empty
+	exportMu            sync.Mutex       // A single export at a time, they are heavy on disk and CPU
 }
 
-func NewTileServer(dataPath string) (*TileServer, error) {
+// dbStmts are the prepared statements of a version DB
+type dbStmts struct {
+	tile *sql.Stmt // Tile data
+	stat *sql.Stmt // Tile size and CRC, without reading the data
+	// Version bound before z, x and y in the statements of a consolidated DB, empty for a version DB
+	version string
+}
+
+func (s dbStmts) Close() error {
+	return errors.Join(s.tile.Close(), s.stat.Close())
+}
+
+// args are the arguments of the statements for the tile z/x/y
+func (s dbStmts) args(z, x, y int) []any {
+	if s.version == "" {
+		return []any{z, x, y}
+	}
+	return []any{s.version, z, x, y}
+}
+
+// forVersion returns the statements of a consolidated DB bound to the version
+func (s dbStmts) forVersion(version string) dbStmts {
+	s.version = version
+	return s
+}
+
+// Default maximum number of tiles kept in memory, per cache
+const defaultTileCacheSize = 4096
+
+// tileCache is a LRU cache of tiles (stored, transcoded, reconstructed), keyed by version/z/x/y.
+// DBs are immutable once published, so entries are never invalidated.
+type tileCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	order      *list.List // Of *tileCacheEntry, most recently used first
+	tiles      map[string]*list.Element
+	hits       atomic.Int64
+	misses     atomic.Int64
+}
+
+type tileCacheEntry struct {
+	key  string
+	data []byte
+}
+
+// CacheStats reports the usage of a tile cache, to tune its size
+type CacheStats struct {
+	Entries int   `json:"entries"`
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+}
+
+func newTileCache(maxEntries int) *tileCache {
+	return &tileCache{
+		maxEntries: maxEntries,
+		order:      list.New(),
+		tiles:      make(map[string]*list.Element),
+	}
+}
+
+func (c *tileCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.tiles[key]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	c.order.MoveToFront(elem)
+	return elem.Value.(*tileCacheEntry).data, true
+}
+
+func (c *tileCache) Put(key string, data []byte) {
+	if c.maxEntries <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.tiles[key]; ok {
+		elem.Value.(*tileCacheEntry).data = data
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.tiles[key] = c.order.PushFront(&tileCacheEntry{key: key, data: data})
+	if c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.tiles, oldest.Value.(*tileCacheEntry).key)
+	}
+}
+
+// Purge drops the tiles of version, and of its diff versions when it's a base
+func (c *tileCache) Purge(version string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, elem := range c.tiles {
+		if strings.HasPrefix(key, version+"/") || strings.HasPrefix(key, version+".") {
+			c.order.Remove(elem)
+			delete(c.tiles, key)
+		}
+	}
+}
+
+func (c *tileCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{Entries: c.order.Len(), Hits: c.hits.Load(), Misses: c.misses.Load()}
+}
+
+// NewTileServer serves the DBs of dataPath, keeping up to cacheSize tiles in memory per cache.
+// The preview image shows the level previewZoom.
+func NewTileServer(dataPath string, cacheSize int, previewZoom int) (*TileServer, error) {
+	return newTileServer(dataPath, "", cacheSize, previewZoom)
+}
+
+// NewSingleDBTileServer is NewTileServer serving the versions of the consolidated DB at singleDB,
+// see store.ConsolidatedDB, instead of the DB files of dataPath. dataPath still holds the other files, like index.html.tmpl.
+func NewSingleDBTileServer(dataPath, singleDB string, cacheSize int, previewZoom int) (*TileServer, error) {
+	return newTileServer(dataPath, singleDB, cacheSize, previewZoom)
+}
+
+func newTileServer(dataPath, singleDB string, cacheSize int, previewZoom int) (*TileServer, error) {
 	ts := &TileServer{
 		dataPath:            dataPath,
+		singleDB:            singleDB,
+		previewZoom:         previewZoom,
+		dbFiles:             make(map[string]string),
 		dbPool:              make(map[string]*sql.DB),
-		stmts:               make(map[string]*sql.Stmt),
+		stmts:               make(map[string]dbStmts),
 		versionDescriptions: make(map[string]string),
+		tileSizes:           make(map[string]int),
+		versionMeta:         make(map[string]map[string]string),
 		indexHtml:           "",
+		rawTiles:            newTileCache(cacheSize),
+		webpTiles:           newTileCache(cacheSize),
+		undiffTiles:         newTileCache(cacheSize),
+		compositeTiles:      newTileCache(cacheSize),
 	}
 
 	if err := ts.initializeDatabases(); err != nil {
@@ -48,107 +216,340 @@ func NewTileServer(dataPath string) (*TileServer, error) {
 	if err := ts.initializeIndex(); err != nil {
 		return nil, err
 	}
+	ts.refreshPreview()
 	var err error
-	ts.previewImage, err = ts.MakeLatestImage()
-	if err != nil {
-		fmt.Printf("Warning: failed to create preview image: %v\n", err)
-	}
 	ts.faviconData, err = ts.MakeFavicon()
 	if err != nil {
-		fmt.Printf("Warning: failed to load favicon: %v\n", err)
+		slog.Warn("failed to load favicon", "err", err)
 	}
 	return ts, nil
 }
 
 // initializeDatabases scans for database files and initializes connections
 func (ts *TileServer) initializeDatabases() error {
+	if _, err := ts.scanDatabases(); err != nil {
+		return err
+	}
+	if len(ts.dbPool) == 0 {
+		if ts.singleDB != "" {
+			return fmt.Errorf("no version found in %s", ts.singleDB)
+		}
+		return fmt.Errorf("no database files found (looking for v*.db files)")
+	}
+	slog.Info("initialized databases", "count", len(ts.dbPool))
+	return nil
+}
+
+// parseDBFileName extracts the version and description of a DB file (v1_desc.db -> v1, desc)
+func parseDBFileName(filename string) (version, description string, ok bool) {
+	if !strings.HasPrefix(filename, "v") || !strings.HasSuffix(filename, ".db") {
+		return "", "", false
+	}
+	name := strings.TrimSuffix(filename, ".db")
+	version, description, _ = strings.Cut(name, "_")
+	return version, description, true
+}
+
+// openReadOnly opens a DB file read-only, with the connection pool of the server
+func openReadOnly(filename string) (*sql.DB, error) {
+	// The shared cache and read-only mode are SQLite URI parameters, only honored in a file: URI
+	db, err := sql.Open("sqlite3", store.FileDSN(filename, url.Values{"cache": {"shared"}, "mode": {"ro"}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database %s: %w", filename, err)
+	}
+
+	// Configure connection pool
+	db.SetMaxOpenConns(10)
+	db.SetMaxIdleConns(3)
+	db.SetConnMaxLifetime(24 * time.Hour) // Once a day refresh connections
+
+	// Test the connection
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to ping database %s: %w", filename, err)
+	}
+	return db, nil
+}
+
+// openDatabase opens a DB file read-only and prepares its statements
+func openDatabase(filename string) (*sql.DB, dbStmts, error) {
+	db, err := openReadOnly(filename)
+	if err != nil {
+		return nil, dbStmts{}, err
+	}
+
+	dedup, err := store.DetectDedup(db)
+	if err != nil {
+		db.Close()
+		return nil, dbStmts{}, fmt.Errorf("failed to read schema of %s: %w", filename, err)
+	}
+	from := store.TilesFrom(dedup)
+
+	// Prepare the statements for this database
+	var stmts dbStmts
+	stmts.tile, err = db.Prepare("SELECT data FROM " + from + " WHERE z = ? AND x = ? AND y = ?")
+	if err != nil {
+		db.Close()
+		return nil, dbStmts{}, fmt.Errorf("failed to prepare statement for %s: %w", filename, err)
+	}
+	stmts.stat, err = db.Prepare("SELECT length(data), COALESCE(crc32, 0), substr(data, 1, 1) = X'01' FROM " + from + " WHERE z = ? AND x = ? AND y = ?")
+	if err != nil {
+		db.Close()
+		return nil, dbStmts{}, fmt.Errorf("failed to prepare statement for %s: %w", filename, err)
+	}
+	return db, stmts, nil
+}
+
+// openConsolidated opens a consolidated DB read-only and prepares its statements, binding the version first
+func openConsolidated(filename string) (*sql.DB, dbStmts, error) {
+	db, err := openReadOnly(filename)
+	if err != nil {
+		return nil, dbStmts{}, err
+	}
+	var stmts dbStmts
+	stmts.tile, err = db.Prepare("SELECT data FROM tiles WHERE version = ? AND z = ? AND x = ? AND y = ?")
+	if err != nil {
+		db.Close()
+		return nil, dbStmts{}, fmt.Errorf("failed to prepare statement for %s: %w", filename, err)
+	}
+	stmts.stat, err = db.Prepare("SELECT length(data), COALESCE(crc32, 0), substr(data, 1, 1) = X'01' FROM tiles WHERE version = ? AND z = ? AND x = ? AND y = ?")
+	if err != nil {
+		stmts.tile.Close()
+		db.Close()
+		return nil, dbStmts{}, fmt.Errorf("failed to prepare statement for %s: %w", filename, err)
+	}
+	return db, stmts, nil
+}
+
+// scanDatabases opens the DB files that appeared in the data folder, and closes those removed.
+// A file failing to open, like one still being copied, is skipped and retried on the next scan.
+// It returns whether the versions changed.
+func (ts *TileServer) scanDatabases() (bool, error) {
+	if ts.singleDB != "" {
+		return ts.scanConsolidated()
+	}
 	files, err := os.ReadDir(ts.dataPath)
 	if err != nil {
-		return fmt.Errorf("failed to read directory: %w", err)
+		return false, fmt.Errorf("failed to read directory: %w", err)
 	}
 
-	dbCount := 0
+	found := make(map[string]string)
+	descriptions := make(map[string]string)
 	for _, file := range files {
 		if file.IsDir() {
 			continue
 		}
-
-		filename := file.Name()
-		if !strings.HasPrefix(filename, "v") || !strings.HasSuffix(filename, ".db") {
+		version, description, ok := parseDBFileName(file.Name())
+		if !ok {
 			continue
 		}
+		found[version] = file.Name()
+		descriptions[version] = description
+	}
 
-		// Extract version from filename (v1_*.db -> 1, desc)
-		name := strings.TrimSuffix(filename, ".db")
-		parts := strings.Split(name, "_")
-		var version string
-		var description string
-		if len(parts) == 2 {
-			version = parts[0]
-			description = parts[1]
-		} else {
-			version = parts[0]
-			description = ""
+	ts.mu.RLock()
+	opened := make(map[string]string)
+	for version, filename := range found {
+		if ts.dbFiles[version] != filename {
+			opened[version] = filename
+		}
+	}
+	removed := make([]string, 0)
+	for version, filename := range ts.dbFiles {
+		if found[version] != filename {
+			removed = append(removed, version)
 		}
-		ts.versionDescriptions[version] = description
+	}
+	ts.mu.RUnlock()
+	if len(opened) == 0 && len(removed) == 0 {
+		return false, nil
+	}
 
+	// Open outside the lock, requests keep being served meanwhile
+	dbs := make(map[string]*sql.DB)
+	stmts := make(map[string]dbStmts)
+	sizes := make(map[string]int)
+	metas := make(map[string]map[string]string)
+	for version, filename := range opened {
 		filename = ts.dataPath + "/" + filename
-		log.Printf("Initializing database: %s (version %s)", filename, version)
-
-		db, err := sql.Open("sqlite3", filename+"?cache=shared&mode=ro")
+		slog.Info("initializing database", "file", filename, "version", version)
+		db, stmt, err := openDatabase(filename)
+		if err == nil {
+			sizes[version], err = store.ReadTileSize(db)
+			if err == nil {
+				metas[version], err = store.ReadMeta(db)
+			}
+			if err != nil {
+				stmt.Close()
+				db.Close()
+				err = fmt.Errorf("failed to read meta of %s: %w", filename, err)
+			}
+		}
 		if err != nil {
-			return fmt.Errorf("failed to open database %s: %w", filename, err)
+			// Maybe still being copied, it is retried on the next scan
+			slog.Warn("skipping database", "file", filename, "version", version, "err", err)
+			delete(opened, version)
+			continue
 		}
+		dbs[version] = db
+		stmts[version] = stmt
+	}
+	if len(opened) == 0 && len(removed) == 0 {
+		return false, nil
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for _, version := range removed {
+		slog.Info("closing database", "file", ts.dbFiles[version], "version", version)
+		ts.stmts[version].Close()
+		ts.dbPool[version].Close()
+		ts.dropVersion(version)
+	}
+	for version, db := range dbs {
+		ts.dbFiles[version] = opened[version]
+		ts.dbPool[version] = db
+		ts.stmts[version] = stmts[version]
+		ts.versionDescriptions[version] = descriptions[version]
+		ts.tileSizes[version] = sizes[version]
+		ts.versionMeta[version] = metas[version]
+	}
+	return true, nil
+}
 
-		// Configure connection pool
-		db.SetMaxOpenConns(10)
-		db.SetMaxIdleConns(3)
-		db.SetConnMaxLifetime(24 * time.Hour) // Once a day refresh connections
+// dropVersion forgets a version and purges its cached tiles, its DB already closed. The caller holds mu.
+func (ts *TileServer) dropVersion(version string) {
+	delete(ts.stmts, version)
+	delete(ts.dbPool, version)
+	delete(ts.dbFiles, version)
+	delete(ts.versionDescriptions, version)
+	delete(ts.tileSizes, version)
+	delete(ts.versionMeta, version)
+	// A new file may reuse the version
+	ts.rawTiles.Purge(version)
+	ts.undiffTiles.Purge(version)
+	ts.webpTiles.Purge(version)
+	ts.compositeTiles.Purge(version)
+}
 
-		// Test the connection
-		if err := db.Ping(); err != nil {
-			db.Close()
-			return fmt.Errorf("failed to ping database %s: %w", filename, err)
+// scanConsolidated is scanDatabases with singleDB: it opens the consolidated DB the first time,
+// then picks up the versions added to or removed from it.
+func (ts *TileServer) scanConsolidated() (bool, error) {
+	ts.mu.RLock()
+	db := ts.single
+	ts.mu.RUnlock()
+	if db == nil {
+		slog.Info("initializing consolidated database", "file", ts.singleDB)
+		var stmts dbStmts
+		var err error
+		db, stmts, err = openConsolidated(ts.singleDB)
+		if err != nil {
+			return false, err
 		}
+		ts.mu.Lock()
+		ts.single, ts.singleStmts = db, stmts
+		ts.mu.Unlock()
+	}
+	versions, err := store.ReadConsolidatedVersions(db)
+	if err != nil {
+		return false, fmt.Errorf("failed to read versions of %s: %w", ts.singleDB, err)
+	}
 
-		// Prepare the statement for this database
-		stmt, err := db.Prepare("SELECT data FROM tiles WHERE z = ? AND x = ? AND y = ?")
-		if err != nil {
-			db.Close()
-			return fmt.Errorf("failed to prepare statement for %s: %w", filename, err)
+	filename := path.Base(ts.singleDB)
+	found := make(map[string]bool, len(versions))
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	changed := false
+	for _, v := range versions {
+		found[v.Version] = true
+		if _, exists := ts.stmts[v.Version]; exists {
+			continue
+		}
+		ts.dbFiles[v.Version] = filename
+		ts.dbPool[v.Version] = db
+		ts.stmts[v.Version] = ts.singleStmts.forVersion(v.Version)
+		ts.versionDescriptions[v.Version] = v.Description
+		ts.tileSizes[v.Version] = v.TileSize
+		ts.versionMeta[v.Version] = v.Meta
+		changed = true
+	}
+	for version := range ts.stmts {
+		if !found[version] {
+			slog.Info("removing version", "file", filename, "version", version)
+			ts.dropVersion(version)
+			changed = true
 		}
+	}
+	return changed, nil
+}
 
-		ts.stmts[version] = stmt
-		ts.dbPool[version] = db
-		dbCount++
+// Rescan picks up the DB files added or removed from the data folder,
+// and refreshes the index and the preview image
+func (ts *TileServer) Rescan() error {
+	changed, err := ts.scanDatabases()
+	if err != nil || !changed {
+		return err
 	}
 
-	if dbCount == 0 {
-		return fmt.Errorf("no database files found (looking for v*.db files)")
+	ts.mu.Lock()
+	previousLatest := ts.latestVersion
+	err = ts.initializeIndex()
+	latest := ts.latestVersion
+	count := len(ts.dbPool)
+	ts.mu.Unlock()
+	if err != nil {
+		return err
 	}
+	slog.Info("serving databases", "count", count, "latest", latest)
 
-	log.Printf("Initialized %d database(s)", dbCount)
+	if latest != previousLatest {
+		ts.refreshPreview()
+	}
 	return nil
 }
 
+// refreshPreview renders the preview image of the latest version.
+// It is rendered outside the lock, reading tiles, then swapped under it.
+// When rendering fails, the previous preview is kept, or without one, the latest tiles alone are a fallback.
+func (ts *TileServer) refreshPreview() {
+	ts.mu.RLock()
+	latest := ts.latestVersion
+	ts.mu.RUnlock()
+	preview, err := ts.makePreviewImage(ts.previewZoom, latest)
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if err != nil {
+		slog.Warn("failed to create preview image", "version", latest, "err", err)
+		if ts.previewImage != nil || preview == nil {
+			return
+		}
+	}
+	ts.previewImage = preview
+	ts.previewVersion = latest
+	slog.Info("rendered preview image", "version", latest, "renders", ts.previewRenders.Add(1))
+}
+
+// watch rescans the data folder every interval
+func (ts *TileServer) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := ts.Rescan(); err != nil {
+			slog.Error("rescan failed", "err", err)
+		}
+	}
+}
+
+// initializeIndex sorts the versions and renders the index. The caller holds mu, if serving.
 func (ts *TileServer) initializeIndex() error {
 	// Collect versions and sort numerically
 	versions := make([]string, 0, len(ts.versionDescriptions))
 	for v := range ts.versionDescriptions {
 		versions = append(versions, v)
 	}
-	// Sort by numeric value after "v"
-	sort.Slice(versions, func(i, j int) bool {
-		vi := strings.TrimPrefix(versions[i], "v")
-		vj := strings.TrimPrefix(versions[j], "v")
-		// Try float comparison, fallback to string
-		fi, erri := strconv.ParseFloat(vi, 64)
-		fj, errj := strconv.ParseFloat(vj, 64)
-		if erri == nil && errj == nil {
-			return fi < fj
-		}
-		return vi < vj
-	})
+	if len(versions) == 0 {
+		return fmt.Errorf("no versions to serve")
+	}
+	sortVersions(versions)
 	ts.latestVersion = versions[len(versions)-1]
 
 	// load index.html.tmpl and replace $$VERSION_OPTIONS$$ with options
@@ -169,6 +570,28 @@ func (ts *TileServer) initializeIndex() error {
 	return nil
 }
 
+// sortVersions sorts versions chronologically, by major then minor, a base before its diffs.
+// The minor is an hour in the week, so v0.048 is before v0.120. Unknown versions come last, by name.
+func sortVersions(versions []string) {
+	sort.Slice(versions, func(i, j int) bool {
+		pi, erri := releases.ProcessedVersionFromString(versions[i])
+		pj, errj := releases.ProcessedVersionFromString(versions[j])
+		if erri != nil || errj != nil {
+			if erri == nil || errj == nil {
+				return erri == nil
+			}
+			return versions[i] < versions[j]
+		}
+		if pi.Major != pj.Major {
+			return pi.Major < pj.Major
+		}
+		if pi.IsBase != pj.IsBase {
+			return pi.IsBase
+		}
+		return pi.Minor < pj.Minor
+	})
+}
+
 // GetTileKey generates the key for a tile based on z/x/y coordinates
 func GetTileKey(z, x, y int) string {
 	return fmt.Sprintf("%d/%d/%d", z, x, y)
@@ -176,93 +599,731 @@ func GetTileKey(z, x, y int) string {
 
 // serveTile handles tile requests
 func (ts *TileServer) serveTile(w http.ResponseWriter, r *http.Request) {
+	ts.serveVersionTile(w, r, mux.Vars(r)["version"])
+}
+
+// serveTileAt handles tile requests for a datetime, served from the newest version at that time
+func (ts *TileServer) serveTileAt(w http.ResponseWriter, r *http.Request) {
+	at, err := parseAtTime(mux.Vars(r)["datetime"])
+	if err != nil {
+		http.Error(w, "Invalid datetime", http.StatusBadRequest)
+		return
+	}
+	version, ok := ts.VersionAt(at)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	ts.serveVersionTile(w, r, version)
+}
+
+// Layouts accepted by the datetime tile endpoint, the DB file names use the first one
+var atTimeLayouts = []string{
+	"2006-01-02T15",
+	time.RFC3339,
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+func parseAtTime(s string) (time.Time, error) {
+	var err error
+	for _, layout := range atTimeLayouts {
+		var t time.Time
+		if t, err = time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// VersionAt returns the newest version whose date is at or before t
+func (ts *TileServer) VersionAt(t time.Time) (string, bool) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	best, bestDate := "", time.Time{}
+	for version, desc := range ts.versionDescriptions {
+		date, err := time.Parse("2006-01-02T15", desc)
+		if err != nil || date.After(t) {
+			continue
+		}
+		if best == "" || date.After(bestDate) {
+			best, bestDate = version, date
+		}
+	}
+	return best, best != ""
+}
+
+// tileCoords parses and validates the z, x, y route variables, answering 400 when invalid
+func tileCoords(w http.ResponseWriter, r *http.Request) (z, x, y int, ok bool) {
 	vars := mux.Vars(r)
-	version := vars["version"]
 	zStr := vars["z"]
 	xStr := vars["x"]
 	yStr := vars["y"]
 
 	// Parse coordinates
-	z, err := strconv.Atoi(zStr)
+	var err error
+	z, err = strconv.Atoi(zStr)
 	if err != nil {
 		http.Error(w, "Invalid z coordinate", http.StatusBadRequest)
-		return
+		return 0, 0, 0, false
 	}
 
-	x, err := strconv.Atoi(xStr)
+	x, err = strconv.Atoi(xStr)
 	if err != nil {
 		http.Error(w, "Invalid x coordinate", http.StatusBadRequest)
-		return
+		return 0, 0, 0, false
 	}
 
-	y, err := strconv.Atoi(yStr)
+	y, err = strconv.Atoi(yStr)
 	if err != nil {
 		http.Error(w, "Invalid y coordinate", http.StatusBadRequest)
-		return
+		return 0, 0, 0, false
 	}
 
 	// Validate coordinates (basic sanity check)
 	if z < 0 || z > 11 || x < 0 || y < 0 || x >= (1<<z) || y >= (1<<z) {
 		http.Error(w, "Invalid tile coordinates", http.StatusBadRequest)
+		return 0, 0, 0, false
+	}
+	return z, x, y, true
+}
+
+// requestCoords is tileCoords, with y converted to the XYZ scheme of the DBs
+func (ts *TileServer) requestCoords(w http.ResponseWriter, r *http.Request) (z, x, y int, ok bool) {
+	z, x, y, ok = tileCoords(w, r)
+	if ok && ts.scheme == store.SchemeTMS {
+		y = store.FlipY(z, y)
+	}
+	return z, x, y, ok
+}
+
+// serveVersionTile serves the tile of the request coordinates from version
+func (ts *TileServer) serveVersionTile(w http.ResponseWriter, r *http.Request, version string) {
+	z, x, y, ok := ts.requestCoords(w, r)
+	if !ok {
 		return
 	}
 
-	tileData, err := ts.GetTile(z, x, y, version)
+	format := tileFormat(r)
+	raw := r.URL.Query().Get("raw") != ""
+	if raw {
+		format = "png"
+	}
+	tileKey := GetTileKey(z, x, y)
+	etag := fmt.Sprintf(`"%s-%s"`, version, tileKey)
+	if format == "webp" {
+		etag = fmt.Sprintf(`"%s-%s.webp"`, version, tileKey)
+	} else if raw {
+		etag = fmt.Sprintf(`"%s-%s.raw"`, version, tileKey)
+	}
+
+	modTime := ts.versionTime(version)
+	if r.Method == http.MethodHead {
+		ts.headVersionTile(w, r, z, x, y, version, format, raw, etag, modTime)
+		return
+	}
+
+	var tileData []byte
+	var err error
+	if raw {
+		tileData, err = ts.GetRawTile(z, x, y, version)
+	} else if format == "webp" {
+		tileData, err = ts.GetWebpTile(z, x, y, version)
+	} else {
+		tileData, err = ts.GetTile(z, x, y, version)
+	}
 	if err != nil {
-		if err == sql.ErrNoRows {
+		if errors.Is(err, sql.ErrNoRows) {
 			http.NotFound(w, r)
 			return
 		}
-		log.Printf("Database query error: %v", err)
+		if errors.Is(err, errMissingBase) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		slog.Error("database query error", "err", err)
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
 
-	// Set appropriate headers
-	tileKey := GetTileKey(z, x, y)
-	w.Header().Set("Content-Type", "image/png")
-	w.Header().Set("Content-Length", strconv.Itoa(len(tileData)))
-	w.Header().Set("Cache-Control", "public, max-age=86400") // Cache for 1 day
-	w.Header().Set("ETag", fmt.Sprintf(`"%s-%s"`, version, tileKey))
+	// ServeContent answers conditional and range requests, and sets Content-Length and Last-Modified
+	setTileHeaders(w, format, etag)
+	setTileDate(w, modTime)
+	http.ServeContent(w, r, "", modTime, bytes.NewReader(tileData))
+}
 
-	// Check if client has cached version
-	if match := r.Header.Get("If-None-Match"); match != "" {
-		if match == fmt.Sprintf(`"%s-%s"`, version, tileKey) {
-			w.WriteHeader(http.StatusNotModified)
+// headVersionTile answers a HEAD request on a tile, without reading nor reconstructing it.
+// Like GET, http.ServeContent answers the conditional and range requests, on the stored size, see headTileSize.
+// When the size is only known once the tile is read, Content-Length is left out and ranges are ignored.
+func (ts *TileServer) headVersionTile(w http.ResponseWriter, r *http.Request, z, x, y int, version, format string, raw bool, etag string, modTime time.Time) {
+	size, err := ts.headTileSize(z, x, y, version, format, raw)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) || errors.Is(err, errMissingBase) {
+			w.WriteHeader(http.StatusNotFound)
 			return
 		}
+		slog.Error("database query error", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
+	setTileHeaders(w, format, etag)
+	setTileDate(w, modTime)
+	if size < 0 {
+		r = r.Clone(r.Context())
+		r.Header.Del("Range")
+		w = unknownLength{w}
+		size = 0
+	}
+	http.ServeContent(w, r, "", modTime, &sizeReader{size: int64(size)})
+}
 
-	// Write tile data
-	w.WriteHeader(http.StatusOK)
-	w.Write(tileData)
+// sizeReader is an io.ReadSeeker of size bytes without content, for http.ServeContent to answer HEAD requests
+type sizeReader struct {
+	size, offset int64
 }
 
+func (r *sizeReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (r *sizeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position %d", offset)
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// unknownLength drops the Content-Length of the size given to http.ServeContent, when the real size is unknown
+type unknownLength struct {
+	http.ResponseWriter
+}
+
+func (w unknownLength) WriteHeader(code int) {
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// setTileHeaders sets the headers of a tile response
+func setTileHeaders(w http.ResponseWriter, format, etag string) {
+	w.Header().Set("Content-Type", "image/"+format)
+	w.Header().Set("Cache-Control", "public, max-age=86400") // Cache for 1 day
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Vary", "Accept")
+}
+
+// setTileDate sets the X-Tile-Date header to the capture date of the tile, the date of its version, if known.
+// For a diff version, it is the date of the diff, not of its base.
+func setTileDate(w http.ResponseWriter, date time.Time) {
+	if !date.IsZero() {
+		w.Header().Set("X-Tile-Date", date.UTC().Format(time.RFC3339))
+	}
+}
+
+// versionTime is the date of the version, the Last-Modified of its tiles. Zero if the version date can't be parsed.
+func (ts *TileServer) versionTime(version string) time.Time {
+	ts.mu.RLock()
+	desc := ts.versionDescriptions[version]
+	ts.mu.RUnlock()
+	date, err := time.Parse("2006-01-02T15", desc)
+	if err != nil {
+		return time.Time{}
+	}
+	return date
+}
+
+// GetTile returns the tile of the version. For a diff version (vMajor.Minor),
+// the tile is reconstructed from the diff and its base version (vMajor).
 func (ts *TileServer) GetTile(z, x, y int, version string) ([]byte, error) {
-	stmt, exists := ts.stmts[version]
+	if !strings.Contains(version, ".") {
+		return ts.GetRawTile(z, x, y, version)
+	}
+
+	key := version + "/" + GetTileKey(z, x, y)
+	if data, ok := ts.undiffTiles.Get(key); ok {
+		return data, nil
+	}
+	data, undiffed, err := ts.undiffTile(z, x, y, version, ts.GetRawTile)
+	if err != nil {
+		return nil, err
+	}
+	if undiffed {
+		ts.undiffTiles.Put(key, data)
+	}
+	return data, nil
+}
+
+// undiffTile reconstructs the tile of the diff version from the tiles returned by raw.
+// undiffed is false when a tile is returned as read, missing from the diff or from the base.
+func (ts *TileServer) undiffTile(z, x, y int, version string, raw func(z, x, y int, version string) ([]byte, error)) (data []byte, undiffed bool, err error) {
+	base, _, _ := strings.Cut(version, ".")
+	if err := ts.checkBase(base, version); err != nil {
+		return nil, false, err
+	}
+	diffData, errDiff := raw(z, x, y, version)
+	if errDiff != nil && !errors.Is(errDiff, sql.ErrNoRows) {
+		return nil, false, errDiff
+	}
+	baseData, errBase := raw(z, x, y, base)
+	if errBase != nil && !errors.Is(errBase, sql.ErrNoRows) {
+		return nil, false, errBase
+	}
+	if errors.Is(errDiff, sql.ErrNoRows) {
+		// No change from base, or no tile at all
+		return baseData, false, errBase
+	}
+	if errors.Is(errBase, sql.ErrNoRows) {
+		// New tile, the diff is the full tile
+		return diffData, false, nil
+	}
+
+	baseImg, err := decodePalettedTile(baseData, z, x, y, base)
+	if err != nil {
+		return nil, false, err
+	}
+	diffImg, err := decodePalettedTile(diffData, z, x, y, version)
+	if err != nil {
+		return nil, false, err
+	}
+	undiff, err := img.UnDiffPaletted(baseImg, diffImg)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to undiff tile %s/%s: %w", version, GetTileKey(z, x, y), err)
+	}
+	data, err = img.EncodePng(undiff)
+	if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+// errMissingBase wraps the failures of a diff version whose base DB is not loaded, answered 404
+var errMissingBase = errors.New("missing base version")
+
+// checkBase returns errMissingBase if the DB of the base of the diff version is not loaded
+func (ts *TileServer) checkBase(base, version string) error {
+	ts.mu.RLock()
+	_, exists := ts.stmts[base]
+	ts.mu.RUnlock()
+	if !exists {
+		return fmt.Errorf("%w %s of diff version %s", errMissingBase, base, version)
+	}
+	return nil
+}
+
+// GetTileImage returns the tile of the version as GetTile, decoded.
+// Tiles of averaged DBs are not paletted, they are an error.
+func (ts *TileServer) GetTileImage(z, x, y int, version string) (*image.Paletted, error) {
+	data, err := ts.GetTile(z, x, y, version)
+	if err != nil {
+		return nil, err
+	}
+	return decodePalettedTile(data, z, x, y, version)
+}
+
+// getImage is GetTileImage for any tile, paletted or not, to draw it
+func (ts *TileServer) getImage(z, x, y int, version string) (image.Image, error) {
+	data, err := ts.GetTile(z, x, y, version)
+	if err != nil {
+		return nil, err
+	}
+	return decodeTile(data, z, x, y, version)
+}
+
+// decodeTile decodes the tile z/x/y read from version
+func decodeTile(data []byte, z, x, y int, version string) (image.Image, error) {
+	i, err := img.DecodeImage(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode tile %s/%s: %w", version, GetTileKey(z, x, y), err)
+	}
+	return i, nil
+}
+
+// decodePalettedTile is decodeTile for the paletted tiles, to diff them
+func decodePalettedTile(data []byte, z, x, y int, version string) (*image.Paletted, error) {
+	i, err := decodeTile(data, z, x, y, version)
+	if err != nil {
+		return nil, err
+	}
+	p, ok := i.(*image.Paletted)
+	if !ok {
+		return nil, fmt.Errorf("tile %s/%s is not paletted", version, GetTileKey(z, x, y))
+	}
+	return p, nil
+}
+
+// GetRawTile returns the tile as stored in the version DB, a diff for diff versions.
+// Sparse diff tiles are transcoded to PNG, see img.SparseFormat.
+func (ts *TileServer) GetRawTile(z, x, y int, version string) ([]byte, error) {
+	key := version + "/" + GetTileKey(z, x, y)
+	if data, ok := ts.rawTiles.Get(key); ok {
+		return data, nil
+	}
+	tileData, err := ts.readRawTile(z, x, y, version)
+	if err != nil {
+		return nil, err
+	}
+	ts.rawTiles.Put(key, tileData)
+	return tileData, nil
+}
+
+// readRawTile is GetRawTile without the cache
+func (ts *TileServer) readRawTile(z, x, y int, version string) ([]byte, error) {
+	// Hold the lock during the query, so a rescan doesn't close the DB meanwhile
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	stmts, exists := ts.stmts[version]
 	if !exists {
 		return nil, fmt.Errorf("requested version %s not found", version)
 	}
 
 	var tileData []byte
-	err := stmt.QueryRow(z, x, y).Scan(&tileData)
-	return tileData, err
+	err := stmts.tile.QueryRow(stmts.args(z, x, y)...).Scan(&tileData)
+	if err != nil {
+		return nil, err
+	}
+	tileData, err = img.DiffToPng(tileData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to transcode sparse tile %s/%s: %w", version, GetTileKey(z, x, y), err)
+	}
+	return tileData, nil
+}
+
+// StatRawTile returns the size and CRC of the tile as stored in the version DB, without reading it.
+// The size is -1 for sparse diff tiles, only known once transcoded by GetRawTile.
+func (ts *TileServer) StatRawTile(z, x, y int, version string) (size int, crc uint32, err error) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	stmts, exists := ts.stmts[version]
+	if !exists {
+		return 0, 0, fmt.Errorf("requested version %s not found", version)
+	}
+	var sparse bool
+	err = stmts.stat.QueryRow(stmts.args(z, x, y)...).Scan(&size, &crc, &sparse)
+	if sparse {
+		size = -1
+	}
+	return size, crc, err
+}
+
+// TileCRC returns the CRC stored with the tile of version, for change detection:
+// tiles with the same CRC in two versions are the same. It is the CRC of the archive file
+// for ingested tiles, of the stored tile for merged ones, not of the served bytes.
+// For a diff version, a tile unchanged from its base has the CRC of the base tile.
+func (ts *TileServer) TileCRC(z, x, y int, version string) (uint32, error) {
+	_, crc, err := ts.StatRawTile(z, x, y, version)
+	if base, _, isDiff := strings.Cut(version, "."); isDiff && errors.Is(err, sql.ErrNoRows) {
+		if err := ts.checkBase(base, version); err != nil {
+			return 0, err
+		}
+		_, crc, err = ts.StatRawTile(z, x, y, base)
+	}
+	return crc, err
+}
+
+// serveTileCRC serves the CRC of a tile as decimal text, see TileCRC
+func (ts *TileServer) serveTileCRC(w http.ResponseWriter, r *http.Request) {
+	z, x, y, ok := ts.requestCoords(w, r)
+	if !ok {
+		return
+	}
+	crc, err := ts.TileCRC(z, x, y, mux.Vars(r)["version"])
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.NotFound(w, r)
+			return
+		}
+		if errors.Is(err, errMissingBase) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		slog.Error("database query error", "err", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Cache-Control", "public, max-age=86400") // Cache for 1 day
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "%d", crc)
+}
+
+// headTileSize returns the size of the tile GetTile, GetWebpTile or GetRawTile would return,
+// from the stored sizes without reading the tiles. The size is -1 when only known once
+// the tile is reconstructed from a diff or transcoded.
+func (ts *TileServer) headTileSize(z, x, y int, version, format string, raw bool) (int, error) {
+	size, _, err := ts.StatRawTile(z, x, y, version)
+	if raw {
+		return size, err
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+	if base, _, isDiff := strings.Cut(version, "."); isDiff {
+		if err := ts.checkBase(base, version); err != nil {
+			return 0, err
+		}
+		baseSize, _, errBase := ts.StatRawTile(z, x, y, base)
+		if errBase != nil && !errors.Is(errBase, sql.ErrNoRows) {
+			return 0, errBase
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			// No change from base, or no tile at all
+			size, err = baseSize, errBase
+		} else if errBase == nil {
+			// Reconstructed from the diff and its base
+			size = -1
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	if format == "webp" {
+		return -1, nil
+	}
+	return size, nil
+}
+
+// TileJSON is a TileJSON 3.0.0 document, see https://github.com/mapbox/tilejson-spec
+type TileJSON struct {
+	TileJSON    string     `json:"tilejson"`
+	Name        string     `json:"name"`
+	Version     string     `json:"version"`
+	Description string     `json:"description"`
+	Attribution string     `json:"attribution"`
+	Scheme      string     `json:"scheme"`
+	Tiles       []string   `json:"tiles"`
+	MinZoom     int        `json:"minzoom"`
+	MaxZoom     int        `json:"maxzoom"`
+	Bounds      [4]float64 `json:"bounds"`
+}
+
+// serveTileJSON handles TileJSON metadata requests for a version
+func (ts *TileServer) serveTileJSON(w http.ResponseWriter, r *http.Request) {
+	version := mux.Vars(r)["version"]
+	ts.mu.RLock()
+	date, exists := ts.versionDescriptions[version]
+	ts.mu.RUnlock()
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+
+	tj := TileJSON{
+		TileJSON:    "3.0.0",
+		Name:        "Wplace " + version,
+		Version:     "1.0.0",
+		Description: date,
+		Attribution: "Wplace (wplace.live)",
+		Scheme:      ts.schemeName(),
+		Tiles:       []string{fmt.Sprintf("%s://%s/tiles/%s/{z}/{x}/{y}.png", scheme, r.Host, version)},
+		MinZoom:     0,
+		MaxZoom:     11,
+		Bounds:      [4]float64{-180, -85.05112877980659, 180, 85.05112877980659},
+	}
+	data, err := json.Marshal(tj)
+	if err != nil {
+		http.Error(w, "Encoding error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=86400") // Cache for 1 day
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// schemeName is the name of the scheme of the tile URLs, for TileJSON
+func (ts *TileServer) schemeName() string {
+	if ts.scheme == store.SchemeTMS {
+		return store.SchemeTMSName
+	}
+	return store.SchemeXYZName
+}
+
+// tileFormat returns "webp" when requested by path extension, format query parameter or Accept header, else "png"
+func tileFormat(r *http.Request) string {
+	if strings.HasSuffix(r.URL.Path, ".webp") || r.URL.Query().Get("format") == "webp" {
+		return "webp"
+	}
+	if strings.Contains(r.Header.Get("Accept"), "image/webp") {
+		return "webp"
+	}
+	return "png"
+}
+
+// GetWebpTile returns the tile transcoded to lossless WebP, using the cache when possible
+func (ts *TileServer) GetWebpTile(z, x, y int, version string) ([]byte, error) {
+	key := version + "/" + GetTileKey(z, x, y)
+	if data, ok := ts.webpTiles.Get(key); ok {
+		return data, nil
+	}
+	tileImg, err := ts.getImage(z, x, y, version)
+	if err != nil {
+		return nil, err
+	}
+	data, err := img.EncodeWebp(tileImg)
+	if err != nil {
+		return nil, err
+	}
+	ts.webpTiles.Put(key, data)
+	return data, nil
 }
 
 func (ts *TileServer) serveIndex(w http.ResponseWriter, _ *http.Request) {
+	ts.mu.RLock()
+	indexHtml := ts.indexHtml
+	ts.mu.RUnlock()
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(ts.indexHtml))
+	w.Write([]byte(indexHtml))
+}
+
+// servePreview serves the preview image of the latest version
+func (ts *TileServer) servePreview(w http.ResponseWriter, _ *http.Request) {
+	ts.mu.RLock()
+	previewImage := ts.previewImage
+	previewVersion := ts.previewVersion
+	ts.mu.RUnlock()
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("X-Preview-Version", previewVersion)
+	w.Header().Set("Content-Length", strconv.Itoa(len(previewImage)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(previewImage)
+}
+
+// serveHealthz reports the server is up
+func (ts *TileServer) serveHealthz(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// serveReadyz reports whether every database connection is alive
+func (ts *TileServer) serveReadyz(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	if ts.single != nil {
+		// The versions share the consolidated DB, pinged once
+		if err := ts.single.Ping(); err != nil {
+			slog.Warn("readiness check failed", "file", ts.singleDB, "err", err)
+			http.Error(w, "consolidated database unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+		return
+	}
+	for version, db := range ts.dbPool {
+		if err := db.Ping(); err != nil {
+			slog.Warn("readiness check failed", "version", version, "err", err)
+			http.Error(w, fmt.Sprintf("database for version %s unavailable", version), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// VersionInfo describes a served version
+type VersionInfo struct {
+	Version  string `json:"version"`
+	Date     string `json:"date"`
+	IsBase   bool   `json:"isBase"`
+	TileSize int    `json:"tileSize"` // Width and height of the tiles in pixels
+	// Provenance of the DB, see store.GetMeta: source release, processed version, ingest time, tile counts
+	Meta map[string]string `json:"meta,omitempty"`
+}
+
+// Versions returns the served versions, sorted chronologically
+func (ts *TileServer) Versions() []VersionInfo {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	versions := make([]string, 0, len(ts.versionDescriptions))
+	for v := range ts.versionDescriptions {
+		versions = append(versions, v)
+	}
+	sortVersions(versions)
+	infos := make([]VersionInfo, 0, len(versions))
+	for _, v := range versions {
+		// A malformed version is neither a base nor a diff, it is served as is
+		pv, err := releases.ProcessedVersionFromString(v)
+		infos = append(infos, VersionInfo{
+			Version:  v,
+			Date:     ts.versionDescriptions[v],
+			IsBase:   err == nil && pv.IsBase,
+			TileSize: ts.tileSizes[v],
+			Meta:     ts.versionMeta[v],
+		})
+	}
+	return infos
+}
+
+// serveVersions lists the served versions as JSON
+func (ts *TileServer) serveVersions(w http.ResponseWriter, _ *http.Request) {
+	data, err := json.Marshal(ts.Versions())
+	if err != nil {
+		http.Error(w, "Encoding error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=60") // New versions appear on rescan
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// serveCachez reports the usage of the tile caches
+func (ts *TileServer) serveCachez(w http.ResponseWriter, _ *http.Request) {
+	stats := map[string]CacheStats{
+		"raw":       ts.rawTiles.Stats(),
+		"undiff":    ts.undiffTiles.Stats(),
+		"webp":      ts.webpTiles.Stats(),
+		"composite": ts.compositeTiles.Stats(),
+	}
+	data, err := json.Marshal(stats)
+	if err != nil {
+		http.Error(w, "Encoding error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
 }
 
 // Close closes all database connections
 func (ts *TileServer) Close() error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
 	var lastErr error
+	if ts.single != nil {
+		// The versions share the statements and the DB
+		if err := errors.Join(ts.singleStmts.Close(), ts.single.Close()); err != nil {
+			slog.Error("failed to close consolidated database", "file", ts.singleDB, "err", err)
+			lastErr = err
+		}
+		return lastErr
+	}
 
 	// Close prepared statements
-	for version, stmt := range ts.stmts {
-		if err := stmt.Close(); err != nil {
-			log.Printf("Error closing statement for version %s: %v", version, err)
+	for version, stmts := range ts.stmts {
+		if err := stmts.Close(); err != nil {
+			slog.Error("failed to close statements", "version", version, "err", err)
 			lastErr = err
 		}
 	}
@@ -270,7 +1331,7 @@ func (ts *TileServer) Close() error {
 	// Close database connections
 	for version, db := range ts.dbPool {
 		if err := db.Close(); err != nil {
-			log.Printf("Error closing database for version %s: %v", version, err)
+			slog.Error("failed to close database", "version", version, "err", err)
 			lastErr = err
 		}
 	}
@@ -278,50 +1339,86 @@ func (ts *TileServer) Close() error {
 	return lastErr
 }
 
+// Highest preview zoom, a level z preview is 1000*2^z pixels wide
+const maxPreviewZoom = 3
+
+// MakeLatestImage renders the preview of the latest version, at the preview zoom
 func (ts *TileServer) MakeLatestImage() ([]byte, error) {
-	// Get latest tile (z=0, x=0, y=0)
-	latestBaseVersion := strings.Split(ts.latestVersion, ".")[0]
-	latestTile, err := ts.GetTile(0, 0, 0, latestBaseVersion)
-	if err != nil {
-		return nil, err
+	return ts.MakePreviewImage(ts.previewZoom)
+}
+
+// MakePreviewImage renders the whole level z of the latest version over the basemap of that zoom,
+// osmZZZ.png with z zero-padded (osm000.png for z=0). A diff version is reconstructed over its base, see GetTile.
+// Missing tiles are transparent, and a basemap of another size is resized.
+// Without basemap, the tiles alone are returned along with the error.
+func (ts *TileServer) MakePreviewImage(z int) ([]byte, error) {
+	ts.mu.RLock()
+	latest := ts.latestVersion
+	ts.mu.RUnlock()
+	return ts.makePreviewImage(z, latest)
+}
+
+// makePreviewImage is MakePreviewImage for the given version
+func (ts *TileServer) makePreviewImage(z int, version string) ([]byte, error) {
+	if z < 0 || z > maxPreviewZoom {
+		return nil, fmt.Errorf("invalid preview zoom %d, expected 0 to %d", z, maxPreviewZoom)
 	}
-	latestImg, err := png.Decode(bytes.NewReader(latestTile))
-	if err != nil {
-		return nil, err
+
+	// Stitch the tiles of the level
+	n := 1 << z
+	var tiles *image.NRGBA
+	for ty := range n {
+		for tx := range n {
+			// Averaged DBs are drawn too, not only paletted ones
+			tileImg, err := ts.getImage(z, tx, ty, version)
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if tiles == nil {
+				size := tileImg.Bounds().Dx()
+				tiles = image.NewNRGBA(image.Rect(0, 0, n*size, n*size))
+			}
+			size := tiles.Bounds().Dx() / n
+			draw.Draw(tiles, image.Rect(tx*size, ty*size, (tx+1)*size, (ty+1)*size), tileImg, tileImg.Bounds().Min, draw.Src)
+		}
+	}
+	if tiles == nil {
+		return nil, fmt.Errorf("no tile at zoom %d in version %s", z, version)
+	}
+	tilesOnly := func(err error) ([]byte, error) {
+		data, encErr := img.EncodePng(tiles)
+		if encErr != nil {
+			return nil, encErr
+		}
+		return data, err
 	}
 
 	// Open basemap image
-	f, err := os.Open(path.Join(ts.dataPath, "osm000.png"))
+	f, err := os.Open(path.Join(ts.dataPath, fmt.Sprintf("osm%03d.png", z)))
 	if err != nil {
-		return latestTile, err
+		return tilesOnly(err)
 	}
 	defer f.Close()
 	basemap, err := png.Decode(f)
 	if err != nil {
-		return latestTile, err
+		return tilesOnly(err)
 	}
-
-	// Overlay latest tile on basemap
-	if basemap.Bounds() != latestImg.Bounds() {
-		return latestTile, fmt.Errorf("basemap size does not match latest tile size")
-	}
-	outImg := image.NewRGBA(basemap.Bounds())
-	for y := 0; y < basemap.Bounds().Dy(); y++ {
-		for x := 0; x < basemap.Bounds().Dx(); x++ {
-			r, g, b, a := basemap.At(x, y).RGBA()
-			tr, tg, tb, ta := latestImg.At(x, y).RGBA()
-			if ta > 0 {
-				outImg.Set(x, y, color.RGBA{uint8(tr >> 8), uint8(tg >> 8), uint8(tb >> 8), uint8(ta >> 8)})
-			} else {
-				outImg.Set(x, y, color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(a >> 8)})
-			}
-		}
+	if basemap.Bounds().Size() != tiles.Bounds().Size() {
+		basemap = img.ResizeNearest(basemap, tiles.Bounds().Dx(), tiles.Bounds().Dy())
 	}
 
+	// Overlay the tiles on the basemap, tile pixels are either transparent or opaque
+	outImg := image.NewNRGBA(tiles.Bounds())
+	draw.Draw(outImg, outImg.Bounds(), basemap, basemap.Bounds().Min, draw.Src)
+	draw.Draw(outImg, outImg.Bounds(), tiles, image.Point{}, draw.Over)
+
 	// Encode output image to PNG
 	var buf bytes.Buffer
 	if err := png.Encode(&buf, outImg); err != nil {
-		return latestTile, err
+		return tilesOnly(err)
 	}
 
 	return buf.Bytes(), nil
@@ -340,38 +1437,97 @@ func (ts *TileServer) MakeFavicon() ([]byte, error) {
 	return faviconData, nil
 }
 
-func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+// Main runs the tile server until SIGINT or SIGTERM, args without the program name.
+// It is configured by environment variables, PORT and DATA_PATH can be overridden by flags.
+func Main(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	port := fs.String("port", envString("PORT", "8080"), "Port to listen on (env PORT)")
+	dataPath := fs.String("data", envString("DATA_PATH", "."), "Folder of the DBs and index.html.tmpl (env DATA_PATH)")
+	schemeName := fs.String("scheme", envString("TILE_SCHEME", store.SchemeXYZName), "Y axis convention of the tile URLs: xyz, y from the north edge like slippy maps, or tms, y from the south edge (env TILE_SCHEME)")
+	pprofAddr := fs.String("pprof", envString("PPROF_ADDR", ""), "Address to serve the pprof profiles on, like localhost:6060, a listener apart from the tiles. Off if empty (env PPROF_ADDR)")
+	singleDB := fs.String("single-db", envString("SINGLE_DB", ""), "Path of a consolidated DB to serve every version from, made by the consolidate command, instead of the v*.db files of -data. Off if empty (env SINGLE_DB)")
+	fs.Parse(args)
+	if err := logging.Setup(); err != nil {
+		return err
 	}
-	dataPath := os.Getenv("DATA_PATH")
-	if dataPath == "" {
-		dataPath = "."
+	if err := profiling.Start(*pprofAddr); err != nil {
+		return err
 	}
 
-	tileServer, err := NewTileServer(dataPath)
+	scheme, err := store.ParseTileScheme(*schemeName)
 	if err != nil {
-		log.Fatalf("Failed to create tile server: %v", err)
+		return err
+	}
+
+	corsOrigin := os.Getenv("CORS_ORIGIN")
+	if corsOrigin == "" {
+		corsOrigin = "*"
+	}
+	gzipMinSize := envInt("GZIP_MIN_SIZE", 1024)
+	cacheSize := envInt("TILE_CACHE_SIZE", defaultTileCacheSize)
+	previewZoom := 0
+	if v := os.Getenv("PREVIEW_ZOOM"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxPreviewZoom {
+			return fmt.Errorf("invalid PREVIEW_ZOOM %s, expected 0 to %d", v, maxPreviewZoom)
+		}
+		previewZoom = n
+	}
+	rescanInterval := envDuration("RESCAN_INTERVAL", time.Minute)
+
+	var tileServer *TileServer
+	if *singleDB != "" {
+		tileServer, err = NewSingleDBTileServer(*dataPath, *singleDB, cacheSize, previewZoom)
+	} else {
+		tileServer, err = NewTileServer(*dataPath, cacheSize, previewZoom)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create tile server: %w", err)
+	}
+	tileServer.scheme = scheme
+	tileServer.exportDir = os.Getenv("EXPORT_DIR")
+	tileServer.basemapURL = os.Getenv("BASEMAP_URL")
+	if rescanInterval > 0 {
+		go tileServer.watch(rescanInterval)
 	}
-	defer tileServer.Close()
 
 	r := mux.NewRouter()
 
 	// Tile endpoint with version, z, x, y parameters
 	r.HandleFunc("/tiles/{version:v[0-9a-z.]+}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.png",
-		tileServer.serveTile).Methods("GET")
+		tileServer.serveTile).Methods("GET", "HEAD")
+	r.HandleFunc("/tiles/{version:v[0-9a-z.]+}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.webp",
+		tileServer.serveTile).Methods("GET", "HEAD")
+
+	// Tile CRC endpoint, for change detection
+	r.HandleFunc("/tiles/{version:v[0-9a-z.]+}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.crc",
+		tileServer.serveTileCRC).Methods("GET")
+
+	// Tile endpoint for a datetime, picking the version
+	r.HandleFunc("/tiles/at/{datetime}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.png",
+		tileServer.serveTileAt).Methods("GET", "HEAD")
+	r.HandleFunc("/tiles/at/{datetime}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.webp",
+		tileServer.serveTileAt).Methods("GET", "HEAD")
+
+	// MBTiles export of a version, or of a region with ?region=z/minX/minY/maxX/maxY,
+	// its rows in the scheme of the tile URLs, flipped with TILE_SCHEME=tms
+	r.HandleFunc("/tiles/{version:v[0-9a-z.]+}/export.mbtiles", tileServer.serveMBTiles).Methods("GET")
+
+	// Tile drawn over the basemap tile of BASEMAP_URL
+	r.HandleFunc("/composite/{version:v[0-9a-z.]+}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.png",
+		tileServer.serveComposite).Methods("GET", "HEAD")
+
+	// TileJSON metadata endpoint
+	r.HandleFunc("/tiles/{version:v[0-9a-z.]+}/tilejson.json", tileServer.serveTileJSON).Methods("GET")
+
+	// Versions list
+	r.HandleFunc("/versions.json", tileServer.serveVersions).Methods("GET")
 
 	// Root endpoint for index.html
 	r.HandleFunc("/", tileServer.serveIndex).Methods("GET")
 
 	// Preview image endpoint
-	r.HandleFunc("/preview.png", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "image/png")
-		w.Header().Set("Content-Length", strconv.Itoa(len(tileServer.previewImage)))
-		w.WriteHeader(http.StatusOK)
-		w.Write(tileServer.previewImage)
-	}).Methods("GET")
+	r.HandleFunc("/preview.png", tileServer.servePreview).Methods("GET")
 
 	// Favicon endpoint
 	r.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
@@ -381,24 +1537,139 @@ func main() {
 		w.Write(tileServer.faviconData)
 	}).Methods("GET")
 
+	// Liveness and readiness probes
+	r.HandleFunc("/healthz", tileServer.serveHealthz).Methods("GET")
+	r.HandleFunc("/readyz", tileServer.serveReadyz).Methods("GET")
+	r.HandleFunc("/cachez", tileServer.serveCachez).Methods("GET")
+
 	// Add middleware for logging
 	r.Use(loggingMiddleware)
+	r.Use(gzipMiddleware(gzipMinSize))
 
 	server := &http.Server{
-		Addr:         ":" + port,
-		Handler:      r,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		Addr:           ":" + *port,
+		Handler:        corsMiddleware(corsOrigin)(r), // Outside the router, preflight requests don't match GET routes
+		ReadTimeout:    envDuration("READ_TIMEOUT", 15*time.Second),
+		WriteTimeout:   envDuration("WRITE_TIMEOUT", 15*time.Second),
+		IdleTimeout:    envDuration("IDLE_TIMEOUT", 60*time.Second),
+		MaxHeaderBytes: envInt("MAX_HEADER_BYTES", http.DefaultMaxHeaderBytes),
+	}
+	if envBool("H2C", false) {
+		// Behind a proxy terminating TLS, lets it multiplex the tile requests
+		server.Protocols = h2cProtocols()
+	}
+
+	ln, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		tileServer.Close()
+		return fmt.Errorf("failed to listen on %s: %w", server.Addr, err)
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	slog.Info("starting tile server", "port", *port)
+	err = runServer(server, ln, stop, shutdownTimeout)
+	// Close the DBs cleanly, even when requests didn't drain in time
+	if cerr := tileServer.Close(); cerr != nil {
+		slog.Error("failed to close tile server", "err", cerr)
+	}
+	if err != nil {
+		return err
+	}
+	slog.Info("tile server stopped")
+	return nil
+}
+
+// envString reads a string environment variable, def when unset
+func envString(name string, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// envInt reads an integer environment variable, def when unset
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return n
+}
+
+// envDuration reads a Go duration environment variable (like 30s), def when unset
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return d
+}
+
+// envBool reads a boolean environment variable (1, true, 0, false...), def when unset
+func envBool(name string, def bool) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
 	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return b
+}
 
-	log.Println("Starting tile server on :8080")
-	log.Fatal(server.ListenAndServe())
+// h2cProtocols enables HTTP/2 without TLS (h2c), next to HTTP/1
+func h2cProtocols() *http.Protocols {
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	return &protocols
+}
+
+// How long in-flight requests get to complete on shutdown
+const shutdownTimeout = 20 * time.Second
+
+// runServer serves on ln until a signal is received on stop,
+// then stops accepting requests and waits up to drainTimeout for the in-flight ones
+func runServer(server *http.Server, ln net.Listener, stop <-chan os.Signal, drainTimeout time.Duration) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- server.Serve(ln)
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case sig := <-stop:
+		slog.Info("shutting down", "signal", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		return fmt.Errorf("failed to drain requests: %w", err)
+	}
+	return nil
 }
 
 // loggingMiddleware logs HTTP requests
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Don't flood the logs with probes
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" || r.URL.Path == "/cachez" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		start := time.Now()
 
 		// Create a response writer wrapper to capture status code
@@ -406,8 +1677,8 @@ func loggingMiddleware(next http.Handler) http.Handler {
 
 		next.ServeHTTP(wrapped, r)
 
-		log.Printf("%s %s %d %v", r.Method, r.URL.Path,
-			wrapped.statusCode, time.Since(start))
+		slog.Info("request", "method", r.Method, "path", r.URL.Path,
+			"status", wrapped.statusCode, "duration", time.Since(start))
 	})
 }
 
@@ -420,3 +1691,121 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.statusCode = code
 	rw.ResponseWriter.WriteHeader(code)
 }
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// corsMiddleware sets CORS headers for the allowed origin and answers preflight requests
+func corsMiddleware(origin string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h := w.Header()
+			h.Set("Access-Control-Allow-Origin", origin)
+			h.Set("Access-Control-Expose-Headers", "ETag, Last-Modified, Content-Range, Accept-Ranges, X-Tile-Date")
+			if origin != "*" {
+				h.Add("Vary", "Origin")
+			}
+			if r.Method == http.MethodOptions {
+				h.Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+				h.Set("Access-Control-Allow-Headers", "If-None-Match, If-Modified-Since, Range, Accept, Accept-Encoding")
+				h.Set("Access-Control-Max-Age", "86400")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// gzipMiddleware compresses text and JSON responses of at least minSize bytes for clients accepting gzip.
+// Images are already compressed and passed through.
+func gzipMiddleware(minSize int) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Add("Vary", "Accept-Encoding")
+			gw := &gzipResponseWriter{ResponseWriter: w, minSize: minSize, statusCode: http.StatusOK}
+			defer gw.Close()
+			next.ServeHTTP(gw, r)
+		})
+	}
+}
+
+// isCompressible returns true for content types worth compressing
+func isCompressible(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/") ||
+		strings.Contains(contentType, "json") ||
+		strings.Contains(contentType, "javascript") ||
+		strings.Contains(contentType, "xml")
+}
+
+// gzipResponseWriter buffers the body until minSize is reached to decide whether to compress it
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	minSize     int
+	statusCode  int
+	wroteHeader bool
+	passthrough bool
+	buf         []byte
+	gz          *gzip.Writer
+}
+
+func (gw *gzipResponseWriter) WriteHeader(code int) {
+	gw.statusCode = code
+	gw.wroteHeader = true
+	if !isCompressible(gw.Header().Get("Content-Type")) {
+		gw.passthrough = true
+		gw.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (gw *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !gw.wroteHeader {
+		gw.WriteHeader(http.StatusOK)
+	}
+	if gw.passthrough {
+		return gw.ResponseWriter.Write(p)
+	}
+	if gw.gz != nil {
+		return gw.gz.Write(p)
+	}
+	gw.buf = append(gw.buf, p...)
+	if len(gw.buf) >= gw.minSize {
+		gw.startGzip()
+	}
+	return len(p), nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (gw *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return gw.ResponseWriter
+}
+
+func (gw *gzipResponseWriter) startGzip() {
+	gw.Header().Set("Content-Encoding", "gzip")
+	gw.Header().Del("Content-Length")
+	gw.ResponseWriter.WriteHeader(gw.statusCode)
+	gw.gz = gzip.NewWriter(gw.ResponseWriter)
+	gw.gz.Write(gw.buf)
+	gw.buf = nil
+}
+
+// Close flushes the buffered body, uncompressed if it stayed under minSize
+func (gw *gzipResponseWriter) Close() {
+	if gw.gz != nil {
+		gw.gz.Close()
+		return
+	}
+	if gw.passthrough {
+		return
+	}
+	gw.ResponseWriter.WriteHeader(gw.statusCode)
+	if len(gw.buf) > 0 {
+		gw.ResponseWriter.Write(gw.buf)
+	}
+}
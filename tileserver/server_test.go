@@ -0,0 +1,1192 @@
+package tileserver
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Hugi-R/wplace-archive-world-map/img"
+	"github.com/Hugi-R/wplace-archive-world-map/store"
+	"github.com/gorilla/mux"
+)
+
+func TestTileCache(t *testing.T) {
+	c := newTileCache(2)
+	c.Put("v1/0/0/0", []byte("a"))
+	c.Put("v1/1/0/0", []byte("b"))
+	if _, ok := c.Get("v1/0/0/0"); !ok {
+		t.Fatal("expected v1/0/0/0 to be cached")
+	}
+	// v1/1/0/0 is now the least recently used
+	c.Put("v1/1/1/0", []byte("c"))
+	if _, ok := c.Get("v1/1/0/0"); ok {
+		t.Fatal("expected v1/1/0/0 to be evicted")
+	}
+	if data, ok := c.Get("v1/0/0/0"); !ok || string(data) != "a" {
+		t.Fatalf("expected v1/0/0/0 to stay cached, got %q", data)
+	}
+	if data, ok := c.Get("v1/1/1/0"); !ok || string(data) != "c" {
+		t.Fatalf("expected v1/1/1/0 to be cached, got %q", data)
+	}
+
+	stats := c.Stats()
+	if stats.Entries != 2 || stats.Hits != 3 || stats.Misses != 1 {
+		t.Fatalf("expected 2 entries, 3 hits, 1 miss, got %+v", stats)
+	}
+
+	disabled := newTileCache(0)
+	disabled.Put("v1/0/0/0", []byte("a"))
+	if _, ok := disabled.Get("v1/0/0/0"); ok {
+		t.Fatal("expected a zero size cache to be disabled")
+	}
+}
+
+// newDataDir creates a data folder with an index template and the DBs, each with a single z=0 tile
+func newDataDir(t *testing.T, names ...string) string {
+	dir := t.TempDir()
+	if err := os.WriteFile(path.Join(dir, "index.html.tmpl"), []byte("//$$VERSION_OPTIONS$$"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		addDB(t, dir, name)
+	}
+	return dir
+}
+
+// Encoded once, encoding is slow with the race detector. Paletted, like ingested tiles.
+var emptyTile, _ = img.EncodePng(img.EmptyImagePaletted(img.TileSize))
+
+func addDB(t *testing.T, dir, name string) {
+	tileDB, err := store.NewTileDB(path.Join(dir, name), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tileDB.Close()
+	if err := tileDB.PutTileAutoCRC(0, 0, 0, emptyTile); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	dir := path.Join(t.TempDir(), "a?b#c")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	addDB(t, dir, "v1_2025-01-07T00.db")
+	db, err := openReadOnly(path.Join(dir, "v1_2025-01-07T00.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM tiles").Scan(&n); err != nil || n != 1 {
+		t.Fatalf("expected the tile of the DB, got %d, %v", n, err)
+	}
+	if _, err := db.Exec("DELETE FROM tiles"); err == nil {
+		t.Fatal("expected an error writing a read-only DB")
+	}
+}
+
+func TestRescan(t *testing.T) {
+	dir := newDataDir(t, "v1_2025-01-07T00.db")
+	ts, err := NewTileServer(dir, 16, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+	if ts.latestVersion != "v1" {
+		t.Fatalf("expected latest version v1, got %s", ts.latestVersion)
+	}
+
+	addDB(t, dir, "v2_2025-01-14T00.db")
+	if err := ts.Rescan(); err != nil {
+		t.Fatal(err)
+	}
+	if ts.latestVersion != "v2" {
+		t.Fatalf("expected latest version v2, got %s", ts.latestVersion)
+	}
+	if !strings.Contains(ts.indexHtml, "v2") {
+		t.Fatalf("expected v2 in the index, got %s", ts.indexHtml)
+	}
+	if _, err := ts.GetRawTile(0, 0, 0, "v2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(path.Join(dir, "v1_2025-01-07T00.db")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.Rescan(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.GetRawTile(0, 0, 0, "v1"); err == nil {
+		t.Fatal("expected v1 to be dropped")
+	}
+	if strings.Contains(ts.indexHtml, "'v1'") {
+		t.Fatalf("expected v1 to be removed from the index, got %s", ts.indexHtml)
+	}
+
+	// A file still being copied is skipped, and picked up once complete
+	partial := path.Join(dir, "v3_2025-01-21T00.db")
+	if err := os.WriteFile(partial, []byte("SQLite format 3\x00 truncated"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.Rescan(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.GetRawTile(0, 0, 0, "v2"); err != nil || ts.latestVersion != "v2" {
+		t.Fatalf("expected v2 still served as latest, got %s, %v", ts.latestVersion, err)
+	}
+	if err := os.Remove(partial); err != nil {
+		t.Fatal(err)
+	}
+	addDB(t, dir, path.Base(partial))
+	if err := ts.Rescan(); err != nil {
+		t.Fatal(err)
+	}
+	if ts.latestVersion != "v3" {
+		t.Fatalf("expected latest version v3 once complete, got %s", ts.latestVersion)
+	}
+}
+
+func TestRescanPreview(t *testing.T) {
+	dir := newDataDir(t, "v1_2025-01-07T00.db")
+	basemap, err := img.EncodePng(image.NewNRGBA(image.Rect(0, 0, 4, 4)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	basemapPath := path.Join(dir, "osm000.png")
+	if err := os.WriteFile(basemapPath, basemap, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ts, err := NewTileServer(dir, 16, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+	preview := func() (string, []byte) {
+		w := httptest.NewRecorder()
+		ts.servePreview(w, httptest.NewRequest("GET", "/preview.png", nil))
+		return w.Header().Get("X-Preview-Version"), w.Body.Bytes()
+	}
+	if version, data := preview(); version != "v1" || len(data) == 0 {
+		t.Fatalf("expected the preview of v1, got %q, %d bytes", version, len(data))
+	}
+
+	// A new latest version renders the preview again
+	addDB(t, dir, "v2_2025-01-14T00.db")
+	if err := ts.Rescan(); err != nil {
+		t.Fatal(err)
+	}
+	version, before := preview()
+	if version != "v2" || ts.previewRenders.Load() != 2 {
+		t.Fatalf("expected the preview of v2 as second render, got %q, %d renders", version, ts.previewRenders.Load())
+	}
+
+	// Without basemap, the previous preview is kept
+	if err := os.Remove(basemapPath); err != nil {
+		t.Fatal(err)
+	}
+	addDB(t, dir, "v3_2025-01-21T00.db")
+	if err := ts.Rescan(); err != nil {
+		t.Fatal(err)
+	}
+	version, after := preview()
+	if version != "v2" || !bytes.Equal(before, after) {
+		t.Fatalf("expected the preview of v2 to be kept, got %q", version)
+	}
+}
+
+func TestConcurrentRescan(t *testing.T) {
+	dir := newDataDir(t, "v1_2025-01-07T00.db")
+	ts, err := NewTileServer(dir, 16, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if _, err := ts.GetTile(0, 0, 0, "v1"); err != nil {
+					t.Error(err)
+					return
+				}
+				// v0 comes and goes
+				ts.GetTile(0, 0, 0, "v0")
+				ts.serveIndex(httptest.NewRecorder(), nil)
+				ts.servePreview(httptest.NewRecorder(), nil)
+			}
+		}()
+	}
+
+	// An older version, the latest and its preview stay the same
+	old := path.Join(dir, "v0_2025-01-01T00.db")
+	for i := range 10 {
+		if i%2 == 0 {
+			addDB(t, dir, path.Base(old))
+		} else if err := os.Remove(old); err != nil {
+			t.Fatal(err)
+		}
+		if err := ts.Rescan(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestSortVersions(t *testing.T) {
+	versions := []string{"v1", "v0.120", "vlatest", "v0", "v0.024", "v1.048", "v0.048"}
+	sortVersions(versions)
+	expected := []string{"v0", "v0.024", "v0.048", "v0.120", "v1", "v1.048", "vlatest"}
+	if strings.Join(versions, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected %v, got %v", expected, versions)
+	}
+}
+
+func TestMakePreviewImage(t *testing.T) {
+	dir := newDataDir(t, "v1_2025-01-07T00.db")
+
+	// Two opaque tiles of the first palette color on level 1
+	palette := img.NewPaletter().Palette()
+	tile := image.NewPaletted(image.Rect(0, 0, img.TileSize, img.TileSize), palette)
+	for i := range tile.Pix {
+		tile.Pix[i] = 1
+	}
+	tileData, err := img.EncodePng(tile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tileDB, err := store.NewTileDB(path.Join(dir, "v1_2025-01-07T00.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, xy := range [][2]int{{0, 0}, {1, 1}} {
+		if err := tileDB.PutTileAutoCRC(1, xy[0], xy[1], tileData); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tileDB.Close()
+
+	ts, err := NewTileServer(dir, 16, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	// Without basemap, the tiles alone
+	data, err := ts.MakePreviewImage(1)
+	if err == nil || data == nil {
+		t.Fatalf("expected the tiles and an error without basemap, got %d bytes and %v", len(data), err)
+	}
+
+	// A basemap smaller than the level is resized
+	basemap := image.NewNRGBA(image.Rect(0, 0, 500, 500))
+	blue := color.NRGBA{0, 0, 255, 255}
+	draw.Draw(basemap, basemap.Bounds(), image.NewUniform(blue), image.Point{}, draw.Src)
+	basemapData, err := img.EncodePng(basemap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(dir, "osm001.png"), basemapData, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	data, err = ts.MakePreviewImage(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	preview, err := img.DecodeImage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview.Bounds().Dx() != 2*img.TileSize || preview.Bounds().Dy() != 2*img.TileSize {
+		t.Fatalf("expected a %dpx preview, got %v", 2*img.TileSize, preview.Bounds())
+	}
+	if !sameColor(preview.At(10, 10), palette[1]) || !sameColor(preview.At(1500, 1500), palette[1]) {
+		t.Fatalf("expected tile color %v on tiles, got %v and %v", palette[1], preview.At(10, 10), preview.At(1500, 1500))
+	}
+	if !sameColor(preview.At(1500, 10), blue) {
+		t.Fatalf("expected basemap color on a missing tile, got %v", preview.At(1500, 10))
+	}
+
+	// A diff version is the latest, its new tile is drawn over the tiles of its base
+	diffDB, err := store.NewTileDB(path.Join(dir, "v1.024_2025-01-08T00.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := diffDB.PutTileAutoCRC(1, 1, 0, tileData); err != nil {
+		t.Fatal(err)
+	}
+	diffDB.Close()
+	if err := ts.Rescan(); err != nil {
+		t.Fatal(err)
+	}
+	data, err = ts.MakePreviewImage(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview, err = img.DecodeImage(data); err != nil {
+		t.Fatal(err)
+	}
+	if !sameColor(preview.At(1500, 10), palette[1]) || !sameColor(preview.At(10, 10), palette[1]) {
+		t.Fatalf("expected the tiles of the diff and its base, got %v and %v", preview.At(1500, 10), preview.At(10, 10))
+	}
+
+	if _, err := ts.MakePreviewImage(maxPreviewZoom + 1); err == nil {
+		t.Fatal("expected an error above the max preview zoom")
+	}
+}
+
+func sameColor(a, b color.Color) bool {
+	ar, ag, ab, aa := a.RGBA()
+	br, bg, bb, ba := b.RGBA()
+	return ar == br && ag == bg && ab == bb && aa == ba
+}
+
+func TestServeTileAt(t *testing.T) {
+	dir := newDataDir(t, "v1_2025-01-07T00.db", "v1.024_2025-01-08T00.db", "v2_2025-01-14T00.db")
+	ts, err := NewTileServer(dir, 16, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	tests := []struct {
+		datetime string
+		version  string
+		status   int
+	}{
+		{"2025-01-07T00", "v1", http.StatusOK},
+		{"2025-01-07T23", "v1", http.StatusOK},
+		{"2025-01-08T05", "v1.024", http.StatusOK},
+		{"2025-01-13", "v1.024", http.StatusOK},
+		{"2025-02-01T10:00:00Z", "v2", http.StatusOK},
+		{"2025-01-06T23", "", http.StatusNotFound},
+		{"yesterday", "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.datetime, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/tiles/at/"+tt.datetime+"/0/0/0.png", nil)
+			r = mux.SetURLVars(r, map[string]string{"datetime": tt.datetime, "z": "0", "x": "0", "y": "0"})
+			w := httptest.NewRecorder()
+			ts.serveTileAt(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("expected status %d, got %d", tt.status, w.Code)
+			}
+			if tt.status == http.StatusOK && !strings.HasPrefix(w.Header().Get("ETag"), `"`+tt.version+"-") {
+				t.Fatalf("expected version %s, got ETag %s", tt.version, w.Header().Get("ETag"))
+			}
+		})
+	}
+}
+
+func TestServeVersions(t *testing.T) {
+	dir := newDataDir(t, "v1.024_2025-01-08T00.db", "v1_2025-01-07T00.db", "v0.120_2025-01-06T00.db", "v0_2025-01-01T00.db", "vtest_2025-01-09T00.db")
+	ts, err := NewTileServer(dir, 16, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	w := httptest.NewRecorder()
+	ts.serveVersions(w, httptest.NewRequest("GET", "/versions.json", nil))
+	var versions []VersionInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &versions); err != nil {
+		t.Fatal(err)
+	}
+	// The DBs record the scheme of their rows on creation
+	meta := map[string]string{store.MetaScheme: store.SchemeXYZName}
+	expected := []VersionInfo{
+		{"v0", "2025-01-01T00", true, img.TileSize, meta},
+		{"v0.120", "2025-01-06T00", false, img.TileSize, meta},
+		{"v1", "2025-01-07T00", true, img.TileSize, meta},
+		{"v1.024", "2025-01-08T00", false, img.TileSize, meta},
+		// Malformed, neither a base nor a diff
+		{"vtest", "2025-01-09T00", false, img.TileSize, meta},
+	}
+	if !reflect.DeepEqual(versions, expected) {
+		t.Fatalf("expected %v, got %v", expected, versions)
+	}
+}
+
+func TestRunServerDrains(t *testing.T) {
+	started := make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("done"))
+	})}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan os.Signal, 1)
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- runServer(server, ln, stop, 5*time.Second)
+	}()
+
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		results <- result{string(body), err}
+	}()
+
+	<-started
+	stop <- syscall.SIGTERM
+	res := <-results
+	if res.err != nil || res.body != "done" {
+		t.Fatalf("expected the in-flight request to complete, got %q, %v", res.body, res.err)
+	}
+	if err := <-stopped; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := http.Get("http://" + ln.Addr().String()); err == nil {
+		t.Fatal("expected the server to refuse new requests")
+	}
+}
+
+func TestH2C(t *testing.T) {
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Proto))
+		}),
+		Protocols: h2cProtocols(),
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan os.Signal, 1)
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- runServer(server, ln, stop, time.Second)
+	}()
+	defer func() {
+		stop <- syscall.SIGTERM
+		<-stopped
+	}()
+
+	for _, proto := range []string{"HTTP/1.1", "HTTP/2.0"} {
+		var protocols http.Protocols
+		protocols.SetHTTP1(proto == "HTTP/1.1")
+		protocols.SetUnencryptedHTTP2(proto == "HTTP/2.0")
+		client := &http.Client{Transport: &http.Transport{Protocols: &protocols}}
+		resp, err := client.Get("http://" + ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != proto {
+			t.Fatalf("expected %s, got %s", proto, body)
+		}
+	}
+}
+
+func TestHeadTile(t *testing.T) {
+	dir := newDataDir(t, "v1_2025-01-07T00.db", "v1.024_2025-01-08T00.db")
+	ts, err := NewTileServer(dir, 16, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+	cached := ts.rawTiles.Stats().Entries
+
+	tests := []struct {
+		name    string
+		target  string
+		status  int
+		version string
+		z       string
+		length  string
+	}{
+		{"Base", "/tiles/v1/0/0/0.png", http.StatusOK, "v1", "0", strconv.Itoa(len(emptyTile))},
+		{"Missing", "/tiles/v1/1/1/1.png", http.StatusNotFound, "v1", "1", ""},
+		{"Diff", "/tiles/v1.024/0/0/0.png", http.StatusOK, "v1.024", "0", ""},
+		{"DiffRaw", "/tiles/v1.024/0/0/0.png?raw=1", http.StatusOK, "v1.024", "0", strconv.Itoa(len(emptyTile))},
+		{"Webp", "/tiles/v1/0/0/0.webp", http.StatusOK, "v1", "0", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("HEAD", tt.target, nil)
+			r = mux.SetURLVars(r, map[string]string{"version": tt.version, "z": tt.z, "x": tt.z, "y": tt.z})
+			w := httptest.NewRecorder()
+			ts.serveTile(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("expected status %d, got %d", tt.status, w.Code)
+			}
+			if w.Body.Len() != 0 {
+				t.Fatalf("expected no body, got %d bytes", w.Body.Len())
+			}
+			if got := w.Header().Get("Content-Length"); got != tt.length {
+				t.Fatalf("expected Content-Length %q, got %q", tt.length, got)
+			}
+			if tt.status == http.StatusOK && !strings.HasPrefix(w.Header().Get("ETag"), `"`+tt.version+"-") {
+				t.Fatalf("expected an ETag of version %s, got %s", tt.version, w.Header().Get("ETag"))
+			}
+		})
+	}
+	if s := ts.rawTiles.Stats(); s.Entries != cached {
+		t.Fatalf("expected HEAD requests not to read the tiles, got %d cached instead of %d", s.Entries, cached)
+	}
+}
+
+func TestServeTileRange(t *testing.T) {
+	dir := newDataDir(t, "v1_2025-01-07T00.db")
+	ts, err := NewTileServer(dir, 16, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+	modified := time.Date(2025, 1, 7, 0, 0, 0, 0, time.UTC).Format(http.TimeFormat)
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		status int
+		body   []byte
+	}{
+		{"Full", nil, http.StatusOK, emptyTile},
+		{"Range", map[string]string{"Range": "bytes=0-9"}, http.StatusPartialContent, emptyTile[:10]},
+		{"ETag", map[string]string{"If-None-Match": `"v1-0/0/0"`}, http.StatusNotModified, nil},
+		{"OtherETag", map[string]string{"If-None-Match": `"v0-0/0/0"`}, http.StatusOK, emptyTile},
+		{"ETagList", map[string]string{"If-None-Match": `"v0-0/0/0", W/"v1-0/0/0"`}, http.StatusNotModified, nil},
+		{"NotModified", map[string]string{"If-Modified-Since": modified}, http.StatusNotModified, nil},
+	}
+	// HEAD answers as GET, without body
+	for _, method := range []string{"GET", "HEAD"} {
+		for _, tt := range tests {
+			t.Run(method+tt.name, func(t *testing.T) {
+				r := httptest.NewRequest(method, "/tiles/v1/0/0/0.png", nil)
+				for k, v := range tt.header {
+					r.Header.Set(k, v)
+				}
+				r = mux.SetURLVars(r, map[string]string{"version": "v1", "z": "0", "x": "0", "y": "0"})
+				w := httptest.NewRecorder()
+				ts.serveTile(w, r)
+				if w.Code != tt.status {
+					t.Fatalf("expected status %d, got %d", tt.status, w.Code)
+				}
+				body := tt.body
+				if method == "HEAD" {
+					if got := w.Header().Get("Content-Length"); tt.body != nil && got != strconv.Itoa(len(tt.body)) {
+						t.Fatalf("expected Content-Length %d, got %q", len(tt.body), got)
+					}
+					body = nil
+				}
+				if !bytes.Equal(w.Body.Bytes(), body) {
+					t.Fatalf("expected %d bytes, got %d", len(body), w.Body.Len())
+				}
+				if got := w.Header().Get("ETag"); got != `"v1-0/0/0"` {
+					t.Fatalf("expected ETag %q, got %q", `"v1-0/0/0"`, got)
+				}
+				if got := w.Header().Get("Last-Modified"); tt.status != http.StatusNotModified && got != modified {
+					t.Fatalf("expected Last-Modified %q, got %q", modified, got)
+				}
+				if tt.status == http.StatusOK && w.Header().Get("Content-Type") != "image/png" {
+					t.Fatalf("expected Content-Type image/png, got %q", w.Header().Get("Content-Type"))
+				}
+			})
+		}
+	}
+}
+
+func TestServeTileDate(t *testing.T) {
+	dir := newDataDir(t, "v1_2025-01-07T00.db", "v1.024_2025-01-08T00.db")
+	ts, err := NewTileServer(dir, 16, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	// A diff reconstruction has the date of the diff, not of its base
+	for _, tt := range []struct{ method, version, date string }{
+		{"GET", "v1", "2025-01-07T00:00:00Z"},
+		{"GET", "v1.024", "2025-01-08T00:00:00Z"},
+		{"HEAD", "v1.024", "2025-01-08T00:00:00Z"},
+	} {
+		r := httptest.NewRequest(tt.method, "/tiles/"+tt.version+"/0/0/0.png", nil)
+		r = mux.SetURLVars(r, map[string]string{"version": tt.version, "z": "0", "x": "0", "y": "0"})
+		w := httptest.NewRecorder()
+		ts.serveTile(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s %s: expected status 200, got %d", tt.method, tt.version, w.Code)
+		}
+		if got := w.Header().Get("X-Tile-Date"); got != tt.date {
+			t.Fatalf("%s %s: expected X-Tile-Date %s, got %q", tt.method, tt.version, tt.date, got)
+		}
+	}
+}
+
+func TestServeTileCRC(t *testing.T) {
+	dir := newDataDir(t, "v1_2025-01-07T00.db", "v1.024_2025-01-08T00.db")
+	// A tile changed in the diff
+	tileDB, err := store.NewTileDB(path.Join(dir, "v1.024_2025-01-08T00.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tileDB.PutTile(1, 1, 1, emptyTile, 42); err != nil {
+		t.Fatal(err)
+	}
+	tileDB.Close()
+	// A tile only in the base
+	tileDB, err = store.NewTileDB(path.Join(dir, "v1_2025-01-07T00.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tileDB.PutTile(1, 0, 0, emptyTile, 7); err != nil {
+		t.Fatal(err)
+	}
+	tileDB.Close()
+	ts, err := NewTileServer(dir, 16, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+	baseCRC := strconv.FormatUint(uint64(crc32.ChecksumIEEE(emptyTile)), 10)
+
+	tests := []struct {
+		name    string
+		version string
+		z       string
+		status  int
+		crc     string
+	}{
+		{"Base", "v1", "0", http.StatusOK, baseCRC},
+		{"Diff", "v1.024", "1", http.StatusOK, "42"},
+		{"Missing", "v1", "1", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/tiles/"+tt.version+"/"+tt.z+"/"+tt.z+"/"+tt.z+".crc", nil)
+			r = mux.SetURLVars(r, map[string]string{"version": tt.version, "z": tt.z, "x": tt.z, "y": tt.z})
+			w := httptest.NewRecorder()
+			ts.serveTileCRC(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("expected status %d, got %d", tt.status, w.Code)
+			}
+			if tt.status == http.StatusOK && w.Body.String() != tt.crc {
+				t.Fatalf("expected CRC %s, got %s", tt.crc, w.Body.String())
+			}
+		})
+	}
+
+	// Unchanged in the diff, the CRC of the base tile
+	crc, err := ts.TileCRC(1, 0, 0, "v1.024")
+	if err != nil || crc != 7 {
+		t.Fatalf("expected the CRC of the base tile, got %d, %v", crc, err)
+	}
+}
+
+func TestServeMissingBase(t *testing.T) {
+	dir := newDataDir(t, "v1_2025-01-07T00.db", "v2.024_2025-01-08T00.db")
+	ts, err := NewTileServer(dir, 16, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		z      string
+		serve  http.HandlerFunc
+	}{
+		{"Get", "GET", "/tiles/v2.024/0/0/0.png", "0", ts.serveTile},
+		{"Head", "HEAD", "/tiles/v2.024/0/0/0.png", "0", ts.serveTile},
+		{"Webp", "GET", "/tiles/v2.024/0/0/0.webp", "0", ts.serveTile},
+		// Missing from the diff, the CRC of the base tile
+		{"CRC", "GET", "/tiles/v2.024/1/1/1.crc", "1", ts.serveTileCRC},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			r = mux.SetURLVars(r, map[string]string{"version": "v2.024", "z": tt.z, "x": tt.z, "y": tt.z})
+			w := httptest.NewRecorder()
+			tt.serve(w, r)
+			if w.Code != http.StatusNotFound {
+				t.Fatalf("expected status %d, got %d", http.StatusNotFound, w.Code)
+			}
+			if tt.method == "GET" && !strings.Contains(w.Body.String(), "v2 ") {
+				t.Fatalf("expected the message to name the missing base v2, got %q", w.Body.String())
+			}
+		})
+	}
+
+	// The raw diff tile doesn't need the base
+	r := httptest.NewRequest("GET", "/tiles/v2.024/0/0/0.png?raw=1", nil)
+	r = mux.SetURLVars(r, map[string]string{"version": "v2.024", "z": "0", "x": "0", "y": "0"})
+	w := httptest.NewRecorder()
+	ts.serveTile(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d for the raw tile, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestServeSparseDiff(t *testing.T) {
+	dir := newDataDir(t, "v1_2025-01-07T00.db", "v1.024_2025-01-08T00.db")
+	diff := img.EmptyImagePaletted(img.TileSize).(*image.Paletted)
+	for i := range 10 {
+		diff.Pix[i] = 7
+	}
+	sparse, err := img.EncodeDiff(diff, img.DefaultSparseMaxRuns, png.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tileDB, err := store.NewTileDB(path.Join(dir, "v1.024_2025-01-08T00.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tileDB.PutTileAutoCRC(0, 0, 0, sparse); err != nil {
+		t.Fatal(err)
+	}
+	tileDB.Close()
+
+	ts, err := NewTileServer(dir, 16, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	for _, target := range []string{"/tiles/v1.024/0/0/0.png?raw=1", "/tiles/v1.024/0/0/0.png"} {
+		for _, method := range []string{"HEAD", "GET"} {
+			r := httptest.NewRequest(method, target, nil)
+			r = mux.SetURLVars(r, map[string]string{"version": "v1.024", "z": "0", "x": "0", "y": "0"})
+			w := httptest.NewRecorder()
+			ts.serveTile(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s %s: expected status 200, got %d", method, target, w.Code)
+			}
+			if method == "HEAD" {
+				// Unknown until transcoded
+				if got := w.Header().Get("Content-Length"); got != "" {
+					t.Fatalf("HEAD %s: expected no Content-Length, got %s", target, got)
+				}
+				continue
+			}
+			// Served as PNG, the stored diff for raw, else reconstructed on the empty base
+			tile, err := png.Decode(w.Body)
+			if err != nil {
+				t.Fatalf("GET %s: %v", target, err)
+			}
+			p, ok := tile.(*image.Paletted)
+			if !ok || p.Pix[9] != 7 || p.Pix[10] != 0 {
+				t.Fatalf("GET %s: expected the 10 changed pixels", target)
+			}
+		}
+	}
+}
+
+func TestGetTileImage(t *testing.T) {
+	dir := newDataDir(t, "v1_2025-01-07T00.db")
+	tileDB, err := store.NewTileDB(path.Join(dir, "v1_2025-01-07T00.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tileDB.PutTileAutoCRC(1, 0, 0, []byte("not a png")); err != nil {
+		t.Fatal(err)
+	}
+	tileDB.Close()
+	ts, err := NewTileServer(dir, 16, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	tile, err := ts.GetTileImage(0, 0, 0, "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tile.Bounds().Dx() != img.TileSize || !img.IsAllTransparent(tile) {
+		t.Fatalf("expected the empty tile, got %v", tile.Bounds())
+	}
+	if _, err := ts.GetTileImage(1, 1, 1, "v1"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected sql.ErrNoRows for a missing tile, got %v", err)
+	}
+	if _, err := ts.GetTileImage(1, 0, 0, "v1"); err == nil || !strings.Contains(err.Error(), "v1/1/0/0") {
+		t.Fatalf("expected a decode error naming the tile, got %v", err)
+	}
+}
+
+func TestServeMBTiles(t *testing.T) {
+	dir := newDataDir(t, "v1_2025-01-07T00.db", "v1.024_2025-01-08T00.db")
+	for _, tile := range []struct {
+		db      string
+		z, x, y int
+	}{{"v1_2025-01-07T00.db", 1, 1, 0}, {"v1.024_2025-01-08T00.db", 1, 0, 1}} {
+		tileDB, err := store.NewTileDB(path.Join(dir, tile.db), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tileDB.PutTileAutoCRC(tile.z, tile.x, tile.y, emptyTile); err != nil {
+			t.Fatal(err)
+		}
+		tileDB.Close()
+	}
+	ts, err := NewTileServer(dir, 16, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	tests := []struct {
+		name   string
+		region string
+		scheme store.TileScheme
+		rows   [][3]int // z, column, TMS row
+	}{
+		{"World", "", store.SchemeXYZ, [][3]int{{0, 0, 0}, {1, 0, 0}, {1, 1, 1}}},
+		{"Region", "?region=1/0/1/0/1", store.SchemeXYZ, [][3]int{{0, 0, 0}, {1, 0, 0}}},
+		// Row 0 in TMS, as the tile URLs
+		{"RegionTMS", "?region=1/0/0/0/0", store.SchemeTMS, [][3]int{{0, 0, 0}, {1, 0, 0}}},
+		{"WorldTMS", "", store.SchemeTMS, [][3]int{{0, 0, 0}, {1, 0, 0}, {1, 1, 1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts.scheme = tt.scheme
+			r := httptest.NewRequest("GET", "/tiles/v1.024/export.mbtiles"+tt.region, nil)
+			r = mux.SetURLVars(r, map[string]string{"version": "v1.024"})
+			w := httptest.NewRecorder()
+			ts.serveMBTiles(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+			}
+			file := path.Join(t.TempDir(), "export.mbtiles")
+			if err := os.WriteFile(file, w.Body.Bytes(), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			db, err := sql.Open("sqlite3", file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			rows, err := db.Query("SELECT zoom_level, tile_column, tile_row, tile_data FROM tiles ORDER BY zoom_level, tile_column")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+			var got [][3]int
+			for rows.Next() {
+				var tile [3]int
+				var data []byte
+				if err := rows.Scan(&tile[0], &tile[1], &tile[2], &data); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := png.Decode(bytes.NewReader(data)); err != nil {
+					t.Fatalf("tile %v: %v", tile, err)
+				}
+				got = append(got, tile)
+			}
+			if !reflect.DeepEqual(got, tt.rows) {
+				t.Fatalf("expected tiles %v, got %v", tt.rows, got)
+			}
+			var format string
+			if err := db.QueryRow("SELECT value FROM metadata WHERE name = 'format'").Scan(&format); err != nil || format != "png" {
+				t.Fatalf("expected format png, got %q, %v", format, err)
+			}
+		})
+	}
+
+	r := httptest.NewRequest("GET", "/tiles/v1/export.mbtiles?region=1/0/2/0/2", nil)
+	r = mux.SetURLVars(r, map[string]string{"version": "v1"})
+	w := httptest.NewRecorder()
+	ts.serveMBTiles(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for a region out of the level, got %d", w.Code)
+	}
+}
+
+func TestExportRegion(t *testing.T) {
+	r, err := parseRegion("2/1/2/1/3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	levels := map[int][4]int{
+		0: {0, 0, 0, 0},
+		1: {0, 1, 0, 1},
+		2: {1, 2, 1, 3},
+		3: {2, 4, 3, 7},
+	}
+	for z, want := range levels {
+		minX, minY, maxX, maxY := r.level(z)
+		if got := [4]int{minX, minY, maxX, maxY}; got != want {
+			t.Fatalf("level %d: expected %v, got %v", z, want, got)
+		}
+	}
+	bounds := worldRegion.bounds()
+	if math.Abs(bounds[0]+180) > 1e-9 || math.Abs(bounds[2]-180) > 1e-9 || math.Abs(bounds[3]-85.0511287798) > 1e-9 || math.Abs(bounds[1]+85.0511287798) > 1e-9 {
+		t.Fatalf("unexpected world bounds %v", bounds)
+	}
+	bounds = r.bounds()
+	if bounds[0] != -90 || bounds[2] != 0 || bounds[3] != 0 {
+		t.Fatalf("unexpected region bounds %v", bounds)
+	}
+}
+
+func TestServeTileTMS(t *testing.T) {
+	dir := newDataDir(t, "v1_2025-01-07T00.db")
+	tileDB, err := store.NewTileDB(path.Join(dir, "v1_2025-01-07T00.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tileDB.PutTileAutoCRC(1, 1, 0, emptyTile); err != nil {
+		t.Fatal(err)
+	}
+	tileDB.Close()
+	ts, err := NewTileServer(dir, 16, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+	ts.scheme = store.SchemeTMS
+
+	// The north-east tile of level 1 is row 1 in TMS, row 0 in the DB
+	for y, code := range map[string]int{"1": http.StatusOK, "0": http.StatusNotFound} {
+		r := httptest.NewRequest("GET", "/tiles/v1/1/1/"+y+".png", nil)
+		r = mux.SetURLVars(r, map[string]string{"version": "v1", "z": "1", "x": "1", "y": y})
+		w := httptest.NewRecorder()
+		ts.serveTile(w, r)
+		if w.Code != code {
+			t.Fatalf("TMS row %s: expected status %d, got %d", y, code, w.Code)
+		}
+	}
+}
+
+func TestServeDedup(t *testing.T) {
+	dir := newDataDir(t)
+	tileDB, err := store.NewTileDBWithOptions(path.Join(dir, "v1_2025-01-07T00.db"), store.TileDBOptions{Dedup: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, xy := range [][2]int{{0, 0}, {1, 0}} {
+		if err := tileDB.PutTileAutoCRC(1, xy[0], xy[1], emptyTile); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tileDB.Close()
+	ts, err := NewTileServer(dir, 16, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	for _, x := range []int{0, 1} {
+		data, err := ts.GetRawTile(1, x, 0, "v1")
+		if err != nil || !bytes.Equal(data, emptyTile) {
+			t.Fatalf("expected the shared tile at 1/%d/0, got %v", x, err)
+		}
+	}
+	crc, err := ts.TileCRC(1, 1, 0, "v1")
+	if err != nil || crc != crc32.ChecksumIEEE(emptyTile) {
+		t.Fatalf("expected the CRC of the tile, got %d, %v", crc, err)
+	}
+}
+
+func TestServeSingleDB(t *testing.T) {
+	dir := newDataDir(t, "v2_2025-01-14T00.db")
+	// A dedup DB is copied with its data
+	tileDB, err := store.NewTileDBWithOptions(path.Join(dir, "v1_2025-01-07T00.db"), store.TileDBOptions{Dedup: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, xy := range [][2]int{{0, 0}, {1, 0}} {
+		if err := tileDB.PutTileAutoCRC(1, xy[0], xy[1], emptyTile); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tileDB.SetMeta(store.MetaRelease, "r1"); err != nil {
+		t.Fatal(err)
+	}
+	tileDB.Close()
+
+	single := path.Join(dir, "all.db")
+	if added, err := Consolidate(dir, single); err != nil || added != 2 {
+		t.Fatalf("expected 2 versions consolidated, got %d, %v", added, err)
+	}
+	if added, err := Consolidate(dir, single); err != nil || added != 0 {
+		t.Fatalf("expected the versions already consolidated to be skipped, got %d, %v", added, err)
+	}
+
+	ts, err := NewSingleDBTileServer(dir, single, 16, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+	versions := ts.Versions()
+	if len(versions) != 2 || versions[0].Date != "2025-01-07T00" || versions[0].Meta[store.MetaRelease] != "r1" {
+		t.Fatalf("expected v1 and v2 with their dates and meta, got %+v", versions)
+	}
+	if data, err := ts.GetRawTile(1, 1, 0, "v1"); err != nil || !bytes.Equal(data, emptyTile) {
+		t.Fatalf("expected the tile of v1, got %v", err)
+	}
+	// The version is bound, v1 has no z=0 tile
+	if _, err := ts.GetRawTile(0, 0, 0, "v1"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected no z=0 tile in v1, got %v", err)
+	}
+	if crc, err := ts.TileCRC(0, 0, 0, "v2"); err != nil || crc != crc32.ChecksumIEEE(emptyTile) {
+		t.Fatalf("expected the CRC of the tile of v2, got %d, %v", crc, err)
+	}
+	level := make(map[[2]int]bool)
+	if err := ts.listLevel("v1", 1, 0, 0, 1, 1, level); err != nil || len(level) != 2 {
+		t.Fatalf("expected the 2 tiles of v1 level 1, got %v, %v", level, err)
+	}
+	w := httptest.NewRecorder()
+	ts.serveReadyz(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected ready, got %d", w.Code)
+	}
+
+	// The DB files of the data folder are not served, the versions added to the consolidated DB are
+	addDB(t, dir, "v3_2025-01-21T00.db")
+	if err := ts.Rescan(); err != nil {
+		t.Fatal(err)
+	}
+	if ts.latestVersion != "v2" {
+		t.Fatalf("expected latest version v2 before consolidating v3, got %s", ts.latestVersion)
+	}
+	if _, err := Consolidate(dir, single); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.Rescan(); err != nil {
+		t.Fatal(err)
+	}
+	if ts.latestVersion != "v3" {
+		t.Fatalf("expected latest version v3, got %s", ts.latestVersion)
+	}
+	if _, err := ts.GetRawTile(0, 0, 0, "v3"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServeComposite(t *testing.T) {
+	// A red basemap of 256 pixels
+	red := image.NewNRGBA(image.Rect(0, 0, 256, 256))
+	for i := 0; i < len(red.Pix); i += 4 {
+		copy(red.Pix[i:], []uint8{255, 0, 0, 255})
+	}
+	var basemapData bytes.Buffer
+	if err := png.Encode(&basemapData, red); err != nil {
+		t.Fatal(err)
+	}
+	var fetched atomic.Int64
+	basemap := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched.Add(1)
+		if r.URL.Path == "/broken/0/0/0.png" {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		w.Write(basemapData.Bytes())
+	}))
+	defer basemap.Close()
+
+	dir := newDataDir(t, "v1_2025-01-07T00.db")
+	painted := img.EmptyImagePaletted(img.TileSize).(*image.Paletted)
+	painted.Pix[0] = 5
+	tile, err := img.EncodePng(painted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tileDB, err := store.NewTileDB(path.Join(dir, "v1_2025-01-07T00.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tileDB.PutTileAutoCRC(1, 0, 0, tile); err != nil {
+		t.Fatal(err)
+	}
+	tileDB.Close()
+	ts, err := NewTileServer(dir, 16, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	get := func(z string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/composite/v1/"+z+"/0/0.png", nil)
+		r = mux.SetURLVars(r, map[string]string{"version": "v1", "z": z, "x": "0", "y": "0"})
+		w := httptest.NewRecorder()
+		ts.serveComposite(w, r)
+		return w
+	}
+	if w := get("1"); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 without basemap URL, got %d", w.Code)
+	}
+
+	ts.basemapURL = basemap.URL + "/{z}/{x}/{y}.png"
+	for range 2 {
+		w := get("1")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+		composite, err := png.Decode(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := composite.Bounds().Dx(); size != img.TileSize {
+			t.Fatalf("expected a tile of %d pixels, got %d", img.TileSize, size)
+		}
+		// The painted pixel over the basemap, elsewhere the basemap
+		if !sameColor(composite.At(0, 0), painted.Palette[5]) {
+			t.Fatalf("expected the tile color, got %v", composite.At(0, 0))
+		}
+		if !sameColor(composite.At(1, 0), color.RGBA{255, 0, 0, 255}) {
+			t.Fatalf("expected the basemap color, got %v", composite.At(1, 0))
+		}
+	}
+	if n := fetched.Load(); n != 1 {
+		t.Fatalf("expected the composite to be cached, got %d basemap fetches", n)
+	}
+
+	// Without tile, the basemap alone
+	if w := get("2"); w.Code != http.StatusOK {
+		t.Fatalf("expected the basemap for a missing tile, got %d", w.Code)
+	}
+	ts.basemapURL = basemap.URL + "/broken/{z}/{x}/{y}.png"
+	if w := get("0"); w.Code != http.StatusBadGateway {
+		t.Fatalf("expected 502 when the basemap fails, got %d", w.Code)
+	}
+}
@@ -0,0 +1,87 @@
+package verify
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Hugi-R/wplace-archive-world-map/store"
+)
+
+// maxPrinted is the count of problems printed for each level, the JSON output has them all
+const maxPrinted = 10
+
+// Main runs the verify command line, args without the program name.
+// It returns an error when any problem is found.
+func Main(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	dbPath := fs.String("db", "", "Mandatory DB path")
+	base := fs.String("base", "", "Optional base DB path, when --db is a diff DB")
+	workers := fs.Int("workers", 10, "Optional number of workers (default 10)")
+	asJSON := fs.Bool("json", false, "Optional, print the report as JSON")
+
+	fs.Parse(args)
+
+	// Check mandatory flags
+	if *dbPath == "" {
+		return fmt.Errorf("missing required flag: --db")
+	}
+
+	tileDB, err := store.NewTileDB(*dbPath, true)
+	if err != nil {
+		return fmt.Errorf("failed to open tile database %s: %w", *dbPath, err)
+	}
+	defer tileDB.Close()
+
+	var baseSource TileSource
+	if *base != "" {
+		baseDB, err := store.NewTileDB(*base, true)
+		if err != nil {
+			return fmt.Errorf("failed to open base tile database %s: %w", *base, err)
+		}
+		defer baseDB.Close()
+		baseSource = &baseDB
+	}
+
+	report, err := Verify(&tileDB, baseSource, *workers)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		printReport(report)
+	}
+	if !report.OK() {
+		return fmt.Errorf("%d problems found in %s", len(report.Problems), *dbPath)
+	}
+	return nil
+}
+
+func printReport(report Report) {
+	byLevel := make(map[int][]Problem)
+	for _, p := range report.Problems {
+		byLevel[p.Z] = append(byLevel[p.Z], p)
+	}
+	for _, l := range report.Levels {
+		fmt.Printf("z=%d: %d tiles, %d empty, %d undecodable, %d bad palette, %d orphans, %d bad base, %d bad count\n",
+			l.Z, l.Tiles, l.Empty, l.Undecodable, l.BadPalette, l.Orphans, l.BadBase, l.BadCount)
+		problems := byLevel[l.Z]
+		for i, p := range problems {
+			if i == maxPrinted {
+				fmt.Printf("  ... and %d more\n", len(problems)-maxPrinted)
+				break
+			}
+			fmt.Printf("  %d/%d/%d %s: %s\n", p.Z, p.X, p.Y, p.Kind, p.Error)
+		}
+	}
+	if report.OK() {
+		fmt.Println("OK")
+	}
+}
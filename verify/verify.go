@@ -0,0 +1,340 @@
+// Package verify checks the consistency of the tile pyramid of a DB before it is published.
+package verify
+
+import (
+	"fmt"
+	"image/color"
+	"strconv"
+	"sync"
+
+	"github.com/Hugi-R/wplace-archive-world-map/img"
+	"github.com/Hugi-R/wplace-archive-world-map/store"
+)
+
+// MaxZ is the zoom level of the ingested tiles, the bottom of the pyramid
+const MaxZ = 11
+
+// TileSource is the read side of a store.TileDB
+type TileSource interface {
+	ListTiles(z int) ([][2]uint16, error)
+	IterateTiles(z int, fn func(x, y int, data []byte) error) error
+	GetTile(z, x, y int) ([]byte, error)
+}
+
+// MetaSource is the meta table of a store.TileDB. When the DB has one, the tile counts it records are checked.
+type MetaSource interface {
+	GetMeta(key string) (value string, found bool, err error)
+}
+
+// Kinds of problems
+const (
+	// The tile is not a paletted PNG nor a sparse diff tile
+	Undecodable = "undecodable"
+	// The tile palette differs from the palette of this project
+	BadPalette = "palette"
+	// The parent tile has no non-empty child
+	Orphan = "orphan"
+	// The diff tile cannot be applied on its base tile
+	BadBase = "base"
+	// The level has another count of tiles than recorded in the meta table, reported at x=0, y=0
+	BadCount = "count"
+)
+
+// Problem is a tile failing a check
+type Problem struct {
+	Z     int    `json:"z"`
+	X     int    `json:"x"`
+	Y     int    `json:"y"`
+	Kind  string `json:"kind"`
+	Error string `json:"error"`
+}
+
+// LevelReport counts the tiles and problems of one zoom level
+type LevelReport struct {
+	Z           int `json:"z"`
+	Tiles       int `json:"tiles"`
+	Empty       int `json:"empty"`
+	Undecodable int `json:"undecodable"`
+	BadPalette  int `json:"bad_palette"`
+	Orphans     int `json:"orphans"`
+	BadBase     int `json:"bad_base"`
+	BadCount    int `json:"bad_count"`
+}
+
+// Problems is the count of problems of the level
+func (l LevelReport) Problems() int {
+	return l.Undecodable + l.BadPalette + l.Orphans + l.BadBase + l.BadCount
+}
+
+// Report is the result of Verify, levels from MaxZ to 0
+type Report struct {
+	Levels   []LevelReport `json:"levels"`
+	Problems []Problem     `json:"problems"`
+}
+
+// OK is true when no problem was found
+func (r Report) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// Verify checks every tile of db, from level MaxZ to 0:
+//   - the tile is a paletted PNG or a sparse diff tile, with the palette of this project,
+//   - a parent tile has at least one non-empty child at the level below,
+//   - with a base, a diff tile can be applied on its base tile,
+//   - when db is a MetaSource, the count of tiles of each level is the recorded one.
+//
+// A diff tile without base tile is a new tile, stored in full, and the base tiles count
+// as children of the diff parents, which are merged from both.
+// The returned error is a failure to read the DBs, problems of the tiles are in the report.
+func Verify(db, base TileSource, workers int) (Report, error) {
+	var report Report
+	// Non-empty tiles of the level below
+	var children map[[2]uint16]bool
+	for z := MaxZ; z >= 0; z-- {
+		level, problems, nonEmpty, err := verifyLevel(db, base, z, children, workers)
+		if err != nil {
+			return report, err
+		}
+		if meta, ok := db.(MetaSource); ok {
+			problem, err := checkCount(meta, level)
+			if err != nil {
+				return report, err
+			}
+			if problem != nil {
+				level.BadCount++
+				problems = append(problems, *problem)
+			}
+		}
+		report.Levels = append(report.Levels, level)
+		report.Problems = append(report.Problems, problems...)
+		children = nonEmpty
+	}
+	return report, nil
+}
+
+// tileResult is the check of a single tile
+type tileResult struct {
+	tile    [2]uint16
+	empty   bool
+	problem *Problem
+	err     error
+}
+
+// tileData is a tile read from the DB, to check
+type tileData struct {
+	tile [2]uint16
+	data []byte
+}
+
+// verifyLevel checks the tiles of level z, streamed from db to the workers
+func verifyLevel(db, base TileSource, z int, children map[[2]uint16]bool, workers int) (LevelReport, []Problem, map[[2]uint16]bool, error) {
+	level := LevelReport{Z: z}
+	var baseTiles map[[2]uint16]bool
+	if base != nil {
+		list, err := base.ListTiles(z)
+		if err != nil {
+			return level, nil, nil, fmt.Errorf("failed to list base tiles of level %d: %w", z, err)
+		}
+		baseTiles = make(map[[2]uint16]bool, len(list))
+		for _, t := range list {
+			baseTiles[t] = true
+		}
+	}
+
+	jobs := make(chan tileData)
+	results := make(chan tileResult)
+	var wg sync.WaitGroup
+	for range max(workers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				results <- checkTile(j.data, base, z, j.tile, baseTiles[j.tile])
+			}
+		}()
+	}
+	var iterErr error
+	go func() {
+		iterErr = db.IterateTiles(z, func(x, y int, data []byte) error {
+			jobs <- tileData{tile: [2]uint16{uint16(x), uint16(y)}, data: data}
+			return nil
+		})
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	var problems []Problem
+	var firstErr error
+	var tiles [][2]uint16
+	nonEmpty := make(map[[2]uint16]bool)
+	for res := range results {
+		tiles = append(tiles, res.tile)
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			continue
+		}
+		if res.problem != nil {
+			problems = append(problems, *res.problem)
+			switch res.problem.Kind {
+			case Undecodable:
+				level.Undecodable++
+			case BadPalette:
+				level.BadPalette++
+			case BadBase:
+				level.BadBase++
+			}
+			continue
+		}
+		if res.empty {
+			level.Empty++
+		} else {
+			nonEmpty[res.tile] = true
+		}
+	}
+	// Results are closed after the iteration ended
+	if iterErr != nil {
+		return level, nil, nil, fmt.Errorf("failed to read tiles of level %d: %w", z, iterErr)
+	}
+	if firstErr != nil {
+		return level, nil, nil, firstErr
+	}
+	level.Tiles = len(tiles)
+	// A diff parent is merged from its diff and base children
+	for t := range baseTiles {
+		nonEmpty[t] = true
+	}
+
+	if z < MaxZ {
+		for _, t := range tiles {
+			if hasChild(children, t) {
+				continue
+			}
+			level.Orphans++
+			problems = append(problems, Problem{
+				Z: z, X: int(t[0]), Y: int(t[1]),
+				Kind:  Orphan,
+				Error: fmt.Sprintf("no non-empty child at level %d", z+1),
+			})
+		}
+	}
+	return level, problems, nonEmpty, nil
+}
+
+// checkCount compares the count of tiles of the level with the count recorded in meta, if any
+func checkCount(meta MetaSource, level LevelReport) (*Problem, error) {
+	value, found, err := meta.GetMeta(store.MetaTiles(level.Z))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the tile count of level %d: %w", level.Z, err)
+	}
+	if !found {
+		return nil, nil
+	}
+	recorded, err := strconv.Atoi(value)
+	if err != nil {
+		return &Problem{Z: level.Z, Kind: BadCount, Error: fmt.Sprintf("invalid recorded count %q", value)}, nil
+	}
+	if recorded != level.Tiles {
+		return &Problem{Z: level.Z, Kind: BadCount, Error: fmt.Sprintf("%d tiles, %d recorded", level.Tiles, recorded)}, nil
+	}
+	return nil, nil
+}
+
+// hasChild is true when one of the 4 children of t is in children
+func hasChild(children map[[2]uint16]bool, t [2]uint16) bool {
+	for dx := range uint16(2) {
+		for dy := range uint16(2) {
+			if children[[2]uint16{2*t[0] + dx, 2*t[1] + dy}] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func checkTile(data []byte, base TileSource, z int, t [2]uint16, hasBase bool) tileResult {
+	res := tileResult{tile: t}
+	x, y := int(t[0]), int(t[1])
+	problem := func(kind string, err error) tileResult {
+		res.problem = &Problem{Z: z, X: x, Y: y, Kind: kind, Error: err.Error()}
+		return res
+	}
+
+	tile, err := img.DecodePaletted(data)
+	if err != nil {
+		return problem(Undecodable, err)
+	}
+	if err := checkPalette(tile.Palette); err != nil {
+		return problem(BadPalette, err)
+	}
+	// By alpha, index 0 is an opaque color in a compact palette
+	res.empty = img.IsAllTransparent(tile)
+
+	if !hasBase {
+		return res
+	}
+	baseData, err := base.GetTile(z, x, y)
+	if err != nil {
+		res.err = fmt.Errorf("failed to read base tile %d/%d/%d: %w", z, x, y, err)
+		return res
+	}
+	baseTile, err := img.DecodePaletted(baseData)
+	if err != nil {
+		return problem(BadBase, fmt.Errorf("base tile: %w", err))
+	}
+	if _, err := img.UnDiffPaletted(baseTile, tile); err != nil {
+		return problem(BadBase, err)
+	}
+	return res
+}
+
+// palette is the palette of this project
+var palette = img.NewPaletter().Palette()
+
+// paletteColors are the colors of palette, see rgba
+var paletteColors = func() map[[4]uint32]bool {
+	colors := make(map[[4]uint32]bool, len(palette))
+	for _, c := range palette {
+		colors[rgba(c)] = true
+	}
+	return colors
+}()
+
+// rgba is the alpha-premultiplied color, the PNG decoder returns the palette colors in other types
+func rgba(c color.Color) [4]uint32 {
+	r, g, b, a := c.RGBA()
+	return [4]uint32{r, g, b, a}
+}
+
+// checkPalette compares p with the palette of this project.
+// Diff tiles of img.DiffErasures have one more transparent color, the erased sentinel.
+// Tiles of img.CompactPalette have fewer colors, each of the palette of this project.
+func checkPalette(p color.Palette) error {
+	if len(p) < len(palette) {
+		for i, c := range p {
+			if !paletteColors[rgba(c)] {
+				return fmt.Errorf("palette color %d is not a color of the palette", i)
+			}
+		}
+		return nil
+	}
+	if len(p) == len(palette)+1 {
+		if _, _, _, a := p[len(palette)].RGBA(); a != 0 {
+			return fmt.Errorf("palette color %d is not the transparent erased sentinel", len(palette))
+		}
+		p = p[:len(palette)]
+	}
+	if len(p) != len(palette) {
+		return fmt.Errorf("palette has %d colors, expected %d", len(p), len(palette))
+	}
+	for i := range palette {
+		r1, g1, b1, a1 := p[i].RGBA()
+		r2, g2, b2, a2 := palette[i].RGBA()
+		if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+			return fmt.Errorf("palette color %d differs", i)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package verify
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/Hugi-R/wplace-archive-world-map/img"
+	"github.com/Hugi-R/wplace-archive-world-map/store"
+)
+
+// memSource holds encoded tiles by z, x, y
+type memSource map[[3]int][]byte
+
+func (s memSource) ListTiles(z int) ([][2]uint16, error) {
+	var res [][2]uint16
+	for t := range s {
+		if t[0] == z {
+			res = append(res, [2]uint16{uint16(t[1]), uint16(t[2])})
+		}
+	}
+	return res, nil
+}
+
+func (s memSource) IterateTiles(z int, fn func(x, y int, data []byte) error) error {
+	for t, data := range s {
+		if t[0] == z {
+			if err := fn(t[1], t[2], data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s memSource) GetTile(z, x, y int) ([]byte, error) {
+	data, ok := s[[3]int{z, x, y}]
+	if !ok {
+		return nil, fmt.Errorf("tile %d/%d/%d not found", z, x, y)
+	}
+	return data, nil
+}
+
+// tileT encodes a 4x4 paletted tile filled with the palette index i
+func tileT(i uint8, p color.Palette, t *testing.T) []byte {
+	tile := image.NewPaletted(image.Rect(0, 0, 4, 4), p)
+	for j := range tile.Pix {
+		tile.Pix[j] = i
+	}
+	data, err := img.EncodePng(tile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func count(report Report, kind string) int {
+	n := 0
+	for _, p := range report.Problems {
+		if p.Kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+func TestVerify(t *testing.T) {
+	p := img.NewPaletter().Palette()
+	db := memSource{
+		{11, 0, 0}: tileT(7, p, t),
+		{11, 2, 0}: tileT(0, p, t), // Empty
+		{10, 0, 0}: tileT(7, p, t),
+		{10, 1, 0}: tileT(7, p, t), // Orphan, its only child is empty
+		{9, 0, 0}:  tileT(7, p, t),
+	}
+	report, err := Verify(db, nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Levels) != MaxZ+1 {
+		t.Fatalf("expected %d levels, got %d", MaxZ+1, len(report.Levels))
+	}
+	if report.Levels[0].Empty != 1 {
+		t.Errorf("expected 1 empty tile at level 11, got %d", report.Levels[0].Empty)
+	}
+	if len(report.Problems) != 1 || report.Problems[0] != (Problem{Z: 10, X: 1, Y: 0, Kind: Orphan, Error: "no non-empty child at level 11"}) {
+		t.Errorf("expected the orphan 10/1/0, got %+v", report.Problems)
+	}
+
+	// Corrupt tiles
+	db[[3]int{11, 3, 3}] = []byte("not a png")
+	db[[3]int{11, 4, 4}] = tileT(1, color.Palette{color.Transparent, color.RGBA{1, 2, 3, 255}}, t)
+	// A compact palette of colors of the palette is fine
+	db[[3]int{11, 5, 5}] = tileT(1, color.Palette{p[0], p[7]}, t)
+	report, err = Verify(db, nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count(report, Undecodable) != 1 || count(report, BadPalette) != 1 {
+		t.Errorf("expected 1 undecodable and 1 bad palette tile, got %+v", report.Problems)
+	}
+	if report.OK() {
+		t.Error("expected the report not to be OK")
+	}
+
+	// A solid tile of a compact palette whose index 0 is opaque is not empty
+	db = memSource{
+		{11, 6, 6}: tileT(0, color.Palette{p[7]}, t),
+		{10, 3, 3}: tileT(7, p, t),
+	}
+	report, err = Verify(db, nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Levels[0].Empty != 0 || !report.OK() {
+		t.Errorf("expected the solid compact tile not empty, got %+v and %+v", report.Levels[0], report.Problems)
+	}
+}
+
+func TestVerifyBase(t *testing.T) {
+	p := img.NewPaletter().Palette()
+	base := memSource{
+		{11, 0, 0}: tileT(7, p, t),
+		{11, 1, 0}: tileT(7, p, t),
+		{10, 0, 0}: tileT(7, p, t),
+	}
+	large := image.NewPaletted(image.Rect(0, 0, 8, 8), p)
+	largeData, err := img.EncodePng(large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff := memSource{
+		{11, 1, 0}: largeData,      // Doesn't match its base
+		{11, 4, 4}: tileT(5, p, t), // New tile
+		{10, 0, 0}: tileT(5, p, t), // Merged from unchanged children of the base
+	}
+	report, err := Verify(diff, base, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 1 || report.Problems[0].Kind != BadBase || report.Problems[0].X != 1 {
+		t.Errorf("expected the bad base 11/1/0, got %+v", report.Problems)
+	}
+}
+
+// metaSource is a memSource with a meta table
+type metaSource struct {
+	memSource
+	meta map[string]string
+}
+
+func (s metaSource) GetMeta(key string) (string, bool, error) {
+	value, ok := s.meta[key]
+	return value, ok, nil
+}
+
+func TestVerifyCount(t *testing.T) {
+	p := img.NewPaletter().Palette()
+	db := metaSource{
+		memSource: memSource{
+			{11, 0, 0}: tileT(7, p, t),
+			{11, 1, 0}: tileT(7, p, t),
+			{10, 0, 0}: tileT(7, p, t),
+		},
+		meta: map[string]string{
+			store.MetaTiles(11): "3", // A tile was lost since recorded
+			store.MetaTiles(10): "1",
+		},
+	}
+	report, err := Verify(db, nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 1 || report.Problems[0] != (Problem{Z: 11, Kind: BadCount, Error: "2 tiles, 3 recorded"}) {
+		t.Fatalf("expected the count of level 11 to differ, got %+v", report.Problems)
+	}
+	if report.Levels[0].BadCount != 1 || report.Levels[0].Problems() != 1 {
+		t.Fatalf("expected a bad count at level 11, got %+v", report.Levels[0])
+	}
+}
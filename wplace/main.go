@@ -0,0 +1,76 @@
+// wplace bundles the tools of this project as subcommands of a single binary.
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Hugi-R/wplace-archive-world-map/compose"
+	"github.com/Hugi-R/wplace-archive-world-map/diffstat"
+	"github.com/Hugi-R/wplace-archive-world-map/merger"
+	"github.com/Hugi-R/wplace-archive-world-map/plan"
+	"github.com/Hugi-R/wplace-archive-world-map/render"
+	"github.com/Hugi-R/wplace-archive-world-map/store"
+	"github.com/Hugi-R/wplace-archive-world-map/tileserver"
+	"github.com/Hugi-R/wplace-archive-world-map/verify"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+	// timed commands print their elapsed time, as the standalone binaries
+	timed bool
+}
+
+var commands = []command{
+	{"ingest", "Ingest an archive into a DB", store.Main, true},
+	{"merge", "Build the lower zoom levels of a DB", merger.Main, true},
+	{"plan", "Print the import plan without executing it", plan.PlanMain, false},
+	{"exec", "Plan and execute the import: download, ingest, and merge", plan.Main, false},
+	{"retain", "Delete the diffs superseded in the done folder", plan.RetainMain, false},
+	{"serve", "Run the tile server", tileserver.Main, false},
+	{"consolidate", "Copy the version DBs into a single DB served with -single-db", tileserver.ConsolidateMain, true},
+	{"export", "Export a zoom level of a DB as a PNG", render.Main, true},
+	{"diffstat", "Compare two DBs", diffstat.Main, true},
+	{"verify", "Check the tile pyramid of a DB", verify.Main, true},
+	{"compose", "Compose a chain of diff DBs into a single diff DB of their base", compose.Main, true},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun %s <command> -h for the flags of a command.\n", os.Args[0])
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	name := os.Args[1]
+	if name == "-h" || name == "-help" || name == "--help" || name == "help" {
+		usage()
+		return
+	}
+	for _, c := range commands {
+		if c.name != name {
+			continue
+		}
+		start := time.Now()
+		if err := c.run(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if c.timed {
+			fmt.Fprintf(os.Stderr, "Elapsed time: %s\n", time.Since(start))
+		}
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", name)
+	usage()
+	os.Exit(2)
+}